@@ -0,0 +1,250 @@
+package activitystreams
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/providers/mastodon"
+	"github.com/chcolte/fediverse-archive-bot-go/providers/misskey"
+	"github.com/chcolte/fediverse-archive-bot-go/utils"
+	"github.com/chcolte/fediverse-archive-bot-go/writer"
+)
+
+// アーカイブ内のメディア対応表のファイル名 (media-downloader が日付ディレクトリごとに作成する)
+const mediaMappingFile = "filename_url_mapping.jsonl"
+
+// LoadMediaMap はアーカイブ内の全ての対応表を読み込み，元のURL → 保存先パスの対応を返す
+func LoadMediaMap(dir string) (map[string]string, error) {
+	media := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != mediaMappingFile {
+			return nil
+		}
+		return eachRecord(path, func(rec record) {
+			var mapping models.FilenameURLMapping
+			if err := json.Unmarshal(rec.Data, &mapping); err != nil || mapping.URL == "" {
+				return
+			}
+			media[mapping.URL] = mapping.Filepath
+		})
+	})
+	return media, err
+}
+
+// ReadPosts はアーカイブ (例: downloads) 以下の投稿を正規化して fn に渡す。
+//
+//   - 正規化済みストリームの post レコードはそのまま使う (全プラットフォーム)
+//   - 正規化済みストリームのない古いアーカイブでも，Misskey・Mastodon の message レコードは生データから変換する
+//
+// 同じ投稿 (編集・重複受信を含む) は最新版の1件だけを渡す (postVersion.newerThan)。
+// 全投稿をメモリに持たないよう，1回目の走査で各投稿の最新版の位置を調べ，2回目の走査で渡す
+func ReadPosts(dir string, fn func(models.Post) error) error {
+	latest := make(map[string]postVersion)
+	err := walkPosts(dir, func(post models.Post, version postVersion) error {
+		key := post.Platform + "\x00" + post.ID
+		if current, ok := latest[key]; !ok || version.newerThan(current) {
+			latest[key] = version
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return walkPosts(dir, func(post models.Post, version postVersion) error {
+		if latest[post.Platform+"\x00"+post.ID].position != version.position {
+			return nil
+		}
+		return fn(post)
+	})
+}
+
+// postVersion は投稿レコードの保存時刻・編集時刻とアーカイブ内の位置
+type postVersion struct {
+	savedAt  time.Time
+	editedAt time.Time
+	position recordPosition
+}
+
+// newerThan は v が other より新しい版かを判定する。
+// saved_at は秒単位のため，同じ秒なら編集時刻で，それも同じなら同じタイムラインのファイル内の保存順で比べる。
+// 別のタイムラインの同時刻のレコードは先に見つけた方を残す
+func (v postVersion) newerThan(other postVersion) bool {
+	if !v.savedAt.Equal(other.savedAt) {
+		return v.savedAt.After(other.savedAt)
+	}
+	if !v.editedAt.Equal(other.editedAt) {
+		return v.editedAt.After(other.editedAt)
+	}
+	if v.position.stream != other.position.stream {
+		return false
+	}
+	if v.position.segment != other.position.segment {
+		return v.position.segment > other.position.segment
+	}
+	return v.position.line > other.position.line
+}
+
+// recordPosition はレコードのファイルと，ファイル内で何番目のレコードか。
+// 走査の間にセグメントが完了・圧縮されても変わらないよう，ファイル名は拡張子を除いて比べる
+type recordPosition struct {
+	file    string
+	stream  string // タイムラインのファイル (セグメントの期間・連番を除く)
+	segment string // タイムライン内のセグメントの順 (期間・連番)
+	line    int
+}
+
+// walkPosts はアーカイブ内の投稿を保存順に fn に渡す
+func walkPosts(dir string, fn func(models.Post, postVersion) error) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isArchiveFile(d.Name()) {
+			return nil
+		}
+		system, server := archiveTarget(dir, path)
+		file := utils.TrimCompressionExt(strings.TrimSuffix(path, writer.PartSuffix))
+		stream, segment := file, ""
+		if base, period, seq, ok := writer.SplitSegmentName(filepath.Base(file)); ok {
+			stream = filepath.Join(filepath.Dir(file), base)
+			segment = fmt.Sprintf("%s_%04d", period, seq)
+		}
+
+		var fnErr error
+		line := 0
+		err = eachRecord(path, func(rec record) {
+			line++
+			if fnErr != nil {
+				return
+			}
+			post, ok := decodePost(rec.RecordType, rec.Data, system, server)
+			if !ok {
+				return
+			}
+			version := postVersion{position: recordPosition{file: file, stream: stream, segment: segment, line: line}}
+			version.savedAt, _ = time.Parse(time.RFC3339, rec.SavedAt)
+			if post.EditedAt != nil {
+				version.editedAt = *post.EditedAt
+			}
+			fnErr = fn(post, version)
+		})
+		if err != nil {
+			logger.Errorf("Failed to read %s: %v", path, err)
+		}
+		return fnErr
+	})
+}
+
+// decodePost はレコードから投稿を取り出す
+func decodePost(recordType string, data json.RawMessage, system, server string) (models.Post, bool) {
+	switch recordType {
+	case "post":
+		var post models.Post
+		if err := json.Unmarshal(data, &post); err != nil || post.ID == "" {
+			return models.Post{}, false
+		}
+		return post, true
+
+	case "message":
+		var message struct {
+			Raw json.RawMessage `json:"raw"`
+		}
+		if err := json.Unmarshal(data, &message); err != nil || len(message.Raw) == 0 {
+			return models.Post{}, false
+		}
+		switch strings.TrimSuffix(system, "-poll") {
+		case "misskey":
+			return misskeyPost(message.Raw, server)
+		case "mastodon":
+			return mastodonPost(message.Raw, server)
+		}
+	}
+	return models.Post{}, false
+}
+
+// misskeyPost はストリーミングのチャンネルメッセージ，またはREST APIのノートを変換する
+func misskeyPost(raw json.RawMessage, server string) (models.Post, bool) {
+	var msg misskey.StreamingMessage
+	if err := json.Unmarshal(raw, &msg); err == nil && msg.Type == "channel" && msg.Body.Body.ID != "" {
+		return misskey.NormalizeNote(msg.Body.Body, server), true
+	}
+	var note misskey.Note
+	if err := json.Unmarshal(raw, &note); err != nil || note.ID == "" || note.User.ID == "" {
+		return models.Post{}, false
+	}
+	return misskey.NormalizeNote(note, server), true
+}
+
+// mastodonPost はストリーミングの update / status.update イベント，またはREST APIのステータスを変換する
+func mastodonPost(raw json.RawMessage, server string) (models.Post, bool) {
+	var msg mastodon.StreamingMessage
+	if err := json.Unmarshal(raw, &msg); err == nil && msg.Event != "" {
+		if msg.Event != mastodon.EventUpdate && msg.Event != mastodon.EventStatusUpdate {
+			return models.Post{}, false
+		}
+		raw = json.RawMessage(msg.Payload)
+	}
+	post, err := mastodon.NormalizeStatus(raw, server)
+	if err != nil || post.ID == "" || post.Author.ID == "" {
+		return models.Post{}, false
+	}
+	return post, true
+}
+
+// isArchiveFile は日付で始まるタイムラインのJSONL (書き込み中・圧縮済みのセグメントを含む) かどうかを判定する
+// (crawl_sessions.jsonl, filename_url_mapping.jsonl 等を除く)
+func isArchiveFile(name string) bool {
+	name = utils.TrimCompressionExt(strings.TrimSuffix(name, writer.PartSuffix))
+	return strings.HasSuffix(name, ".jsonl") && len(name) > 10 && name[4] == '-' && name[7] == '-'
+}
+
+// archiveTarget はファイルのパス (<dir>/<system>/<server>/...) からサーバー種別とホスト名を求める
+func archiveTarget(dir, path string) (system, server string) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return "", ""
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) < 3 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+// record はアーカイブのJSONLレコードのうち，読み出しに使う項目
+type record struct {
+	RecordType string          `json:"record_type"`
+	SavedAt    string          `json:"saved_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// eachRecord はJSONLファイル (圧縮済みを含む) のレコードを順に fn に渡す
+func eachRecord(path string, fn func(record)) error {
+	file, err := utils.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		fn(rec)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,52 @@
+package activitystreams
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+func TestReadPostsLatestVersion(t *testing.T) {
+	dir := t.TempDir()
+	daily := filepath.Join(dir, "mastodon", "example.com", "2026-01-01")
+	os.MkdirAll(daily, 0755)
+	// 全て同じ秒に保存したレコード
+	write := func(name string, posts ...string) {
+		var lines []string
+		for _, post := range posts {
+			lines = append(lines, `{"record_type":"post","saved_at":"2026-01-01T00:00:00Z","data":`+post+`}`)
+		}
+		if err := os.WriteFile(filepath.Join(daily, name), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 1. 編集時刻の新しい版を残す (先に走査する global の方が新しい)
+	write("2026-01-01_global_2026-01-01.jsonl",
+		`{"id":"1","platform":"mastodon","text":"edited","edited_at":"2026-01-01T00:00:00Z"}`)
+	write("2026-01-01_local_2026-01-01.jsonl",
+		`{"id":"1","platform":"mastodon","text":"original"}`,
+		// 2. 同じタイムラインでは後に保存した方を残す
+		`{"id":"2","platform":"mastodon","text":"first"}`,
+		`{"id":"2","platform":"mastodon","text":"second"}`)
+	// 3. 同じタイムラインでは後のセグメントを残す
+	write("2026-01-01_local_2026-01-01_0002.jsonl.part",
+		`{"id":"2","platform":"mastodon","text":"third"}`)
+
+	texts := make(map[string]string)
+	err := ReadPosts(dir, func(post models.Post) error {
+		if _, dup := texts[post.ID]; dup {
+			t.Errorf("post %s was passed twice", post.ID)
+		}
+		texts[post.ID] = post.Text
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if texts["1"] != "edited" || texts["2"] != "third" {
+		t.Errorf("latest versions = %v", texts)
+	}
+}
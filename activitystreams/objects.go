@@ -0,0 +1,263 @@
+package activitystreams
+
+import (
+	"html"
+	"strings"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+/*
+[ActivityStreams 2.0]
+正規化した投稿 (models.Post) を ActivityPub 対応のツールで読める形に変換する。
+
+  - 通常の投稿は Create{Note}，ブースト (リノート・リポスト) は Announce
+  - 投稿者は actor に Person として埋め込む
+  - 添付メディアの url は，アーカイブ済みであればローカルのファイルを指す
+*/
+
+// 公開アドレス
+const PublicAddress = "https://www.w3.org/ns/activitystreams#Public"
+
+// JSON-LD コンテキスト (AS2 に加えて，Mastodon等が使う拡張語彙)
+var Context = []interface{}{
+	"https://www.w3.org/ns/activitystreams",
+	map[string]string{
+		"sensitive": "as:sensitive",
+		"Hashtag":   "as:Hashtag",
+		"quoteUrl":  "as:quoteUrl",
+	},
+}
+
+// Activity は Create または Announce
+type Activity struct {
+	Context   interface{} `json:"@context,omitempty"`
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Actor     *Actor      `json:"actor"`
+	Published string      `json:"published,omitempty"`
+	To        []string    `json:"to,omitempty"`
+	Cc        []string    `json:"cc,omitempty"`
+	Object    interface{} `json:"object"` // Create なら *Note，Announce なら対象のURI
+}
+
+// Note は投稿本体
+type Note struct {
+	ID           string            `json:"id"`
+	Type         string            `json:"type"`
+	AttributedTo string            `json:"attributedTo"`
+	Published    string            `json:"published,omitempty"`
+	URL          string            `json:"url,omitempty"`
+	Summary      string            `json:"summary,omitempty"`
+	Sensitive    bool              `json:"sensitive,omitempty"`
+	Content      string            `json:"content"`
+	ContentMap   map[string]string `json:"contentMap,omitempty"`
+	Source       *Source           `json:"source,omitempty"`
+	InReplyTo    string            `json:"inReplyTo,omitempty"`
+	QuoteURL     string            `json:"quoteUrl,omitempty"`
+	To           []string          `json:"to,omitempty"`
+	Cc           []string          `json:"cc,omitempty"`
+	Tag          []Tag             `json:"tag,omitempty"`
+	Attachment   []Document        `json:"attachment,omitempty"`
+}
+
+// Source は変換前の本文 (プレーンテキスト)
+type Source struct {
+	Content   string `json:"content"`
+	MediaType string `json:"mediaType"`
+}
+
+// Actor は投稿者
+type Actor struct {
+	ID                string `json:"id"`
+	Type              string `json:"type"`
+	PreferredUsername string `json:"preferredUsername,omitempty"`
+	Name              string `json:"name,omitempty"`
+	URL               string `json:"url,omitempty"`
+}
+
+// Tag は Hashtag または Mention
+type Tag struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+	Href string `json:"href,omitempty"`
+}
+
+// Document は添付メディア
+type Document struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType,omitempty"`
+	Name      string `json:"name,omitempty"`
+	URL       []Link `json:"url"`
+}
+
+// Link は添付メディアの所在。ローカルのファイルと元のURLを並べる
+type Link struct {
+	Type      string `json:"type"`
+	Href      string `json:"href"`
+	MediaType string `json:"mediaType,omitempty"`
+	Rel       string `json:"rel,omitempty"`
+}
+
+// MediaResolver は元のURLからアーカイブ済みファイルの参照先を返す (なければ空)
+type MediaResolver func(url string) string
+
+// FromPost は投稿を Create{Note} または Announce に変換する
+func FromPost(post models.Post, resolve MediaResolver) *Activity {
+	actor := actorOf(post)
+	to, cc := addressing(post, actor.ID)
+	activity := &Activity{
+		Context:   Context,
+		Actor:     actor,
+		Published: formatTime(post.CreatedAt),
+		To:        to,
+		Cc:        cc,
+	}
+
+	id := objectID(post)
+	if post.BoostOf != nil {
+		activity.ID = id
+		activity.Type = "Announce"
+		activity.Object = refID(post.BoostOf)
+		return activity
+	}
+
+	note := &Note{
+		ID:           id,
+		Type:         "Note",
+		AttributedTo: actor.ID,
+		Published:    activity.Published,
+		URL:          post.URL,
+		Summary:      post.Summary,
+		Sensitive:    post.Sensitive,
+		Content:      textToHTML(post.Text),
+		Source:       &Source{Content: post.Text, MediaType: "text/plain"},
+		To:           to,
+		Cc:           cc,
+	}
+	if post.Language != "" {
+		note.ContentMap = map[string]string{post.Language: note.Content}
+	}
+	if post.ReplyTo != nil {
+		note.InReplyTo = refID(post.ReplyTo)
+	}
+	if post.QuoteOf != nil {
+		note.QuoteURL = refID(post.QuoteOf)
+	}
+	for _, tag := range post.Tags {
+		note.Tag = append(note.Tag, Tag{Type: "Hashtag", Name: "#" + tag})
+	}
+	for _, mention := range post.Mentions {
+		note.Tag = append(note.Tag, mentionTag(mention))
+	}
+	for _, media := range post.Media {
+		note.Attachment = append(note.Attachment, document(media, resolve))
+	}
+
+	activity.ID = id + "#create"
+	activity.Type = "Create"
+	activity.Object = note
+	return activity
+}
+
+// objectID は投稿のIDとして使うURI。URIを持たない投稿はURLかIDで代用する
+func objectID(post models.Post) string {
+	switch {
+	case post.URI != "":
+		return post.URI
+	case post.URL != "":
+		return post.URL
+	default:
+		return "urn:" + post.Platform + ":" + post.ID
+	}
+}
+
+func refID(ref *models.PostRef) string {
+	if ref.URI != "" {
+		return ref.URI
+	}
+	return ref.ID
+}
+
+func actorOf(post models.Post) *Actor {
+	author := post.Author
+	actor := &Actor{
+		ID:                author.URI,
+		Type:              "Person",
+		PreferredUsername: author.Username,
+		Name:              author.DisplayName,
+	}
+	if strings.HasPrefix(author.URI, "http") {
+		actor.URL = author.URI
+	}
+	if actor.ID == "" {
+		// URIの分からないリモートユーザーは acct: で表す
+		if author.Username != "" && author.Host != "" {
+			actor.ID = "acct:" + author.Username + "@" + author.Host
+		} else {
+			actor.ID = "urn:" + post.Platform + ":user:" + author.ID
+		}
+	}
+	return actor
+}
+
+// addressing は公開範囲を to / cc に変換する
+func addressing(post models.Post, actorID string) (to, cc []string) {
+	followers := actorID + "/followers"
+	switch post.Visibility {
+	case models.VisibilityPublic:
+		return []string{PublicAddress}, []string{followers}
+	case models.VisibilityUnlisted:
+		return []string{followers}, []string{PublicAddress}
+	case models.VisibilityFollowers:
+		return []string{followers}, nil
+	default:
+		// direct の宛先はメンション先からは復元できない
+		return nil, nil
+	}
+}
+
+func mentionTag(mention string) Tag {
+	if strings.HasPrefix(mention, "http") {
+		return Tag{Type: "Mention", Href: mention}
+	}
+	if strings.Contains(mention, "@") {
+		return Tag{Type: "Mention", Name: "@" + strings.TrimPrefix(mention, "@")}
+	}
+	// ユーザーID・pubkey・DID
+	return Tag{Type: "Mention", Name: mention}
+}
+
+func document(media models.PostMedia, resolve MediaResolver) Document {
+	doc := Document{Type: "Document", Name: media.Description}
+	if strings.Contains(media.Type, "/") {
+		doc.MediaType = media.Type
+	}
+	if resolve != nil {
+		if local := resolve(media.URL); local != "" {
+			doc.URL = append(doc.URL, Link{Type: "Link", Href: local, MediaType: doc.MediaType})
+		}
+	}
+	doc.URL = append(doc.URL, Link{Type: "Link", Href: media.URL, MediaType: doc.MediaType, Rel: "canonical"})
+	return doc
+}
+
+// textToHTML はプレーンテキストの本文を content 用のHTMLにする
+func textToHTML(text string) string {
+	if text == "" {
+		return ""
+	}
+	paragraphs := strings.Split(html.EscapeString(text), "\n\n")
+	for i, p := range paragraphs {
+		paragraphs[i] = "<p>" + strings.ReplaceAll(p, "\n", "<br>") + "</p>"
+	}
+	return strings.Join(paragraphs, "")
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
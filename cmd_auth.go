@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/credentials"
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/providers/mastodon"
+	"github.com/chcolte/fediverse-archive-bot-go/providers/misskey"
+)
+
+// runAuth はユーザートークンを対話的に取得して認証情報ファイルに保存する
+// (Mastodon: OAuth認可コードフロー, Misskey: MiAuth)
+// usage: fediverse-archive-bot-go auth -s mastodon -u mastodon.social [-credentials credentials.json]
+func runAuth(args []string) {
+	fs := flag.NewFlagSet("auth", flag.ExitOnError)
+	var (
+		s = fs.String("s", "mastodon", "target system (mastodon, misskey)")
+		u = fs.String("u", "", "server host (e.g. mastodon.social)")
+		c = fs.String("credentials", "credentials.json", "credentials file to update")
+		v = fs.Bool("V", false, "verbose output")
+	)
+	fs.Parse(args)
+	logger.SetVerbose(*v)
+
+	host := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(*u, "https://"), "http://"), "/")
+	if host == "" {
+		logger.Fatal("auth: -u is required")
+	}
+
+	store := credentials.NewStore()
+	if err := store.Load(*c); err != nil {
+		logger.Fatalf("Failed to load credentials: %v", err)
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	var cred *credentials.Credential
+	var err error
+	switch *s {
+	case "mastodon":
+		cred, err = authMastodon(host, stdin)
+	case "misskey":
+		cred, err = authMisskey(host, stdin)
+	default:
+		logger.Fatalf("auth: unsupported system: %s", *s)
+	}
+	if err != nil {
+		logger.Fatalf("Authorization failed: %v", err)
+	}
+
+	if err := store.Set(host, cred); err != nil {
+		logger.Fatalf("Failed to save credentials: %v", err)
+	}
+	logger.Infof("Saved %s token for %s (%s) to %s", cred.Type, host, cred.Account, *c)
+}
+
+// authMastodon はOAuth認可コードフローでユーザートークンを取得する
+func authMastodon(host string, stdin *bufio.Reader) (*credentials.Credential, error) {
+	app, err := mastodon.RegisterUserApp(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register app: %w", err)
+	}
+
+	fmt.Println("Open the following URL, approve the app and paste the code shown:")
+	fmt.Println(mastodon.AuthorizeURL(host, app))
+	fmt.Print("code: ")
+	code, err := stdin.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := mastodon.ExchangeCode(host, app, strings.TrimSpace(code))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+	account, err := mastodon.VerifyAccount(host, token.AccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("token does not work: %w", err)
+	}
+
+	return &credentials.Credential{
+		Type:        "mastodon",
+		AccessToken: token.AccessToken,
+		Account:     account,
+		Scope:       token.Scope,
+		CreatedAt:   time.Now(),
+	}, nil
+}
+
+// authMisskey はMiAuthでユーザートークンを取得する
+func authMisskey(host string, stdin *bufio.Reader) (*credentials.Credential, error) {
+	session := misskey.NewMiAuthSession(host)
+
+	fmt.Println("Open the following URL, approve the app and then press Enter:")
+	fmt.Println(session.URL())
+	if _, err := stdin.ReadString('\n'); err != nil {
+		return nil, err
+	}
+
+	result, err := session.Check()
+	if err != nil {
+		return nil, err
+	}
+
+	return &credentials.Credential{
+		Type:        "misskey",
+		AccessToken: result.Token,
+		Account:     result.User.Username,
+		CreatedAt:   time.Now(),
+	}, nil
+}
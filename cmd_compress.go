@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/utils"
+	"github.com/chcolte/fediverse-archive-bot-go/writer"
+)
+
+// runCompress は完成済みのJSONL (ローテーション導入前の日ごとのファイルを含む) をその場で圧縮する
+// usage: fediverse-archive-bot-go compress [-d downloads] [-format zstd] [-min-age 1h] [-dry-run]
+func runCompress(args []string) {
+	fs := flag.NewFlagSet("compress", flag.ExitOnError)
+	var (
+		d      = fs.String("d", "downloads", "download directory")
+		f      = fs.String("format", string(utils.CompressionZstd), "compression format (gzip, zstd)")
+		minAge = fs.Duration("min-age", time.Hour, "skip files modified more recently than this (may still be written by an older crawler)")
+		dryRun = fs.Bool("dry-run", false, "only list the files that would be compressed")
+		v      = fs.Bool("V", false, "verbose output")
+	)
+	fs.Parse(args)
+	logger.SetVerbose(*v)
+
+	compression, err := utils.ParseCompression(*f)
+	if err != nil || compression == utils.CompressionNone {
+		logger.Fatalf("compress: unsupported format: %s", *f)
+	}
+
+	var count int
+	var before, after int64
+	cutoff := time.Now().Add(-*minAge)
+	err = filepath.WalkDir(*d, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !isCompressibleSegment(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			logger.Debugf("Skipped recently modified file: %s", path)
+			return nil
+		}
+		if *dryRun {
+			logger.Info(path)
+			count++
+			return nil
+		}
+
+		compressed, err := writer.CompressSegment(path, compression)
+		if err != nil {
+			logger.Errorf("Failed to compress %s: %v", path, err)
+			return nil
+		}
+		if stat, err := os.Stat(compressed); err == nil {
+			before += info.Size()
+			after += stat.Size()
+		}
+		count++
+		logger.Debugf("Compressed %s", compressed)
+		return nil
+	})
+	if err != nil {
+		logger.Fatalf("Compress failed: %v", err)
+	}
+	if *dryRun {
+		logger.Infof("%d files would be compressed", count)
+		return
+	}
+	logger.Infof("Compressed %d files (%d KiB -> %d KiB)", count, before>>10, after>>10)
+}
+
+// isCompressibleSegment は日付で始まる，圧縮されていない完成済みのJSONLかどうかを判定する
+// (書き込み中の .part，crawl_sessions.jsonl 等の追記され続けるファイルを除く)
+func isCompressibleSegment(name string) bool {
+	return strings.HasSuffix(name, ".jsonl") && name != writer.CompletedSegmentsFile &&
+		len(name) > 10 && name[4] == '-' && name[7] == '-'
+}
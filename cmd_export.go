@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/chcolte/fediverse-archive-bot-go/activitystreams"
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+// runExport はアーカイブ済みの投稿を ActivityStreams 2.0 (Create{Note} / Announce) に変換して書き出す
+// usage: fediverse-archive-bot-go export [-d downloads] [-o export.ndjson | -format files -o export/] [-platforms misskey,mastodon]
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var (
+		d = fs.String("d", "downloads", "download directory")
+		o = fs.String("o", "export.ndjson", "output file (ndjson, \"-\" for stdout) or directory (files)")
+		f = fs.String("format", "ndjson", "output format (ndjson: one activity per line, files: one JSON file per activity)")
+		p = fs.String("platforms", "misskey,mastodon", "platforms to export (misskey, mastodon, nostr, bluesky, lemmy, or all)")
+		m = fs.String("media-base", "", "URL prefix for archived media (default: paths relative to the download directory)")
+		v = fs.Bool("V", false, "verbose output")
+	)
+	fs.Parse(args)
+	logger.SetVerbose(*v)
+
+	platforms := make(map[string]bool)
+	for _, platform := range strings.Split(*p, ",") {
+		platforms[strings.TrimSpace(platform)] = true
+	}
+
+	mediaMap, err := activitystreams.LoadMediaMap(*d)
+	if err != nil {
+		logger.Fatalf("Failed to load media mapping: %v", err)
+	}
+	resolve := func(url string) string {
+		local, ok := mediaMap[url]
+		if !ok {
+			return ""
+		}
+		return mediaHref(*d, local, *m)
+	}
+
+	var write func(post models.Post, activity *activitystreams.Activity) error
+	switch *f {
+	case "ndjson":
+		out, closeOut, err := openOutput(*o)
+		if err != nil {
+			logger.Fatalf("Failed to open output: %v", err)
+		}
+		defer closeOut()
+		encoder := json.NewEncoder(out)
+		encoder.SetEscapeHTML(false)
+		write = func(_ models.Post, activity *activitystreams.Activity) error {
+			return encoder.Encode(activity)
+		}
+	case "files":
+		write = func(post models.Post, activity *activitystreams.Activity) error {
+			return writeActivityFile(*o, post, activity)
+		}
+	default:
+		logger.Fatalf("export: unsupported format: %s", *f)
+	}
+
+	count := 0
+	err = activitystreams.ReadPosts(*d, func(post models.Post) error {
+		if !platforms["all"] && !platforms[post.Platform] {
+			return nil
+		}
+		count++
+		return write(post, activitystreams.FromPost(post, resolve))
+	})
+	if err != nil {
+		logger.Fatalf("Export failed: %v", err)
+	}
+	if *o != "-" { // 標準出力に書き出す場合はログを混ぜない
+		logger.Infof("Exported %d activities (%d archived media files known) to %s", count, len(mediaMap), *o)
+	}
+}
+
+// openOutput は出力先のファイルを開く ("-" なら標準出力)
+func openOutput(name string) (io.Writer, func(), error) {
+	if name == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		return w, func() { w.Flush() }, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := bufio.NewWriter(file)
+	return w, func() {
+		if err := w.Flush(); err != nil {
+			logger.Errorf("Failed to write %s: %v", name, err)
+		}
+		file.Close()
+	}, nil
+}
+
+// writeActivityFile は1件のアクティビティを <dir>/<platform>/<id>.json に書き出す
+func writeActivityFile(dir string, post models.Post, activity *activitystreams.Activity) error {
+	platformDir := filepath.Join(dir, post.Platform)
+	if err := os.MkdirAll(platformDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(activity, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := models.TimelineFileName(post.ID) + ".json"
+	return os.WriteFile(filepath.Join(platformDir, name), data, 0644)
+}
+
+// mediaHref は対応表に記録された保存先パスを，ダウンロードディレクトリからの相対パス
+// (media-base があればそのURL) にする
+func mediaHref(downloadDir, local, mediaBase string) string {
+	rel, err := filepath.Rel(downloadDir, local)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = local
+	}
+	rel = filepath.ToSlash(rel)
+	if mediaBase == "" {
+		return rel
+	}
+	return strings.TrimSuffix(mediaBase, "/") + "/" + path.Clean(rel)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"path/filepath"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/relay"
+)
+
+// runRelay はアーカイブ済みNostrイベントを読み取り専用のNIP-01リレーとして公開する
+// usage: fediverse-archive-bot-go relay [-d downloads] [-listen localhost:7777]
+func runRelay(args []string) {
+	fs := flag.NewFlagSet("relay", flag.ExitOnError)
+	var (
+		d = fs.String("d", "downloads", "download directory")
+		l = fs.String("listen", "localhost:7777", "listen address")
+		n = fs.Int("max-limit", 500, "maximum number of events returned per filter")
+		v = fs.Bool("V", false, "verbose output")
+	)
+	fs.Parse(args)
+	logger.SetVerbose(*v)
+
+	index, err := relay.BuildIndex(filepath.Join(*d, "nostr"))
+	if err != nil {
+		logger.Fatalf("Failed to build index: %v", err)
+	}
+
+	server := relay.NewServer(index)
+	server.MaxLimit = *n
+
+	logger.Infof("Serving %d archived events as a read-only relay on ws://%s", index.Size(), *l)
+	logger.Fatal(http.ListenAndServe(*l, server))
+}
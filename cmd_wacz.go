@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/utils"
+	"github.com/chcolte/fediverse-archive-bot-go/wacz"
+	"github.com/chcolte/fediverse-archive-bot-go/warc"
+)
+
+// runCDXJ は -warc で書き出したWARCファイルのCDXJ索引を作成する
+// usage: fediverse-archive-bot-go cdxj -warc warc/ [-o warc/index.cdxj]
+func runCDXJ(args []string) {
+	fs := flag.NewFlagSet("cdxj", flag.ExitOnError)
+	var (
+		d = fs.String("warc", "warc", "WARC directory")
+		o = fs.String("o", "", "output file (default: <WARC directory>/index.cdxj, \"-\" for stdout)")
+		v = fs.Bool("V", false, "verbose output")
+	)
+	fs.Parse(args)
+	logger.SetVerbose(*v)
+	if *o == "" {
+		*o = filepath.Join(*d, "index.cdxj")
+	}
+
+	files, err := warc.ListFiles(*d)
+	if err != nil {
+		logger.Fatalf("Failed to list WARC files: %v", err)
+	}
+	var entries []warc.IndexEntry
+	for _, file := range files {
+		// 索引のファイル名はWARCディレクトリからの相対パス
+		fileEntries, err := warc.IndexFile(file, filepath.Base(file))
+		if err != nil {
+			logger.Errorf("Failed to index %s: %v", file, err)
+		}
+		entries = append(entries, fileEntries...)
+	}
+
+	out, closeOut, err := openOutput(*o)
+	if err != nil {
+		logger.Fatalf("Failed to open output: %v", err)
+	}
+	defer closeOut()
+	if err := warc.WriteCDXJ(out, entries); err != nil {
+		logger.Fatalf("Failed to write index: %v", err)
+	}
+	if *o != "-" {
+		logger.Infof("Indexed %d captures from %d WARC files to %s", len(entries), len(files), *o)
+	}
+}
+
+// runWACZ は1日分，または1つのクロールセッション分のWARCレコードを WACZ にまとめる
+// usage: fediverse-archive-bot-go wacz -warc warc/ [-date 2006-01-02] [-session <crawl_session_id>] [-o archive.wacz]
+func runWACZ(args []string) {
+	fs := flag.NewFlagSet("wacz", flag.ExitOnError)
+	var (
+		d       = fs.String("warc", "warc", "WARC directory")
+		o       = fs.String("o", "", "output file (default: <date or session>.wacz)")
+		date    = fs.String("date", "", "include only records of this day (YYYY-MM-DD, UTC)")
+		session = fs.String("session", "", "include only records of this crawl session")
+		title   = fs.String("title", "", "collection title")
+		v       = fs.Bool("V", false, "verbose output")
+	)
+	fs.Parse(args)
+	logger.SetVerbose(*v)
+
+	opts := wacz.Options{
+		Title:    *title,
+		Software: "fediverse-archive-bot-go/" + utils.ToolVersion,
+		Session:  *session,
+	}
+	name := "archive"
+	if *date != "" {
+		day, err := time.Parse("2006-01-02", *date)
+		if err != nil {
+			logger.Fatalf("Invalid date: %v", err)
+		}
+		opts.Date = day
+		name = *date
+	}
+	if *session != "" {
+		name = *session
+	}
+	if *o == "" {
+		*o = name + ".wacz"
+	}
+	if opts.Title == "" {
+		opts.Title = "Fediverse archive " + name
+	}
+
+	files, err := warc.ListFiles(*d)
+	if err != nil {
+		logger.Fatalf("Failed to list WARC files: %v", err)
+	}
+	count, err := wacz.Create(*o, files, opts)
+	if err != nil {
+		os.Remove(*o)
+		logger.Fatalf("Failed to create WACZ: %v", err)
+	}
+	logger.Infof("Packaged %d records from %d WARC files to %s", count, len(files), *o)
+}
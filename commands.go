@@ -0,0 +1,11 @@
+package main
+
+// サブコマンド一覧 (引数の先頭がコマンド名の場合はクローラーの代わりに実行する)
+var commands = map[string]func(args []string){
+	"relay":    runRelay,
+	"auth":     runAuth,
+	"export":   runExport,
+	"cdxj":     runCDXJ,
+	"wacz":     runWACZ,
+	"compress": runCompress,
+}
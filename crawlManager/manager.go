@@ -1,7 +1,7 @@
 package crawlManager
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -13,10 +13,6 @@ import (
 	"github.com/chcolte/fediverse-archive-bot-go/models"
 	"github.com/chcolte/fediverse-archive-bot-go/nodeinfo"
 	"github.com/chcolte/fediverse-archive-bot-go/providers"
-	"github.com/chcolte/fediverse-archive-bot-go/providers/bluesky"
-	"github.com/chcolte/fediverse-archive-bot-go/providers/mastodon"
-	"github.com/chcolte/fediverse-archive-bot-go/providers/misskey"
-	"github.com/chcolte/fediverse-archive-bot-go/providers/nostr"
 	"github.com/chcolte/fediverse-archive-bot-go/utils"
 	"github.com/chcolte/fediverse-archive-bot-go/writer"
 	"github.com/google/uuid"
@@ -63,16 +59,27 @@ type CrawlManager struct {
 	RegistryLock      sync.RWMutex
 
 	DownloadDir      string
-	Mode             string // live, past
+	Mode             string // live (現在は live のみ)
 	Media            bool
 	Media_fetch_only bool
 	ParallelDownload int
 	Scope            string
 	Timelines        []string // 共通タイムライン名のリスト (local, global)
+
+	ctx    context.Context // Stop でキャンセルされる
+	cancel context.CancelFunc
 }
 
 func NewCrawlManager(downloadDir string, mode string, media bool, media_fetch_only bool, parallelDownload int, scope string, timelines []string) *CrawlManager {
+	// Providerの永続化された状態 (Nostrの重複排除テーブル等) を復元
+	if err := providers.Setup(downloadDir); err != nil {
+		logger.Errorf("Failed to set up providers: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	return &CrawlManager{
+		ctx:               ctx,
+		cancel:            cancel,
 		NewServerReceiver: make(chan models.Server, 100),
 		ArchiverRegistry:  make(map[string]*Archiver),
 		ExplorerRegistry:  make(map[string]*Explorer),
@@ -147,7 +154,12 @@ func (c *CrawlManager) addKnownServer(server models.Server) {
 	c.AppendToFile(server.URL+" "+server.Type, serverListPath)
 
 	// NodeInfoを取得して保存（Nostr, Bluesky等は失敗してもスキップ）
-	c.saveNodeInfo(server)
+	// NostrリレーはNodeInfoを提供しないため，代わりにNIP-11を取得する
+	if server.Type == "nostr" {
+		c.saveRelayInfo(server)
+	} else {
+		c.saveNodeInfo(server)
+	}
 }
 
 func (c *CrawlManager) saveNodeInfo(server models.Server) {
@@ -163,6 +175,7 @@ func (c *CrawlManager) saveNodeInfo(server models.Server) {
 		"source_url":     fmt.Sprintf("https://%s/.well-known/nodeinfo", server.URL),
 		"server_url":     server.URL,
 		"server_type":    server.Type,
+		"software":       info.Software.Name,
 		"schema_version": info.Version,
 	}
 
@@ -171,6 +184,28 @@ func (c *CrawlManager) saveNodeInfo(server models.Server) {
 	}
 }
 
+// saveRelayInfo はNostrリレーのNIP-11ドキュメントを取得して保存する
+func (c *CrawlManager) saveRelayInfo(server models.Server) {
+	info, err := nodeinfo.GetRelayInfo(server.URL)
+	if err != nil {
+		logger.Debugf("Relay info (NIP-11) not available for %s: %v", server.URL, err)
+		return
+	}
+
+	savePath := filepath.Join(c.DownloadDir, server.Type, server.URL, "relayinfo.jsonl")
+
+	extraMeta := map[string]string{
+		"source_url":  nodeinfo.RelayInfoURL(server.URL),
+		"server_url":  server.URL,
+		"server_type": server.Type,
+		"accept":      "application/nostr+json",
+	}
+
+	if err := utils.SaveMetadata([]byte(info.RawJSON), "", savePath, extraMeta); err != nil {
+		logger.Errorf("Failed to save relay info for %s: %v", server.URL, err)
+	}
+}
+
 // saveCrawlSession はクロールセッションのメタデータを保存する
 func (c *CrawlManager) saveCrawlSession(crawlSessionID string, target models.Target, role string) {
 	savePath := filepath.Join(c.DownloadDir, target.Server.Type, target.Server.URL, "crawl_sessions.jsonl")
@@ -180,6 +215,9 @@ func (c *CrawlManager) saveCrawlSession(crawlSessionID string, target models.Tar
 		"timeline":    target.Timeline,
 		"role":        role,
 	}
+	if target.Server.Software != "" {
+		meta["software"] = target.Server.Software
+	}
 	if err := utils.SaveMetadata(nil, crawlSessionID, savePath, meta); err != nil {
 		logger.Errorf("Failed to save crawl session: %v", err)
 	}
@@ -187,7 +225,17 @@ func (c *CrawlManager) saveCrawlSession(crawlSessionID string, target models.Tar
 
 
 func (c *CrawlManager) Start() {
-	for server := range c.NewServerReceiver {
+	for {
+		var server models.Server
+		select {
+		case <-c.ctx.Done():
+			return
+		case server = <-c.NewServerReceiver:
+		}
+
+		// フォーク (Sharkey, Akkoma 等) のソフトウェア名を対応するProvider種別に変換
+		server = providers.ResolveServer(server)
+
 		// サーバーリストを更新
 		if c.isKnownServer(server) {
 			continue
@@ -202,6 +250,16 @@ func (c *CrawlManager) Start() {
 
 		logger.Debug("Received new server: ", server)
 
+		var explore = true;
+		if c.Scope == "server" || !canExplore(server) {
+			explore = false;
+		}
+
+		// 対応Providerでは1本の接続をArchiverとExplorerで共有する
+		if c.startMultiplexed(server, explore) {
+			continue
+		}
+
 		// ------------Archiver--------------
 		// 各タイムラインに対してArchiverを作成
 		for _, timeline := range c.Timelines {
@@ -220,6 +278,10 @@ func (c *CrawlManager) Start() {
 				logger.Errorf("Failed to create archiver connection for %s (%s): %v", server.URL, timeline, err)
 				continue
 			}
+			if err := checkTimeline(server, archiverConn.Provider, timeline); err != nil {
+				logger.Errorf("Skipping archiver for %s: %v", server.URL, err)
+				continue
+			}
 
 			archiver := &Archiver{
 				Conn:    archiverConn,
@@ -235,11 +297,6 @@ func (c *CrawlManager) Start() {
 		}
 
 		// ------------Explorer--------------
-		var explore = true;
-		if c.Scope == "server"{
-			explore = false;
-		}
-
 		if explore {
 			explorerTarget := models.Target{
 				Server:   server,
@@ -271,8 +328,33 @@ func (c *CrawlManager) Start() {
 	}
 }
 
+// Stop は全ての接続を閉じ，受信とダウンロードの終了を待つ
 func (c *CrawlManager) Stop() {
-	// TODO: implement
+	c.cancel()
+
+	c.RegistryLock.RLock()
+	var wgs []*sync.WaitGroup
+	for _, archiver := range c.ArchiverRegistry {
+		wgs = append(wgs, archiver.WG)
+	}
+	for _, explorer := range c.ExplorerRegistry {
+		wgs = append(wgs, explorer.WG)
+	}
+	c.RegistryLock.RUnlock()
+
+	for _, wg := range wgs {
+		wg.Wait()
+	}
+}
+
+// sleep は d だけ待つ。途中で Stop された場合は false を返す
+func (c *CrawlManager) sleep(d time.Duration) bool {
+	select {
+	case <-c.ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
 }
 
 func (c *CrawlManager) createConnection(target models.Target) (*Connection, error) {
@@ -287,98 +369,102 @@ func (c *CrawlManager) createConnection(target models.Target) (*Connection, erro
 }
 
 func (c *CrawlManager) getProvider(target models.Target) (providers.PlatformProvider, error) {
-	server := target.Server
-	//downloadPath := filepath.Join(c.DownloadDir, server.Type, server.URL)
-
-	switch server.Type {
-	case "misskey":
-		return misskey.NewMisskeyProvider(server.URL, target.Timeline), nil
-	case "nostr":
-		return nostr.NewNostrProvider(server.URL), nil
-	case "bluesky":
-		return bluesky.NewBlueskyProvider(server.URL), nil
-	case "mastodon":
-		return mastodon.NewMastodonProvider(server.URL, target.Timeline), nil
-	default:
-		return nil, errors.New("unsupported system specified: " + server.Type)
+	return providers.New(target)
+}
+
+// canMultiplex はサーバーのProviderが1本の接続で複数のタイムラインを購読できるかを返す
+func canMultiplex(server models.Server) bool {
+	reg, ok := providers.Lookup(server.Type)
+	return ok && reg.Capabilities.Multiplex
+}
+
+// canExplore はサーバーのProviderが新規サーバーの探索に対応しているかを返す
+func canExplore(server models.Server) bool {
+	reg, ok := providers.Lookup(server.Type)
+	return ok && reg.Capabilities.Discovery
+}
+
+// checkTimeline はProviderとサーバーのソフトウェアがタイムラインに対応しているかを確認する
+// (タイムラインを解釈しないProviderは常に成功する)
+func checkTimeline(server models.Server, provider providers.PlatformProvider, timeline string) error {
+	if err := providers.CheckSoftwareTimeline(server.Software, timeline); err != nil {
+		return err
 	}
+	if reg, ok := providers.Lookup(server.Type); ok {
+		spec, err := models.ParseTimeline(timeline)
+		if err != nil {
+			return err
+		}
+		if !reg.Capabilities.SupportsTimelineKind(spec.Kind) {
+			return fmt.Errorf("%w for %s: %s", models.ErrUnsupportedTimeline, server.Type, timeline)
+		}
+	}
+	if checker, ok := provider.(providers.TimelineChecker); ok {
+		return checker.CheckTimeline(timeline)
+	}
+	return nil
 }
 
 // Archiverを開始
 func (c *CrawlManager) startArchiver(archiver *Archiver) {
 	conn := archiver.Conn
+	stream := providers.Adapt(conn.Provider)
 
 	// クロールセッション情報を記録
 	c.saveCrawlSession(archiver.CrawlSessionID, conn.Target, "archiver")
 
 	// 接続
-	targetURL, err := conn.Provider.Connect()
-	if err != nil {
-		logger.Error("Failed to connect:", err)
-		close(archiver.DLQueue)
-		close(archiver.MessageQueue)
-		return
-	}
 	savePath := filepath.Join(c.DownloadDir, conn.Target.Server.Type, conn.Target.Server.URL, "crawl_sessions.jsonl")
-	utils.SaveRequest(nil, targetURL, archiver.CrawlSessionID, savePath)
-
-	sentMsg, err := conn.Provider.ConnectChannel()
-	if err != nil {
-		logger.Error("Failed to connect channel:", err)
+	sourceURL, ok := c.openStream(stream, archiver.CrawlSessionID, savePath)
+	if !ok {
 		close(archiver.DLQueue)
 		close(archiver.MessageQueue)
 		return
 	}
-	if sentMsg != nil {
-		utils.SaveRequest(sentMsg, targetURL, archiver.CrawlSessionID, savePath)
-	}
 
 	// Start Writer
 	w := &writer.Writer{
 		BaseDir: filepath.Join(c.DownloadDir, conn.Target.Server.Type, conn.Target.Server.URL),
 		Timeline: conn.Target.Timeline,
 		CrawlSessionID: archiver.CrawlSessionID,
+		SourceURL: sourceURL,
 	}
-	go w.Run(archiver.MessageQueue)
+	// 停止時に書き込み中のセグメントを完成させるまで待つ
+	archiver.WG.Add(1)
+	go func() {
+		defer archiver.WG.Done()
+		w.Run(archiver.MessageQueue)
+	}()
 
 	// 受信
 	archiver.WG.Add(1)
 	go func() {
 		defer archiver.WG.Done()
-		defer conn.Provider.Close()
+		defer stream.Close()
 		defer close(archiver.MessageQueue)
 		defer close(archiver.DLQueue)
 		for {
-			if err := conn.Provider.ReceiveMessages(archiver.DLQueue, archiver.MessageQueue); err != nil {
-				logger.Errorf("ReceiveMessages error: %v. Reconnecting in 5 seconds... [%s]", err, conn.Target.Server.URL)
-				time.Sleep(5 * time.Second)
-
-				// 再接続
-				conn.Provider.Close()
-
-				archiver.CrawlSessionID = uuid.New().String()
-				w.CrawlSessionID = archiver.CrawlSessionID
-				c.saveCrawlSession(archiver.CrawlSessionID, conn.Target, "archiver")
-				
-				if targetURL, err := conn.Provider.Connect(); err != nil {
-					logger.Errorf("Reconnect failed: %v. Retrying... [%s]", err, conn.Target.Server.URL)
-					continue
-				} else {
-					utils.SaveRequest(nil, targetURL, archiver.CrawlSessionID, savePath)
-				}
-				if sentMsg, err := conn.Provider.ConnectChannel(); err != nil {
-					logger.Errorf("ReconnectChannel failed: %v. Retrying... [%s]", err, conn.Target.Server.URL)
-					continue
-				} else if sentMsg != nil {
-					utils.SaveRequest(sentMsg, targetURL, archiver.CrawlSessionID, savePath)
-				}
-				logger.Infof("Reconnected successfully [%s]", conn.Target.Server.URL)
+			err := stream.Receive(c.ctx, archiver.DLQueue, archiver.MessageQueue)
+			if err == nil || c.ctx.Err() != nil {
+				break
+			}
+			logger.Errorf("ReceiveMessages error: %v. Reconnecting in 5 seconds... [%s]", err, conn.Target.Server.URL)
+			if !c.sleep(5 * time.Second) {
+				break
+			}
 
-				// TODO: ダウンタイムの間のポストをREST APIで取得する処理
+			// 再接続
+			stream.CloseStream()
 
-			} else {
-				break
+			archiver.CrawlSessionID = uuid.New().String()
+			w.SetCrawlSessionID(archiver.CrawlSessionID)
+			c.saveCrawlSession(archiver.CrawlSessionID, conn.Target, "archiver")
+
+			if _, ok := c.openStream(stream, archiver.CrawlSessionID, savePath); ok {
+				logger.Infof("Reconnected successfully [%s]", conn.Target.Server.URL)
 			}
+
+			// TODO: ダウンタイムの間のポストをREST APIで取得する処理
 		}
 	}()
 
@@ -389,6 +475,7 @@ func (c *CrawlManager) startArchiver(archiver *Archiver) {
 			go mediaDownloader.MediaDownloader(archiver.DLQueue, archiver.WG, c.DownloadDir, c.Media_fetch_only)
 		}
 	} else {
+		archiver.WG.Add(1)
 		go func() {
 			defer archiver.WG.Done()
 			for item := range archiver.DLQueue {
@@ -401,67 +488,63 @@ func (c *CrawlManager) startArchiver(archiver *Archiver) {
 // Explorerを開始
 func (c *CrawlManager) startExplorer(explorer *Explorer) {
 	conn := explorer.Conn
+	stream := providers.Adapt(conn.Provider)
 
 	// クロールセッション情報を記録
 	c.saveCrawlSession(explorer.CrawlSessionID, conn.Target, "explorer")
 
 	// 接続
-	targetURL, err := conn.Provider.Connect()
-	if err != nil {
-		logger.Error("Failed to connect:", err)
-		return
-	}
 	savePath := filepath.Join(c.DownloadDir, conn.Target.Server.Type, conn.Target.Server.URL, "crawl_sessions.jsonl")
-	utils.SaveRequest(nil, targetURL, explorer.CrawlSessionID, savePath)
-
-	sentMsg, err := conn.Provider.ConnectChannel()
-	if err != nil {
-		logger.Error("Failed to connect channel:", err)
+	if _, ok := c.openStream(stream, explorer.CrawlSessionID, savePath); !ok {
 		return
 	}
-	if sentMsg != nil {
-		utils.SaveRequest(sentMsg, targetURL, explorer.CrawlSessionID, savePath)
-	}
 
 	// 受信
 	explorer.WG.Add(1)
 	go func() {
 		defer explorer.WG.Done()
-		defer conn.Provider.Close()
+		defer stream.Close()
 		for {
-			if err := conn.Provider.CrawlNewServer(explorer.ServerQueue); err != nil {
-				logger.Errorf("CrawlNewServer error: %v. Reconnecting in 5 seconds...", err)
-				time.Sleep(5 * time.Second)
-
-				// 再接続
-				conn.Provider.Close()
-
-				explorer.CrawlSessionID = uuid.New().String()
-				c.saveCrawlSession(explorer.CrawlSessionID, conn.Target, "explorer")
-
-				if targetURL, err := conn.Provider.Connect(); err != nil {
-					logger.Errorf("Reconnect failed: %v. Retrying...", err)
-					continue
-				} else {
-					utils.SaveRequest(nil, targetURL, explorer.CrawlSessionID, savePath)
-				}
-				if sentMsg, err := conn.Provider.ConnectChannel(); err != nil {
-					logger.Errorf("ReconnectChannel failed: %v. Retrying...", err)
-					continue
-				} else if sentMsg != nil {
-					utils.SaveRequest(sentMsg, targetURL, explorer.CrawlSessionID, savePath)
-				}
-				logger.Info("Reconnected successfully")
+			err := stream.Discover(c.ctx, explorer.ServerQueue)
+			if err == nil || c.ctx.Err() != nil {
+				break
+			}
+			logger.Errorf("CrawlNewServer error: %v. Reconnecting in 5 seconds...", err)
+			if !c.sleep(5 * time.Second) {
+				break
+			}
 
-				// TODO: ダウンタイムの間のポストをREST APIで取得する処理
+			// 再接続
+			stream.CloseStream()
 
-			} else {
-				break
+			explorer.CrawlSessionID = uuid.New().String()
+			c.saveCrawlSession(explorer.CrawlSessionID, conn.Target, "explorer")
+
+			if _, ok := c.openStream(stream, explorer.CrawlSessionID, savePath); ok {
+				logger.Info("Reconnected successfully")
 			}
 		}
 	}()
 }
 
+// openStream は接続してチャンネルを購読し，送信したリクエストを記録する。接続先のURLを返す
+func (c *CrawlManager) openStream(stream providers.ContextProvider, crawlSessionID, savePath string) (string, bool) {
+	targetURL, sentMsg, err := stream.Open(c.ctx)
+	if targetURL != "" {
+		utils.SaveRequest(nil, targetURL, crawlSessionID, savePath)
+	}
+	if err != nil {
+		if c.ctx.Err() == nil {
+			logger.Error("Failed to connect:", err)
+		}
+		return targetURL, false
+	}
+	if sentMsg != nil {
+		utils.SaveRequest(sentMsg, targetURL, crawlSessionID, savePath)
+	}
+	return targetURL, true
+}
+
 func (c *CrawlManager) AppendToFile(text string, filePath string) {
 	dir := filepath.Dir(filePath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
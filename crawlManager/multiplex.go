@@ -0,0 +1,273 @@
+package crawlManager
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/media-downloader"
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
+	"github.com/chcolte/fediverse-archive-bot-go/writer"
+	"github.com/google/uuid"
+)
+
+/*
+[多重化接続]
+1本の接続 (MultiplexProvider) で複数のタイムラインを購読し，
+受信したメッセージを Metadata["timeline"] で各Archiverに振り分ける。
+Explorerも同じ接続の連合TLからサーバーを探索する。
+
+             ┌→ Archiver(local)  → Writer
+Provider ─振り分け→ Archiver(global) → Writer
+             └→ Explorer (global) → DiscoverServers
+*/
+
+// startMultiplexed は対応Providerであれば1本の接続でArchiverとExplorerを開始する。
+// 対応していないProviderの場合は false を返す（従来通りタイムラインごとに接続する）
+func (c *CrawlManager) startMultiplexed(server models.Server, explore bool) bool {
+	// 対応していない種別ではProviderを作らない
+	if !canMultiplex(server) {
+		return false
+	}
+	provider, err := c.getProvider(models.Target{Server: server, Timeline: c.Timelines[0]})
+	if err != nil {
+		return false
+	}
+	mux, ok := provider.(providers.MultiplexProvider)
+	if !ok {
+		return false
+	}
+
+	// まだ保存していないタイムライン
+	var timelines []string
+	for _, timeline := range c.Timelines {
+		if c.archiverExists(models.Target{Server: server, Timeline: timeline}) {
+			continue
+		}
+		if err := checkTimeline(server, mux, timeline); err != nil {
+			logger.Errorf("Skipping archiver for %s: %v", server.URL, err)
+			continue
+		}
+		timelines = append(timelines, timeline)
+	}
+
+	// Explorerは連合TLを使う。保存対象でなければ探索専用として購読する
+	explorerTarget := models.Target{Server: server, Timeline: models.TimelineGlobal}
+	explore = explore && !c.explorerExists(explorerTarget)
+	var discoveryOnly []string
+	if explore && !contains(timelines, models.TimelineGlobal) {
+		discoveryOnly = append(discoveryOnly, models.TimelineGlobal)
+	}
+	if len(timelines) == 0 && !explore {
+		return true
+	}
+	mux.SetTimelines(timelines, discoveryOnly)
+
+	dlQueue := make(chan models.DownloadItem, 100)
+	wg := &sync.WaitGroup{}
+
+	archivers := make(map[string]*Archiver)
+	for _, timeline := range timelines {
+		archiver := &Archiver{
+			Conn:         &Connection{Target: models.Target{Server: server, Timeline: timeline}, Provider: mux},
+			DLQueue:      dlQueue,
+			MessageQueue: make(chan models.RawMessage, 100),
+			WG:           wg,
+		}
+		c.registerArchiver(archiver)
+		archivers[timeline] = archiver
+	}
+
+	var explorer *Explorer
+	if explore {
+		explorer = &Explorer{
+			Conn:        &Connection{Target: explorerTarget, Provider: mux},
+			ServerQueue: c.NewServerReceiver,
+			WG:          wg,
+		}
+		c.registerExplorer(explorer)
+	}
+
+	c.runMultiplexed(server, mux, timelines, archivers, explorer, dlQueue, wg)
+	return true
+}
+
+// runMultiplexed は共有接続の受信・振り分け・保存・探索を開始する
+func (c *CrawlManager) runMultiplexed(server models.Server, mux providers.MultiplexProvider, timelines []string, archivers map[string]*Archiver, explorer *Explorer, dlQueue chan models.DownloadItem, wg *sync.WaitGroup) {
+	stream := providers.Adapt(mux)
+	savePath := filepath.Join(c.DownloadDir, server.Type, server.URL, "crawl_sessions.jsonl")
+	sessionID := uuid.New().String()
+
+	// クロールセッション情報を記録（接続を共有する全ての役割について）
+	writers := make(map[string]*writer.Writer)
+	saveSessions := func(id string) {
+		for _, timeline := range timelines {
+			archivers[timeline].CrawlSessionID = id
+			c.saveCrawlSession(id, archivers[timeline].Conn.Target, "archiver")
+			if w, ok := writers[timeline]; ok {
+				w.SetCrawlSessionID(id)
+			}
+		}
+		if explorer != nil {
+			explorer.CrawlSessionID = id
+			c.saveCrawlSession(id, explorer.Conn.Target, "explorer")
+		}
+	}
+	saveSessions(sessionID)
+
+	closeQueues := func() {
+		for _, archiver := range archivers {
+			close(archiver.MessageQueue)
+		}
+		close(dlQueue)
+	}
+
+	// 接続 (失敗した場合も受信ループで再接続を試みる)
+	sourceURL, connected := c.openStream(stream, sessionID, savePath)
+	if !connected && c.ctx.Err() != nil {
+		closeQueues()
+		return
+	}
+
+	// Start Writer (タイムラインごと)
+	for _, timeline := range timelines {
+		w := &writer.Writer{
+			BaseDir:        filepath.Join(c.DownloadDir, server.Type, server.URL),
+			Timeline:       timeline,
+			CrawlSessionID: sessionID,
+			SourceURL:      sourceURL,
+		}
+		writers[timeline] = w
+		wg.Add(1)
+		go func(queue chan models.RawMessage) {
+			defer wg.Done()
+			w.Run(queue)
+		}(archivers[timeline].MessageQueue)
+	}
+
+	// 振り分け
+	muxQueue := make(chan models.RawMessage, 100)
+	var discoverQueue chan models.RawMessage
+	if explorer != nil {
+		discoverQueue = make(chan models.RawMessage, 100)
+	}
+	go func() {
+		for msg := range muxQueue {
+			timeline := msg.Metadata["timeline"]
+			if archiver := routeMessage(msg, timelines, archivers); archiver != nil {
+				archiver.MessageQueue <- msg
+			} else if timeline == "" {
+				// 探索専用の接続では保存先のArchiverがない
+				logger.Warnf("Dropped message without timeline: no archiver on the shared connection [%s]", server.URL)
+			}
+			if discoverQueue != nil && timeline == models.TimelineGlobal {
+				select {
+				case discoverQueue <- msg:
+				default:
+					logger.Debug("Skipped server discovery. Discovery queue is full.")
+				}
+			}
+		}
+		for _, archiver := range archivers {
+			close(archiver.MessageQueue)
+		}
+		if discoverQueue != nil {
+			close(discoverQueue)
+		}
+	}()
+
+	// 探索
+	if explorer != nil {
+		logger.Info("Starting to crawl new servers [", server.URL, "]")
+		explorer.WG.Add(1)
+		go func() {
+			defer explorer.WG.Done()
+			for msg := range discoverQueue {
+				// 停止後は Start が受け付けないため，見つけたサーバーは捨てる
+				if c.ctx.Err() != nil {
+					continue
+				}
+				for _, found := range mux.DiscoverServers(msg) {
+					select {
+					case explorer.ServerQueue <- found:
+					case <-c.ctx.Done():
+					}
+				}
+			}
+		}()
+	}
+
+	// 受信
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer stream.Close()
+		defer close(muxQueue)
+		defer close(dlQueue)
+		for {
+			if connected {
+				err := stream.Receive(c.ctx, dlQueue, muxQueue)
+				if err == nil || c.ctx.Err() != nil {
+					break
+				}
+				logger.Errorf("ReceiveMessages error: %v. Reconnecting in 5 seconds... [%s]", err, server.URL)
+			} else {
+				logger.Errorf("Not connected. Reconnecting in 5 seconds... [%s]", server.URL)
+			}
+			if !c.sleep(5 * time.Second) {
+				break
+			}
+
+			// 再接続
+			stream.CloseStream()
+
+			sessionID := uuid.New().String()
+			saveSessions(sessionID)
+
+			if _, connected = c.openStream(stream, sessionID, savePath); connected {
+				logger.Infof("Reconnected successfully [%s]", server.URL)
+			}
+		}
+	}()
+
+	// ダウンローダーを開始
+	if c.Media && len(timelines) > 0 {
+		for i := 0; i < c.ParallelDownload; i++ {
+			wg.Add(1)
+			go mediaDownloader.MediaDownloader(dlQueue, wg, c.DownloadDir, c.Media_fetch_only)
+		}
+	} else {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range dlQueue {
+				logger.Debug("Discarding item:", item)
+			}
+		}()
+	}
+}
+
+// routeMessage はメッセージを保存するArchiverを Metadata["timeline"] で選ぶ。
+// タイムラインに属さないメッセージ (ノートの更新通知等) は先頭のタイムラインに保存する (別ストリームに分けるのはProvider側)。
+// 保存しないメッセージ (探索専用のタイムライン等) なら nil を返す
+func routeMessage(msg models.RawMessage, timelines []string, archivers map[string]*Archiver) *Archiver {
+	timeline := msg.Metadata["timeline"]
+	if archiver, ok := archivers[timeline]; ok {
+		return archiver
+	}
+	if timeline == "" && len(timelines) > 0 {
+		return archivers[timelines[0]]
+	}
+	return nil
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
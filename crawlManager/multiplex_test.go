@@ -0,0 +1,63 @@
+package crawlManager
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
+)
+
+func TestRouteMessage(t *testing.T) {
+	local, global := &Archiver{}, &Archiver{}
+	message := func(timeline string) models.RawMessage {
+		return models.RawMessage{Metadata: map[string]string{"timeline": timeline}}
+	}
+
+	// 1. タイムラインごとのArchiverに振り分け，タイムラインのないメッセージは先頭に保存する
+	timelines := []string{models.TimelineLocal, models.TimelineGlobal}
+	archivers := map[string]*Archiver{models.TimelineLocal: local, models.TimelineGlobal: global}
+	if routeMessage(message(models.TimelineGlobal), timelines, archivers) != global {
+		t.Error("global message was not routed to the global archiver")
+	}
+	if routeMessage(models.RawMessage{}, timelines, archivers) != local {
+		t.Error("message without timeline was not routed to the first archiver")
+	}
+
+	// 2. 探索専用のタイムラインは保存しない
+	timelines = []string{models.TimelineLocal}
+	archivers = map[string]*Archiver{models.TimelineLocal: local}
+	if routeMessage(message(models.TimelineGlobal), timelines, archivers) != nil {
+		t.Error("discovery-only message was routed to an archiver")
+	}
+
+	// 3. 探索専用の接続ではタイムラインのないメッセージの保存先もない
+	if routeMessage(message(""), nil, map[string]*Archiver{}) != nil {
+		t.Error("message without timeline was routed although there is no archiver")
+	}
+}
+
+// 多重化に対応していないテスト用のProvider (レジストリは取り消せないため一度だけ登録する)
+var (
+	registerSingle    sync.Once
+	singleConstructed bool
+)
+
+func TestStartMultiplexedChecksCapability(t *testing.T) {
+	registerSingle.Do(func() {
+		providers.Register("test-single", func(models.Target) providers.PlatformProvider {
+			singleConstructed = true
+			return nil
+		}, providers.Capabilities{})
+	})
+	singleConstructed = false
+
+	// 多重化に対応していない種別ではProviderを作らずに従来の接続に任せる
+	c := &CrawlManager{Timelines: []string{models.TimelineLocal}}
+	if c.startMultiplexed(models.Server{Type: "test-single", URL: "example.com"}, false) {
+		t.Error("startMultiplexed handled a provider without the Multiplex capability")
+	}
+	if singleConstructed {
+		t.Error("startMultiplexed constructed a provider without the Multiplex capability")
+	}
+}
@@ -0,0 +1,121 @@
+package credentials
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credential holds a user access token for one server
+type Credential struct {
+	Type        string    `json:"type"`              // mastodon, misskey
+	AccessToken string    `json:"access_token"`      // Mastodon OAuth token or Misskey "i" token
+	Account     string    `json:"account,omitempty"` // account the token belongs to (informational)
+	Scope       string    `json:"scope,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Store keeps per-server user tokens, keyed by host (e.g. "mastodon.social").
+// The file is a JSON object so operators can also edit it by hand:
+//
+//	{"mastodon.social": {"type": "mastodon", "access_token": "..."}}
+type Store struct {
+	mu      sync.RWMutex
+	path    string
+	entries map[string]*Credential
+}
+
+var (
+	// DefaultStore is the global credential store used by providers
+	DefaultStore = NewStore()
+)
+
+// NewStore creates an empty Store that is not backed by a file
+func NewStore() *Store {
+	return &Store{
+		entries: make(map[string]*Credential),
+	}
+}
+
+// Load reads credentials from path. A missing file is not an error;
+// the file will be created by the first Set.
+func (s *Store) Load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]*Credential)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	s.entries = make(map[string]*Credential, len(entries))
+	for host, cred := range entries {
+		s.entries[normalizeHost(host)] = cred
+	}
+	return nil
+}
+
+// Get returns the credential for host, or nil if none is configured
+func (s *Store) Get(host string) *Credential {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.entries[normalizeHost(host)]
+}
+
+// Token returns the access token for host, or "" if none is configured
+func (s *Store) Token(host string) string {
+	if cred := s.Get(host); cred != nil {
+		return cred.AccessToken
+	}
+	return ""
+}
+
+// Set stores a credential and writes the store back to its file (if loaded from one)
+func (s *Store) Set(host string, cred *Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[normalizeHost(host)] = cred
+	if s.path == "" {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the store atomically with owner-only permissions, since it contains secrets
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// normalizeHost strips the scheme and trailing slash so that "https://example.com/" and "example.com" match
+func normalizeHost(host string) string {
+	for _, scheme := range []string{"https://", "http://", "wss://", "ws://"} {
+		host = strings.TrimPrefix(host, scheme)
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "/"))
+}
@@ -0,0 +1,45 @@
+package credentials
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth", "credentials.json")
+
+	// 1. ファイルがなくても読み込める
+	store := NewStore()
+	if err := store.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if store.Token("mastodon.social") != "" {
+		t.Error("empty store returned a token")
+	}
+
+	// 2. URL形式のホストで保存しても，ホスト名だけで引ける
+	if err := store.Set("https://Mastodon.Social/", &Credential{Type: "mastodon", AccessToken: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.Token("mastodon.social"); got != "secret" {
+		t.Errorf("Token = %q, want secret", got)
+	}
+
+	// 3. 書き出したファイルは所有者だけが読め，読み込み直しても同じトークンを返す
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("file mode = %v, want 0600", perm)
+	}
+	reloaded := NewStore()
+	if err := reloaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	cred := reloaded.Get("wss://mastodon.social")
+	if cred == nil || cred.Type != "mastodon" || cred.AccessToken != "secret" {
+		t.Errorf("reloaded credential = %+v", cred)
+	}
+}
@@ -4,27 +4,68 @@ import (
 	"bufio"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
 	"strings"
 	"log"
 	"path/filepath"
-	//"os/signal"
+	"os/signal"
 	//"sync"
-	//"syscall"
-	//"time"
+	"syscall"
+	"time"
 
 	"github.com/chcolte/fediverse-archive-bot-go/crawlManager"
+	"github.com/chcolte/fediverse-archive-bot-go/credentials"
 	"github.com/chcolte/fediverse-archive-bot-go/logger"
 	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
+	"github.com/chcolte/fediverse-archive-bot-go/providers/mastodon"
+	"github.com/chcolte/fediverse-archive-bot-go/providers/misskey"
+	"github.com/chcolte/fediverse-archive-bot-go/providers/nostr"
+	"github.com/chcolte/fediverse-archive-bot-go/sqlitestore"
 	"github.com/chcolte/fediverse-archive-bot-go/utils"
+	"github.com/chcolte/fediverse-archive-bot-go/warc"
+	"github.com/chcolte/fediverse-archive-bot-go/writer"
+
+	// Providerの登録 (init で providers.Register される)
+	_ "github.com/chcolte/fediverse-archive-bot-go/providers/bluesky"
+	_ "github.com/chcolte/fediverse-archive-bot-go/providers/polling"
 
 	// for debug 
 	// "net/http"
 	// _ "net/http/pprof"
 )
 
+// 認証情報などのオプション（秘密情報は環境変数からも指定できる）
+var (
+	nostrKey      = flag.String("nostr-key", os.Getenv("NOSTR_SECRET_KEY"), "hex secret key used to answer Nostr NIP-42 AUTH challenges (or $NOSTR_SECRET_KEY)")
+	subNote       = flag.Int("misskey-subnote", 0, "number of recent Misskey notes to watch for reactions, votes and deletions (0 = disabled)")
+	credPath      = flag.String("credentials", "credentials.json", "per-server user access tokens (created by the auth command)")
+	appCache      = flag.String("mastodon-token-cache", "mastodon_tokens.json", "file to persist registered Mastodon apps and their tokens")
+	readTimeout   = flag.Duration("read-timeout", 0, "reconnect when no message is received for this long (0 = disabled)")
+	warcDir       = flag.String("warc", "", "also write WARC files to this directory (empty = disabled)")
+	warcMaxSize   = flag.Int64("warc-max-size", warc.DefaultMaxSize>>20, "rotate WARC files after this many MiB")
+	warcGzip      = flag.Bool("warc-gzip", true, "write gzip-compressed WARC files (.warc.gz)")
+	rotate        = flag.String("rotate", writer.RotateDaily, "start a new JSONL segment every day or hour (daily, hourly)")
+	rotateSize    = flag.Int64("rotate-size", 0, "also start a new JSONL segment once its file reaches this many MiB on disk, i.e. after compression with -compress (0 = unlimited)")
+	rotateRecords = flag.Int("rotate-records", 0, "also start a new JSONL segment after this many records (0 = unlimited)")
+	compress      = flag.String("compress", string(utils.CompressionNone), "compress JSONL segments while they are written (none, gzip, zstd)")
+	flushInterval = flag.Duration("flush-interval", utils.DefaultFlushInterval, "keep JSONL files open and flush buffered records at this interval (0 = write through)")
+	idleTimeout   = flag.Duration("file-idle-timeout", utils.DefaultIdleTimeout, "close JSONL files not written for this long")
+	sqlitePath    = flag.String("sqlite", "", "also store messages and normalized posts in this SQLite database (empty = disabled)")
+	sqliteBatch   = flag.Int("sqlite-batch", sqlitestore.DefaultBatchSize, "number of messages inserted per SQLite transaction")
+)
+
 func main() {
 
+	// サブコマンド (relay 等) の場合はクローラーを起動しない
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	// for debug
 	// go func() {
 	// 	logger.Info("pprof server listening on :6060")
@@ -35,10 +76,72 @@ func main() {
 	system, mode, url, serverListPath, timelineStr, downloadDir, verbose, media, media_fetch_only, parallelDownload, scope := readFlags()
 	logger.SetVerbose(verbose)
 
+	misskey.DefaultSubNoteWindow = *subNote
+	providers.DefaultReadTimeout = *readTimeout
+
+	compression, err := utils.ParseCompression(*compress)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	writer.DefaultRotation = writer.RotationPolicy{Interval: *rotate, MaxBytes: *rotateSize << 20, MaxRecords: *rotateRecords, Compression: compression}
+	if err := writer.DefaultRotation.Validate(); err != nil {
+		logger.Fatal(err)
+	}
+	// 前回の実行で完成させられなかった (期間の過ぎた) セグメントを完成させる
+	if n, err := writer.FinishStaleSegments(downloadDir, time.Now()); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Failed to finish stale segments: %v", err)
+	} else if n > 0 {
+		logger.Infof("Completed %d segments left by the previous run", n)
+	}
+
+	if *flushInterval > 0 {
+		utils.DefaultFilePool = utils.NewFilePool(*flushInterval, *idleTimeout)
+	}
+
+	if *sqlitePath != "" {
+		store, err := sqlitestore.Open(*sqlitePath, *sqliteBatch, sqlitestore.DefaultFlushInterval)
+		if err != nil {
+			logger.Fatalf("Failed to open SQLite database: %v", err)
+		}
+		sqlitestore.DefaultStore = store
+	}
+
+	if *warcDir != "" {
+		warc.DefaultWriter = warc.NewWriter(*warcDir, "fediverse-archive", *warcMaxSize<<20, *warcGzip)
+	}
+
+	// 過去の投稿を取得 (Capabilities.Backfill) できるProviderはまだないため，live のみ受け付ける
+	if mode != "live" {
+		logger.Fatalf("Invalid mode %q (currently live only)", mode)
+	}
+	scope, err = validateScope(scope)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := credentials.DefaultStore.Load(*credPath); err != nil {
+		logger.Fatalf("Failed to load credentials: %v", err)
+	}
+	if err := mastodon.DefaultTokenCache.Open(*appCache); err != nil {
+		logger.Errorf("Failed to load Mastodon token cache: %v", err)
+	}
+
+	if *nostrKey != "" {
+		signer, err := nostr.NewSigner(*nostrKey)
+		if err != nil {
+			logger.Fatalf("Invalid Nostr key: %v", err)
+		}
+		nostr.DefaultSigner = signer
+		logger.Info("Nostr NIP-42 AUTH enabled as ", signer.PubKey)
+	}
+
 	// カンマ区切りのタイムラインを配列に変換
 	timelines := strings.Split(timelineStr, ",")
 	for i := range timelines {
 		timelines[i] = strings.TrimSpace(timelines[i])
+		if _, err := models.ParseTimeline(timelines[i]); err != nil {
+			logger.Fatalf("Invalid timeline: %v", err)
+		}
 	}
 
 	cm := crawlManager.NewCrawlManager(downloadDir, mode, media, media_fetch_only, parallelDownload, scope, timelines)
@@ -72,31 +175,28 @@ func main() {
 	startMessage(mode, serverList, timelines, downloadDir, media, scope)
 
 	// start crawler
-	cm.Start()
-
-	// // シグナルハンドリング
-	// quit := make(chan os.Signal, 1)
-	// signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
-
-	// <-quit // シグナル待ち
-	// logger.Info("Shutting down...")
+	go cm.Start()
 
-	// // WebSocket接続を閉じる
-	// // TODO: fix: L77で結局Reconnectしてしまう
-	// provider.Close()
-	// logger.Info("Closed provider connection")
+	// シグナルハンドリング
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
-	// // 未処理のURLを保存する
-	// savePendingURLs(dlqueue)
-	// logger.Info("Saved pending URLs to file")
+	<-quit // シグナル待ち
+	logger.Info("Shutting down...")
 
-	// // チャネルを閉じてワーカーを停止させる
-	// close(dlqueue)
-	// logger.Info("Closed download queue.")
+	// 受信中の接続を閉じ，Archiverが書き込みを終えるのを待つ
+	cm.Stop()
+	logger.Info("All archivers stopped")
 
-	// // 全てのワーカーが終了するのを待つ
-	// // wg.Wait() //これしちゃうと，dlqueueにURLが送られてくるときにパニックを起こすまで止まらない
-	// // logger.Info("All workers finished")
+	if err := utils.DefaultFilePool.Close(); err != nil {
+		logger.Errorf("Failed to flush JSONL files: %v", err)
+	}
+	if err := sqlitestore.DefaultStore.Close(); err != nil {
+		logger.Errorf("Failed to close SQLite database: %v", err)
+	}
+	if err := warc.DefaultWriter.Close(); err != nil {
+		logger.Errorf("Failed to close WARC file: %v", err)
+	}
 }
 
 func startMessage(mode string, serverList []models.Server, timelines []string, downloadDir string, media bool, scope string) {
@@ -114,19 +214,31 @@ func startMessage(mode string, serverList []models.Server, timelines []string, d
 	logger.SetFlags(log.LstdFlags)
 }
 
+// validateScope は -Scope の値を検証する。ソフトウェア名 (sharkey 等) はProvider種別に変換する
+func validateScope(scope string) (string, error) {
+	if scope == "unbounded" || scope == "server" {
+		return scope, nil
+	}
+	scope = providers.ResolveServer(models.Server{Type: scope}).Type
+	if _, ok := providers.Lookup(scope); !ok {
+		return "", fmt.Errorf("invalid scope %q (available: unbounded, server, %s)", scope, strings.Join(providers.Available(), ", "))
+	}
+	return scope, nil
+}
+
 func readFlags() (string, string, string, string, string, string, bool, bool, bool, int, string) {
 	var (
-		s = flag.String("s", "misskey", "target system. (e.g misskey, nostr)")
+		s = flag.String("s", "misskey", "target system or NodeInfo software name. (e.g misskey, sharkey, akkoma, nostr, lemmy, mastodon-poll)")
 		m = flag.String("m", "live", "archive mode.(currently live only)")
 		u = flag.String("u", "", "server URL. (e.g. https://misskey.io)")
 		a = flag.String("a", "", "server URL list. (Max 100 servers) (e.g. ./server_urls.txt)")
-		t = flag.String("t", "local", "timeline to archive (local, global)")
+		t = flag.String("t", "local", "timelines to archive, comma separated (local, global, remote, hybrid, home, <tl>:media, hashtag:<tag>, list:<id>, channel:<id>, antenna:<id>)")
 		d = flag.String("d", "downloads", "download directory")
 		v = flag.Bool("V", false, "verbose output")
 		M = flag.Bool("media", false, "download media files")
 		Mf = flag.Bool("media-fetch-only", false, "don't save media files")
 		P = flag.Int("parallel-download", 1, "Number of Media Downloaders")
-		S = flag.String("Scope", "server", "scope (e.g. unbounded, server, misskey, mastodon, nostr, bluesky)")
+		S = flag.String("Scope", "server", "scope (e.g. unbounded, server, misskey, mastodon, nostr, bluesky, lemmy)")
 	)
 	flag.Parse()
 	return *s, *m, *u, *a, *t, *d, *v, *M, *Mf, *P, *S
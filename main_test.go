@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestValidateScope(t *testing.T) {
+	for scope, want := range map[string]string{
+		"unbounded": "unbounded",
+		"server":    "server",
+		"mastodon":  "mastodon",
+		"sharkey":   "misskey", // ソフトウェア名はProvider種別に変換する
+		"lemmy":     "lemmy",
+	} {
+		got, err := validateScope(scope)
+		if err != nil || got != want {
+			t.Errorf("validateScope(%s) = %s, %v, want %s", scope, got, err, want)
+		}
+	}
+	if _, err := validateScope("unknown"); err == nil {
+		t.Error("validateScope(unknown) succeeded")
+	}
+}
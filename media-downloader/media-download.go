@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
@@ -17,12 +18,16 @@ import (
 	"github.com/chcolte/fediverse-archive-bot-go/logger"
 	"github.com/chcolte/fediverse-archive-bot-go/models"
 	"github.com/chcolte/fediverse-archive-bot-go/utils"
+	"github.com/chcolte/fediverse-archive-bot-go/warc"
 	"github.com/patrickmn/go-cache"
 )
 
 // TTL: 24 hours, cleanup interval: 30 minutes.
 var urlCache = cache.New(24*time.Hour, 30*time.Minute)
 
+// Content-Typeを確認できなかったURL。同じURLが何度も届いても，TTLの間は確認し直さない
+var probeFailureCache = cache.New(time.Hour, 30*time.Minute)
+
 // MediaDownloader downloads assets from the download queue
 func MediaDownloader(dlqueue chan models.DownloadItem, wg *sync.WaitGroup, downloadDir string, media_fetch_only bool) {
 	defer wg.Done()
@@ -44,6 +49,26 @@ func MediaDownloader(dlqueue chan models.DownloadItem, wg *sync.WaitGroup, downl
 			continue
 		}
 
+		// メディアか分からないURLは，先にContent-Typeを確認する
+		if item.CheckContentType {
+			if _, failed := probeFailureCache.Get(item.URL); failed {
+				logger.Debug("Skipped fetch URL whose content type could not be checked recently: "+item.URL)
+				continue
+			}
+			isMedia, err := isMediaURL(item.URL)
+			if err != nil {
+				// 取得済みにはせず，TTLが過ぎてからもう一度確認する
+				logger.Debugf("Failed to check content type of %s: %v", item.URL, err)
+				probeFailureCache.SetDefault(item.URL, true)
+				continue
+			}
+			if !isMedia {
+				logger.Debug("Skipped fetch non-media URL: "+item.URL)
+				markAsFetched(item.URL)
+				continue
+			}
+		}
+
 		resp, err := fetchFile(item.URL)
 		if err != nil {
 			logger.Errorf("Failed to fetch %s : %v", item.URL, err)
@@ -51,11 +76,13 @@ func MediaDownloader(dlqueue chan models.DownloadItem, wg *sync.WaitGroup, downl
 		}
 		
 		if media_fetch_only {
-			io.Copy(io.Discard, resp.Body)
+			hasher := sha256.New()
+			io.Copy(hasher, resp.Body)
 			resp.Body.Close()
+			verifyHash(item, hex.EncodeToString(hasher.Sum(nil)))
 			
 		}else{
-			err := saveFile(resp, item.URL, item.Datetime, downloadDir)
+			err := saveFile(resp, item, downloadDir)
 			resp.Body.Close()
 			if err != nil {
 				logger.Errorf("Failed to download %s: %v", item.URL, err)
@@ -82,11 +109,75 @@ func markAsFetched(fileURL string) {
 	urlCache.SetDefault(fileURL, true)
 }
 
-func fetchFile(fileURL string) (*http.Response, error) {
+func newHTTPClient() *http.Client {
 	// Skip TLS Verify (for Pywb proxy)
 	tr := http.DefaultTransport.(*http.Transport).Clone()
 	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	client := &http.Client{Transport: tr}
+	return &http.Client{Transport: tr}
+}
+
+// isMediaURL checks whether the URL points to image, video or audio.
+// It returns an error when the Content-Type could not be probed at all.
+func isMediaURL(fileURL string) (bool, error) {
+	contentType, err := probeContentType(fileURL)
+	if err != nil {
+		return false, err
+	}
+	contentType = strings.ToLower(contentType)
+	return strings.HasPrefix(contentType, "image/") ||
+		strings.HasPrefix(contentType, "video/") ||
+		strings.HasPrefix(contentType, "audio/"), nil
+}
+
+// probeContentType returns the Content-Type of the URL using a HEAD request.
+// Servers that reject HEAD (e.g. 405) are retried with a GET for the first byte only.
+func probeContentType(fileURL string) (string, error) {
+	client := newHTTPClient()
+	client.Timeout = 10 * time.Second
+
+	resp, err := client.Head(fileURL)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return resp.Header.Get("Content-Type"), nil
+		}
+		logger.Debugf("HTTP HEAD returned status %d, retrying with ranged GET: %s", resp.StatusCode, fileURL)
+	} else {
+		logger.Debugf("Failed to http Head, retrying with ranged GET: %s", fileURL)
+	}
+
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err = client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to probe content type: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return "", fmt.Errorf("probe returned status %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Content-Type"), nil
+}
+
+// verifyHash compares the downloaded content hash with the hash announced by the post (if any)
+func verifyHash(item models.DownloadItem, actual string) bool {
+	if item.SHA256 == "" {
+		return true
+	}
+	if !strings.EqualFold(item.SHA256, actual) {
+		logger.Warnf("SHA256 mismatch for %s: expected %s, got %s", item.URL, item.SHA256, actual)
+		return false
+	}
+	logger.Debugf("SHA256 verified for %s", item.URL)
+	return true
+}
+
+func fetchFile(fileURL string) (*http.Response, error) {
+	client := newHTTPClient()
 
 	// Fetch file
 	resp, err := client.Get(fileURL)
@@ -103,7 +194,8 @@ func fetchFile(fileURL string) (*http.Response, error) {
 }
 
 // saveFile downloads a file from URL and saves it to the appropriate directory
-func saveFile(resp *http.Response, fileURL string, datetime time.Time, downloadDir string) error {
+func saveFile(resp *http.Response, item models.DownloadItem, downloadDir string) error {
+	fileURL := item.URL
 
 	// Get Content-Type header
 	contentType := resp.Header.Get("Content-Type")
@@ -115,17 +207,29 @@ func saveFile(resp *http.Response, fileURL string, datetime time.Time, downloadD
 		return err
 	}
 
+	// WARC出力が有効なら取得したレスポンスをそのまま残す
+	if err := warc.DefaultWriter.WriteHTTP(resp, buffer); err != nil {
+		logger.Errorf("Failed to write WARC record for %s: %v", fileURL, err)
+	}
+
 	// Create date-based directory structure
-	dateStr := datetime.Format("2006-01-02")
+	dateStr := item.Datetime.Format("2006-01-02")
 	dailyDir := filepath.Join(downloadDir, dateStr)
 	assetsDir := filepath.Join(dailyDir, "assets")
 
+	// 投稿側が宣言したハッシュと一致しないファイルは，別物の可能性があるため隔離して保存する
+	hash := getFileHash(buffer)
+	verified := verifyHash(item, hash)
+	if !verified {
+		assetsDir = filepath.Join(assetsDir, "quarantine")
+	}
+
 	if err := os.MkdirAll(assetsDir, 0755); err != nil {
 		return err
 	}
 
 	// Determine file name
-	filename := determineFileName(fileURL, buffer, contentType)
+	filename := determineFileName(fileURL, hash, contentType)
 
 	// Save file
 	fileDownloadPathFull := filepath.Join(assetsDir, filename)
@@ -136,22 +240,30 @@ func saveFile(resp *http.Response, fileURL string, datetime time.Time, downloadD
 	// Save metadata (今は決め打ち)
 	fileDownloadPathRelative := filepath.Join(assetsDir, filename)
 	metadataSavePath := filepath.Join(dailyDir, "filename_url_mapping.jsonl")
-	return writeFileNameURLMapping(fileURL, fileDownloadPathRelative, time.Now().UTC().Format(time.RFC3339), metadataSavePath)
+	data := map[string]interface{}{}
+	if item.SHA256 != "" {
+		// 投稿側が宣言したハッシュ (Nostr imeta の x 等) との照合結果
+		data["sha256_expected"] = item.SHA256
+		data["sha256_verified"] = verified
+	}
+	return writeFileNameURLMapping(fileURL, fileDownloadPathRelative, time.Now().UTC().Format(time.RFC3339), metadataSavePath, data)
 }
 
 // writeFileNameURLMapping saves the mapping between filename and download URL
-func writeFileNameURLMapping(fileURL, filepath string, downloadtime string, saveHere string) error {
+func writeFileNameURLMapping(fileURL, filepath string, downloadtime string, saveHere string, extra map[string]interface{}) error {
 	data := map[string]interface{}{
 		"filepath":     filepath,
 		"url":          fileURL,
 		"downloadtime": downloadtime,
 	}
+	for k, v := range extra {
+		data[k] = v
+	}
 	return utils.SaveRecord(utils.RecordTypeMediaMapping, data, saveHere)
 }
 
 // determineFileName determines the file name based on Content-Type and URL
-func determineFileName(fileURL string, filebinary []byte, contentType string) string {
-	hash := getFileHash(filebinary)
+func determineFileName(fileURL string, hash string, contentType string) string {
 
 	// まずContent-Typeから拡張子を決定
 	ext := extFromContentType(contentType)
@@ -0,0 +1,64 @@
+package mediaDownloader
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+func TestSaveFileQuarantinesHashMismatch(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	hash := getFileHash([]byte("image"))
+	for expected, want := range map[string]string{
+		hash:              filepath.Join(dir, "2026-01-01", "assets", hash+".png"),
+		"0000" + hash[4:]: filepath.Join(dir, "2026-01-01", "assets", "quarantine", hash+".png"),
+	} {
+		resp := &http.Response{
+			Header: http.Header{"Content-Type": {"image/png"}},
+			Body:   io.NopCloser(strings.NewReader("image")),
+		}
+		item := models.DownloadItem{URL: "https://example.com/a.png", Datetime: day, SHA256: expected}
+		if err := saveFile(resp, item, dir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(want); err != nil {
+			t.Errorf("file for expected hash %s was not saved at %s", expected, want)
+		}
+	}
+}
+
+func TestProbeFailureIsCached(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	// Content-Typeを確認できないURLが2回届いても，確認は1回だけ (HEADと範囲指定のGET)
+	queue := make(chan models.DownloadItem, 2)
+	item := models.DownloadItem{URL: server.URL + "/page", Datetime: time.Now(), CheckContentType: true}
+	queue <- item
+	queue <- item
+	close(queue)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	MediaDownloader(queue, wg, t.TempDir(), false)
+
+	if got := requests.Load(); got != 2 {
+		t.Errorf("probe requests = %d, want 2", got)
+	}
+	if isRecentlyFetched(item.URL) {
+		t.Error("URL whose content type could not be checked was marked as fetched")
+	}
+}
@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+// 公開範囲 (Post.Visibility)
+const (
+	VisibilityPublic    = "public"    // 誰でも閲覧でき，公開TLに流れる
+	VisibilityUnlisted  = "unlisted"  // 誰でも閲覧できるが，公開TLには流れない (Misskey の home)
+	VisibilityFollowers = "followers" // フォロワー限定 (Mastodon の private)
+	VisibilityDirect    = "direct"    // 指定したユーザーのみ (Misskey の specified)
+)
+
+// Post はプラットフォームに依存しない投稿の正規化表現。
+// Providerが生データ (RawMessage.Data) から作成し，生データとは別のストリームに保存する。
+// 生データを置き換えるものではなく，横断的な分析のための派生データ。
+type Post struct {
+	ID         string      `json:"id"`            // プラットフォーム上のID (ノートID, ステータスID, イベントID等)
+	URI        string      `json:"uri"`           // 正規のURI (ActivityPub の id, at://, nostr:)
+	URL        string      `json:"url,omitempty"` // ブラウザで開けるURL
+	Platform   string      `json:"platform"`      // misskey, mastodon, nostr, bluesky, lemmy
+	Server     string      `json:"server"`        // 受信したサーバー (リレー)
+	Author     PostAuthor  `json:"author"`
+	CreatedAt  time.Time   `json:"created_at"`
+	EditedAt   *time.Time  `json:"edited_at,omitempty"` // 最後に編集された時刻 (分かる場合のみ)
+	Text       string      `json:"text"`                // 本文 (プレーンテキスト)
+	Summary    string      `json:"summary,omitempty"`   // CW・タイトル
+	Sensitive  bool        `json:"sensitive,omitempty"`
+	Language   string      `json:"language,omitempty"` // ISO 639-1 (分かる場合のみ)
+	Visibility string      `json:"visibility"`         // VisibilityPublic 等
+	Media      []PostMedia `json:"media,omitempty"`
+	ReplyTo    *PostRef    `json:"reply_to,omitempty"` // 返信先
+	QuoteOf    *PostRef    `json:"quote_of,omitempty"` // 引用元
+	BoostOf    *PostRef    `json:"boost_of,omitempty"` // ブースト (リノート・リポスト) 元。本文を持たない
+	Tags       []string    `json:"tags,omitempty"`     // ハッシュタグ (# なし)
+	Mentions   []string    `json:"mentions,omitempty"` // メンション先 (acct, ユーザーID, pubkey, DID)
+}
+
+// 投稿者
+type PostAuthor struct {
+	ID          string `json:"id"` // プラットフォーム上のID (ユーザーID, pubkey, DID)
+	Username    string `json:"username,omitempty"`
+	Host        string `json:"host,omitempty"` // 投稿者の所属サーバー (ローカルユーザーなら受信したサーバー)
+	DisplayName string `json:"display_name,omitempty"`
+	URI         string `json:"uri,omitempty"`
+}
+
+// 添付メディア
+type PostMedia struct {
+	URL         string `json:"url"`
+	Type        string `json:"type,omitempty"`        // MIMEタイプ，または image/video/audio 等の種類
+	Description string `json:"description,omitempty"` // 代替テキスト
+	SHA256      string `json:"sha256,omitempty"`      // 分かっている場合のみ
+}
+
+// 他の投稿への参照。URIが分からない場合はIDのみ
+type PostRef struct {
+	ID  string `json:"id,omitempty"`
+	URI string `json:"uri,omitempty"`
+}
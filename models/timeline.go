@@ -0,0 +1,71 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 共通タイムライン名（TimelineLocal, TimelineGlobal 以外）
+const (
+	TimelineRemote = "remote" // リモートTL（他サーバーの投稿のみ）
+	TimelineHybrid = "hybrid" // ソーシャルTL（ホーム＋ローカル）
+	TimelineHome   = "home"   // ホームTL（ユーザートークンが必要）
+)
+
+// 引数付きタイムラインの種類 ("hashtag:xyz" のように指定する)
+const (
+	TimelineHashtag = "hashtag" // ハッシュタグ
+	TimelineList    = "list"    // リスト (ID)
+	TimelineChannel = "channel" // Misskeyのチャンネル (ID)
+	TimelineAntenna = "antenna" // Misskeyのアンテナ (ID)
+)
+
+// メディア付きの投稿のみに絞り込む接尾辞 (例: "local:media")
+const TimelineMediaSuffix = "media"
+
+// Providerが対応していないタイムラインを指定した場合のエラー
+var ErrUnsupportedTimeline = errors.New("unsupported timeline")
+
+// 解析済みのタイムライン指定
+type TimelineSpec struct {
+	Kind  string // local, global, remote, hybrid, home, hashtag, list, channel, antenna
+	Arg   string // ハッシュタグ名やID (引数付きタイムラインのみ)
+	Media bool   // メディア付きの投稿のみ
+}
+
+// ParseTimeline はタイムライン指定を解析する。
+// 書式は "<kind>[:media]" または "<kind>:<arg>" (hashtag, list, channel, antenna)
+func ParseTimeline(timeline string) (TimelineSpec, error) {
+	kind, rest, _ := strings.Cut(timeline, ":")
+
+	switch kind {
+	case "localTimeline": // 後方互換性のため旧名も対応
+		kind = TimelineLocal
+	case "globalTimeline":
+		kind = TimelineGlobal
+	}
+
+	switch kind {
+	case TimelineLocal, TimelineGlobal, TimelineRemote, TimelineHybrid, TimelineHome:
+		switch rest {
+		case "":
+			return TimelineSpec{Kind: kind}, nil
+		case TimelineMediaSuffix:
+			return TimelineSpec{Kind: kind, Media: true}, nil
+		}
+		return TimelineSpec{}, fmt.Errorf("%w: %q (only %q may follow %q)", ErrUnsupportedTimeline, timeline, TimelineMediaSuffix, kind)
+	case TimelineHashtag, TimelineList, TimelineChannel, TimelineAntenna:
+		arg := strings.TrimPrefix(rest, "#")
+		if arg == "" {
+			return TimelineSpec{}, fmt.Errorf("%w: %q (expected %s:<value>)", ErrUnsupportedTimeline, timeline, kind)
+		}
+		return TimelineSpec{Kind: kind, Arg: arg}, nil
+	}
+	return TimelineSpec{}, fmt.Errorf("%w: %q", ErrUnsupportedTimeline, timeline)
+}
+
+// TimelineFileName はタイムライン名をファイル名に使える形に変換する (例: "hashtag:xyz" → "hashtag-xyz")
+func TimelineFileName(timeline string) string {
+	return strings.NewReplacer(":", "-", "/", "-", "\\", "-").Replace(timeline)
+}
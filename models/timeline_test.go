@@ -0,0 +1,35 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseTimeline(t *testing.T) {
+	valid := map[string]TimelineSpec{
+		"local":                {Kind: TimelineLocal},
+		"home":                 {Kind: TimelineHome},
+		"local:media":          {Kind: TimelineLocal, Media: true},
+		"globalTimeline:media": {Kind: TimelineGlobal, Media: true}, // 旧名
+		"hashtag:#fediverse":   {Kind: TimelineHashtag, Arg: "fediverse"},
+		"hashtag:media":        {Kind: TimelineHashtag, Arg: "media"},
+		"list:123":             {Kind: TimelineList, Arg: "123"},
+		"antenna:a:b":          {Kind: TimelineAntenna, Arg: "a:b"},
+	}
+	for timeline, want := range valid {
+		got, err := ParseTimeline(timeline)
+		if err != nil || got != want {
+			t.Errorf("ParseTimeline(%q) = %+v, %v; want %+v", timeline, got, err, want)
+		}
+	}
+
+	for _, timeline := range []string{"", "Local", "local:photos", "hashtag", "hashtag:#"} {
+		if _, err := ParseTimeline(timeline); !errors.Is(err, ErrUnsupportedTimeline) {
+			t.Errorf("ParseTimeline(%q) error = %v, want ErrUnsupportedTimeline", timeline, err)
+		}
+	}
+
+	if got := TimelineFileName("list:a/b\\c"); got != "list-a-b-c" {
+		t.Errorf("TimelineFileName = %q, want list-a-b-c", got)
+	}
+}
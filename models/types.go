@@ -12,6 +12,8 @@ const (
 type DownloadItem struct {
 	URL      string
 	Datetime time.Time
+	SHA256           string // 期待されるSHA256 (hex)。分かっている場合はダウンロード後に検証する
+	CheckContentType bool   // メディアか不明なURL。取得前にHEADでContent-Typeを確認する
 }
 
 // FilenameURLMapping represents the mapping between filename and URL
@@ -23,14 +25,15 @@ type FilenameURLMapping struct {
 
 // サーバーの基本情報
 type Server struct {
-	Type string // bluesky, mastodon, misskey, nostr
+	Type string // bluesky, mastodon, misskey, nostr (Providerの種別)
 	URL  string // baseURL
+	Software string // NodeInfoのソフトウェア名 (sharkey, akkoma 等。Typeと異なる場合の記録用)
 }
 
 // 監視対象（サーバー × タイムライン）
 type Target struct {
 	Server   Server
-	Timeline string // timeline name (use TimelineLocal or TimelineGlobal)
+	Timeline string // timeline name (TimelineLocal, TimelineGlobal, "hashtag:xyz" 等。ParseTimeline 参照)
 }
 
 // Providerが受信したメッセージ
@@ -40,4 +43,7 @@ type RawMessage struct {
 	ReceivedAt	time.Time
     DataType	string    // ex. cbor, json 
     Metadata	map[string]string 
+    Posts		[]Post    // Data から作成した正規化済みの投稿 (生データとは別ストリームに保存)
+    Saved		func()    // 生データをファイルに書き出した後に呼ばれる (nilなら何もしない)
+    Failed		func()    // 生データを書き出せなかった場合に呼ばれる (nilなら何もしない)
 }
\ No newline at end of file
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/warc"
 )
 
 // WellKnownNodeInfo represents the response from /.well-known/nodeinfo
@@ -36,13 +37,15 @@ type NodeInfo struct {
 	RawJSON           string   `json:"-"` // Original JSON response (not part of the schema)
 }
 
-// CacheEntry holds a cached NodeInfo with its fetch time
+// CacheEntry holds a cached document with its fetch time.
+// Only one of NodeInfo and RelayInfo is set, depending on what was cached.
 type CacheEntry struct {
 	NodeInfo  *NodeInfo
+	RelayInfo *RelayInfo
 	FetchedAt time.Time
 }
 
-// Cache provides thread-safe caching for NodeInfo
+// Cache provides thread-safe caching for NodeInfo and NIP-11 documents
 type Cache struct {
 	mu      sync.RWMutex
 	entries map[string]*CacheEntry
@@ -65,12 +68,12 @@ func NewCache(ttl time.Duration) *Cache {
 	}
 }
 
-// Get retrieves a cached NodeInfo if available and not expired
-func (c *Cache) Get(host string) (*NodeInfo, bool) {
+// lookup returns the entry for key if available and not expired
+func (c *Cache) lookup(key string) (*CacheEntry, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	entry, exists := c.entries[host]
+	entry, exists := c.entries[key]
 	if !exists {
 		return nil, false
 	}
@@ -79,18 +82,44 @@ func (c *Cache) Get(host string) (*NodeInfo, bool) {
 		return nil, false
 	}
 
+	return entry, true
+}
+
+// store records entry under key with the current time
+func (c *Cache) store(key string, entry *CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.FetchedAt = time.Now()
+	c.entries[key] = entry
+}
+
+// Get retrieves a cached NodeInfo if available and not expired
+func (c *Cache) Get(host string) (*NodeInfo, bool) {
+	entry, ok := c.lookup(host)
+	if !ok || entry.NodeInfo == nil {
+		return nil, false
+	}
 	return entry.NodeInfo, true
 }
 
 // Set stores a NodeInfo in the cache
 func (c *Cache) Set(host string, nodeInfo *NodeInfo) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.store(host, &CacheEntry{NodeInfo: nodeInfo})
+}
 
-	c.entries[host] = &CacheEntry{
-		NodeInfo:  nodeInfo,
-		FetchedAt: time.Now(),
+// GetRelayInfo retrieves a cached NIP-11 document if available and not expired
+func (c *Cache) GetRelayInfo(relay string) (*RelayInfo, bool) {
+	entry, ok := c.lookup(relay)
+	if !ok || entry.RelayInfo == nil {
+		return nil, false
 	}
+	return entry.RelayInfo, true
+}
+
+// SetRelayInfo stores a NIP-11 document in the cache
+func (c *Cache) SetRelayInfo(relay string, info *RelayInfo) {
+	c.store(relay, &CacheEntry{RelayInfo: info})
 }
 
 // GetAll returns a map of all cached entries (for saving/debugging)
@@ -164,8 +193,14 @@ func fetchNodeInfo(host string) (*NodeInfo, error) {
 		return nil, fmt.Errorf("well-known nodeinfo returned status %d", resp.StatusCode)
 	}
 
+	wellKnownBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read well-known nodeinfo: %w", err)
+	}
+	recordHTTP(resp, wellKnownBody)
+
 	var wellKnown WellKnownNodeInfo
-	if err := json.NewDecoder(resp.Body).Decode(&wellKnown); err != nil {
+	if err := json.Unmarshal(wellKnownBody, &wellKnown); err != nil {
 		return nil, fmt.Errorf("failed to decode well-known nodeinfo: %w", err)
 	}
 
@@ -193,6 +228,7 @@ func fetchNodeInfo(host string) (*NodeInfo, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read nodeinfo body: %w", err)
 	}
+	recordHTTP(resp2, rawBody)
 
 	var nodeInfo NodeInfo
 	if err := json.Unmarshal(rawBody, &nodeInfo); err != nil {
@@ -205,6 +241,13 @@ func fetchNodeInfo(host string) (*NodeInfo, error) {
 	return &nodeInfo, nil
 }
 
+// recordHTTP writes the exchange to the WARC output (if enabled)
+func recordHTTP(resp *http.Response, body []byte) {
+	if err := warc.DefaultWriter.WriteHTTP(resp, body); err != nil {
+		logger.Errorf("Failed to write WARC record for %s: %v", resp.Request.URL, err)
+	}
+}
+
 // findBestNodeInfoURL returns the URL for the highest supported schema version
 func findBestNodeInfoURL(links []WellKnownLink) string {
 	// Prefer higher versions
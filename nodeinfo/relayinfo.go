@@ -0,0 +1,127 @@
+package nodeinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+)
+
+// RelayInfo represents a NIP-11 relay information document
+type RelayInfo struct {
+	Name          string          `json:"name"`
+	Description   string          `json:"description"`
+	Pubkey        string          `json:"pubkey"`
+	Contact       string          `json:"contact"`
+	SupportedNIPs []int           `json:"supported_nips"`
+	Software      string          `json:"software"`
+	Version       string          `json:"version"`
+	Limitation    RelayLimitation `json:"limitation"`
+	RawJSON       string          `json:"-"` // Original JSON response (not part of the schema)
+}
+
+// RelayLimitation represents the "limitation" object of a NIP-11 document
+type RelayLimitation struct {
+	MaxMessageLength int  `json:"max_message_length"`
+	MaxSubscriptions int  `json:"max_subscriptions"`
+	MaxFilters       int  `json:"max_filters"`
+	MaxLimit         int  `json:"max_limit"`
+	MaxSubidLength   int  `json:"max_subid_length"`
+	MinPowDifficulty int  `json:"min_pow_difficulty"`
+	AuthRequired     bool `json:"auth_required"`
+	PaymentRequired  bool `json:"payment_required"`
+	RestrictedWrites bool `json:"restricted_writes"`
+}
+
+// DefaultRelayCache is the global relay information cache instance.
+// It is kept apart from DefaultCache because a host may serve both documents.
+var DefaultRelayCache = NewCache(24 * time.Hour)
+
+// SupportsNIP reports whether the relay advertises support for the given NIP
+func (r *RelayInfo) SupportsNIP(nip int) bool {
+	if r == nil {
+		return false
+	}
+	for _, n := range r.SupportedNIPs {
+		if n == nip {
+			return true
+		}
+	}
+	return false
+}
+
+// RelayInfoURL returns the HTTP(S) URL the NIP-11 document is served from.
+// relay may be a bare host or a ws(s)/http(s) URL.
+func RelayInfoURL(relay string) string {
+	switch {
+	case strings.HasPrefix(relay, "wss://"):
+		return "https://" + strings.TrimPrefix(relay, "wss://")
+	case strings.HasPrefix(relay, "ws://"):
+		return "http://" + strings.TrimPrefix(relay, "ws://")
+	case strings.HasPrefix(relay, "https://"), strings.HasPrefix(relay, "http://"):
+		return relay
+	}
+	return "https://" + relay
+}
+
+// GetRelayInfo fetches the NIP-11 document for a given relay (with caching)
+func GetRelayInfo(relay string) (*RelayInfo, error) {
+	return GetRelayInfoWithCache(relay, DefaultRelayCache)
+}
+
+// GetRelayInfoWithCache fetches the NIP-11 document using a specific cache
+func GetRelayInfoWithCache(relay string, cache *Cache) (*RelayInfo, error) {
+	// Check cache first
+	if cached, ok := cache.GetRelayInfo(relay); ok {
+		logger.Debugf("Relay info cache hit for %s", relay)
+		return cached, nil
+	}
+
+	logger.Debugf("Relay info cache miss for %s, fetching...", relay)
+
+	info, err := fetchRelayInfo(relay)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.SetRelayInfo(relay, info)
+
+	return info, nil
+}
+
+// fetchRelayInfo performs the HTTP request to get the NIP-11 document
+func fetchRelayInfo(relay string) (*RelayInfo, error) {
+	req, err := http.NewRequest("GET", RelayInfoURL(relay), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/nostr+json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch relay info: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("relay info returned status %d", resp.StatusCode)
+	}
+
+	rawBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read relay info body: %w", err)
+	}
+
+	var info RelayInfo
+	if err := json.Unmarshal(rawBody, &info); err != nil {
+		return nil, fmt.Errorf("failed to decode relay info: %w", err)
+	}
+
+	info.RawJSON = string(rawBody)
+
+	return &info, nil
+}
@@ -0,0 +1,68 @@
+package nodeinfo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelayInfoURL(t *testing.T) {
+	cases := map[string]string{
+		"wss://relay.example.com":    "https://relay.example.com",
+		"ws://localhost:7777":        "http://localhost:7777",
+		"https://relay.example.com/": "https://relay.example.com/",
+		"relay.example.com":          "https://relay.example.com",
+	}
+	for relay, want := range cases {
+		if got := RelayInfoURL(relay); got != want {
+			t.Errorf("RelayInfoURL(%q) = %q, want %q", relay, got, want)
+		}
+	}
+}
+
+func TestGetRelayInfoWithCache(t *testing.T) {
+	const doc = `{"name":"test relay","supported_nips":[1,11,42],"limitation":{"max_limit":500,"max_subid_length":16,"auth_required":true}}`
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Accept") != "application/nostr+json" {
+			t.Errorf("Accept = %q", r.Header.Get("Accept"))
+		}
+		w.Header().Set("Content-Type", "application/nostr+json")
+		w.Write([]byte(doc))
+	}))
+	defer server.Close()
+
+	// 1. ws:// のリレーから http:// でNIP-11を取得し，limitation を読み取る
+	cache := NewCache(time.Hour)
+	relay := "ws://" + strings.TrimPrefix(server.URL, "http://")
+	info, err := GetRelayInfoWithCache(relay, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "test relay" || info.Limitation.MaxLimit != 500 || info.Limitation.MaxSubidLength != 16 || !info.Limitation.AuthRequired {
+		t.Errorf("unexpected relay info: %+v", info)
+	}
+	if info.RawJSON != doc {
+		t.Errorf("RawJSON = %q", info.RawJSON)
+	}
+	if !info.SupportsNIP(42) || info.SupportsNIP(50) {
+		t.Errorf("SupportsNIP: supported_nips=%v", info.SupportedNIPs)
+	}
+
+	// 2. 2回目はキャッシュから返す
+	if _, err := GetRelayInfoWithCache(relay, cache); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("fetched %d times, want 1", requests)
+	}
+
+	// 3. 取得できなかったリレーは nil で，どのNIPにも対応しない
+	var missing *RelayInfo
+	if missing.SupportsNIP(1) {
+		t.Error("nil RelayInfo supports NIP-1")
+	}
+}
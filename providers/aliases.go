@@ -0,0 +1,95 @@
+package providers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+// SoftwareAlias は NodeInfo のソフトウェア名と，そのサーバーが話すAPI (Provider種別) の対応
+type SoftwareAlias struct {
+	Provider string // misskey, mastodon, mastodon-poll, lemmy 等
+	Quirks   Quirks
+}
+
+// Quirks はフォークごとの差異
+type Quirks struct {
+	UnsupportedTimelines []string // 購読できないタイムラインの種類 (models.TimelineRemote 等)
+	NoMediaFilter        bool     // ":media" のタイムラインがない
+}
+
+// ソフトウェア名 (小文字) → 対応
+var softwareAliases = map[string]SoftwareAlias{
+	// Misskey とそのフォーク (Misskey API)
+	"misskey":    {Provider: "misskey"},
+	"sharkey":    {Provider: "misskey"},
+	"firefish":   {Provider: "misskey"},
+	"calckey":    {Provider: "misskey"},
+	"iceshrimp":  {Provider: "misskey"},
+	"cherrypick": {Provider: "misskey"},
+	"foundkey":   {Provider: "misskey"},
+	"meisskey":   {Provider: "misskey"},
+	"catodon":    {Provider: "misskey"},
+
+	// Mastodon とそのフォーク・互換実装 (Mastodon API)
+	"mastodon": {Provider: "mastodon"},
+	"hometown": {Provider: "mastodon"},
+	"fedibird": {Provider: "mastodon"},
+	"kmyblue":  {Provider: "mastodon"},
+	"pleroma":  {Provider: "mastodon"},
+	"akkoma":   {Provider: "mastodon"},
+	"gotosocial": {Provider: "mastodon", Quirks: Quirks{
+		// GoToSocial のストリーミングには public:remote と :media がない
+		UnsupportedTimelines: []string{models.TimelineRemote},
+		NoMediaFilter:        true,
+	}},
+	// ストリーミングAPIを持たないため REST で取得する
+	"pixelfed":  {Provider: "mastodon-poll"},
+	"friendica": {Provider: "mastodon-poll"},
+
+	"lemmy":   {Provider: "lemmy"},
+	"nostr":   {Provider: "nostr"},
+	"bluesky": {Provider: "bluesky"},
+}
+
+// LookupSoftware はソフトウェア名から対応を求める (大文字小文字は区別しない)
+func LookupSoftware(software string) (SoftwareAlias, bool) {
+	alias, ok := softwareAliases[strings.ToLower(strings.TrimSpace(software))]
+	return alias, ok
+}
+
+// ResolveServer はサーバー種別がソフトウェア名であれば Provider 種別に置き換え，
+// 元のソフトウェア名を Software に記録する
+func ResolveServer(server models.Server) models.Server {
+	alias, ok := LookupSoftware(server.Type)
+	if !ok {
+		return server
+	}
+	if server.Software == "" {
+		server.Software = strings.ToLower(server.Type)
+	}
+	server.Type = alias.Provider
+	return server
+}
+
+// CheckSoftwareTimeline はフォーク固有の制約でタイムラインを購読できるか確認する
+func CheckSoftwareTimeline(software, timeline string) error {
+	alias, ok := LookupSoftware(software)
+	if !ok {
+		return nil
+	}
+	spec, err := models.ParseTimeline(timeline)
+	if err != nil {
+		return err
+	}
+	for _, kind := range alias.Quirks.UnsupportedTimelines {
+		if spec.Kind == kind {
+			return fmt.Errorf("%w for %s: %s", models.ErrUnsupportedTimeline, software, timeline)
+		}
+	}
+	if spec.Media && alias.Quirks.NoMediaFilter {
+		return fmt.Errorf("%w for %s: %s (no media-only stream)", models.ErrUnsupportedTimeline, software, timeline)
+	}
+	return nil
+}
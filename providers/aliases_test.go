@@ -0,0 +1,54 @@
+package providers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+func TestResolveServer(t *testing.T) {
+	tests := []struct {
+		in, want models.Server
+	}{
+		// フォークは Provider 種別に置き換え，元のソフトウェア名を残す
+		{models.Server{Type: "Sharkey", URL: "a.example"}, models.Server{Type: "misskey", URL: "a.example", Software: "sharkey"}},
+		{models.Server{Type: "pixelfed", URL: "b.example"}, models.Server{Type: "mastodon-poll", URL: "b.example", Software: "pixelfed"}},
+		// 既に分かっているソフトウェア名は上書きしない
+		{models.Server{Type: "mastodon", Software: "glitch"}, models.Server{Type: "mastodon", Software: "glitch"}},
+		// 対応のない種別はそのまま
+		{models.Server{Type: "mastodon-poll"}, models.Server{Type: "mastodon-poll"}},
+		{models.Server{Type: "unknown"}, models.Server{Type: "unknown"}},
+	}
+	for _, test := range tests {
+		if got := ResolveServer(test.in); got != test.want {
+			t.Errorf("ResolveServer(%+v) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestCheckSoftwareTimeline(t *testing.T) {
+	// GoToSocial は public:remote と :media のストリームがない
+	for timeline, supported := range map[string]bool{
+		models.TimelineLocal:  true,
+		models.TimelineGlobal: true,
+		"hashtag:go":          true,
+		models.TimelineRemote: false,
+		"local:media":         false,
+	} {
+		err := CheckSoftwareTimeline("GoToSocial", timeline)
+		if supported && err != nil {
+			t.Errorf("gotosocial %s: %v", timeline, err)
+		}
+		if !supported && !errors.Is(err, models.ErrUnsupportedTimeline) {
+			t.Errorf("gotosocial %s = %v, want ErrUnsupportedTimeline", timeline, err)
+		}
+	}
+	// 制約のないソフトウェアや未知のソフトウェアは確認しない
+	if err := CheckSoftwareTimeline("mastodon", "remote:media"); err != nil {
+		t.Errorf("mastodon remote:media: %v", err)
+	}
+	if err := CheckSoftwareTimeline("", models.TimelineRemote); err != nil {
+		t.Errorf("unknown software: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package bluesky
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,6 +14,7 @@ import (
 	"github.com/ipld/go-car/v2"
 	"github.com/chcolte/fediverse-archive-bot-go/logger"
 	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
 	"golang.org/x/net/websocket"
 )
 
@@ -20,6 +22,7 @@ type BlueskyProvider struct {
 	URL      string
 	ws       *websocket.Conn
 	subscriptionID string
+	closed   bool // Close 済み (再度 Open しない)
 }
 
 // 新しい BlueskyProvider を作成
@@ -32,8 +35,13 @@ func NewBlueskyProvider(url string) *BlueskyProvider {
 // Bluesky サーバーに WebSocket 接続
 // WebSocketのHTTP HeaderとResponseが取りたいところだが，今のパッケージだと無理
 func (m *BlueskyProvider) Connect() (string, error) {
+	return m.connect(context.Background())
+}
+
+// connect は ctx でキャンセルできる Connect
+func (m *BlueskyProvider) connect(ctx context.Context) (string, error) {
 	wsURL, httpURL := urlAdjust(m.URL)
-	ws, err := websocket.Dial(wsURL, "", httpURL)
+	ws, err := providers.DialWebSocket(ctx, wsURL, httpURL)
 	if err != nil {
 		return wsURL, err
 	}
@@ -42,6 +50,18 @@ func (m *BlueskyProvider) Connect() (string, error) {
 	return wsURL, nil
 }
 
+// Open は接続する。ctx がキャンセルされたら接続を中断する
+func (m *BlueskyProvider) Open(ctx context.Context) (string, []byte, error) {
+	if m.closed {
+		return "", nil, providers.ErrProviderClosed
+	}
+	wsURL, err := m.connect(ctx)
+	if err != nil && ctx.Err() != nil {
+		return wsURL, nil, ctx.Err()
+	}
+	return wsURL, nil, err
+}
+
 // チャンネルに接続せずとも流れてくる
 func (m *BlueskyProvider) ConnectChannel() ([]byte, error) {
 	return nil, nil
@@ -55,12 +75,21 @@ type FirehoseHeader struct {
 
 // CBORメッセージを受信
 func (m *BlueskyProvider) ReceiveMessages(output chan<- models.DownloadItem, message chan<- models.RawMessage) error {
+	return m.Receive(context.Background(), output, message)
+}
+
+// Receive は接続が切れるか ctx がキャンセルされるまでメッセージを受信する
+func (m *BlueskyProvider) Receive(ctx context.Context, output chan<- models.DownloadItem, message chan<- models.RawMessage) error {
 	logger.Info("BlueskyProvider: Starting to receive messages")
+	guard := providers.GuardRead(ctx, m.ws, providers.DefaultReadTimeout)
+	defer guard.Release()
 
 	for {
 		var rawMsg []byte
-		if err := websocket.Message.Receive(m.ws, &rawMsg); err != nil {
-			logger.Errorf("BlueskyProvider: Receive error: %v", err)
+		if err := guard.Receive(&rawMsg); err != nil {
+			if ctx.Err() == nil {
+				logger.Errorf("BlueskyProvider: Receive error: %v", err)
+			}
 			return err
 		}
 
@@ -156,6 +185,7 @@ func (m *BlueskyProvider) ReceiveMessages(output chan<- models.DownloadItem, mes
 					"filename": cborFileName,
 					"metadata_json": string(metadataJSON),
 				},
+				Posts: m.normalizeCommit(commit),
 			}
 
 			// ログ出力
@@ -218,6 +248,11 @@ func (m *BlueskyProvider) ReceiveMessages(output chan<- models.DownloadItem, mes
 
 
 func (m *BlueskyProvider) CrawlNewServer(server chan <- models.Server) error {
+	return m.Discover(context.Background(), server)
+}
+
+// Discover は新規サーバーを探索する (未実装のためすぐに戻る)
+func (m *BlueskyProvider) Discover(ctx context.Context, server chan<- models.Server) error {
 	logger.Info("BlueskyProvider: Starting to crawl new servers")
 	return nil
 	// for {
@@ -284,14 +319,20 @@ func parseCommitPayload(m map[string]interface{}) *CommitPayload {
 	return commit
 }
 
-// WebSocket接続を閉じる
-func (m *BlueskyProvider) Close() error {
+// CloseStream は WebSocket 接続を閉じる。再度 Open できる
+func (m *BlueskyProvider) CloseStream() error {
 	if m.ws != nil {
 		return m.ws.Close()
 	}
 	return nil
 }
 
+// WebSocket接続を閉じ，Providerを破棄する
+func (m *BlueskyProvider) Close() error {
+	m.closed = true
+	return m.CloseStream()
+}
+
 // マップ内のバイト配列を文字列形式に変換するヘルパー関数
 func formatMapWithStrings(m map[string]interface{}) map[string]interface{} {
 	result := make(map[string]interface{})
@@ -0,0 +1,166 @@
+package bluesky
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ipld/go-car/v2"
+)
+
+// 正規化の対象にするレコードのコレクション
+const (
+	collectionPost   = "app.bsky.feed.post"
+	collectionRepost = "app.bsky.feed.repost"
+)
+
+// normalizeCommit はコミットで作成された投稿・リポストを正規化する。
+// 操作 (ops) のCIDとCARブロックを突き合わせ，レコードのパスから at:// URI を組み立てる
+func (m *BlueskyProvider) normalizeCommit(commit *CommitPayload) []models.Post {
+	if len(commit.Blocks) == 0 {
+		return nil
+	}
+
+	var targets []CommitOp
+	for _, op := range commit.Ops {
+		if op.Action != "create" {
+			continue
+		}
+		if strings.HasPrefix(op.Path, collectionPost+"/") || strings.HasPrefix(op.Path, collectionRepost+"/") {
+			targets = append(targets, op)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	records := readRecords(commit.Blocks)
+	var posts []models.Post
+	for _, op := range targets {
+		cidStr := cidToString(op.CID)
+		record, ok := records[cidStr]
+		if !ok {
+			continue
+		}
+		posts = append(posts, m.normalizeRecord(commit.Repo, op.Path, cidStr, record))
+	}
+	return posts
+}
+
+// readRecords はCARブロックをCID → レコードの対応にする
+func readRecords(blocks []byte) map[string]map[string]interface{} {
+	records := make(map[string]map[string]interface{})
+	reader, err := car.NewBlockReader(bytes.NewReader(blocks))
+	if err != nil {
+		logger.Debugf("Failed to create CAR reader: %v", err)
+		return records
+	}
+	for {
+		block, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Debugf("Error reading CAR block: %v", err)
+			break
+		}
+		var record map[string]interface{}
+		if err := cbor.Unmarshal(block.RawData(), &record); err != nil {
+			continue
+		}
+		records[block.Cid().String()] = record
+	}
+	return records
+}
+
+func (m *BlueskyProvider) normalizeRecord(repo, path, cidStr string, record map[string]interface{}) models.Post {
+	collection, rkey, _ := strings.Cut(path, "/")
+	post := models.Post{
+		ID:         cidStr,
+		URI:        "at://" + repo + "/" + path,
+		Platform:   "bluesky",
+		Server:     m.URL,
+		Visibility: models.VisibilityPublic,
+		Author: models.PostAuthor{
+			ID:  repo,
+			URI: "at://" + repo,
+		},
+	}
+	if createdAt, ok := record["createdAt"].(string); ok {
+		post.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+	}
+
+	if collection == collectionRepost {
+		post.BoostOf = strongRef(record["subject"])
+		return post
+	}
+
+	post.URL = "https://bsky.app/profile/" + repo + "/post/" + rkey
+	post.Text, _ = record["text"].(string)
+	if langs, ok := record["langs"].([]interface{}); ok && len(langs) > 0 {
+		post.Language, _ = langs[0].(string)
+	}
+	if reply := toStringMap(record["reply"]); reply != nil {
+		post.ReplyTo = strongRef(reply["parent"])
+	}
+
+	// 引用: app.bsky.embed.record または app.bsky.embed.recordWithMedia
+	if embed := toStringMap(record["embed"]); embed != nil {
+		switch embed["$type"] {
+		case "app.bsky.embed.record":
+			post.QuoteOf = strongRef(embed["record"])
+		case "app.bsky.embed.recordWithMedia":
+			if inner := toStringMap(embed["record"]); inner != nil {
+				post.QuoteOf = strongRef(inner["record"])
+			}
+		}
+	}
+	for _, url := range m.extractBlobsFromPost(repo, record) {
+		post.Media = append(post.Media, models.PostMedia{URL: url})
+	}
+
+	// メンション・ハッシュタグは facets に入る
+	facets, _ := record["facets"].([]interface{})
+	for _, f := range facets {
+		facet := toStringMap(f)
+		if facet == nil {
+			continue
+		}
+		features, _ := facet["features"].([]interface{})
+		for _, feat := range features {
+			feature := toStringMap(feat)
+			if feature == nil {
+				continue
+			}
+			switch feature["$type"] {
+			case "app.bsky.richtext.facet#mention":
+				if did, ok := feature["did"].(string); ok {
+					post.Mentions = append(post.Mentions, did)
+				}
+			case "app.bsky.richtext.facet#tag":
+				if tag, ok := feature["tag"].(string); ok {
+					post.Tags = append(post.Tags, tag)
+				}
+			}
+		}
+	}
+	return post
+}
+
+// strongRef は com.atproto.repo.strongRef ({uri, cid}) を参照に変換する
+func strongRef(v interface{}) *models.PostRef {
+	ref := toStringMap(v)
+	if ref == nil {
+		return nil
+	}
+	uri, _ := ref["uri"].(string)
+	cidStr, _ := ref["cid"].(string)
+	if uri == "" && cidStr == "" {
+		return nil
+	}
+	return &models.PostRef{ID: cidStr, URI: uri}
+}
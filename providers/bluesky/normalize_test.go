@@ -0,0 +1,51 @@
+package bluesky
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeRecord(t *testing.T) {
+	m := NewBlueskyProvider("bsky.network")
+	const repo = "did:plc:alice"
+
+	// 1. 投稿: 返信・引用・メンション・ハッシュタグ
+	post := m.normalizeRecord(repo, "app.bsky.feed.post/3k", "bafy-post", map[string]interface{}{
+		"text":      "hello #go @bob",
+		"createdAt": "2026-01-01T00:00:00.123Z",
+		"langs":     []interface{}{"ja"},
+		"reply": map[string]interface{}{
+			"parent": map[string]interface{}{"uri": "at://did:plc:bob/app.bsky.feed.post/1", "cid": "bafy-parent"},
+		},
+		"embed": map[string]interface{}{
+			"$type":  "app.bsky.embed.record",
+			"record": map[string]interface{}{"uri": "at://did:plc:bob/app.bsky.feed.post/2", "cid": "bafy-quote"},
+		},
+		"facets": []interface{}{
+			map[string]interface{}{"features": []interface{}{
+				map[string]interface{}{"$type": "app.bsky.richtext.facet#tag", "tag": "go"},
+				map[string]interface{}{"$type": "app.bsky.richtext.facet#mention", "did": "did:plc:bob"},
+			}},
+		},
+	})
+	if post.URI != "at://did:plc:alice/app.bsky.feed.post/3k" || post.URL != "https://bsky.app/profile/did:plc:alice/post/3k" || post.ID != "bafy-post" {
+		t.Errorf("post = %+v", post)
+	}
+	if want := time.Date(2026, 1, 1, 0, 0, 0, 123000000, time.UTC); !post.CreatedAt.Equal(want) || post.Language != "ja" {
+		t.Errorf("CreatedAt = %s, Language = %s", post.CreatedAt, post.Language)
+	}
+	if post.ReplyTo == nil || post.ReplyTo.ID != "bafy-parent" || post.QuoteOf == nil || post.QuoteOf.ID != "bafy-quote" {
+		t.Errorf("reply = %+v, quote = %+v", post.ReplyTo, post.QuoteOf)
+	}
+	if len(post.Tags) != 1 || post.Tags[0] != "go" || len(post.Mentions) != 1 || post.Mentions[0] != "did:plc:bob" {
+		t.Errorf("tags = %v, mentions = %v", post.Tags, post.Mentions)
+	}
+
+	// 2. リポストは本文を持たず，元の投稿への参照になる
+	repost := m.normalizeRecord(repo, "app.bsky.feed.repost/3l", "bafy-repost", map[string]interface{}{
+		"subject": map[string]interface{}{"uri": "at://did:plc:bob/app.bsky.feed.post/1", "cid": "bafy-parent"},
+	})
+	if repost.BoostOf == nil || repost.BoostOf.URI != "at://did:plc:bob/app.bsky.feed.post/1" || repost.Text != "" || repost.URL != "" {
+		t.Errorf("repost = %+v", repost)
+	}
+}
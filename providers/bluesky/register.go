@@ -0,0 +1,16 @@
+package bluesky
+
+import (
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
+)
+
+func init() {
+	// Firehoseはタイムラインの区別がない
+	providers.Register("bluesky", func(target models.Target) providers.PlatformProvider {
+		return NewBlueskyProvider(target.Server.URL)
+	}, providers.Capabilities{
+		Backfill: false,
+		DataType: "cbor",
+	})
+}
@@ -0,0 +1,200 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+/*
+[context対応のProvider (v2)]
+PlatformProvider は受信中の websocket.Message.Receive を止める手段が
+別goroutineからの Close しかなく，停止と再接続の区別もつかない。
+ContextProvider では
+
+  - Open / Receive / Discover は ctx のキャンセルで終了する (ctx.Err() を返す)
+  - CloseStream は現在の接続 (ストリーム) だけを閉じ，再度 Open できる
+  - Close はProvider自体を破棄する
+
+既存のProviderは Adapt で ContextProvider として扱える。
+WebSocketのProviderは読み取り期限を使って ContextProvider を直接実装する (websocket.go)。
+*/
+
+// ContextProvider はcontextでキャンセルできるProviderのインターフェース
+type ContextProvider interface {
+	// Open は接続してチャンネルを購読する。記録用に接続先URLと送信したメッセージを返す
+	Open(ctx context.Context) (url string, sent []byte, err error)
+	// Receive は接続が切れるか ctx がキャンセルされるまでメッセージを受信する
+	Receive(ctx context.Context, output chan<- models.DownloadItem, message chan<- models.RawMessage) error
+	// Discover は接続が切れるか ctx がキャンセルされるまで新規サーバーを探索する
+	Discover(ctx context.Context, server chan<- models.Server) error
+	// CloseStream は現在の接続を閉じる
+	CloseStream() error
+	// Close はProviderを破棄する
+	Close() error
+}
+
+// ReadTimeout の間メッセージが届かなければ接続が止まっているとみなす
+var ErrReadTimeout = errors.New("no message received within read timeout")
+
+// Close したProviderを再度 Open しようとした
+var ErrProviderClosed = errors.New("provider is closed")
+
+// DefaultReadTimeout はProviderの読み取り期限 (0なら無効)
+var DefaultReadTimeout time.Duration = 0
+
+// Adapt は PlatformProvider を ContextProvider として扱えるようにする。
+// すでに ContextProvider を実装していればそのまま返す
+func Adapt(provider PlatformProvider) ContextProvider {
+	if cp, ok := provider.(ContextProvider); ok {
+		return cp
+	}
+	return &providerAdapter{provider: provider, ReadTimeout: DefaultReadTimeout}
+}
+
+// providerAdapter は PlatformProvider をラップする。
+// キャンセル時は内側のProviderを Close してブロック中の受信を解除する
+// (PlatformProvider の Close は接続を閉じるだけで，再度 Connect できる)
+type providerAdapter struct {
+	provider    PlatformProvider
+	ReadTimeout time.Duration
+	closed      bool
+}
+
+func (a *providerAdapter) Open(ctx context.Context) (string, []byte, error) {
+	if a.closed {
+		return "", nil, ErrProviderClosed
+	}
+	type result struct {
+		url  string
+		sent []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		url, err := a.provider.Connect()
+		if err != nil {
+			done <- result{url: url, err: err}
+			return
+		}
+		sent, err := a.provider.ConnectChannel()
+		if err != nil {
+			err = fmt.Errorf("failed to connect channel: %w", err)
+		}
+		done <- result{url: url, sent: sent, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.url, r.sent, r.err
+	case <-ctx.Done():
+		// 接続中に閉じると Connect が閉じた後の接続を保持しうるため，終わるのを待ってから閉じる
+		r := <-done
+		a.provider.Close()
+		return r.url, nil, ctx.Err()
+	}
+}
+
+func (a *providerAdapter) Receive(ctx context.Context, output chan<- models.DownloadItem, message chan<- models.RawMessage) error {
+	// 受信を監視するため，メッセージを中継する
+	relay := make(chan models.RawMessage)
+	done := make(chan error, 1)
+	go func() {
+		done <- a.provider.ReceiveMessages(output, relay)
+	}()
+	return a.watch(ctx, done, relay, message)
+}
+
+func (a *providerAdapter) Discover(ctx context.Context, server chan<- models.Server) error {
+	// 停止後は送信先が読まれないため，中継して ctx を見ながら送る
+	relay := make(chan models.Server)
+	done := make(chan error, 1)
+	go func() {
+		done <- a.provider.CrawlNewServer(relay)
+	}()
+
+	// 停止後も CrawlNewServer が中継先に送ろうとしてブロックしないように読み捨てる
+	stop := func(err error) error {
+		a.provider.Close()
+		for {
+			select {
+			case <-done:
+				return err
+			case <-relay:
+			}
+		}
+	}
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case found := <-relay:
+			select {
+			case server <- found:
+			case <-ctx.Done():
+				return stop(ctx.Err())
+			}
+		case <-ctx.Done():
+			return stop(ctx.Err())
+		}
+	}
+}
+
+// watch は受信goroutineの終了・ctxのキャンセル・読み取り期限を待つ。
+// in のメッセージを message に中継し，届くたびに期限を延長する
+func (a *providerAdapter) watch(ctx context.Context, done <-chan error, in <-chan models.RawMessage, message chan<- models.RawMessage) error {
+	var deadline <-chan time.Time
+	var timer *time.Timer
+	if a.ReadTimeout > 0 {
+		timer = time.NewTimer(a.ReadTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	// 停止後も受信goroutineが中継先に送ろうとしてブロックしないように読み捨てる
+	stop := func(err error) error {
+		a.provider.Close()
+		for {
+			select {
+			case <-done:
+				return err
+			case msg := <-in:
+				message <- msg
+			}
+		}
+	}
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case msg := <-in:
+			message <- msg
+			if timer != nil {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(a.ReadTimeout)
+			}
+		case <-deadline:
+			return stop(ErrReadTimeout)
+		case <-ctx.Done():
+			return stop(ctx.Err())
+		}
+	}
+}
+
+// CloseStream は現在の接続を閉じる。再度 Open できる
+func (a *providerAdapter) CloseStream() error {
+	return a.provider.Close()
+}
+
+// Close は接続を閉じ，以降の Open を拒否する
+func (a *providerAdapter) Close() error {
+	a.closed = true
+	return a.provider.Close()
+}
@@ -0,0 +1,95 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+// blockingProvider は Close されるまで受信し続ける PlatformProvider
+type blockingProvider struct {
+	messages chan models.RawMessage
+	closed   chan struct{}
+}
+
+func newBlockingProvider() *blockingProvider {
+	return &blockingProvider{messages: make(chan models.RawMessage), closed: make(chan struct{})}
+}
+
+func (p *blockingProvider) Connect() (string, error)        { return "wss://example.com", nil }
+func (p *blockingProvider) ConnectChannel() ([]byte, error) { return []byte("sub"), nil }
+func (p *blockingProvider) ReceiveMessages(output chan<- models.DownloadItem, message chan<- models.RawMessage) error {
+	for {
+		select {
+		case msg := <-p.messages:
+			message <- msg
+		case <-p.closed:
+			return errors.New("use of closed connection")
+		}
+	}
+}
+func (p *blockingProvider) CrawlNewServer(server chan<- models.Server) error {
+	<-p.closed
+	return errors.New("use of closed connection")
+}
+func (p *blockingProvider) Close() error {
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
+	return nil
+}
+
+func TestAdapterReceive(t *testing.T) {
+	inner := newBlockingProvider()
+	stream := Adapt(inner)
+	if url, sent, err := stream.Open(context.Background()); err != nil || url != "wss://example.com" || string(sent) != "sub" {
+		t.Fatalf("Open = %s, %s, %v", url, sent, err)
+	}
+
+	// 1. メッセージを中継し，キャンセルされたら内側のProviderを閉じて ctx.Err() を返す
+	ctx, cancel := context.WithCancel(context.Background())
+	message := make(chan models.RawMessage, 1)
+	done := make(chan error, 1)
+	go func() { done <- stream.Receive(ctx, nil, message) }()
+	inner.messages <- models.RawMessage{DataType: "json"}
+	if msg := <-message; msg.DataType != "json" {
+		t.Errorf("relayed message = %+v", msg)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Receive after cancel = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Receive did not return after cancel")
+	}
+
+	// 2. Close した後は Open できない
+	stream.Close()
+	if _, _, err := stream.Open(context.Background()); !errors.Is(err, ErrProviderClosed) {
+		t.Errorf("Open after Close = %v, want ErrProviderClosed", err)
+	}
+}
+
+func TestAdapterReadTimeout(t *testing.T) {
+	stream := &providerAdapter{provider: newBlockingProvider(), ReadTimeout: 50 * time.Millisecond}
+	// メッセージが届かなければ読み取り期限で止める
+	if err := stream.Receive(context.Background(), nil, make(chan models.RawMessage)); !errors.Is(err, ErrReadTimeout) {
+		t.Errorf("Receive without messages = %v, want ErrReadTimeout", err)
+	}
+}
+
+func TestAdapterDiscoverCancel(t *testing.T) {
+	stream := Adapt(newBlockingProvider())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := stream.Discover(ctx, make(chan models.Server)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Discover after timeout = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -2,9 +2,12 @@ package mastodon
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -29,18 +32,24 @@ type TokenResponse struct {
 
 // CachedToken holds token info with metadata
 type CachedToken struct {
-	AccessToken  string
-	ClientID     string
-	ClientSecret string
-	CreatedAt    time.Time
+	AccessToken  string    `json:"access_token"`
+	ClientID     string    `json:"client_id"`
+	ClientSecret string    `json:"client_secret"`
+	CreatedAt    time.Time `json:"created_at"`
 }
 
-// TokenCache provides thread-safe caching for tokens
+// TokenCache provides thread-safe caching for tokens.
+// When opened with Open, entries are persisted so that restarts reuse the registered apps.
 type TokenCache struct {
-	mu      sync.RWMutex
-	entries map[string]*CachedToken
+	mu       sync.RWMutex
+	entries  map[string]*CachedToken
+	path     string
+	verified map[string]bool // hosts whose cached token was verified in this process
 }
 
+// errTokenRevoked is returned when the server rejects a cached token
+var errTokenRevoked = errors.New("token revoked")
+
 var (
 	httpClientAuth = &http.Client{
 		Timeout: 15 * time.Second,
@@ -53,13 +62,64 @@ const (
 	appName      = "FediverseArchiveBot"
 	redirectURI  = "urn:ietf:wg:oauth:2.0:oob"
 	defaultScope = "read:statuses"
+	// userScope is requested for user tokens (the user stream needs more than read:statuses)
+	userScope = "read"
 )
 
 // NewTokenCache creates a new TokenCache
 func NewTokenCache() *TokenCache {
 	return &TokenCache{
-		entries: make(map[string]*CachedToken),
+		entries:  make(map[string]*CachedToken),
+		verified: make(map[string]bool),
+	}
+}
+
+// Open loads persisted tokens from path and persists future updates there.
+// A missing file is not an error.
+func (c *TokenCache) Open(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]*CachedToken)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	// A file containing JSON null decodes to a nil map
+	if entries == nil {
+		entries = make(map[string]*CachedToken)
+	}
+	c.entries = entries
+	logger.Debugf("Loaded %d cached Mastodon tokens from %s", len(entries), path)
+	return nil
+}
+
+// persist writes the cache to disk with owner-only permissions. Caller must hold the lock.
+func (c *TokenCache) persist() error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return err
 	}
+	if dir := filepath.Dir(c.path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
 }
 
 // Get retrieves a cached token if available
@@ -74,6 +134,23 @@ func (c *TokenCache) Set(host string, token *CachedToken) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.entries[host] = token
+	if err := c.persist(); err != nil {
+		logger.Errorf("Failed to persist token cache: %v", err)
+	}
+}
+
+// isVerified reports whether the cached token for host was verified in this process
+func (c *TokenCache) isVerified(host string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.verified[host]
+}
+
+// markVerified records that the cached token for host is known to be valid
+func (c *TokenCache) markVerified(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.verified[host] = true
 }
 
 // GetAccessToken retrieves or creates an access token for the given host
@@ -81,18 +158,49 @@ func GetAccessToken(host string) (string, error) {
 	return GetAccessTokenWithCache(host, DefaultTokenCache)
 }
 
-// GetAccessTokenWithCache retrieves or creates an access token using a specific cache
+// GetAccessTokenWithCache retrieves or creates an access token using a specific cache.
+// A cached token is verified once per process; the app is re-registered only when
+// both the token and the app credentials have been revoked.
 func GetAccessTokenWithCache(host string, cache *TokenCache) (string, error) {
 	// Check cache first
 	if cached := cache.Get(host); cached != nil {
-		logger.Debugf("Token cache hit for %s", host)
-		return cached.AccessToken, nil
+		if cache.isVerified(host) {
+			logger.Debugf("Token cache hit for %s", host)
+			return cached.AccessToken, nil
+		}
+
+		err := verifyAppToken(host, cached.AccessToken)
+		if err == nil {
+			cache.markVerified(host)
+			logger.Debugf("Cached token verified for %s", host)
+			return cached.AccessToken, nil
+		}
+		if !errors.Is(err, errTokenRevoked) {
+			// Network errors etc. do not mean the token is invalid
+			logger.Debugf("Could not verify cached token for %s: %v", host, err)
+			return cached.AccessToken, nil
+		}
+
+		// The token was revoked: try to get a new one with the existing app first
+		logger.Infof("Cached token for %s was revoked, requesting a new one...", host)
+		token, err := getClientCredentialsToken(host, cached.ClientID, cached.ClientSecret)
+		if err == nil {
+			cache.Set(host, &CachedToken{
+				AccessToken:  token.AccessToken,
+				ClientID:     cached.ClientID,
+				ClientSecret: cached.ClientSecret,
+				CreatedAt:    time.Now(),
+			})
+			cache.markVerified(host)
+			return token.AccessToken, nil
+		}
+		logger.Debugf("Existing app credentials for %s no longer work: %v", host, err)
 	}
 
 	logger.Debugf("Token cache miss for %s, registering app...", host)
 
 	// Step 1: Register app
-	creds, err := registerApp(host)
+	creds, err := registerApp(host, defaultScope)
 	if err != nil {
 		return "", fmt.Errorf("failed to register app: %w", err)
 	}
@@ -112,19 +220,46 @@ func GetAccessTokenWithCache(host string, cache *TokenCache) (string, error) {
 		ClientSecret: creds.ClientSecret,
 		CreatedAt:    time.Now(),
 	})
+	cache.markVerified(host)
 
 	logger.Infof("Successfully obtained token for %s", host)
 	return token.AccessToken, nil
 }
 
+// verifyAppToken checks an app token with /api/v1/apps/verify_credentials.
+// It returns errTokenRevoked if the server rejects the token.
+func verifyAppToken(host, accessToken string) error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/api/v1/apps/verify_credentials", host), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "FediverseArchiveBot/1.0")
+
+	resp, err := httpClientAuth.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errTokenRevoked
+	default:
+		return fmt.Errorf("verify_credentials failed with status %d", resp.StatusCode)
+	}
+}
+
 // registerApp registers a new OAuth app on the Mastodon server
-func registerApp(host string) (*AppCredentials, error) {
+func registerApp(host, scopes string) (*AppCredentials, error) {
 	apiURL := fmt.Sprintf("https://%s/api/v1/apps", host)
 
 	data := url.Values{}
 	data.Set("client_name", appName)
 	data.Set("redirect_uris", redirectURI)
-	data.Set("scopes", defaultScope)
+	data.Set("scopes", scopes)
 
 	req, err := http.NewRequest("POST", apiURL, strings.NewReader(data.Encode()))
 	if err != nil {
@@ -161,6 +296,11 @@ func getClientCredentialsToken(host, clientID, clientSecret string) (*TokenRespo
 	data.Set("grant_type", "client_credentials")
 	data.Set("scope", defaultScope)
 
+	return requestToken(tokenURL, data)
+}
+
+// requestToken posts a token request to the OAuth token endpoint
+func requestToken(tokenURL string, data url.Values) (*TokenResponse, error) {
 	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return nil, err
@@ -185,3 +325,59 @@ func getClientCredentialsToken(host, clientID, clientSecret string) (*TokenRespo
 
 	return &token, nil
 }
+
+// RegisterUserApp registers an app for the authorization code flow (user tokens)
+func RegisterUserApp(host string) (*AppCredentials, error) {
+	return registerApp(host, userScope)
+}
+
+// AuthorizeURL returns the page where the user approves the app and receives a code
+func AuthorizeURL(host string, creds *AppCredentials) string {
+	q := url.Values{}
+	q.Set("client_id", creds.ClientID)
+	q.Set("scope", userScope)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("response_type", "code")
+	return fmt.Sprintf("https://%s/oauth/authorize?%s", host, q.Encode())
+}
+
+// ExchangeCode exchanges an authorization code for a user access token
+func ExchangeCode(host string, creds *AppCredentials, code string) (*TokenResponse, error) {
+	data := url.Values{}
+	data.Set("client_id", creds.ClientID)
+	data.Set("client_secret", creds.ClientSecret)
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("redirect_uri", redirectURI)
+	data.Set("scope", userScope)
+
+	return requestToken(fmt.Sprintf("https://%s/oauth/token", host), data)
+}
+
+// VerifyAccount returns the acct of the user the token belongs to
+func VerifyAccount(host, accessToken string) (string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/api/v1/accounts/verify_credentials", host), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", "FediverseArchiveBot/1.0")
+
+	resp, err := httpClientAuth.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("verify_credentials failed with status %d", resp.StatusCode)
+	}
+
+	var account struct {
+		Acct string `json:"acct"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&account); err != nil {
+		return "", fmt.Errorf("failed to decode account: %w", err)
+	}
+	return account.Acct, nil
+}
@@ -1,22 +1,31 @@
 package mastodon
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"strings"
 	"fmt"
 	"time"
 	"net/url"
 
+	"github.com/chcolte/fediverse-archive-bot-go/credentials"
 	"github.com/chcolte/fediverse-archive-bot-go/logger"
 	"github.com/chcolte/fediverse-archive-bot-go/models"
 	"github.com/chcolte/fediverse-archive-bot-go/nodeinfo"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
 	"golang.org/x/net/websocket"
 )
 
 type MastodonProvider struct {
 	URL      string
 	Timeline string
+	Timelines []string          // 1本の接続で購読するタイムライン (SetTimelinesで設定，空ならTimelineのみ)
+	discoveryOnly map[string]bool // 探索のためだけに購読しているタイムライン (メディアを抽出しない)
 	ws       *websocket.Conn
+	sse      *sseConn          // WebSocketが使えない場合のSSE接続
+	streams  map[string]string // ストリーム名 (例: public:local) → 共通タイムライン名
+	closed   bool              // Close 済み (再度 Open しない)
 }
 
 // 新しい MastodonProvider を作成
@@ -30,41 +39,113 @@ func NewMastodonProvider(url, timeline string) *MastodonProvider {
 // Mastodon サーバーに WebSocket 接続
 // WebSocketのHTTP HeaderとResponseが取りたいところだが，今のパッケージだと無理
 func (m *MastodonProvider) Connect() (string, error) {
+	return m.connect(context.Background())
+}
+
+// connect は ctx でキャンセルできる Connect
+func (m *MastodonProvider) connect(ctx context.Context) (string, error) {
 	wsURL, httpURL := urlAdjust(m.URL)
+	// 前回のSSE接続は CloseStream で閉じてある
+	m.sse = nil
 
-	tl := m.convertTimeline()
+	// 1つのタイムラインならURLで指定し，複数ならConnectChannelでsubscribeする
+	m.streams = make(map[string]string)
+	var specs []streamSpec
+	for _, timeline := range m.timelines() {
+		spec, err := convertTimeline(timeline)
+		if err != nil {
+			return wsURL, err
+		}
+		m.streams[spec.key()] = timeline
+		specs = append(specs, spec)
+	}
+	streamURL := wsURL + "/api/v1/streaming"
+	if len(specs) == 1 {
+		streamURL += "/?" + specs[0].query()
+	}
 
-	streamURL := wsURL + "/api/v1/streaming/?stream=" + tl
+	// ユーザートークンが設定されていればそれで接続する
+	if userToken := credentials.DefaultStore.Token(m.URL); userToken != "" {
+		ws, err := m.tryConnect(ctx, withAccessToken(streamURL, userToken), httpURL, userToken)
+		if err == nil {
+			m.ws = ws
+			logger.Info("Connected to ", streamURL, " (with user token)")
+			return streamURL, nil
+		}
+		logger.Warnf("Connection with user token failed for %s: %v, falling back...", m.URL, err)
+	}
 
 	// まず認証なしで接続を試みる
-	ws, err := m.tryConnect(streamURL, httpURL, "")
+	ws, err := m.tryConnect(ctx, streamURL, httpURL, "")
 	if err == nil {
 		m.ws = ws
 		logger.Info("Connected to ", streamURL, " (no auth)")
 		return streamURL, nil
 	}
-	
-	logger.Debugf("Connection without auth failed for %s: %v, trying with token...", m.URL, err)
 
-	// 認証なしで失敗した場合、トークン付きでリトライ
+	// WebSocketのアップグレードが拒否される環境ではSSEで接続する。
+	// アプリの登録はサーバーが認証を求めた場合だけにするため，先に認証なし (またはユーザートークン) で試す
+	logger.Warnf("WebSocket connection failed for %s (%v), falling back to SSE...", m.URL, err)
+	userToken := credentials.DefaultStore.Token(m.URL)
+	sseURL, sseErr := m.connectSSE(ctx, httpURL, specs, userToken)
+	if sseErr == nil {
+		return sseURL, nil
+	}
+	if !errors.Is(sseErr, errSSEUnauthorized) || userToken != "" {
+		return sseURL, fmt.Errorf("websocket: %v, sse: %w", err, sseErr)
+	}
+
+	// 認証が必要なサーバーではアプリのトークンで再試行
+	logger.Debugf("Connection without auth was rejected by %s, trying with token...", m.URL)
 	accessToken, tokenErr := GetAccessToken(m.URL)
 	if tokenErr != nil {
 		logger.Errorf("Failed to get access token for %s: %v", m.URL, tokenErr)
-		return streamURL, err // 元のエラーを返す
+		return sseURL, fmt.Errorf("websocket: %v, sse: %w", err, sseErr) // 元のエラーを返す
+	}
+
+	ws, err = m.tryConnect(ctx, withAccessToken(streamURL, accessToken), httpURL, accessToken)
+	if err == nil {
+		m.ws = ws
+		logger.Info("Connected to ", streamURL, " (with token)")
+		return streamURL, nil
 	}
+	sseURL, sseErr = m.connectSSE(ctx, httpURL, specs, accessToken)
+	if sseErr != nil {
+		return sseURL, fmt.Errorf("connection failed both with and without auth: websocket: %v, sse: %w", err, sseErr)
+	}
+	return sseURL, nil
+}
 
-	ws, err = m.tryConnect(streamURL+"&access_token="+accessToken, httpURL, accessToken)
+// Open は接続してタイムラインを購読する。ctx がキャンセルされたら接続を中断する
+func (m *MastodonProvider) Open(ctx context.Context) (string, []byte, error) {
+	if m.closed {
+		return "", nil, providers.ErrProviderClosed
+	}
+	streamURL, err := m.connect(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return streamURL, nil, ctx.Err()
+		}
+		return streamURL, nil, err
+	}
+	sent, err := m.ConnectChannel()
 	if err != nil {
-		return streamURL, fmt.Errorf("connection failed both with and without auth: %w", err)
+		return streamURL, sent, fmt.Errorf("failed to connect channel: %w", err)
 	}
+	return streamURL, sent, nil
+}
 
-	m.ws = ws
-	logger.Info("Connected to ", streamURL, " (with token)")
-	return streamURL, nil
+// withAccessToken はストリーミングURLにアクセストークンを付与する
+func withAccessToken(streamURL, token string) string {
+	sep := "?"
+	if strings.Contains(streamURL, "?") {
+		sep = "&"
+	}
+	return streamURL + sep + "access_token=" + url.QueryEscape(token)
 }
 
 // tryConnect attempts to establish a WebSocket connection
-func (m *MastodonProvider) tryConnect(streamURL, origin, token string) (*websocket.Conn, error) {
+func (m *MastodonProvider) tryConnect(ctx context.Context, streamURL, origin, token string) (*websocket.Conn, error) {
 	config, err := websocket.NewConfig(streamURL, origin)
 	if err != nil {
 		return nil, err
@@ -78,56 +159,119 @@ func (m *MastodonProvider) tryConnect(streamURL, origin, token string) (*websock
 		config.Header.Set("Authorization", "Bearer "+token)
 	}
 
-	return websocket.DialConfig(config)
+	return config.DialContext(ctx)
 }
 
-// 指定されたタイムラインチャンネルに接続 (WebSocket接続時にすでに接続済み)
+// 購読するタイムラインを設定する (1本の接続で複数ストリームを subscribe する)
+func (m *MastodonProvider) SetTimelines(timelines []string, discoveryOnly []string) {
+	m.Timelines = append(append([]string{}, timelines...), discoveryOnly...)
+	m.discoveryOnly = make(map[string]bool)
+	for _, timeline := range discoveryOnly {
+		m.discoveryOnly[timeline] = true
+	}
+}
+
+// 購読対象のタイムライン一覧
+func (m *MastodonProvider) timelines() []string {
+	if len(m.Timelines) > 0 {
+		return m.Timelines
+	}
+	return []string{m.Timeline}
+}
+
+// 指定されたタイムラインチャンネルに接続
+// 1つのタイムラインならWebSocket接続時にすでに接続済み。
+// 複数の場合は subscribe を送信し，送信したメッセージをJSON配列にまとめて返す
 func (m *MastodonProvider) ConnectChannel() ([]byte, error) {
-	logger.Info("Already connected to channel: ", m.Timeline)
-	return nil, nil
+	timelines := m.timelines()
+	if len(timelines) == 1 || m.sse != nil {
+		// SSEはストリームごとに接続済み
+		logger.Info("Already connected to channel: ", timelines)
+		return nil, nil
+	}
+
+	var sent []string
+	for _, timeline := range timelines {
+		spec, err := convertTimeline(timeline)
+		if err != nil {
+			return []byte("[" + strings.Join(sent, ",") + "]"), err
+		}
+		msg := spec.subscribeMessage()
+		logger.Debug("Send message: ", msg)
+		sent = append(sent, msg)
+		if err := websocket.Message.Send(m.ws, msg); err != nil {
+			return []byte("[" + strings.Join(sent, ",") + "]"), err
+		}
+	}
+	logger.Info("Subscribed to channels: ", timelines)
+	return []byte("[" + strings.Join(sent, ",") + "]"), nil
+}
+
+// timelineOf はメッセージの stream フィールドから共通タイムライン名を求める
+func (m *MastodonProvider) timelineOf(msg StreamingMessage) string {
+	if timeline, ok := m.streams[strings.Join(msg.Stream, ":")]; ok {
+		return timeline
+	}
+	if len(msg.Stream) > 0 {
+		if timeline, ok := m.streams[msg.Stream[0]]; ok {
+			return timeline
+		}
+	}
+	// streamフィールドのないイベント (古いサーバー等) は単一購読時のみ判別できる
+	if timelines := m.timelines(); len(timelines) == 1 {
+		return timelines[0]
+	}
+	return ""
 }
 
 // メッセージを受信し、メディアURLを output チャンネルに送信
 func (m *MastodonProvider) ReceiveMessages(output chan<- models.DownloadItem, message chan<- models.RawMessage) error {
+	return m.Receive(context.Background(), output, message)
+}
+
+// Receive は接続が切れるか ctx がキャンセルされるまでメッセージを受信する
+func (m *MastodonProvider) Receive(ctx context.Context, output chan<- models.DownloadItem, message chan<- models.RawMessage) error {
 	logger.Info("MastodonProvider: Starting to receive messages")
-	
+	overSSE := m.sse != nil
+	receive, release := m.receiver(ctx)
+	defer release()
+
 	for {
 		// メッセージを受信
-		var rawMsg string
-		if err := websocket.Message.Receive(m.ws, &rawMsg); err != nil {
-			logger.Errorf("MastodonProvider: Receive error: %v", err)
+		rawMsg, err := receive()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Errorf("MastodonProvider: Receive error: %v", err)
+			}
 			return err
 		}
 
 		// メッセージをパース
-		var payload Payload
 		msg := m.parseStreamingMessage(rawMsg)
-		if(msg.Event == "update"){
-			payload = m.getPayloadFromStreamingMessage(msg)
-			logger.Debug("Received message: ", msg.Event)
-			logger.Debug("Received message: ", payload.ID)
-			logger.Debug("Received message: ", payload.CreatedAt)
-			logger.Debug("Received message: ", payload.URL)
+		raw, payload := m.toRawMessage(rawMsg, msg)
+		if overSSE {
+			raw.Metadata["transport"] = "sse"
 		}
+		logger.Debug("Received message: ", msg.Event, " ", raw.Metadata["status_id"])
 		
 		// Messageをキューに送信	
-		message <- models.RawMessage{
-			Data:	[]byte(rawMsg),
-			CreatedAt: payload.CreatedAt,
-			ReceivedAt: time.Now(),	
-			DataType: "json",
-			Metadata: nil,
+		message <- raw
+
+		// 投稿を含まないイベント (delete, announcement 等) にはメディアがない
+		// 探索のためだけに購読しているタイムラインのメディアは取得しない
+		if payload == nil || m.discoveryOnly[raw.Metadata["timeline"]] {
+			continue
 		}
 		
 		// URLを抽出
-		urls := m.extractMediaURLsFromPayload(payload)
+		urls := m.extractMediaURLsFromPayload(*payload)
 		
 		// URLをDLキューに送信
 		for _, url := range urls {
 			select {
 			case output <- models.DownloadItem {
 				URL:      url,
-				Datetime: payload.CreatedAt,
+				Datetime: raw.CreatedAt,
 			}:
 			default:
 				logger.Warn("Skipped enqueue media. Media download queue is full.: ", url)
@@ -136,14 +280,92 @@ func (m *MastodonProvider) ReceiveMessages(output chan<- models.DownloadItem, me
 	}
 }
 
+// toRawMessage はストリーミングイベントの種類ごとに，保存用のメッセージを作成する。
+// 投稿を含むイベントの場合はその投稿も返す。
+func (m *MastodonProvider) toRawMessage(rawMsg string, msg StreamingMessage) (models.RawMessage, *Payload) {
+	now := time.Now()
+	raw := models.RawMessage{
+		Data:       []byte(rawMsg),
+		CreatedAt:  now, // 投稿時刻を持たないイベントは受信時刻で保存する
+		ReceivedAt: now,
+		DataType:   "json",
+		Metadata: map[string]string{
+			"event":    msg.Event,
+			"timeline": m.timelineOf(msg),
+		},
+	}
+
+	switch msg.Event {
+	case EventUpdate:
+		payload := m.getPayloadFromStreamingMessage(msg)
+		// payloadが壊れていて投稿時刻が取れない場合は受信時刻のままにする
+		if !payload.CreatedAt.IsZero() {
+			raw.CreatedAt = payload.CreatedAt
+		}
+		raw.Metadata["status_id"] = payload.ID
+		raw.Posts = m.normalize(msg)
+		return raw, &payload
+
+	case EventStatusUpdate:
+		// 編集: 元の投稿IDに紐づく新しいバージョンとして保存する
+		payload := m.getPayloadFromStreamingMessage(msg)
+		raw.Metadata["status_id"] = payload.ID
+		raw.Metadata["original_created_at"] = payload.CreatedAt.Format(time.RFC3339)
+		if editedAt, ok := payload.EditedAt.(string); ok {
+			raw.Metadata["edited_at"] = editedAt
+			if t, err := time.Parse(time.RFC3339, editedAt); err == nil {
+				raw.CreatedAt = t
+			}
+		}
+		raw.Posts = m.normalize(msg)
+		return raw, &payload
+
+	case EventDelete:
+		// 削除: payloadは投稿IDのみ。受信時刻付きの墓標として別ストリームに保存する
+		raw.Metadata["status_id"] = msg.Payload
+		raw.Metadata["tombstone"] = "true"
+		raw.Metadata["stream"] = StreamDeletions
+
+	case EventAnnouncement, EventAnnouncementReaction, EventAnnouncementDelete:
+		var announcement struct {
+			ID string `json:"id"`
+		}
+		if msg.Event == EventAnnouncementDelete {
+			raw.Metadata["announcement_id"] = msg.Payload
+		} else if err := json.Unmarshal([]byte(msg.Payload), &announcement); err == nil {
+			raw.Metadata["announcement_id"] = announcement.ID
+		}
+		raw.Metadata["stream"] = StreamAnnouncements
+
+	case "":
+		// パースに失敗したメッセージもそのまま保存する
+		raw.Metadata["event"] = "unknown"
+
+	default:
+		// notification, conversation, filters_changed 等 (公開TLでは通常流れない)
+		logger.Debugf("Unhandled streaming event %q from %s", msg.Event, m.URL)
+	}
+	return raw, nil
+}
+
 
 func (m *MastodonProvider) CrawlNewServer(server chan <- models.Server) error {
+	return m.Discover(context.Background(), server)
+}
+
+// Discover は接続が切れるか ctx がキャンセルされるまで新規サーバーを探索する
+func (m *MastodonProvider) Discover(ctx context.Context, server chan<- models.Server) error {
 	logger.Info("MastodonProvider: Starting to crawl new servers [", m.URL, "]")
+	receive, release := m.receiver(ctx)
+	defer release()
+
 	for {
 		// メッセージを受信
-		var rawMsg string
-		if err := websocket.Message.Receive(m.ws, &rawMsg); err != nil {
-			logger.Errorf("MastodonProvider: Receive error: %v", err)
+		rawMsg, err := receive()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Errorf("MastodonProvider: Receive error: %v", err)
+			}
 			return err
 		}
 
@@ -165,24 +387,81 @@ func (m *MastodonProvider) CrawlNewServer(server chan <- models.Server) error {
 				logger.Errorf("Failed to get software name: %v", err)
 				continue
 			}
-			server <- models.Server{
+			select {
+			case server <- models.Server{
 				Type: softwareName,
 				URL: u.Host,
+			}:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 		}
 	}
-	return nil
 }
 
 
-// WebSocket 接続を閉じる
+// 受信済みメッセージから新規サーバーを抽出する
+func (m *MastodonProvider) DiscoverServers(raw models.RawMessage) []models.Server {
+	msg := m.parseStreamingMessage(string(raw.Data))
+	if msg.Event != EventUpdate {
+		return nil
+	}
+	payload := m.getPayloadFromStreamingMessage(msg)
+
+	u, err := url.Parse(payload.URL)
+	if err != nil {
+		logger.Errorf("Failed to parse URL: %v", err)
+		return nil
+	}
+	if u.Host == "" || u.Host == m.URL {
+		return nil
+	}
+	softwareName, err := nodeinfo.GetSoftwareName(u.Host)
+	if err != nil {
+		logger.Errorf("Failed to get software name: %v", err)
+		return nil
+	}
+	return []models.Server{{
+		Type: softwareName,
+		URL:  u.Host,
+	}}
+}
+
+// WebSocket 接続を閉じ，Providerを破棄する
 func (m *MastodonProvider) Close() error {
+	m.closed = true
+	return m.CloseStream()
+}
+
+// CloseStream は WebSocket (またはSSE) 接続を閉じる。再度 Open できる
+func (m *MastodonProvider) CloseStream() error {
+	// 受信中の goroutine が参照していることがあるため，sse は nil にしない (次の接続時に置き換える)
+	if sse := m.sse; sse != nil {
+		sse.Close()
+	}
 	if m.ws != nil {
 		return m.ws.Close()
 	}
 	return nil
 }
 
+// receiver は次のメッセージをWebSocketまたはSSEから受信する関数と，その後始末をする関数を返す。
+// ctx がキャンセルされるか読み取り期限を過ぎると受信を中断する
+func (m *MastodonProvider) receiver(ctx context.Context) (func() (string, error), func()) {
+	// Close で m.sse が置き換わっても受信中の接続を使い続けるよう，一度だけ読む
+	if sse := m.sse; sse != nil {
+		return func() (string, error) {
+			return sse.Receive(ctx, providers.DefaultReadTimeout)
+		}, func() {}
+	}
+	guard := providers.GuardRead(ctx, m.ws, providers.DefaultReadTimeout)
+	return func() (string, error) {
+		var rawMsg string
+		err := guard.Receive(&rawMsg)
+		return rawMsg, err
+	}, guard.Release
+}
+
 func (m *MastodonProvider) parseStreamingMessage(raw string) StreamingMessage {
 	var msg StreamingMessage
 	if err := json.Unmarshal([]byte(raw), &msg); err != nil {
@@ -202,6 +481,15 @@ func (m *MastodonProvider) getPayloadFromStreamingMessage(msg StreamingMessage)
 	return payload
 }
 
+// normalize は投稿を含むイベントの payload を正規化する
+func (m *MastodonProvider) normalize(msg StreamingMessage) []models.Post {
+	post, err := NormalizeStatus([]byte(msg.Payload), m.URL)
+	if err != nil {
+		return nil
+	}
+	return []models.Post{post}
+}
+
 func (m *MastodonProvider) extractMediaURLsFromPayload(payload Payload) []string {
 	var urls []string
 
@@ -247,15 +535,77 @@ func urlAdjust(url string) (ws string, http string) {
 	return "wss://" + url, "https://" + url
 }
 
-// convertTimeline は共通タイムライン名をMastodon用に変換する
-func (m *MastodonProvider) convertTimeline() string {
-	switch m.Timeline {
-	case models.TimelineLocal, "localTimeline": // 後方互換性のため旧名も対応
-		return "public:local"
-	case models.TimelineGlobal, "globalTimeline":
-		return "public"
+// Mastodonのストリーム指定 (例: stream=hashtag&tag=xyz)
+type streamSpec struct {
+	Stream string // public, public:local, hashtag, list, user 等
+	Param  string // 追加パラメータ名 (tag, list)
+	Value  string
+}
+
+// key はイベントの stream フィールドを ":" で連結したものと一致する (例: "hashtag:xyz")
+func (s streamSpec) key() string {
+	if s.Param == "" {
+		return s.Stream
+	}
+	return s.Stream + ":" + s.Value
+}
+
+// query はストリーミングURLのクエリ文字列
+func (s streamSpec) query() string {
+	q := url.Values{"stream": {s.Stream}}
+	if s.Param != "" {
+		q.Set(s.Param, s.Value)
+	}
+	return q.Encode()
+}
+
+// subscribeMessage は1本の接続で追加購読するためのメッセージ
+func (s streamSpec) subscribeMessage() string {
+	msg := map[string]string{"type": "subscribe", "stream": s.Stream}
+	if s.Param != "" {
+		msg[s.Param] = s.Value
+	}
+	data, _ := json.Marshal(msg)
+	return string(data)
+}
+
+// convertTimeline は共通タイムライン名をMastodonのストリームに変換する
+func convertTimeline(timeline string) (streamSpec, error) {
+	spec, err := models.ParseTimeline(timeline)
+	if err != nil {
+		return streamSpec{}, err
+	}
+
+	var stream streamSpec
+	switch spec.Kind {
+	case models.TimelineLocal:
+		stream = streamSpec{Stream: "public:local"}
+	case models.TimelineGlobal:
+		stream = streamSpec{Stream: "public"}
+	case models.TimelineRemote:
+		stream = streamSpec{Stream: "public:remote"}
+	case models.TimelineHome:
+		stream = streamSpec{Stream: "user"}
+	case models.TimelineHashtag:
+		stream = streamSpec{Stream: "hashtag", Param: "tag", Value: spec.Arg}
+	case models.TimelineList:
+		stream = streamSpec{Stream: "list", Param: "list", Value: spec.Arg}
 	default:
-		// デフォルトは連合TL
-		return "public"
+		return streamSpec{}, fmt.Errorf("%w for mastodon: %s", models.ErrUnsupportedTimeline, timeline)
 	}
+
+	if spec.Media {
+		// メディア付きのみのストリームは public 系にのみ存在する
+		if !strings.HasPrefix(stream.Stream, "public") {
+			return streamSpec{}, fmt.Errorf("%w for mastodon: %s (media filter is only available for public timelines)", models.ErrUnsupportedTimeline, timeline)
+		}
+		stream.Stream += ":media"
+	}
+	return stream, nil
+}
+
+// CheckTimeline はタイムラインをMastodonで購読できるか確認する
+func (m *MastodonProvider) CheckTimeline(timeline string) error {
+	_, err := convertTimeline(timeline)
+	return err
 }
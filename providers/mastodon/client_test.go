@@ -0,0 +1,70 @@
+package mastodon
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// streamingMessage はストリーミングAPIのメッセージを作る
+func streamingMessage(event, payload string) (string, StreamingMessage) {
+	msg := StreamingMessage{Stream: []string{"public:local"}, Event: event, Payload: payload}
+	data, _ := json.Marshal(msg)
+	return string(data), msg
+}
+
+func TestToRawMessage(t *testing.T) {
+	m := NewMastodonProvider("mastodon.example", "local")
+	m.streams = map[string]string{"public:local": "local"}
+	status := `{"id":"100","created_at":"2026-01-01T00:00:00Z","content":"hi","account":{"id":"1","username":"alice","acct":"alice"}}`
+
+	// 1. 投稿: 投稿時刻で保存し，正規化した投稿とメディア抽出用のpayloadを返す
+	raw, payload := m.toRawMessage(streamingMessage(EventUpdate, status))
+	if payload == nil || raw.Metadata["status_id"] != "100" || raw.Metadata["timeline"] != "local" || len(raw.Posts) != 1 {
+		t.Errorf("update = %+v, payload %v", raw.Metadata, payload)
+	}
+	if want := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC); !raw.CreatedAt.Equal(want) {
+		t.Errorf("update CreatedAt = %s, want %s", raw.CreatedAt, want)
+	}
+
+	// 2. 投稿時刻のない投稿は受信時刻で保存する
+	raw, _ = m.toRawMessage(streamingMessage(EventUpdate, `{"id":"101"}`))
+	if raw.CreatedAt.IsZero() || !raw.CreatedAt.Equal(raw.ReceivedAt) {
+		t.Errorf("update without created_at: CreatedAt = %s, ReceivedAt = %s", raw.CreatedAt, raw.ReceivedAt)
+	}
+
+	// 3. 編集: 編集時刻で保存し，元の投稿時刻を残す
+	edited := `{"id":"100","created_at":"2026-01-01T00:00:00Z","edited_at":"2026-01-02T00:00:00Z"}`
+	raw, payload = m.toRawMessage(streamingMessage(EventStatusUpdate, edited))
+	if payload == nil || raw.Metadata["edited_at"] != "2026-01-02T00:00:00Z" || raw.Metadata["original_created_at"] != "2026-01-01T00:00:00Z" {
+		t.Errorf("status.update = %+v", raw.Metadata)
+	}
+	if want := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC); !raw.CreatedAt.Equal(want) {
+		t.Errorf("status.update CreatedAt = %s, want %s", raw.CreatedAt, want)
+	}
+
+	// 4. 投稿を含まないイベントは別ストリームに保存し，payloadを返さない
+	tests := []struct {
+		event, payload, key, value, stream string
+	}{
+		{EventDelete, "100", "status_id", "100", StreamDeletions},
+		{EventAnnouncement, `{"id":"7","content":"maintenance"}`, "announcement_id", "7", StreamAnnouncements},
+		{EventAnnouncementReaction, `{"id":"7","name":"👍"}`, "announcement_id", "7", StreamAnnouncements},
+		{EventAnnouncementDelete, "7", "announcement_id", "7", StreamAnnouncements},
+	}
+	for _, test := range tests {
+		raw, payload := m.toRawMessage(streamingMessage(test.event, test.payload))
+		if payload != nil || raw.Metadata[test.key] != test.value || raw.Metadata["stream"] != test.stream {
+			t.Errorf("%s = %+v, payload %v", test.event, raw.Metadata, payload)
+		}
+	}
+	if raw, _ := m.toRawMessage(streamingMessage(EventDelete, "100")); raw.Metadata["tombstone"] != "true" {
+		t.Error("delete was not marked as a tombstone")
+	}
+
+	// 5. パースできないメッセージもそのまま保存する
+	raw, payload = m.toRawMessage("not json", StreamingMessage{})
+	if payload != nil || raw.Metadata["event"] != "unknown" || string(raw.Data) != "not json" {
+		t.Errorf("unparsable message = %+v", raw.Metadata)
+	}
+}
@@ -0,0 +1,127 @@
+package mastodon
+
+import (
+	"encoding/json"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+// Mastodon の公開範囲 → 共通の公開範囲
+var visibilities = map[string]string{
+	"public":   models.VisibilityPublic,
+	"unlisted": models.VisibilityUnlisted,
+	"private":  models.VisibilityFollowers,
+	"direct":   models.VisibilityDirect,
+}
+
+// Payload で any になっている参照系のフィールド
+type statusRefs struct {
+	InReplyToID string `json:"in_reply_to_id"`
+	Reblog      *struct {
+		ID  string `json:"id"`
+		URI string `json:"uri"`
+	} `json:"reblog"`
+	// Mastodon 4.4 以降の引用
+	Quote *struct {
+		QuotedStatus *struct {
+			ID  string `json:"id"`
+			URI string `json:"uri"`
+		} `json:"quoted_status"`
+	} `json:"quote"`
+	Mentions []struct {
+		Acct string `json:"acct"`
+	} `json:"mentions"`
+}
+
+// NormalizeStatus はステータス (REST API / ストリーミングの payload) を正規化した投稿に変換する。
+// server はステータスを受信したサーバーのホスト名
+func NormalizeStatus(raw []byte, server string) (models.Post, error) {
+	var status Payload
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return models.Post{}, err
+	}
+	var refs statusRefs
+	if err := json.Unmarshal(raw, &refs); err != nil {
+		return models.Post{}, err
+	}
+
+	post := models.Post{
+		ID:         status.ID,
+		URI:        status.URI,
+		URL:        status.URL,
+		Platform:   "mastodon",
+		Server:     server,
+		CreatedAt:  status.CreatedAt,
+		Text:       htmlToText(status.Content),
+		Summary:    status.SpoilerText,
+		Sensitive:  status.Sensitive,
+		Language:   status.Language,
+		Visibility: visibilities[status.Visibility],
+		Author: models.PostAuthor{
+			ID:          status.Account.ID,
+			Username:    status.Account.Username,
+			Host:        server,
+			DisplayName: status.Account.DisplayName,
+			URI:         status.Account.URL,
+		},
+	}
+	if post.Visibility == "" {
+		post.Visibility = status.Visibility
+	}
+	if editedAt, ok := status.EditedAt.(string); ok {
+		if t, err := time.Parse(time.RFC3339, editedAt); err == nil {
+			post.EditedAt = &t
+		}
+	}
+	// acct はローカルユーザーなら username，リモートなら username@host
+	if _, host, ok := strings.Cut(status.Account.Acct, "@"); ok {
+		post.Author.Host = host
+	}
+
+	for _, media := range status.MediaAttachments {
+		url := media.RemoteURL
+		if url == "" {
+			url = media.URL
+		}
+		post.Media = append(post.Media, models.PostMedia{
+			URL:         url,
+			Type:        media.Type,
+			Description: media.Description,
+		})
+	}
+	for _, tag := range status.Tags {
+		post.Tags = append(post.Tags, tag.Name)
+	}
+	for _, mention := range refs.Mentions {
+		post.Mentions = append(post.Mentions, mention.Acct)
+	}
+
+	if refs.InReplyToID != "" {
+		post.ReplyTo = &models.PostRef{ID: refs.InReplyToID}
+	}
+	if refs.Reblog != nil {
+		post.BoostOf = &models.PostRef{ID: refs.Reblog.ID, URI: refs.Reblog.URI}
+	}
+	if refs.Quote != nil && refs.Quote.QuotedStatus != nil {
+		post.QuoteOf = &models.PostRef{ID: refs.Quote.QuotedStatus.ID, URI: refs.Quote.QuotedStatus.URI}
+	}
+	return post, nil
+}
+
+var (
+	lineBreakTags = regexp.MustCompile(`(?i)<br\s*/?>`)
+	paragraphTags = regexp.MustCompile(`(?i)</p>\s*<p[^>]*>`)
+	htmlTags      = regexp.MustCompile(`<[^>]*>`)
+)
+
+// htmlToText は本文のHTMLをプレーンテキストにする (改行と段落のみ保持する)
+func htmlToText(content string) string {
+	text := lineBreakTags.ReplaceAllString(content, "\n")
+	text = paragraphTags.ReplaceAllString(text, "\n\n")
+	text = htmlTags.ReplaceAllString(text, "")
+	return strings.TrimSpace(html.UnescapeString(text))
+}
@@ -0,0 +1,56 @@
+package mastodon
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+func TestNormalizeStatus(t *testing.T) {
+	raw := []byte(`{
+		"id": "100", "uri": "https://remote.example/statuses/1", "url": "https://remote.example/@bob/1",
+		"created_at": "2026-01-01T00:00:00.000Z", "edited_at": "2026-01-02T00:00:00.000Z",
+		"content": "<p>hello &amp; <a href=\"#\">#go</a><br>line</p><p>next</p>",
+		"spoiler_text": "cw", "sensitive": true, "language": "ja", "visibility": "private",
+		"in_reply_to_id": "99",
+		"account": {"id": "7", "username": "bob", "acct": "bob@remote.example", "display_name": "Bob", "url": "https://remote.example/@bob"},
+		"media_attachments": [{"type": "image", "url": "https://local.example/cache/a.png", "remote_url": "https://remote.example/a.png", "description": "alt"}],
+		"tags": [{"name": "go"}],
+		"mentions": [{"acct": "alice"}],
+		"quote": {"quoted_status": {"id": "50", "uri": "https://local.example/statuses/50"}}
+	}`)
+	post, err := NormalizeStatus(raw, "local.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	want := models.Post{
+		ID: "100", URI: "https://remote.example/statuses/1", URL: "https://remote.example/@bob/1",
+		Platform: "mastodon", Server: "local.example",
+		Author:    models.PostAuthor{ID: "7", Username: "bob", Host: "remote.example", DisplayName: "Bob", URI: "https://remote.example/@bob"},
+		CreatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), EditedAt: &edited,
+		Text: "hello & #go\nline\n\nnext", Summary: "cw", Sensitive: true, Language: "ja",
+		Visibility: models.VisibilityFollowers,
+		// リモートの添付は元サーバーのURLを使う
+		Media:    []models.PostMedia{{URL: "https://remote.example/a.png", Type: "image", Description: "alt"}},
+		ReplyTo:  &models.PostRef{ID: "99"},
+		QuoteOf:  &models.PostRef{ID: "50", URI: "https://local.example/statuses/50"},
+		Tags:     []string{"go"},
+		Mentions: []string{"alice"},
+	}
+	if !reflect.DeepEqual(post, want) {
+		t.Errorf("NormalizeStatus =\n%+v\nwant\n%+v", post, want)
+	}
+
+	// ブーストは元の投稿への参照を持ち，ローカルユーザーは受信したサーバーに属する
+	post, err = NormalizeStatus([]byte(`{"id":"101","visibility":"public","account":{"acct":"alice"},"reblog":{"id":"1","uri":"https://remote.example/statuses/1"}}`), "local.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.BoostOf == nil || post.BoostOf.URI != "https://remote.example/statuses/1" || post.Author.Host != "local.example" || post.Visibility != models.VisibilityPublic {
+		t.Errorf("reblog = %+v", post)
+	}
+}
@@ -0,0 +1,21 @@
+package mastodon
+
+import (
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
+)
+
+func init() {
+	providers.Register("mastodon", func(target models.Target) providers.PlatformProvider {
+		return NewMastodonProvider(target.Server.URL, target.Timeline)
+	}, providers.Capabilities{
+		Timelines: []string{
+			models.TimelineLocal, models.TimelineGlobal, models.TimelineRemote, models.TimelineHome,
+			models.TimelineHashtag, models.TimelineList,
+		},
+		Discovery: true,
+		Multiplex: true,
+		Backfill:  false,
+		DataType:  "json",
+	})
+}
@@ -0,0 +1,223 @@
+package mastodon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
+)
+
+/*
+[SSEフォールバック]
+WebSocketのアップグレードをプロキシで拒否しているサーバーでも，
+HTTPのストリーミングAPI (Server-Sent Events) は使えることがある。
+SSEは1接続1ストリームなので，タイムラインごとに接続して1本に束ねる。
+受信したイベントはWebSocketと同じ形のJSON ({"stream", "event", "payload"}) に変換するため，
+以降の処理 (parseStreamingMessage 等) はWebSocketの場合と共通。
+*/
+
+// SSEの認証エラー (トークンを付けて再試行する)
+var errSSEUnauthorized = errors.New("sse: unauthorized")
+
+// ストリーミングのため全体のタイムアウトは設けず，接続とレスポンスヘッダーの待ち時間だけを制限する
+var httpClientSSE = newSSEClient()
+
+// SSEの接続・レスポンスヘッダーの待ち時間
+const (
+	sseDialTimeout           = 10 * time.Second
+	sseResponseHeaderTimeout = 15 * time.Second
+)
+
+func newSSEClient() *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = (&net.Dialer{Timeout: sseDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	tr.TLSHandshakeTimeout = sseDialTimeout
+	tr.ResponseHeaderTimeout = sseResponseHeaderTimeout
+	return &http.Client{Transport: tr}
+}
+
+// sseConn は複数のSSEストリームを束ねた接続
+type sseConn struct {
+	bodies    []io.ReadCloser
+	messages  chan string
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ssePath はストリーム名をSSEのエンドポイントに変換する
+// (例: public:local:media → /api/v1/streaming/public/local?only_media=true)
+func (s streamSpec) ssePath() string {
+	stream := s.Stream
+	q := url.Values{}
+	if strings.HasSuffix(stream, ":media") {
+		stream = strings.TrimSuffix(stream, ":media")
+		q.Set("only_media", "true")
+	}
+	if s.Param != "" {
+		q.Set(s.Param, s.Value)
+	}
+	path := "/api/v1/streaming/" + strings.ReplaceAll(stream, ":", "/")
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	return path
+}
+
+// dialSSE は各ストリームにSSEで接続する。記録用に最初のストリームのURLを返す
+// ctx がキャンセルされるとストリームも閉じる
+func dialSSE(ctx context.Context, httpURL string, specs []streamSpec, token string) (*sseConn, string, error) {
+	conn := &sseConn{
+		messages: make(chan string),
+		errs:     make(chan error, len(specs)),
+		done:     make(chan struct{}),
+	}
+
+	var firstURL string
+	for _, spec := range specs {
+		streamURL := httpURL + spec.ssePath()
+		if firstURL == "" {
+			firstURL = streamURL
+		}
+		body, err := openSSE(ctx, streamURL, token)
+		if err != nil {
+			conn.Close()
+			return nil, firstURL, err
+		}
+		conn.bodies = append(conn.bodies, body)
+		go conn.read(body, spec)
+	}
+	return conn, firstURL, nil
+}
+
+// openSSE はSSEのエンドポイントにGETリクエストを送る
+func openSSE(ctx context.Context, streamURL, token string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", streamURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; FediverseArchiveBot/1.0)")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := httpClientSSE.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w (status %d)", errSSEUnauthorized, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("sse: unexpected status %d from %s", resp.StatusCode, streamURL)
+	}
+	return resp.Body, nil
+}
+
+// read は event:/data: 行を読み取り，WebSocketと同じ形のメッセージにして送る
+func (c *sseConn) read(body io.Reader, spec streamSpec) {
+	reader := bufio.NewReader(body)
+	var event string
+	var data []string
+	stream := strings.Split(spec.key(), ":")
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			// 空行でイベントが確定する
+			if event != "" {
+				msg, _ := json.Marshal(map[string]interface{}{
+					"stream":  stream,
+					"event":   event,
+					"payload": strings.Join(data, "\n"),
+				})
+				select {
+				case c.messages <- string(msg):
+				case <-c.done:
+					return
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// コメント (ハートビート)
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+}
+
+// fail はストリームのエラーを通知する (受信側は最初のエラーで再接続する)
+func (c *sseConn) fail(err error) {
+	select {
+	case c.errs <- err:
+	default:
+	}
+}
+
+// Receive は次のメッセージを返す。いずれかのストリームが切れたらエラーを返す。
+// ctx がキャンセルされたら ctx.Err() を，timeout の間届かなければ ErrReadTimeout を返す (0なら期限なし)
+func (c *sseConn) Receive(ctx context.Context, timeout time.Duration) (string, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	select {
+	case msg := <-c.messages:
+		return msg, nil
+	case err := <-c.errs:
+		return "", err
+	case <-c.done:
+		return "", io.EOF
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-deadline:
+		return "", providers.ErrReadTimeout
+	}
+}
+
+// Close は全てのストリームを閉じる
+func (c *sseConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		for _, body := range c.bodies {
+			body.Close()
+		}
+	})
+	return nil
+}
+
+// connectSSE はWebSocketで接続できなかった場合にSSEで接続する
+func (m *MastodonProvider) connectSSE(ctx context.Context, httpURL string, specs []streamSpec, token string) (string, error) {
+	conn, sseURL, err := dialSSE(ctx, httpURL, specs, token)
+	if err != nil {
+		return sseURL, err
+	}
+	m.sse = conn
+	logger.Info("Connected to ", sseURL, " (SSE)")
+	return sseURL, nil
+}
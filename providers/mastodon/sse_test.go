@@ -0,0 +1,123 @@
+package mastodon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDialSSE(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/streaming/hashtag" || r.URL.Query().Get("tag") != "日本語" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		// ハートビート，CRLF，複数行のdata，eventのないdata を含む
+		io.WriteString(w, ":thump\r\n\r\n"+
+			"data: orphan\n\n"+
+			"event: update\r\ndata: {\"a\":\r\ndata:1}\r\n\r\n"+
+			"event: delete\ndata: 123\n\n"+
+			"event: update\ndata: {}\n") // 空行で確定しないイベントは送らない
+	}))
+	defer server.Close()
+	specs := []streamSpec{{Stream: "hashtag", Param: "tag", Value: "日本語"}}
+
+	// 1. トークンがなければ認証エラー
+	_, firstURL, err := dialSSE(context.Background(), server.URL, specs, "")
+	if !errors.Is(err, errSSEUnauthorized) {
+		t.Fatalf("dialSSE without token = %v, want errSSEUnauthorized", err)
+	}
+	if want := server.URL + "/api/v1/streaming/hashtag?tag=%E6%97%A5%E6%9C%AC%E8%AA%9E"; firstURL != want {
+		t.Errorf("firstURL = %s, want %s", firstURL, want)
+	}
+
+	// 2. WebSocketと同じ形のメッセージを受信する
+	conn, _, err := dialSSE(context.Background(), server.URL, specs, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, want := range []string{
+		`{"event":"update","payload":"{\"a\":\n1}","stream":["hashtag","日本語"]}`,
+		`{"event":"delete","payload":"123","stream":["hashtag","日本語"]}`,
+	} {
+		msg, err := conn.Receive(context.Background(), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != want {
+			t.Errorf("message = %s, want %s", msg, want)
+		}
+	}
+
+	// 3. ストリームが終わったらエラーを返す
+	if _, err := conn.Receive(context.Background(), time.Second); !errors.Is(err, io.EOF) {
+		t.Errorf("Receive at end of stream = %v, want io.EOF", err)
+	}
+}
+
+func TestSSEPathMedia(t *testing.T) {
+	spec := streamSpec{Stream: "public:local:media"}
+	if got, want := spec.ssePath(), "/api/v1/streaming/public/local?only_media=true"; got != want {
+		t.Errorf("ssePath = %s, want %s", got, want)
+	}
+}
+
+// authTransport はアプリ登録などの認証リクエストを記録し，失敗させる
+type authTransport struct{ requested bool }
+
+func (a *authTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	a.requested = true
+	return nil, errors.New("auth disabled in test")
+}
+
+func TestConnectTriesAnonymousSSEBeforeRegistering(t *testing.T) {
+	defer func(client *http.Client) { httpClientAuth = client }(httpClientAuth)
+
+	for _, requireAuth := range []bool{false, true} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path != "/api/v1/streaming/public/local":
+				// WebSocketのアップグレードは拒否する
+				w.WriteHeader(http.StatusBadRequest)
+			case requireAuth:
+				w.WriteHeader(http.StatusUnauthorized)
+			default:
+				w.Header().Set("Content-Type", "text/event-stream")
+				io.WriteString(w, "event: update\ndata: {}\n\n")
+			}
+		}))
+		auth := &authTransport{}
+		httpClientAuth = &http.Client{Transport: auth}
+
+		m := NewMastodonProvider(server.URL, "local")
+		streamURL, err := m.connect(context.Background())
+		if requireAuth {
+			// 認証を求めるサーバーでだけアプリを登録する
+			if !errors.Is(err, errSSEUnauthorized) || !auth.requested {
+				t.Errorf("connect to a server requiring auth = %v, registered = %v", err, auth.requested)
+			}
+		} else {
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.sse.Close()
+			if want := server.URL + "/api/v1/streaming/public/local"; streamURL != want {
+				t.Errorf("streamURL = %s, want %s", streamURL, want)
+			}
+			if auth.requested {
+				t.Error("registered an app although the server accepts anonymous SSE")
+			}
+		}
+		server.Close()
+	}
+}
@@ -5,6 +5,25 @@ import (
 	"encoding/json"
 )
 
+// ストリーミングAPIのイベント種別
+const (
+	EventUpdate               = "update"
+	EventStatusUpdate         = "status.update"
+	EventDelete               = "delete"
+	EventNotification         = "notification"
+	EventConversation         = "conversation"
+	EventFiltersChanged       = "filters_changed"
+	EventAnnouncement         = "announcement"
+	EventAnnouncementReaction = "announcement.reaction"
+	EventAnnouncementDelete   = "announcement.delete"
+)
+
+// 出力ストリーム名 (RawMessage.Metadata["stream"])
+const (
+	StreamDeletions     = "deletions"     // 削除された投稿の墓標
+	StreamAnnouncements = "announcements" // サーバーのお知らせ
+)
+
 type StreamingMessage struct {
 	Stream []string `json:"stream"`
 	Event string `json:"event"`
@@ -103,6 +122,7 @@ type MediaAttachment struct {
 	RemoteURL string `json:"remote_url"`
 	TextURL string `json:"text_url"`
 	Meta json.RawMessage `json:"meta"`
+	Description string `json:"description"`
 }
 
 type ImageMeta struct {
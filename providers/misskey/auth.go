@@ -0,0 +1,84 @@
+package misskey
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var httpClientAuth = &http.Client{
+	Timeout: 15 * time.Second,
+}
+
+const (
+	appName = "FediverseArchiveBot"
+	// permissions requested via MiAuth (read-only)
+	miAuthPermission = "read:account,read:channels,read:following"
+)
+
+// MiAuthSession is a pending MiAuth authorization
+type MiAuthSession struct {
+	Host      string
+	SessionID string
+}
+
+// MiAuthCheckResponse is the response of /api/miauth/{session}/check
+type MiAuthCheckResponse struct {
+	OK    bool   `json:"ok"`
+	Token string `json:"token"`
+	User  struct {
+		Username string `json:"username"`
+	} `json:"user"`
+}
+
+// NewMiAuthSession starts a new MiAuth session for host
+func NewMiAuthSession(host string) *MiAuthSession {
+	return &MiAuthSession{
+		Host:      host,
+		SessionID: uuid.New().String(),
+	}
+}
+
+// URL returns the page where the user approves the session
+func (s *MiAuthSession) URL() string {
+	q := url.Values{}
+	q.Set("name", appName)
+	q.Set("permission", miAuthPermission)
+	return fmt.Sprintf("https://%s/miauth/%s?%s", s.Host, s.SessionID, q.Encode())
+}
+
+// Check retrieves the token once the user has approved the session
+func (s *MiAuthSession) Check() (*MiAuthCheckResponse, error) {
+	apiURL := fmt.Sprintf("https://%s/api/miauth/%s/check", s.Host, s.SessionID)
+
+	req, err := http.NewRequest("POST", apiURL, strings.NewReader("{}"))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "FediverseArchiveBot/1.0")
+
+	resp, err := httpClientAuth.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("miauth check failed with status %d", resp.StatusCode)
+	}
+
+	var result MiAuthCheckResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode miauth response: %w", err)
+	}
+	if !result.OK || result.Token == "" {
+		return nil, fmt.Errorf("miauth session %s has not been approved", s.SessionID)
+	}
+	return &result, nil
+}
@@ -1,12 +1,18 @@
 package misskey
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/chcolte/fediverse-archive-bot-go/credentials"
 	"github.com/chcolte/fediverse-archive-bot-go/logger"
 	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/nodeinfo"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
 	"github.com/google/uuid"
 	"golang.org/x/net/websocket"
 )
@@ -14,23 +20,51 @@ import (
 type MisskeyProvider struct {
 	URL      string
 	Timeline string
+	Timelines []string          // 1本の接続で購読するタイムライン (SetTimelinesで設定，空ならTimelineのみ)
+	discoveryOnly map[string]bool // 探索のためだけに購読しているタイムライン (メディアを抽出しない)
 	ws       *websocket.Conn
+	channels map[string]string // チャンネル接続ID → 共通タイムライン名
+
+	// subNote で更新を購読する直近ノートの数 (0なら購読しない)
+	SubNoteWindow int
+	subNotes      []string // 購読中のノートID (古い順)
+	subNoteSet    map[string]bool
+
+	closed bool // Close 済み (再度 Open しない)
 }
 
+// DefaultSubNoteWindow は新しい MisskeyProvider の SubNoteWindow の初期値
+var DefaultSubNoteWindow = 0
+
 // 新しい MisskeyProvider を作成
 func NewMisskeyProvider(url, timeline string) *MisskeyProvider {
 	return &MisskeyProvider{
 		URL:      url,
 		Timeline: timeline,
+		SubNoteWindow: DefaultSubNoteWindow,
+		subNoteSet:    make(map[string]bool),
 	}
 }
 
 // Misskey サーバーに WebSocket 接続
 // WebSocketのHTTP HeaderとResponseが取りたいところだが，今のパッケージだと無理
 func (m *MisskeyProvider) Connect() (string, error) {
+	return m.connect(context.Background())
+}
+
+// connect は ctx でキャンセルできる Connect
+func (m *MisskeyProvider) connect(ctx context.Context) (string, error) {
 	wsURL, httpURL := urlAdjust(m.URL)
 
-	ws, err := websocket.Dial(wsURL, "", httpURL)
+	// ユーザートークンが設定されていれば i パラメータで認証する
+	// (記録するURLにはトークンを含めない)
+	dialURL := wsURL
+	if token := credentials.DefaultStore.Token(m.URL); token != "" {
+		wsURL += "/streaming"
+		dialURL = wsURL + "?i=" + url.QueryEscape(token)
+	}
+
+	ws, err := providers.DialWebSocket(ctx, dialURL, httpURL)
 	if err != nil {
 		return wsURL, err
 	}
@@ -39,57 +73,162 @@ func (m *MisskeyProvider) Connect() (string, error) {
 	return wsURL, nil
 }
 
+// Open は接続してチャンネルに接続する。ctx がキャンセルされたら接続を中断する
+func (m *MisskeyProvider) Open(ctx context.Context) (string, []byte, error) {
+	if m.closed {
+		return "", nil, providers.ErrProviderClosed
+	}
+	wsURL, err := m.connect(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return wsURL, nil, ctx.Err()
+		}
+		return wsURL, nil, err
+	}
+	sent, err := m.ConnectChannel()
+	if err != nil {
+		return wsURL, sent, fmt.Errorf("failed to connect channel: %w", err)
+	}
+	return wsURL, sent, nil
+}
+
+// 購読するタイムラインを設定する (1本の接続で複数チャンネルに connect する)
+func (m *MisskeyProvider) SetTimelines(timelines []string, discoveryOnly []string) {
+	m.Timelines = append(append([]string{}, timelines...), discoveryOnly...)
+	m.discoveryOnly = make(map[string]bool)
+	for _, timeline := range discoveryOnly {
+		m.discoveryOnly[timeline] = true
+	}
+}
+
+// 購読対象のタイムライン一覧
+func (m *MisskeyProvider) timelines() []string {
+	if len(m.Timelines) > 0 {
+		return m.Timelines
+	}
+	return []string{m.Timeline}
+}
+
 // 指定されたタイムラインチャンネルに接続
 // WebSocketのHTTP HeaderとResponseが取りたいところだが，今のパッケージだと無理
+// 複数のタイムラインを購読する場合，送信したメッセージはJSON配列にまとめて返す
 func (m *MisskeyProvider) ConnectChannel() ([]byte, error) {
-	id, err := uuid.NewRandom()
-	if err != nil {
-		return nil, err
-	}
+	m.channels = make(map[string]string)
 
-	channel := m.convertTimeline()
+	var sent []string
+	for _, timeline := range m.timelines() {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return nil, err
+		}
 
-	msg := `{
-		"type": "connect",
-		"body": {
-			"channel": "` + channel + `",
-			"id": "` + id.String() + `"
+		channel, params, err := convertTimeline(timeline)
+		if err != nil {
+			return joinSentMessages(sent), err
 		}
-	}`
-	logger.Debug("Send message: ", msg)
 
-	if err := websocket.Message.Send(m.ws, msg); err != nil {
-		return []byte(msg), err
+		body := map[string]interface{}{
+			"channel": channel,
+			"id":      id.String(),
+		}
+		if len(params) > 0 {
+			body["params"] = params
+		}
+		data, err := json.Marshal(map[string]interface{}{"type": "connect", "body": body})
+		if err != nil {
+			return joinSentMessages(sent), err
+		}
+		msg := string(data)
+		logger.Debug("Send message: ", msg)
+		sent = append(sent, msg)
+
+		if err := websocket.Message.Send(m.ws, msg); err != nil {
+			return joinSentMessages(sent), err
+		}
+		m.channels[id.String()] = timeline
+
+		logger.Debug("Connected to channel:", channel)
 	}
+	msg := joinSentMessages(sent)
 
-	logger.Debug("Connected to channel:", channel)
-	return []byte(msg), nil
+	// 再接続時は購読していたノートを購読し直す
+	for _, noteID := range m.subNotes {
+		if err := m.sendSubNote("subNote", noteID); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+// 送信したメッセージを記録用にまとめる (1件ならそのまま，複数ならJSON配列)
+func joinSentMessages(sent []string) []byte {
+	if len(sent) == 1 {
+		return []byte(sent[0])
+	}
+	return []byte("[" + strings.Join(sent, ",") + "]")
 }
 
 // メッセージを受信し、メディアURLを output チャンネルに送信
 func (m *MisskeyProvider) ReceiveMessages(output chan<- models.DownloadItem, message chan<- models.RawMessage) error {
+	return m.Receive(context.Background(), output, message)
+}
+
+// Receive は接続が切れるか ctx がキャンセルされるまでメッセージを受信する
+func (m *MisskeyProvider) Receive(ctx context.Context, output chan<- models.DownloadItem, message chan<- models.RawMessage) error {
 	logger.Info("MisskeyProvider: Starting to receive messages [", m.URL, "]")
-	
+	guard := providers.GuardRead(ctx, m.ws, providers.DefaultReadTimeout)
+	defer guard.Release()
+
 	for {
 		// メッセージを受信
 		var rawMsg string
-		if err := websocket.Message.Receive(m.ws, &rawMsg); err != nil {
-			logger.Errorf("MisskeyProvider: Receive error: %v", err)
+		if err := guard.Receive(&rawMsg); err != nil {
+			if ctx.Err() == nil {
+				logger.Errorf("MisskeyProvider: Receive error: %v", err)
+			}
 			return err
 		}
 
 		// メッセージをパース
 		msg := m.parseStreamingMessage(rawMsg)
+
+		// subNoteで購読したノートの更新 (リアクション，投票，削除など)
+		if msg.Type == "noteUpdated" {
+			if err := m.handleNoteUpdated(rawMsg, message); err != nil {
+				return err
+			}
+			continue
+		}
+
 		note := m.getNoteFromStreamingMessage(msg) // todo: 万に一つ，受信したメッセージにノートが含まれていない可能性をどうするか
 		logger.Debug("Received Note ID: ", note.ID)
+
+		// 探索のためだけに購読しているタイムラインのノートは更新を購読しない
+		timeline := m.channels[msg.Body.ID]
+		if note.ID != "" && !m.discoveryOnly[timeline] {
+			if err := m.subscribeNote(note.ID); err != nil {
+				return err
+			}
+		}
 	
 		// Messageをキューに送信	
-		message <- models.RawMessage{
+		raw := models.RawMessage{
 			Data:	[]byte(rawMsg),
 			CreatedAt: note.CreatedAt,
 			ReceivedAt: time.Now(),	
 			DataType: "json",
-			Metadata: nil,
+			Metadata: map[string]string{
+				"timeline": timeline,
+			},
+		}
+		if note.ID != "" {
+			raw.Posts = []models.Post{NormalizeNote(note, m.URL)}
+		}
+		message <- raw
+
+		// 探索のためだけに購読しているタイムラインのメディアは取得しない
+		if m.discoveryOnly[timeline] {
+			continue
 		}
 
 		// URLを抽出
@@ -109,13 +248,105 @@ func (m *MisskeyProvider) ReceiveMessages(output chan<- models.DownloadItem, mes
 	}
 }
 
+// handleNoteUpdated は noteUpdated イベントをノートIDに紐づけて保存する
+func (m *MisskeyProvider) handleNoteUpdated(rawMsg string, message chan<- models.RawMessage) error {
+	var update NoteUpdatedMessage
+	if err := json.Unmarshal([]byte(rawMsg), &update); err != nil {
+		logger.Errorf("Failed to parse noteUpdated: %v", err)
+		return nil
+	}
+	logger.Debugf("Note %s updated: %s", update.Body.ID, update.Body.Type)
+
+	now := time.Now()
+	message <- models.RawMessage{
+		Data:       []byte(rawMsg),
+		CreatedAt:  now, // 更新イベントは受信時刻で保存する
+		ReceivedAt: now,
+		DataType:   "json",
+		Metadata: map[string]string{
+			"event":       "noteUpdated",
+			"note_id":     update.Body.ID,
+			"update_type": update.Body.Type,
+			"stream":      StreamNoteUpdates,
+		},
+	}
+
+	// 削除されたノートはもう更新されない
+	if update.Body.Type == NoteUpdateDeleted {
+		return m.unsubscribeNote(update.Body.ID)
+	}
+	return nil
+}
+
+// subscribeNote はノートの更新を購読し，窓から溢れた古いノートの購読を解除する
+func (m *MisskeyProvider) subscribeNote(noteID string) error {
+	if m.SubNoteWindow <= 0 || m.subNoteSet[noteID] {
+		return nil
+	}
+	for len(m.subNotes) >= m.SubNoteWindow {
+		if err := m.unsubscribeNote(m.subNotes[0]); err != nil {
+			return err
+		}
+	}
+	if err := m.sendSubNote("subNote", noteID); err != nil {
+		return err
+	}
+	m.subNotes = append(m.subNotes, noteID)
+	m.subNoteSet[noteID] = true
+	return nil
+}
+
+// unsubscribeNote はノートの購読を解除する
+func (m *MisskeyProvider) unsubscribeNote(noteID string) error {
+	if !m.subNoteSet[noteID] {
+		return nil
+	}
+	delete(m.subNoteSet, noteID)
+	for i, id := range m.subNotes {
+		if id == noteID {
+			m.subNotes = append(m.subNotes[:i], m.subNotes[i+1:]...)
+			break
+		}
+	}
+	return m.sendSubNote("unsubNote", noteID)
+}
+
+// sendSubNote は subNote / unsubNote メッセージを送信する
+func (m *MisskeyProvider) sendSubNote(msgType, noteID string) error {
+	msg, err := subNoteMessage(msgType, noteID)
+	if err != nil {
+		return err
+	}
+	logger.Debug("Send message: ", msg)
+	return websocket.Message.Send(m.ws, msg)
+}
+
+// subNoteMessage は subNote / unsubNote メッセージを作る (ノートIDはサーバーから受け取った値なのでエスケープする)
+func subNoteMessage(msgType, noteID string) (string, error) {
+	data, err := json.Marshal(map[string]interface{}{"type": msgType, "body": map[string]string{"id": noteID}})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
 func (m *MisskeyProvider) CrawlNewServer(server chan <- models.Server) error {
+	return m.Discover(context.Background(), server)
+}
+
+// Discover は接続が切れるか ctx がキャンセルされるまで新規サーバーを探索する
+func (m *MisskeyProvider) Discover(ctx context.Context, server chan<- models.Server) error {
 	logger.Info("MisskeyProvider: Starting to crawl new servers [", m.URL, "]")
+	guard := providers.GuardRead(ctx, m.ws, providers.DefaultReadTimeout)
+	defer guard.Release()
+
 	for {
 		// メッセージを受信
 		var rawMsg string
-		if err := websocket.Message.Receive(m.ws, &rawMsg); err != nil {
-			logger.Errorf("MisskeyProvider: Receive error: %v", err)
+		if err := guard.Receive(&rawMsg); err != nil {
+			if ctx.Err() == nil {
+				logger.Errorf("MisskeyProvider: Receive error: %v", err)
+			}
 			return err
 		}
 
@@ -125,21 +356,61 @@ func (m *MisskeyProvider) CrawlNewServer(server chan <- models.Server) error {
 
 		// サーバーを通知
 		if note.User.Host == "null" || note.User.Host == "" {continue} // Host: nullの場合は他サーバーではない
-		server <- models.Server{
-			Type: note.User.Instance.SoftwareName,
+		select {
+		case server <- models.Server{
+			Type: softwareOf(note),
 			URL: note.User.Host,
+		}:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
-// WebSocket 接続を閉じる
-func (m *MisskeyProvider) Close() error {
+// 受信済みメッセージから新規サーバーを抽出する
+func (m *MisskeyProvider) DiscoverServers(raw models.RawMessage) []models.Server {
+	msg := m.parseStreamingMessage(string(raw.Data))
+	if msg.Type != "channel" {
+		return nil
+	}
+	note := m.getNoteFromStreamingMessage(msg)
+	if note.User.Host == "null" || note.User.Host == "" { // Host: nullの場合は他サーバーではない
+		return nil
+	}
+	return []models.Server{{
+		Type: softwareOf(note),
+		URL:  note.User.Host,
+	}}
+}
+
+// softwareOf は投稿者のサーバーのソフトウェア名を返す。
+// 連合先の情報が未取得でノートに含まれない場合はNodeInfoで調べる (結果はキャッシュされる)
+func softwareOf(note Note) string {
+	if name := note.User.Instance.SoftwareName; name != "" {
+		return name
+	}
+	name, err := nodeinfo.GetSoftwareName(note.User.Host)
+	if err != nil {
+		logger.Debugf("Failed to get software name for %s: %v", note.User.Host, err)
+		return ""
+	}
+	return name
+}
+
+// CloseStream は WebSocket 接続を閉じる。購読中のノートは再接続時に購読し直す
+func (m *MisskeyProvider) CloseStream() error {
 	if m.ws != nil {
 		return m.ws.Close()
 	}
 	return nil
 }
 
+// WebSocket 接続を閉じ，Providerを破棄する
+func (m *MisskeyProvider) Close() error {
+	m.closed = true
+	return m.CloseStream()
+}
+
 func (m *MisskeyProvider) parseStreamingMessage(raw string) StreamingMessage {
 	var msg StreamingMessage
 	if err := json.Unmarshal([]byte(raw), &msg); err != nil {
@@ -171,15 +442,49 @@ func urlAdjust(url string) (ws string, http string) {
 	return "wss://" + url, "https://" + url
 }
 
-// convertTimeline は共通タイムライン名をMisskey用に変換する
-func (m *MisskeyProvider) convertTimeline() string {
-	switch m.Timeline {
-	case models.TimelineLocal, "localTimeline": // 後方互換性のため旧名も対応
-		return "localTimeline"
-	case models.TimelineGlobal, "globalTimeline":
-		return "globalTimeline"
+// convertTimeline は共通タイムライン名をMisskeyのチャンネル名とパラメータに変換する
+func convertTimeline(timeline string) (string, map[string]interface{}, error) {
+	spec, err := models.ParseTimeline(timeline)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var channel string
+	params := map[string]interface{}{}
+	switch spec.Kind {
+	case models.TimelineLocal:
+		channel = "localTimeline"
+	case models.TimelineGlobal:
+		channel = "globalTimeline"
+	case models.TimelineHybrid:
+		channel = "hybridTimeline"
+	case models.TimelineHome:
+		channel = "homeTimeline"
+	case models.TimelineHashtag:
+		// q は AND条件の配列のOR ([[a, b], [c]] は (a AND b) OR c)
+		channel = "hashtag"
+		params["q"] = [][]string{{spec.Arg}}
+	case models.TimelineList:
+		channel = "userList"
+		params["listId"] = spec.Arg
+	case models.TimelineChannel:
+		channel = "channel"
+		params["channelId"] = spec.Arg
+	case models.TimelineAntenna:
+		channel = "antenna"
+		params["antennaId"] = spec.Arg
 	default:
-		// デフォルトはローカルTL
-		return "localTimeline"
+		return "", nil, fmt.Errorf("%w for misskey: %s", models.ErrUnsupportedTimeline, timeline)
+	}
+
+	if spec.Media {
+		params["withFiles"] = true
 	}
+	return channel, params, nil
+}
+
+// CheckTimeline はタイムラインをMisskeyで購読できるか確認する
+func (m *MisskeyProvider) CheckTimeline(timeline string) error {
+	_, _, err := convertTimeline(timeline)
+	return err
 }
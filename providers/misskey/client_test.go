@@ -0,0 +1,14 @@
+package misskey
+
+import "testing"
+
+func TestSubNoteMessage(t *testing.T) {
+	// 引用符を含むIDでもJSONとして壊れない
+	msg, err := subNoteMessage("subNote", `9x"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"body":{"id":"9x\"}"},"type":"subNote"}`; msg != want {
+		t.Errorf("message = %s, want %s", msg, want)
+	}
+}
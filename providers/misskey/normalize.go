@@ -0,0 +1,95 @@
+package misskey
+
+import (
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+// Misskey の公開範囲 → 共通の公開範囲
+var visibilities = map[string]string{
+	"public":    models.VisibilityPublic,
+	"home":      models.VisibilityUnlisted,
+	"followers": models.VisibilityFollowers,
+	"specified": models.VisibilityDirect,
+}
+
+// NormalizeNote はノートを正規化した投稿に変換する。
+// server はノートを受信したサーバーのホスト名で，ローカルのノート・ユーザーのURIを組み立てるのに使う
+func NormalizeNote(note Note, server string) models.Post {
+	post := models.Post{
+		ID:         note.ID,
+		URI:        noteURI(note, server),
+		URL:        note.URL,
+		Platform:   "misskey",
+		Server:     server,
+		CreatedAt:  note.CreatedAt,
+		Text:       stringOf(note.Text),
+		Summary:    stringOf(note.Cw),
+		Visibility: visibilities[note.Visibility],
+		Tags:       note.Tags,
+		Mentions:   note.Mentions,
+		Author: models.PostAuthor{
+			ID:          note.User.ID,
+			Username:    note.User.Username,
+			Host:        note.User.Host,
+			DisplayName: note.User.Name,
+		},
+	}
+	if post.URL == "" {
+		post.URL = post.URI
+	}
+	if post.Visibility == "" {
+		post.Visibility = note.Visibility
+	}
+	if note.User.Host == "" {
+		post.Author.Host = server
+		post.Author.URI = "https://" + server + "/users/" + note.User.ID
+	}
+
+	for _, file := range note.Files {
+		post.Media = append(post.Media, models.PostMedia{
+			URL:         file.URL,
+			Type:        file.Type,
+			Description: file.Comment,
+		})
+		if file.IsSensitive {
+			post.Sensitive = true
+		}
+	}
+	post.Sensitive = post.Sensitive || post.Summary != ""
+
+	if note.ReplyID != "" {
+		post.ReplyTo = noteRef(note.ReplyID, note.Reply, server)
+	}
+	if note.RenoteID != "" {
+		ref := noteRef(note.RenoteID, note.Renote, server)
+		// 本文・CW・添付・投票のないリノートはブースト，それ以外は引用
+		if note.Text == nil && note.Cw == nil && len(note.FileIds) == 0 && len(note.Poll.Choices) == 0 {
+			post.BoostOf = ref
+		} else {
+			post.QuoteOf = ref
+		}
+	}
+	return post
+}
+
+// ノートのURI。ローカルのノートは uri を持たないため，受信したサーバーのURLで代用する
+func noteURI(note Note, server string) string {
+	if note.URI != "" {
+		return note.URI
+	}
+	return "https://" + server + "/notes/" + note.ID
+}
+
+// 返信先・リノート元への参照。ノート本体が埋め込まれていなければIDから組み立てる
+func noteRef(id string, note *Note, server string) *models.PostRef {
+	if note != nil && note.ID != "" {
+		return &models.PostRef{ID: note.ID, URI: noteURI(*note, server)}
+	}
+	return &models.PostRef{ID: id, URI: "https://" + server + "/notes/" + id}
+}
+
+// text, cw は null になりうる
+func stringOf(v any) string {
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,55 @@
+package misskey
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+// note はJSONからノートを作る
+func note(t *testing.T, data string) Note {
+	t.Helper()
+	var n Note
+	if err := json.Unmarshal([]byte(data), &n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestNormalizeNote(t *testing.T) {
+	// 1. ローカルのノートはURIを受信したサーバーから組み立てる
+	post := NormalizeNote(note(t, `{"id":"9a","text":"hi","cw":null,"visibility":"home","user":{"id":"u1","username":"alice","host":null},
+		"files":[{"url":"https://misskey.example/files/a.png","type":"image/png","comment":"alt","isSensitive":true}],
+		"replyId":"9z","tags":["go"],"mentions":["u2"]}`), "misskey.example")
+	if post.URI != "https://misskey.example/notes/9a" || post.URL != post.URI {
+		t.Errorf("local note URI = %s, URL = %s", post.URI, post.URL)
+	}
+	if post.Author.Host != "misskey.example" || post.Author.URI != "https://misskey.example/users/u1" {
+		t.Errorf("local author = %+v", post.Author)
+	}
+	if post.Visibility != models.VisibilityUnlisted || !post.Sensitive || len(post.Media) != 1 || post.Media[0].Description != "alt" {
+		t.Errorf("local note = %+v", post)
+	}
+	if post.ReplyTo == nil || post.ReplyTo.URI != "https://misskey.example/notes/9z" {
+		t.Errorf("reply = %+v", post.ReplyTo)
+	}
+
+	// 2. リモートのノートは元のURIを使い，CWがあれば sensitive
+	post = NormalizeNote(note(t, `{"id":"9b","text":"hi","cw":"spoiler","visibility":"followers","uri":"https://remote.example/notes/1",
+		"user":{"id":"u3","username":"bob","host":"remote.example"}}`), "misskey.example")
+	if post.URI != "https://remote.example/notes/1" || post.Author.Host != "remote.example" || post.Summary != "spoiler" || !post.Sensitive {
+		t.Errorf("remote note = %+v", post)
+	}
+
+	// 3. 本文のないリノートはブースト，本文のあるリノートは引用
+	renote := `"renoteId":"9c","renote":{"id":"9c","uri":"https://remote.example/notes/2"},"user":{"id":"u1"},"visibility":"public"`
+	boost := NormalizeNote(note(t, `{"id":"9d","text":null,`+renote+`}`), "misskey.example")
+	quote := NormalizeNote(note(t, `{"id":"9e","text":"see",`+renote+`}`), "misskey.example")
+	if boost.BoostOf == nil || boost.QuoteOf != nil || boost.BoostOf.URI != "https://remote.example/notes/2" {
+		t.Errorf("renote without text = boost %+v, quote %+v", boost.BoostOf, boost.QuoteOf)
+	}
+	if quote.QuoteOf == nil || quote.BoostOf != nil {
+		t.Errorf("renote with text = boost %+v, quote %+v", quote.BoostOf, quote.QuoteOf)
+	}
+}
@@ -0,0 +1,21 @@
+package misskey
+
+import (
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
+)
+
+func init() {
+	providers.Register("misskey", func(target models.Target) providers.PlatformProvider {
+		return NewMisskeyProvider(target.Server.URL, target.Timeline)
+	}, providers.Capabilities{
+		Timelines: []string{
+			models.TimelineLocal, models.TimelineGlobal, models.TimelineHybrid, models.TimelineHome,
+			models.TimelineHashtag, models.TimelineList, models.TimelineChannel, models.TimelineAntenna,
+		},
+		Discovery: true,
+		Multiplex: true,
+		Backfill:  false,
+		DataType:  "json",
+	})
+}
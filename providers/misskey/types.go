@@ -1,6 +1,7 @@
 package misskey
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -149,3 +150,27 @@ type StreamingBody struct {
 	Type string `json:"type"`
 	Body Note   `json:"body"`
 }
+
+// noteUpdated の種類
+const (
+	NoteUpdateReacted   = "reacted"
+	NoteUpdateUnreacted = "unreacted"
+	NoteUpdatePollVoted = "pollVoted"
+	NoteUpdateDeleted   = "deleted"
+	NoteUpdateUpdated   = "updated"
+)
+
+// 出力ストリーム名 (RawMessage.Metadata["stream"])
+const (
+	StreamNoteUpdates = "note_updates" // subNoteで受信したノートの更新
+)
+
+// subNoteで購読したノートの更新通知
+type NoteUpdatedMessage struct {
+	Type string `json:"type"` // "noteUpdated"
+	Body struct {
+		ID   string          `json:"id"`   // ノートID
+		Type string          `json:"type"` // reacted, unreacted, pollVoted, deleted, updated
+		Body json.RawMessage `json:"body"`
+	} `json:"body"`
+}
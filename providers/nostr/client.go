@@ -1,43 +1,125 @@
 package nostr
 
 import (
+	"context"
 	"strings"
 	"fmt"
 	"time"
 	"encoding/json"
-	"mvdan.cc/xurls/v2"
 
 	"github.com/chcolte/fediverse-archive-bot-go/logger"
 	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/nodeinfo"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
 	"golang.org/x/net/websocket"
 	"github.com/google/uuid"
 )
 
 type NostrProvider struct {
 	URL      string
+	Dedup    *EventDeduper // リレー横断の重複排除テーブル (nilなら重複排除しない)
+	Signer   *Signer       // NIP-42 AUTH に使う署名者 (nilならAUTHに応答しない)
+	Index    *ReplaceableIndex // 置き換え可能イベントの索引 (nilなら追跡しない)
 	ws       *websocket.Conn
+	wsURL    string
+	relayInfo *nodeinfo.RelayInfo // NIP-11 (取得できなければnil)
 	subscriptionID string
+
+	// NIP-42 AUTH の状態
+	authEventID   string // 送信したAUTHイベントのID (OK応答の照合用)
+	authenticated bool
+	reqPending    bool   // auth-requiredで閉じられ，認証後の再REQ待ち
+	authRetried   bool
+
+	closed bool // Close 済み (再度 Open しない)
 }
 
 // 新しい NostrProvider を作成
 func NewNostrProvider(url string) *NostrProvider {
 	return &NostrProvider{
 		URL: url,
+		Dedup: DefaultDeduper,
+		Signer: DefaultSigner,
+		Index: DefaultReplaceableIndex,
 	}
 }
 
 // Nostr サーバーに WebSocket 接続
 func (m *NostrProvider) Connect() (string, error) {
+	return m.connect(context.Background())
+}
+
+// connect は ctx でキャンセルできる Connect
+func (m *NostrProvider) connect(ctx context.Context) (string, error) {
 	wsURL, httpURL := urlAdjust(m.URL)
-	ws, err := websocket.Dial(wsURL, "", httpURL)
+
+	// NIP-11で購読できないと分かっているリレーには接続しない
+	if err := m.checkRelayInfo(); err != nil {
+		return wsURL, err
+	}
+	ws, err := providers.DialWebSocket(ctx, wsURL, httpURL)
 	if err != nil {
 		return wsURL, err
 	}
 	m.ws = ws
+	m.wsURL = wsURL
+	m.authEventID = ""
+	m.authenticated = false
+	m.reqPending = false
+	m.authRetried = false
 	logger.Info("Connected to ", wsURL)
 	return wsURL, nil
 }
 
+// Open は接続して購読を開始する。ctx がキャンセルされたら接続を中断する
+func (m *NostrProvider) Open(ctx context.Context) (string, []byte, error) {
+	if m.closed {
+		return "", nil, providers.ErrProviderClosed
+	}
+	wsURL, err := m.connect(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return wsURL, nil, ctx.Err()
+		}
+		return wsURL, nil, err
+	}
+	sent, err := m.ConnectChannel()
+	if err != nil {
+		return wsURL, sent, fmt.Errorf("failed to connect channel: %w", err)
+	}
+	return wsURL, sent, nil
+}
+
+// checkRelayInfo はNIP-11のlimitationを見て，購読可能なリレーかを判定する。
+// NIP-11を提供していないリレーは制限なしとみなす。
+func (m *NostrProvider) checkRelayInfo() error {
+	info, err := nodeinfo.GetRelayInfo(m.URL)
+	if err != nil {
+		logger.Debugf("Relay info (NIP-11) not available for %s: %v", m.URL, err)
+		m.relayInfo = nil
+		return nil
+	}
+	m.relayInfo = info
+	logger.Debugf("Relay info for %s: supported_nips=%v limitation=%+v", m.URL, info.SupportedNIPs, info.Limitation)
+
+	if info.Limitation.PaymentRequired {
+		return fmt.Errorf("relay requires payment (NIP-11): %s", m.URL)
+	}
+	if info.Limitation.AuthRequired && m.Signer == nil {
+		return fmt.Errorf("relay requires authentication (NIP-11) but no key is configured: %s", m.URL)
+	}
+	return nil
+}
+
+// buildFilter は購読に使うフィルタを作成する。
+// リレーがmax_limitを公表している場合はそれを超えないようにする。
+func (m *NostrProvider) buildFilter() string {
+	if m.relayInfo != nil && m.relayInfo.Limitation.MaxLimit > 0 {
+		return fmt.Sprintf(`{ "limit": %d }`, m.relayInfo.Limitation.MaxLimit)
+	}
+	return `{ }`
+}
+
 // チャンネルに接続
 func (m *NostrProvider) ConnectChannel() ([]byte, error) {
 	id, err := uuid.NewRandom()
@@ -45,72 +127,261 @@ func (m *NostrProvider) ConnectChannel() ([]byte, error) {
 		return nil, err
 	}
 	m.subscriptionID = id.String()
+	// リレーがサブスクリプションIDの長さを制限している場合は切り詰める
+	if m.relayInfo != nil {
+		if max := m.relayInfo.Limitation.MaxSubidLength; max > 0 && len(m.subscriptionID) > max {
+			m.subscriptionID = m.subscriptionID[:max]
+		}
+	}
+
+	msg, err := m.sendREQ()
+	if err != nil {
+		return msg, err
+	}
 
+	logger.Info("Connected to Timeline.")
+	return msg, nil
+}
+
+// sendREQ は現在のサブスクリプションIDでREQを送信する
+func (m *NostrProvider) sendREQ() ([]byte, error) {
 	msg := `[
 		"REQ",
 		"` + m.subscriptionID + `",
-		{ }
+		` + m.buildFilter() + `
 	]`
 	logger.Debug("Send message: ", msg)
 
 	if err := websocket.Message.Send(m.ws, msg); err != nil {
 		return []byte(msg), err
 	}
-
-	logger.Info("Connected to Timeline.")
 	return []byte(msg), nil
 }
 
+// handleAuth はNIP-42のAUTHチャレンジに署名済みの kind 22242 イベントで応答する
+func (m *NostrProvider) handleAuth(challenge string) error {
+	if m.Signer == nil {
+		logger.Debugf("Ignored AUTH challenge from %s (no key configured)", m.URL)
+		return nil
+	}
+	// NIP-11 で対応NIPを公表しているのに42を含まないリレーには応答しない
+	if m.relayInfo != nil && len(m.relayInfo.SupportedNIPs) > 0 && !m.relayInfo.SupportsNIP(42) {
+		logger.Debugf("Ignored AUTH challenge from %s (NIP-42 not in supported_nips)", m.URL)
+		return nil
+	}
+	event, err := m.Signer.NewAuthEvent(m.wsURL, challenge)
+	if err != nil {
+		return err
+	}
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	msg := `["AUTH",` + string(eventJSON) + `]`
+	logger.Debug("Send message: ", msg)
+
+	if err := websocket.Message.Send(m.ws, msg); err != nil {
+		return err
+	}
+	m.authEventID = event.ID
+	logger.Infof("Sent AUTH response to %s", m.URL)
+	return nil
+}
+
 // メッセージを受信
 func (m *NostrProvider) ReceiveMessages(output chan<- models.DownloadItem, message chan<- models.RawMessage) error {
+	return m.Receive(context.Background(), output, message)
+}
+
+// Receive は接続が切れるか ctx がキャンセルされるまでメッセージを受信する
+func (m *NostrProvider) Receive(ctx context.Context, output chan<- models.DownloadItem, message chan<- models.RawMessage) error {
 	logger.Info("NostrProvider: Starting to receive messages")
+	guard := providers.GuardRead(ctx, m.ws, providers.DefaultReadTimeout)
+	defer guard.Release()
 
 	afterEOSE := false
 	for {
 		var rawMsg string
-		if err := websocket.Message.Receive(m.ws, &rawMsg); err != nil {
-			logger.Errorf("NostrProvider: Receive error: %v", err)
+		if err := guard.Receive(&rawMsg); err != nil {
+			if ctx.Err() == nil {
+				logger.Errorf("NostrProvider: Receive error: %v", err)
+			}
 			return err
 		}
 		logger.Debug("Received message: ", rawMsg)
 
 
 		msg, _ := unmarshalJSON([]byte(rawMsg))
-		if (msg.Type == "EVENT" && afterEOSE) {
+		if (msg.Type == "EVENT" && afterEOSE && msg.Event != nil) {
 			logger.Debug("Parsed message: ", msg.Event.CreatedAt)
 
-			message <- models.RawMessage{
+			// 他のリレーで既に保存済みのイベントは，観測記録だけを残す。
+			// IDや署名を検証できないイベントは，本物のイベントを重複として捨てさせないよう重複排除に使わない
+			dedup := m.Dedup != nil && VerifyEvent(msg.Event)
+			if m.Dedup != nil && !dedup {
+				logger.Warnf("Event ID or signature is invalid, skipped dedup: %s from %s", msg.Event.ID, m.URL)
+			}
+			if dedup && !m.Dedup.Mark(msg.Event.ID) {
+				m.sendSighting(msg, message)
+				continue
+			}
+
+			raw := models.RawMessage{
 				Data:	[]byte(rawMsg),
 				CreatedAt: time.Unix(msg.Event.CreatedAt,0),
 				ReceivedAt: time.Now(),	
 				DataType: "json",
 				Metadata: nil,
 			}
+			if dedup {
+				// イベント本体がファイルに書き出されてから，保存済みとして永続化する。書き出せなければ記録を取り消す
+				deduper, id := m.Dedup, msg.Event.ID
+				raw.Saved = func() { deduper.Persist(id) }
+				raw.Failed = func() { deduper.Unmark(id) }
+			}
+			if post, ok := normalizeEvent(msg.Event, m.URL); ok {
+				raw.Posts = []models.Post{post}
+			}
+			message <- raw
+
+			// 置き換え可能イベント・削除リクエストの追跡記録
+			m.sendEventRecords(msg.Event, message)
 			
-			// URL抽出→キューイング
-			// リレーのwssはダウンロードできないので除外
-			// TODO: メディア以外のURL(wss, html etc.)が多くを占めているが，それらは除外してもよいのでは。
-			rxStrict := xurls.Strict()
-			foundURLs := rxStrict.FindAllString(rawMsg, -1)
-			for _, url := range foundURLs {
+			// メディア抽出→キューイング
+			// imeta / NIP-94 / プロフィール画像 / 本文中のメディアURLのみを対象にする
+			for _, media := range extractMedia(msg.Event) {
 				select {
 				case output <- models.DownloadItem {
-					URL:      url,
+					URL:      media.URL,
 					Datetime: time.Unix(msg.Event.CreatedAt, 0),
+					SHA256:   media.SHA256,
+					CheckContentType: media.CheckContentType,
 				}:
 				default:
-					logger.Warn("Skipped enqueue media. Media download queue is full.: ", url)
+					logger.Warn("Skipped enqueue media. Media download queue is full.: ", media.URL)
 				}
 			}
 
 		}else if(msg.Type == "EOSE"){
 			logger.Info("Received End of Stored Events. The real-time stream is being acquired.")
 			afterEOSE = true
+
+		}else if(msg.Type == "AUTH"){
+			if err := m.handleAuth(msg.Challenge); err != nil {
+				return fmt.Errorf("failed to respond to AUTH: %w", err)
+			}
+
+		}else if(msg.Type == "OK" && msg.EventID != "" && msg.EventID == m.authEventID){
+			if !msg.Accepted {
+				return fmt.Errorf("AUTH rejected by relay: %s", msg.Message)
+			}
+			logger.Infof("Authenticated to %s", m.URL)
+			m.authenticated = true
+			// 認証待ちで閉じられていた購読をやり直す
+			if m.reqPending {
+				m.reqPending = false
+				afterEOSE = false
+				if _, err := m.sendREQ(); err != nil {
+					return err
+				}
+			}
+
+		}else if(msg.Type == "CLOSED" && msg.SubscriptionID == m.subscriptionID){
+			if !strings.HasPrefix(msg.Message, "auth-required:") {
+				return fmt.Errorf("subscription closed by relay: %s", msg.Message)
+			}
+			if m.Signer == nil {
+				return fmt.Errorf("relay requires authentication but no key is configured: %s", msg.Message)
+			}
+			if m.authenticated {
+				// 認証完了とCLOSEDが行き違った場合に備えて一度だけ再送する
+				if m.authRetried {
+					return fmt.Errorf("subscription closed even after authentication: %s", msg.Message)
+				}
+				m.authRetried = true
+				afterEOSE = false
+				if _, err := m.sendREQ(); err != nil {
+					return err
+				}
+				continue
+			}
+			// AUTHチャレンジへの応答が受理された時点でREQを再送する
+			m.reqPending = true
+
+		}else if(msg.Type == "NOTICE"){
+			logger.Infof("NOTICE from %s: %s", m.URL, msg.Message)
 		}
 	}
 }
 
+// sendSighting は重複イベントの「リレーXで時刻Tに観測」記録をキューに送信する
+func (m *NostrProvider) sendSighting(msg NostrMessage, message chan<- models.RawMessage) {
+	now := time.Now()
+	sighting, err := json.Marshal(Sighting{
+		EventID:        msg.Event.ID,
+		Relay:          m.URL,
+		SubscriptionID: msg.SubscriptionID,
+		SeenAt:         now.Format(time.RFC3339),
+	})
+	if err != nil {
+		logger.Errorf("Failed to marshal sighting: %v", err)
+		return
+	}
+	logger.Debug("Duplicate event, recorded sighting: ", msg.Event.ID)
+
+	message <- models.RawMessage{
+		Data:       sighting,
+		CreatedAt:  time.Unix(msg.Event.CreatedAt, 0),
+		ReceivedAt: now,
+		DataType:   "json",
+		Metadata: map[string]string{
+			"stream": StreamSightings,
+		},
+	}
+}
+
+// sendEventRecords は置き換え可能イベントのバージョン記録と，削除リクエストの記録をキューに送信する。
+// 記録には署名が残らないため，検証できないイベント (偽造された削除リクエスト等) は記録しない
+func (m *NostrProvider) sendEventRecords(event *NostrEvent, message chan<- models.RawMessage) {
+	if (event.Kind == KindDeletion || EventAddress(event) != "") && !VerifyEvent(event) {
+		logger.Warnf("Event ID or signature is invalid, skipped records of kind %d: %s from %s", event.Kind, event.ID, m.URL)
+		return
+	}
+	var record interface{}
+	var stream string
+	switch {
+	case event.Kind == KindDeletion:
+		record = NewDeletionRequest(event, m.URL)
+		stream = StreamDeletions
+	case m.Index != nil && EventAddress(event) != "":
+		record = m.Index.Update(event, m.URL)
+		stream = StreamReplaceable
+	default:
+		return
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		logger.Errorf("Failed to marshal %s record: %v", stream, err)
+		return
+	}
+	message <- models.RawMessage{
+		Data:       data,
+		CreatedAt:  time.Unix(event.CreatedAt, 0),
+		ReceivedAt: time.Now(),
+		DataType:   "json",
+		Metadata: map[string]string{
+			"stream": stream,
+		},
+	}
+}
+
 func (m *NostrProvider) CrawlNewServer(server chan <- models.Server) error {
+	return m.Discover(context.Background(), server)
+}
+
+// Discover は新規サーバーを探索する (未実装のためすぐに戻る)
+func (m *NostrProvider) Discover(ctx context.Context, server chan<- models.Server) error {
 	logger.Info("NostrProvider: Starting to crawl new servers")
 	return nil
 	// for {
@@ -119,25 +390,34 @@ func (m *NostrProvider) CrawlNewServer(server chan <- models.Server) error {
 }
 
 
-// WebSocket接続を閉じる
+// WebSocket接続を閉じ，Providerを破棄する
 func (m *NostrProvider) Close() error {
-	
-	msg := `[
+	m.closed = true
+	return m.CloseStream()
+}
+
+// CloseStream は購読を終了して WebSocket 接続を閉じる。再度 Open できる
+func (m *NostrProvider) CloseStream() error {
+	// 未接続・接続失敗時は送信先がない
+	if m.ws == nil {
+		return nil
+	}
+
+	// 購読中であればCLOSEを送る (切断済みで送れなくても接続は閉じる)
+	if m.subscriptionID != "" {
+		msg := `[
 		"CLOSE",
 		"` + m.subscriptionID + `"
 	]`
-
-	if err := websocket.Message.Send(m.ws, msg); err != nil {
-		return err
+		if err := websocket.Message.Send(m.ws, msg); err != nil {
+			logger.Debug("Failed to send CLOSE: ", err)
+		} else {
+			logger.Debug("Send message: ", msg)
+		}
+		logger.Info("Closed connection to Timeline (" + m.subscriptionID + ").")
 	}
-	logger.Debug("Send message: ", msg)
-	logger.Info("Closed connection to Timeline (" + m.subscriptionID + ").")
 
-
-	if m.ws != nil {
-		return m.ws.Close()
-	}
-	return nil
+	return m.ws.Close()
 }
 
 
@@ -215,7 +495,38 @@ func unmarshalJSON(data []byte) (NostrMessage, error) {
 		}
 	case "OK":
 		// OK messages: ["OK", "event_id", true/false, "message"]
-		// Handle as needed
+		if len(raw) >= 3 {
+			if err := json.Unmarshal(raw[1], &NostrMessage.EventID); err != nil {
+				return NostrMessage, err
+			}
+			if err := json.Unmarshal(raw[2], &NostrMessage.Accepted); err != nil {
+				return NostrMessage, err
+			}
+		}
+		if len(raw) >= 4 {
+			if err := json.Unmarshal(raw[3], &NostrMessage.Message); err != nil {
+				return NostrMessage, err
+			}
+		}
+	case "CLOSED":
+		// CLOSED messages: ["CLOSED", "subscription_id", "message"]
+		if len(raw) >= 2 {
+			if err := json.Unmarshal(raw[1], &NostrMessage.SubscriptionID); err != nil {
+				return NostrMessage, err
+			}
+		}
+		if len(raw) >= 3 {
+			if err := json.Unmarshal(raw[2], &NostrMessage.Message); err != nil {
+				return NostrMessage, err
+			}
+		}
+	case "AUTH":
+		// AUTH messages: ["AUTH", "challenge"]
+		if len(raw) >= 2 {
+			if err := json.Unmarshal(raw[1], &NostrMessage.Challenge); err != nil {
+				return NostrMessage, err
+			}
+		}
 	}
 
 	return NostrMessage, nil
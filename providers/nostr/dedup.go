@@ -0,0 +1,208 @@
+package nostr
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+)
+
+// EventDeduper は全リレーで共有されるイベントIDの重複排除テーブル。
+// 直近 capacity 件のIDだけを保持し（リングバッファで古いものから忘れる），
+// ファイルに追記することで再起動後も状態を引き継ぐ。
+type EventDeduper struct {
+	mu       sync.Mutex
+	capacity int
+	seen     map[string]int // ID → ring の位置
+	ring     []string
+	next     int
+
+	path  string
+	file  *os.File
+	lines int // 永続化ファイルの行数（コンパクション判定用）
+}
+
+var (
+	// DefaultDeduper は全 NostrProvider が共有するデフォルトのテーブル
+	DefaultDeduper = NewEventDeduper(500000)
+)
+
+// 新しい EventDeduper を作成
+func NewEventDeduper(capacity int) *EventDeduper {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &EventDeduper{
+		capacity: capacity,
+		seen:     make(map[string]int, capacity),
+		ring:     make([]string, capacity),
+	}
+}
+
+// Open は永続化ファイルから既知のIDを読み込み，以降の追記先として設定する。
+// ファイルが存在しない場合は最初の追記時に作成される。
+func (d *EventDeduper) Open(path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.path = path
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open dedup file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		id := scanner.Text()
+		if id == "" {
+			continue
+		}
+		d.add(id)
+		d.lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read dedup file: %w", err)
+	}
+	logger.Infof("Loaded %d known Nostr event IDs from %s", len(d.seen), path)
+	return nil
+}
+
+// Mark はイベントIDを記録し，初めて見たIDであれば true を返す。
+// ファイルには書き込まない (イベント本体を保存した後に Persist で書き込む)
+func (d *EventDeduper) Mark(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.seen[id]; exists {
+		return false
+	}
+	d.add(id)
+	return true
+}
+
+// Unmark は Mark したIDを忘れる。イベント本体を保存できなかった場合に呼び，
+// 他のリレーから届いた同じイベントを改めて保存できるようにする
+func (d *EventDeduper) Unmark(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if i, exists := d.seen[id]; exists {
+		d.ring[i] = ""
+		delete(d.seen, id)
+	}
+}
+
+// Persist はIDをファイルに追記する。イベント本体がファイルに書き出された後に呼ぶ
+// (先に書き込むと，異常終了時に保存されていないイベントを保存済みとみなしてしまう)
+func (d *EventDeduper) Persist(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.persist(id)
+}
+
+// Size は保持しているIDの数を返す
+func (d *EventDeduper) Size() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.seen)
+}
+
+// Close は永続化ファイルを閉じる
+func (d *EventDeduper) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// add はリングバッファにIDを追加し，溢れた古いIDを忘れる（ロック取得済みであること）
+func (d *EventDeduper) add(id string) {
+	if _, exists := d.seen[id]; exists {
+		return
+	}
+	if old := d.ring[d.next]; old != "" {
+		delete(d.seen, old)
+	}
+	d.ring[d.next] = id
+	d.seen[id] = d.next
+	d.next = (d.next + 1) % d.capacity
+}
+
+// persist はIDをファイルに追記する（ロック取得済みであること）
+func (d *EventDeduper) persist(id string) {
+	if d.path == "" {
+		return
+	}
+	if d.file == nil {
+		if err := os.MkdirAll(filepath.Dir(d.path), 0755); err != nil {
+			logger.Errorf("Failed to create directory: %v", err)
+			return
+		}
+		file, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logger.Errorf("Failed to open dedup file: %v", err)
+			return
+		}
+		d.file = file
+	}
+	if _, err := d.file.WriteString(id + "\n"); err != nil {
+		logger.Errorf("Failed to write dedup file: %v", err)
+		return
+	}
+	d.lines++
+
+	// 忘れたIDでファイルが肥大化しないよう，保持数の2倍を超えたら書き直す
+	if d.lines > 2*d.capacity {
+		if err := d.compact(); err != nil {
+			logger.Errorf("Failed to compact dedup file: %v", err)
+		}
+	}
+}
+
+// compact は現在保持しているIDだけでファイルを書き直す（ロック取得済みであること）
+func (d *EventDeduper) compact() error {
+	tmpPath := d.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	count := 0
+	// 古い順に書き出す
+	for i := 0; i < d.capacity; i++ {
+		id := d.ring[(d.next+i)%d.capacity]
+		if id == "" {
+			continue
+		}
+		w.WriteString(id + "\n")
+		count++
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if d.file != nil {
+		d.file.Close()
+		d.file = nil
+	}
+	if err := os.Rename(tmpPath, d.path); err != nil {
+		return err
+	}
+	d.lines = count
+	return nil
+}
@@ -0,0 +1,69 @@
+package nostr
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEventDeduper(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nostr", "dedup.txt")
+
+	d := NewEventDeduper(2)
+	if err := d.Open(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1. 初めてのIDだけ true
+	if !d.Mark("a") || d.Mark("a") {
+		t.Fatal("Mark(a) should be true only the first time")
+	}
+
+	// 2. 容量を超えると古いIDから忘れる
+	d.Mark("b")
+	d.Mark("c")
+	if !d.Mark("a") {
+		t.Error("evicted ID a was still remembered")
+	}
+
+	// 3. 保存できなかったイベントのIDは記録を取り消す
+	d.Unmark("c")
+	if !d.Mark("c") {
+		t.Error("unmarked ID c was still remembered")
+	}
+	if d.Mark("a") {
+		t.Error("Unmark(c) forgot ID a")
+	}
+
+	// 4. 保存できたイベントのIDだけを書き込む
+	d.Persist("c")
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := NewEventDeduper(2)
+	if err := reopened.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Mark("c") {
+		t.Error("persisted ID c was not restored")
+	}
+	if !reopened.Mark("b") {
+		t.Error("ID b was restored although it was never persisted")
+	}
+
+	// 5. 保持数の2倍を超えたら保持しているIDだけで書き直す
+	for _, id := range []string{"d", "e", "f", "g"} {
+		reopened.Mark(id)
+		reopened.Persist(id)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(strings.Fields(string(data)), ","); got != "f,g" {
+		t.Errorf("compacted file = %s, want f,g", got)
+	}
+}
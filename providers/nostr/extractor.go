@@ -0,0 +1,185 @@
+package nostr
+
+import (
+	"encoding/json"
+	"net/url"
+	"path"
+	"strings"
+
+	"mvdan.cc/xurls/v2"
+)
+
+// NIP-94 ファイルメタデータイベントの kind
+const KindFileMetadata = 1063
+
+// 本文中のURLをメディアとみなす拡張子
+var mediaExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".avif": true, ".svg": true, ".bmp": true, ".heic": true,
+	".mp4": true, ".webm": true, ".mov": true, ".m4v": true,
+	".mp3": true, ".ogg": true, ".wav": true, ".m4a": true, ".flac": true,
+}
+
+// 本文中のURLで，明らかにメディアではない拡張子
+var pageExtensions = map[string]bool{
+	".html": true, ".htm": true, ".php": true, ".asp": true, ".aspx": true,
+	".jsp": true, ".json": true, ".xml": true, ".txt": true, ".pdf": true,
+}
+
+// イベントから抽出したメディア
+type MediaRef struct {
+	URL              string
+	MimeType         string // 分かっている場合のみ (imeta の m など)
+	SHA256           string // 分かっている場合のみ (imeta / NIP-94 の x)
+	CheckContentType bool   // 拡張子で判定できないため，取得前にContent-Typeを確認する
+}
+
+// イベントからメディアを抽出する
+func extractMedia(event *NostrEvent) []MediaRef {
+	var refs []MediaRef
+	refs = append(refs, extractIMeta(event.Tags)...)
+
+	switch event.Kind {
+	case KindFileMetadata:
+		refs = append(refs, extractFileMetadata(event.Tags)...)
+	case 0:
+		refs = append(refs, extractProfile(event.Content)...)
+	}
+
+	refs = append(refs, extractContentURLs(event.Content, refs)...)
+	return dedupMediaRefs(refs)
+}
+
+// NIP-92 imeta タグ: ["imeta", "url https://...", "m image/jpeg", "x <sha256>", ...]
+func extractIMeta(tags [][]string) []MediaRef {
+	var refs []MediaRef
+	for _, tag := range tags {
+		if len(tag) < 2 || tag[0] != "imeta" {
+			continue
+		}
+		fields := map[string]string{}
+		var fallbacks []string
+		for _, entry := range tag[1:] {
+			key, value, ok := strings.Cut(entry, " ")
+			if !ok {
+				continue
+			}
+			if key == "fallback" {
+				fallbacks = append(fallbacks, value)
+				continue
+			}
+			if _, exists := fields[key]; !exists {
+				fields[key] = value
+			}
+		}
+		if isHTTPURL(fields["url"]) {
+			refs = append(refs, MediaRef{
+				URL:      fields["url"],
+				MimeType: fields["m"],
+				SHA256:   strings.ToLower(fields["x"]),
+			})
+		}
+		for _, u := range append([]string{fields["thumb"], fields["image"]}, fallbacks...) {
+			if isHTTPURL(u) {
+				refs = append(refs, MediaRef{URL: u})
+			}
+		}
+	}
+	return refs
+}
+
+// NIP-94 kind 1063: ["url", ...], ["m", ...], ["x", ...], ["thumb", ...], ["image", ...]
+func extractFileMetadata(tags [][]string) []MediaRef {
+	var file MediaRef
+	var extra []MediaRef
+	for _, tag := range tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "url":
+			file.URL = tag[1]
+		case "m":
+			file.MimeType = tag[1]
+		case "x":
+			file.SHA256 = strings.ToLower(tag[1])
+		case "thumb", "image", "fallback":
+			if isHTTPURL(tag[1]) {
+				extra = append(extra, MediaRef{URL: tag[1]})
+			}
+		}
+	}
+	if !isHTTPURL(file.URL) {
+		return extra
+	}
+	return append([]MediaRef{file}, extra...)
+}
+
+// kind 0 (プロフィール) の content にある picture / banner
+func extractProfile(content string) []MediaRef {
+	var profile struct {
+		Picture string `json:"picture"`
+		Banner  string `json:"banner"`
+	}
+	if err := json.Unmarshal([]byte(content), &profile); err != nil {
+		return nil
+	}
+	var refs []MediaRef
+	for _, u := range []string{profile.Picture, profile.Banner} {
+		if isHTTPURL(u) {
+			refs = append(refs, MediaRef{URL: u})
+		}
+	}
+	return refs
+}
+
+// 本文中のURLのうち，メディアと思われるものを抽出する。
+// 拡張子がメディアのものはそのまま，拡張子で判断できないものはContent-Typeの確認を要求する。
+func extractContentURLs(content string, known []MediaRef) []MediaRef {
+	seen := make(map[string]bool, len(known))
+	for _, ref := range known {
+		seen[ref.URL] = true
+	}
+
+	var refs []MediaRef
+	for _, u := range xurls.Strict().FindAllString(content, -1) {
+		if seen[u] || !isHTTPURL(u) {
+			continue
+		}
+		seen[u] = true
+
+		parsed, err := url.Parse(u)
+		if err != nil {
+			continue
+		}
+		ext := strings.ToLower(path.Ext(parsed.Path))
+		switch {
+		case mediaExtensions[ext]:
+			refs = append(refs, MediaRef{URL: u})
+		case pageExtensions[ext], parsed.Path == "", parsed.Path == "/":
+			continue
+		default:
+			refs = append(refs, MediaRef{URL: u, CheckContentType: true})
+		}
+	}
+	return refs
+}
+
+// 同じURLが複数回出てきた場合は，情報の多い最初のものを残す
+func dedupMediaRefs(refs []MediaRef) []MediaRef {
+	seen := make(map[string]bool, len(refs))
+	var result []MediaRef
+	for _, ref := range refs {
+		if seen[ref.URL] {
+			continue
+		}
+		seen[ref.URL] = true
+		result = append(result, ref)
+	}
+	return result
+}
+
+// リレーのwss等はダウンロードできないので除外する
+func isHTTPURL(u string) bool {
+	return strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://")
+}
@@ -0,0 +1,65 @@
+package nostr
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// formatRefs は比較しやすいよう MediaRef を1行ずつの文字列にする
+func formatRefs(refs []MediaRef) string {
+	var lines []string
+	for _, ref := range refs {
+		lines = append(lines, fmt.Sprintf("%s m=%s x=%s check=%v", ref.URL, ref.MimeType, ref.SHA256, ref.CheckContentType))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestExtractMedia(t *testing.T) {
+	tests := []struct {
+		name  string
+		event *NostrEvent
+		want  []string
+	}{
+		{
+			name: "imeta",
+			event: &NostrEvent{Kind: 1, Content: "look https://cdn.example/a.jpg", Tags: [][]string{
+				{"imeta", "url https://cdn.example/a.jpg", "m image/jpeg", "x ABCD", "thumb https://cdn.example/a_thumb.jpg", "fallback https://mirror.example/a.jpg"},
+				{"imeta", "url wss://relay.example"}, // ダウンロードできないURL
+			}},
+			want: []string{
+				"https://cdn.example/a.jpg m=image/jpeg x=abcd check=false",
+				"https://cdn.example/a_thumb.jpg m= x= check=false",
+				"https://mirror.example/a.jpg m= x= check=false",
+			},
+		},
+		{
+			name: "kind 1063",
+			event: &NostrEvent{Kind: KindFileMetadata, Tags: [][]string{
+				{"url", "https://files.example/v.mp4"}, {"m", "video/mp4"}, {"x", "EF01"}, {"image", "https://files.example/v.jpg"},
+			}},
+			want: []string{
+				"https://files.example/v.mp4 m=video/mp4 x=ef01 check=false",
+				"https://files.example/v.jpg m= x= check=false",
+			},
+		},
+		{
+			name:  "kind 0",
+			event: &NostrEvent{Kind: 0, Content: `{"name":"alice","picture":"https://img.example/p.png","banner":"data:image/png;base64,AA"}`},
+			want:  []string{"https://img.example/p.png m= x= check=false"},
+		},
+		{
+			name:  "content URLs",
+			event: &NostrEvent{Kind: 1, Content: "https://img.example/b.webp https://example.com/ https://example.com/post.html https://media.example/file?id=1 https://img.example/b.webp"},
+			want: []string{
+				"https://img.example/b.webp m= x= check=false",
+				"https://media.example/file?id=1 m= x= check=true", // 拡張子で判断できない
+			},
+		},
+	}
+	for _, test := range tests {
+		if got, want := formatRefs(extractMedia(test.event)), strings.Join(test.want, "\n"); got != want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", test.name, got, want)
+		}
+	}
+}
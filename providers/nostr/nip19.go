@@ -0,0 +1,94 @@
+package nostr
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+/*
+[NIP-19]
+イベントID・公開鍵を bech32 (note1..., npub1...) で表す。
+正規化した投稿のURI (nostr:note1...) に使う。
+*/
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// encodeNote はイベントID (hex) を note1... にする
+func encodeNote(idHex string) string {
+	return encodeBech32Hex("note", idHex)
+}
+
+// encodeNpub は公開鍵 (hex) を npub1... にする
+func encodeNpub(pubKeyHex string) string {
+	return encodeBech32Hex("npub", pubKeyHex)
+}
+
+func encodeBech32Hex(hrp, hexStr string) string {
+	data, err := hex.DecodeString(hexStr)
+	if err != nil || len(data) != 32 {
+		return ""
+	}
+	values := convertBits(data)
+	checksum := bech32Checksum(hrp, values)
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, v := range append(values, checksum...) {
+		sb.WriteByte(bech32Charset[v])
+	}
+	return sb.String()
+}
+
+// convertBits は8ビット列を5ビット列に変換する (余りは0で埋める)
+func convertBits(data []byte) []byte {
+	var out []byte
+	acc, bits := 0, 0
+	for _, b := range data {
+		acc = acc<<8 | int(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out = append(out, byte(acc>>bits&31))
+		}
+	}
+	if bits > 0 {
+		out = append(out, byte(acc<<(5-bits)&31))
+	}
+	return out
+}
+
+func bech32Checksum(hrp string, values []byte) []byte {
+	var expanded []byte
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	expanded = append(expanded, values...)
+	expanded = append(expanded, 0, 0, 0, 0, 0, 0)
+
+	mod := bech32Polymod(expanded) ^ 1
+	checksum := make([]byte, 6)
+	for i := range checksum {
+		checksum[i] = byte(mod >> uint(5*(5-i)) & 31)
+	}
+	return checksum
+}
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
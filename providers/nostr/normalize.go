@@ -0,0 +1,124 @@
+package nostr
+
+import (
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+// 正規化の対象にするイベントの kind
+const (
+	KindTextNote        = 1
+	KindRepost          = 6
+	KindGenericRepost   = 16
+	KindLongFormArticle = 30023
+)
+
+// normalizeEvent はイベントを正規化した投稿に変換する。投稿でないイベントは false を返す
+func normalizeEvent(event *NostrEvent, relay string) (models.Post, bool) {
+	switch event.Kind {
+	case KindTextNote, KindRepost, KindGenericRepost, KindLongFormArticle:
+	default:
+		return models.Post{}, false
+	}
+
+	post := models.Post{
+		ID:         event.ID,
+		URI:        "nostr:" + encodeNote(event.ID),
+		Platform:   "nostr",
+		Server:     relay,
+		CreatedAt:  time.Unix(event.CreatedAt, 0).UTC(),
+		Text:       event.Content,
+		Visibility: models.VisibilityPublic,
+		Author: models.PostAuthor{
+			ID:  event.PubKey,
+			URI: "nostr:" + encodeNpub(event.PubKey),
+		},
+	}
+
+	var replyRoot, replyMarked, replyLast string
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "e":
+			// NIP-10: マーカー付きなら reply (なければ root)，マーカーなしなら最後の e タグが返信先
+			marker := ""
+			if len(tag) >= 4 {
+				marker = tag[3]
+			}
+			switch marker {
+			case "reply":
+				replyMarked = tag[1]
+			case "root":
+				replyRoot = tag[1]
+			case "mention":
+			default:
+				replyLast = tag[1]
+			}
+		case "q":
+			post.QuoteOf = eventRef(tag[1])
+		case "p":
+			post.Mentions = append(post.Mentions, tag[1])
+		case "t":
+			post.Tags = append(post.Tags, tag[1])
+		case "l":
+			// NIP-32: ["l", "ja", "ISO-639-1"]
+			if len(tag) >= 3 && tag[2] == "ISO-639-1" {
+				post.Language = tag[1]
+			}
+		case "content-warning":
+			post.Sensitive = true
+			post.Summary = tag[1]
+		case "title":
+			post.Summary = tag[1]
+		}
+	}
+
+	for _, media := range extractMedia(event) {
+		if media.CheckContentType {
+			continue // メディアか分からない本文中のURL
+		}
+		post.Media = append(post.Media, models.PostMedia{
+			URL:    media.URL,
+			Type:   media.MimeType,
+			SHA256: media.SHA256,
+		})
+	}
+
+	if event.Kind == KindRepost || event.Kind == KindGenericRepost {
+		// リポストの content は元イベントのJSON (または空) なので本文として扱わない
+		post.Text = ""
+		post.Media = nil
+		target := replyMarked
+		if target == "" {
+			target = replyLast
+		}
+		if target == "" {
+			target = replyRoot
+		}
+		if target != "" {
+			post.BoostOf = eventRef(target)
+		}
+		return post, true
+	}
+
+	switch {
+	case replyMarked != "":
+		post.ReplyTo = eventRef(replyMarked)
+	case replyRoot != "":
+		post.ReplyTo = eventRef(replyRoot)
+	case replyLast != "":
+		post.ReplyTo = eventRef(replyLast)
+	}
+	return post, true
+}
+
+func eventRef(id string) *models.PostRef {
+	ref := &models.PostRef{ID: id}
+	if note := encodeNote(id); note != "" {
+		ref.URI = "nostr:" + note
+	}
+	return ref
+}
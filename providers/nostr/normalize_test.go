@@ -0,0 +1,56 @@
+package nostr
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+func TestNormalizeEvent(t *testing.T) {
+	id := strings.Repeat("a", 64)
+	root, parent := strings.Repeat("b", 64), strings.Repeat("c", 64)
+
+	// 1. テキストノート: NIP-10 のマーカー付き返信，言語，CW，メディア
+	post, ok := normalizeEvent(&NostrEvent{
+		ID: id, PubKey: strings.Repeat("d", 64), CreatedAt: 1767225600, Kind: KindTextNote,
+		Content: "hello https://cdn.example/a.png https://example.com/page",
+		Tags: [][]string{
+			{"e", root, "", "root"}, {"e", parent, "", "reply"},
+			{"p", "pk"}, {"t", "go"}, {"l", "ja", "ISO-639-1"}, {"content-warning", "spoiler"},
+		},
+	}, "wss://relay.example")
+	if !ok {
+		t.Fatal("text note was not normalized")
+	}
+	if post.URI != "nostr:"+encodeNote(id) || post.Server != "wss://relay.example" || post.Visibility != models.VisibilityPublic {
+		t.Errorf("post = %+v", post)
+	}
+	if post.ReplyTo == nil || post.ReplyTo.ID != parent {
+		t.Errorf("reply = %+v, want the reply marker", post.ReplyTo)
+	}
+	if post.Language != "ja" || post.Summary != "spoiler" || !post.Sensitive || post.Tags[0] != "go" || post.Mentions[0] != "pk" {
+		t.Errorf("tags = %+v", post)
+	}
+	// Content-Typeを確認しないと分からないURLはメディアにしない
+	if len(post.Media) != 1 || post.Media[0].URL != "https://cdn.example/a.png" {
+		t.Errorf("media = %+v", post.Media)
+	}
+
+	// 2. マーカーのない返信は最後の e タグが返信先
+	post, _ = normalizeEvent(&NostrEvent{ID: id, Kind: KindTextNote, Tags: [][]string{{"e", root}, {"e", parent}}}, "")
+	if post.ReplyTo == nil || post.ReplyTo.ID != parent {
+		t.Errorf("unmarked reply = %+v", post.ReplyTo)
+	}
+
+	// 3. リポストは本文を持たず，元のイベントへの参照になる
+	post, _ = normalizeEvent(&NostrEvent{ID: id, Kind: KindRepost, Content: `{"id":"x"}`, Tags: [][]string{{"e", parent}}}, "")
+	if post.Text != "" || post.BoostOf == nil || post.BoostOf.ID != parent || post.ReplyTo != nil {
+		t.Errorf("repost = %+v", post)
+	}
+
+	// 4. 投稿でないイベントは正規化しない
+	if _, ok := normalizeEvent(&NostrEvent{ID: id, Kind: 7}, ""); ok {
+		t.Error("reaction was normalized")
+	}
+}
@@ -0,0 +1,35 @@
+package nostr
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
+)
+
+func init() {
+	// リレーはタイムラインの区別がない
+	providers.Register("nostr", func(target models.Target) providers.PlatformProvider {
+		return NewNostrProvider(target.Server.URL)
+	}, providers.Capabilities{
+		Backfill: false,
+		DataType: "json",
+	})
+	providers.RegisterSetup(setup)
+}
+
+// setup はリレー横断の重複排除テーブルと置換可能イベントの索引を前回の状態から復元する
+func setup(downloadDir string) error {
+	var errs []error
+	dedupPath := filepath.Join(downloadDir, "nostr", "seen_event_ids.txt")
+	if err := DefaultDeduper.Open(dedupPath); err != nil {
+		errs = append(errs, fmt.Errorf("failed to load Nostr dedup table: %w", err))
+	}
+	indexPath := filepath.Join(downloadDir, "nostr", "replaceable_index.jsonl")
+	if err := DefaultReplaceableIndex.Open(indexPath); err != nil {
+		errs = append(errs, fmt.Errorf("failed to load Nostr replaceable index: %w", err))
+	}
+	return errors.Join(errs...)
+}
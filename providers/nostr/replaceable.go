@@ -0,0 +1,266 @@
+package nostr
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+)
+
+// NIP-09 削除リクエストの kind
+const KindDeletion = 5
+
+// 置き換え可能イベント (NIP-01: 0, 3, 10000-19999) かどうか
+func isReplaceable(kind int) bool {
+	return kind == 0 || kind == 3 || (10000 <= kind && kind < 20000)
+}
+
+// パラメータ付き置き換え可能イベント (NIP-01: 30000-39999) かどうか
+func isParameterizedReplaceable(kind int) bool {
+	return 30000 <= kind && kind < 40000
+}
+
+// EventAddress は置き換え可能イベントのアドレス "kind:pubkey:d-tag" を返す。
+// 置き換え可能でない場合は空文字列。
+func EventAddress(event *NostrEvent) string {
+	switch {
+	case isReplaceable(event.Kind):
+		return strconv.Itoa(event.Kind) + ":" + event.PubKey + ":"
+	case isParameterizedReplaceable(event.Kind):
+		return strconv.Itoa(event.Kind) + ":" + event.PubKey + ":" + dTag(event.Tags)
+	}
+	return ""
+}
+
+// 最初の d タグの値 (無ければ空文字列)
+func dTag(tags [][]string) string {
+	for _, tag := range tags {
+		if len(tag) >= 2 && tag[0] == "d" {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// ReplaceableIndex はアドレスごとの最新バージョンを保持する索引。
+// 全バージョンは通常のイベントとして保存され，ここでは最新がどれかだけを追跡する。
+type ReplaceableIndex struct {
+	mu     sync.Mutex
+	latest map[string]IndexEntry
+
+	path  string
+	file  *os.File
+	lines int
+}
+
+// 索引のエントリ (永続化ファイルの1行)
+type IndexEntry struct {
+	Address   string `json:"address"`
+	EventID   string `json:"event_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+var (
+	// DefaultReplaceableIndex は全 NostrProvider が共有する索引
+	DefaultReplaceableIndex = NewReplaceableIndex()
+)
+
+// 新しい ReplaceableIndex を作成
+func NewReplaceableIndex() *ReplaceableIndex {
+	return &ReplaceableIndex{
+		latest: make(map[string]IndexEntry),
+	}
+}
+
+// Open は永続化ファイルから索引を復元し，以降の追記先として設定する
+func (x *ReplaceableIndex) Open(path string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.path = path
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open replaceable index: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry IndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		x.lines++
+		if current, exists := x.latest[entry.Address]; !exists || newer(entry, current) {
+			x.latest[entry.Address] = entry
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read replaceable index: %w", err)
+	}
+	logger.Infof("Loaded %d replaceable event addresses from %s", len(x.latest), path)
+	return nil
+}
+
+// Update はイベントを索引に反映し，バージョン記録を返す
+func (x *ReplaceableIndex) Update(event *NostrEvent, relay string) ReplaceableVersion {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	entry := IndexEntry{
+		Address:   EventAddress(event),
+		EventID:   event.ID,
+		CreatedAt: event.CreatedAt,
+	}
+	version := ReplaceableVersion{
+		Address:   entry.Address,
+		Kind:      event.Kind,
+		PubKey:    event.PubKey,
+		DTag:      dTag(event.Tags),
+		EventID:   event.ID,
+		CreatedAt: event.CreatedAt,
+		Relay:     relay,
+	}
+
+	current, exists := x.latest[entry.Address]
+	switch {
+	case !exists:
+		version.IsLatest = true
+	case current.EventID == entry.EventID:
+		version.IsLatest = true
+		return version
+	case newer(entry, current):
+		version.IsLatest = true
+		version.PreviousEventID = current.EventID
+		version.PreviousCreatedAt = current.CreatedAt
+	default:
+		// 古いバージョンを後から受信した
+		version.SupersededBy = current.EventID
+		return version
+	}
+
+	x.latest[entry.Address] = entry
+	x.persist(entry)
+	return version
+}
+
+// Latest はアドレスの最新バージョンを返す
+func (x *ReplaceableIndex) Latest(address string) (IndexEntry, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entry, ok := x.latest[address]
+	return entry, ok
+}
+
+// NIP-01: created_atが新しい方，同じならIDが辞書順で小さい方を残す
+func newer(a, b IndexEntry) bool {
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt > b.CreatedAt
+	}
+	return a.EventID < b.EventID
+}
+
+// persist はエントリを追記する（ロック取得済みであること）
+func (x *ReplaceableIndex) persist(entry IndexEntry) {
+	if x.path == "" {
+		return
+	}
+	if x.file == nil {
+		if err := os.MkdirAll(filepath.Dir(x.path), 0755); err != nil {
+			logger.Errorf("Failed to create directory: %v", err)
+			return
+		}
+		file, err := os.OpenFile(x.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logger.Errorf("Failed to open replaceable index: %v", err)
+			return
+		}
+		x.file = file
+	}
+	line, _ := json.Marshal(entry)
+	if _, err := x.file.Write(append(line, '\n')); err != nil {
+		logger.Errorf("Failed to write replaceable index: %v", err)
+		return
+	}
+	x.lines++
+
+	// 古いバージョンの行が溜まったら，最新のみで書き直す
+	if x.lines > 2*len(x.latest)+1000 {
+		if err := x.compact(); err != nil {
+			logger.Errorf("Failed to compact replaceable index: %v", err)
+		}
+	}
+}
+
+// compact は最新エントリだけでファイルを書き直す（ロック取得済みであること）
+func (x *ReplaceableIndex) compact() error {
+	tmpPath := x.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, entry := range x.latest {
+		line, _ := json.Marshal(entry)
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if x.file != nil {
+		x.file.Close()
+		x.file = nil
+	}
+	if err := os.Rename(tmpPath, x.path); err != nil {
+		return err
+	}
+	x.lines = len(x.latest)
+	return nil
+}
+
+// NewDeletionRequest は kind 5 イベントから削除リクエストの記録を作成する
+func NewDeletionRequest(event *NostrEvent, relay string) DeletionRequest {
+	req := DeletionRequest{
+		DeletionEventID: event.ID,
+		PubKey:          event.PubKey,
+		CreatedAt:       event.CreatedAt,
+		Reason:          event.Content,
+		Relay:           relay,
+	}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "e":
+			req.Targets = append(req.Targets, DeletionTarget{Type: "e", EventID: tag[1]})
+		case "a":
+			target := DeletionTarget{Type: "a", Address: tag[1]}
+			// アドレスに含まれる作者と削除者が一致する場合のみ有効 (NIP-09)
+			if parts := strings.SplitN(tag[1], ":", 3); len(parts) == 3 {
+				valid := parts[1] == event.PubKey
+				target.AuthorMatch = &valid
+			}
+			req.Targets = append(req.Targets, target)
+		case "k":
+			if kind, err := strconv.Atoi(tag[1]); err == nil {
+				req.Kinds = append(req.Kinds, kind)
+			}
+		}
+	}
+	return req
+}
@@ -0,0 +1,90 @@
+package nostr
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaceableIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replaceable.jsonl")
+	article := func(id string, createdAt int64) *NostrEvent {
+		return &NostrEvent{ID: id, Kind: 30023, PubKey: "pk", CreatedAt: createdAt, Tags: [][]string{{"t", "x"}, {"d", "post"}}}
+	}
+
+	x := NewReplaceableIndex()
+	if err := x.Open(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1. 最初のバージョン
+	v := x.Update(article("a", 100), "wss://relay.example")
+	if v.Address != "30023:pk:post" || !v.IsLatest || v.PreviousEventID != "" {
+		t.Errorf("first version = %+v", v)
+	}
+
+	// 2. 新しいバージョンで置き換える
+	v = x.Update(article("b", 200), "wss://relay.example")
+	if !v.IsLatest || v.PreviousEventID != "a" || v.PreviousCreatedAt != 100 {
+		t.Errorf("newer version = %+v", v)
+	}
+
+	// 3. 古いバージョンを後から受信しても最新は変わらない
+	v = x.Update(article("c", 150), "wss://other.example")
+	if v.IsLatest || v.SupersededBy != "b" {
+		t.Errorf("late older version = %+v", v)
+	}
+
+	// 4. 再起動後も最新のバージョンを覚えている
+	restored := NewReplaceableIndex()
+	if err := restored.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if latest, ok := restored.Latest("30023:pk:post"); !ok || latest.EventID != "b" {
+		t.Errorf("Latest after reopen = %+v, %v, want b", latest, ok)
+	}
+
+	// 置き換え可能でないイベントにはアドレスがない
+	if addr := EventAddress(&NostrEvent{Kind: 1, PubKey: "pk"}); addr != "" {
+		t.Errorf("EventAddress(kind 1) = %q", addr)
+	}
+	if addr := EventAddress(&NostrEvent{Kind: 10002, PubKey: "pk", Tags: [][]string{{"d", "ignored"}}}); addr != "10002:pk:" {
+		t.Errorf("EventAddress(kind 10002) = %q", addr)
+	}
+}
+
+func TestNewDeletionRequest(t *testing.T) {
+	event := &NostrEvent{
+		ID:     "del",
+		PubKey: "alice",
+		Kind:   KindDeletion,
+		Tags: [][]string{
+			{"e", "note1"},
+			{"a", "30023:alice:post"},
+			{"a", "30023:bob:post"},
+			{"k", "1"},
+			{"e"},
+		},
+		Content: "mistake",
+	}
+	req := NewDeletionRequest(event, "wss://relay.example")
+
+	if req.DeletionEventID != "del" || req.PubKey != "alice" || req.Reason != "mistake" {
+		t.Errorf("request = %+v", req)
+	}
+	if len(req.Targets) != 3 {
+		t.Fatalf("Targets = %+v, want 3 targets", req.Targets)
+	}
+	if req.Targets[0].EventID != "note1" || req.Targets[0].AuthorMatch != nil {
+		t.Errorf("e target = %+v", req.Targets[0])
+	}
+	// 他人のアドレスの削除は記録するが，作者の不一致として印を付ける
+	if m := req.Targets[1].AuthorMatch; m == nil || !*m {
+		t.Errorf("own address target = %+v", req.Targets[1])
+	}
+	if m := req.Targets[2].AuthorMatch; m == nil || *m {
+		t.Errorf("foreign address target = %+v", req.Targets[2])
+	}
+	if len(req.Kinds) != 1 || req.Kinds[0] != 1 {
+		t.Errorf("Kinds = %v, want [1]", req.Kinds)
+	}
+}
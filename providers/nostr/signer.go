@@ -0,0 +1,172 @@
+package nostr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// NIP-42 認証イベントの kind
+const KindClientAuth = 22242
+
+// Signer は設定された秘密鍵でイベントに署名する (BIP-340 Schnorr)
+type Signer struct {
+	privateKey *btcec.PrivateKey
+	PubKey     string // x-only公開鍵 (hex)
+}
+
+var (
+	// DefaultSigner は全 NostrProvider が使う署名者。nilならAUTHに応答しない
+	DefaultSigner *Signer
+)
+
+// 16進数の秘密鍵から Signer を作成
+func NewSigner(secretKeyHex string) (*Signer, error) {
+	keyBytes, err := hex.DecodeString(strings.TrimSpace(secretKeyHex))
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key: %w", err)
+	}
+	if len(keyBytes) != 32 {
+		return nil, fmt.Errorf("invalid secret key length: %d", len(keyBytes))
+	}
+	privateKey, publicKey := btcec.PrivKeyFromBytes(keyBytes)
+	return &Signer{
+		privateKey: privateKey,
+		PubKey:     hex.EncodeToString(schnorr.SerializePubKey(publicKey)),
+	}, nil
+}
+
+// Sign はイベントの pubkey, id, sig を埋める
+func (s *Signer) Sign(event *NostrEvent) error {
+	event.PubKey = s.PubKey
+	id, err := computeEventID(event)
+	if err != nil {
+		return err
+	}
+	sig, err := schnorr.Sign(s.privateKey, id)
+	if err != nil {
+		return fmt.Errorf("failed to sign event: %w", err)
+	}
+	event.ID = hex.EncodeToString(id)
+	event.Sig = hex.EncodeToString(sig.Serialize())
+	return nil
+}
+
+// NewAuthEvent はNIP-42のチャレンジに応答する署名済みイベントを作成する
+func (s *Signer) NewAuthEvent(relayURL, challenge string) (*NostrEvent, error) {
+	event := &NostrEvent{
+		CreatedAt: time.Now().Unix(),
+		Kind:      KindClientAuth,
+		Tags: [][]string{
+			{"relay", relayURL},
+			{"challenge", challenge},
+		},
+		Content: "",
+	}
+	if err := s.Sign(event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// computeEventID はNIP-01の直列化 [0,pubkey,created_at,kind,tags,content] のSHA256を計算する
+func computeEventID(event *NostrEvent) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("[0,")
+	writeNIP01String(&buf, event.PubKey)
+	buf.WriteByte(',')
+	buf.WriteString(strconv.FormatInt(event.CreatedAt, 10))
+	buf.WriteByte(',')
+	buf.WriteString(strconv.Itoa(event.Kind))
+	buf.WriteString(",[")
+	for i, tag := range event.Tags {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('[')
+		for j, value := range tag {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			writeNIP01String(&buf, value)
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteString("],")
+	writeNIP01String(&buf, event.Content)
+	buf.WriteByte(']')
+
+	hash := sha256.Sum256(buf.Bytes())
+	return hash[:], nil
+}
+
+// writeNIP01String はNIP-01の規則で文字列を書き出す。
+// エスケープするのは改行・"・\・CR・タブ・BS・FF と他の制御文字だけで，
+// encoding/json と違って U+2028/U+2029 や不正なUTF-8もそのまま書き出す
+func writeNIP01String(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\n':
+			buf.WriteString(`\n`)
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		default:
+			if c < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// verifyEventID はイベントIDがNIP-01の直列化のハッシュと一致するかを確認する
+func verifyEventID(event *NostrEvent) bool {
+	id, err := computeEventID(event)
+	return err == nil && hex.EncodeToString(id) == event.ID
+}
+
+// VerifyEvent はイベントIDと，公開鍵による署名 (BIP-340 Schnorr) を確認する
+func VerifyEvent(event *NostrEvent) bool {
+	if !verifyEventID(event) {
+		return false
+	}
+	pubKeyBytes, err := hex.DecodeString(event.PubKey)
+	if err != nil {
+		return false
+	}
+	pubKey, err := schnorr.ParsePubKey(pubKeyBytes)
+	if err != nil {
+		return false
+	}
+	sigBytes, err := hex.DecodeString(event.Sig)
+	if err != nil {
+		return false
+	}
+	sig, err := schnorr.ParseSignature(sigBytes)
+	if err != nil {
+		return false
+	}
+	idBytes, _ := hex.DecodeString(event.ID)
+	return sig.Verify(idBytes, pubKey)
+}
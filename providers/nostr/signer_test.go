@@ -0,0 +1,90 @@
+package nostr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+func TestSignerAuthEvent(t *testing.T) {
+	if _, err := NewSigner("not hex"); err == nil {
+		t.Error("NewSigner accepted a non-hex key")
+	}
+	if _, err := NewSigner("01"); err == nil {
+		t.Error("NewSigner accepted a short key")
+	}
+
+	// 秘密鍵1の公開鍵は生成元のx座標
+	signer, err := NewSigner("0000000000000000000000000000000000000000000000000000000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"; signer.PubKey != want {
+		t.Fatalf("PubKey = %s, want %s", signer.PubKey, want)
+	}
+
+	event, err := signer.NewAuthEvent("wss://relay.example", "challenge-string")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Kind != KindClientAuth || event.PubKey != signer.PubKey {
+		t.Errorf("event = %+v", event)
+	}
+	if event.Tags[0][1] != "wss://relay.example" || event.Tags[1][1] != "challenge-string" {
+		t.Errorf("tags = %v", event.Tags)
+	}
+
+	// 署名は公開鍵とIDで検証できる
+	pubKeyBytes, _ := hex.DecodeString(event.PubKey)
+	pubKey, err := schnorr.ParsePubKey(pubKeyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigBytes, _ := hex.DecodeString(event.Sig)
+	sig, err := schnorr.ParseSignature(sigBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idBytes, _ := hex.DecodeString(event.ID)
+	if !sig.Verify(idBytes, pubKey) {
+		t.Error("signature does not verify")
+	}
+}
+
+func TestComputeEventID(t *testing.T) {
+	// 本文 → NIP-01 の直列化での本文
+	contents := map[string]string{
+		"<a href=\"x\">&</a>\n": `"<a href=\"x\">&</a>\n"`, // HTMLの文字はエスケープしない
+		"line\u2028sep\u2029":   "\"line\u2028sep\u2029\"", // U+2028/U+2029 はそのまま
+		"tab\t\x01\x7f":         `"tab\t\u0001` + "\x7f\"",
+		"こんにちは\\":               `"こんにちは\\"`,
+	}
+	for content, serialized := range contents {
+		event := &NostrEvent{PubKey: "pk", CreatedAt: 1700000000, Kind: 1, Tags: [][]string{{"e", "abc"}, {"p", "def", "wss://relay"}}, Content: content}
+		id, err := computeEventID(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := sha256.Sum256([]byte(`[0,"pk",1700000000,1,[["e","abc"],["p","def","wss://relay"]],` + serialized + `]`))
+		if !bytes.Equal(id, want[:]) {
+			t.Errorf("computeEventID(%q) does not hash %s", content, serialized)
+		}
+	}
+
+	// U+2028 を含む署名済みイベントも検証できる
+	signer, _ := NewSigner("0000000000000000000000000000000000000000000000000000000000000003")
+	event := &NostrEvent{CreatedAt: 1, Kind: 1, Tags: [][]string{}, Content: "a\u2028b"}
+	if err := signer.Sign(event); err != nil {
+		t.Fatal(err)
+	}
+	if !verifyEventID(event) {
+		t.Error("verifyEventID rejected an event containing U+2028")
+	}
+	event.Content = "a\u2029b"
+	if verifyEventID(event) {
+		t.Error("verifyEventID accepted a modified event")
+	}
+}
@@ -7,10 +7,13 @@ import (
 
 // 一応，EVENTのみに対応することを想定
 type NostrMessage struct {
-	Type           string      // "EVENT", "NOTICE", "EOSE", "OK", etc.
-	SubscriptionID string      // Subscription ID for "EVENT"
+	Type           string      // "EVENT", "NOTICE", "EOSE", "OK", "CLOSED", "AUTH"
+	SubscriptionID string      // Subscription ID for "EVENT", "EOSE", "CLOSED"
 	Event          *NostrEvent // Event data for "EVENT"
-	Message        string      // Message content for "NOTICE"
+	Message        string      // Message content for "NOTICE", "OK", "CLOSED"
+	EventID        string      // Event ID for "OK"
+	Accepted       bool        // Result for "OK"
+	Challenge      string      // Challenge string for "AUTH"
 }
 
 // EVENT時のJSONオブジェクト
@@ -24,3 +27,52 @@ type NostrEvent struct {
 	Sig       string     `json:"sig"`
 }
 
+// 出力ストリーム名 (RawMessage.Metadata["stream"])
+const (
+	StreamSightings   = "sightings"   // 重複イベントの観測記録
+	StreamReplaceable = "replaceable" // 置き換え可能イベントのバージョン記録
+	StreamDeletions   = "deletions"   // 削除リクエスト (kind 5) の記録
+)
+
+// 既に保存済みのイベントを別のリレー（または別の購読）で観測した記録
+type Sighting struct {
+	EventID        string `json:"event_id"`
+	Relay          string `json:"relay"`
+	SubscriptionID string `json:"subscription_id"`
+	SeenAt         string `json:"seen_at"`
+}
+
+// 置き換え可能イベントのバージョン記録
+// (kind, pubkey, d-tag) ごとに，どのイベントが最新か・何を置き換えたかを残す
+type ReplaceableVersion struct {
+	Address           string `json:"address"` // "kind:pubkey:d-tag"
+	Kind              int    `json:"kind"`
+	PubKey            string `json:"pubkey"`
+	DTag              string `json:"d_tag"`
+	EventID           string `json:"event_id"`
+	CreatedAt         int64  `json:"created_at"`
+	IsLatest          bool   `json:"is_latest"`
+	PreviousEventID   string `json:"previous_event_id,omitempty"` // このバージョンが置き換えたイベント
+	PreviousCreatedAt int64  `json:"previous_created_at,omitempty"`
+	SupersededBy      string `json:"superseded_by,omitempty"` // 受信時点で既に新しいバージョンがあった場合
+	Relay             string `json:"relay"`
+}
+
+// 削除リクエスト (NIP-09) の記録
+type DeletionRequest struct {
+	DeletionEventID string           `json:"deletion_event_id"`
+	PubKey          string           `json:"pubkey"`
+	CreatedAt       int64            `json:"created_at"`
+	Reason          string           `json:"reason"`
+	Targets         []DeletionTarget `json:"targets"`
+	Kinds           []int            `json:"kinds,omitempty"`
+	Relay           string           `json:"relay"`
+}
+
+// 削除対象 (e タグはイベントID，a タグはアドレス)
+type DeletionTarget struct {
+	Type        string `json:"type"` // "e" or "a"
+	EventID     string `json:"event_id,omitempty"`
+	Address     string `json:"address,omitempty"`
+	AuthorMatch *bool  `json:"author_match,omitempty"` // a タグの作者と削除者が一致するか
+}
@@ -0,0 +1,359 @@
+package polling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/providers/mastodon"
+	"github.com/chcolte/fediverse-archive-bot-go/providers/misskey"
+)
+
+// 対応するREST API
+const (
+	SoftwareMastodon = "mastodon"
+	SoftwareMisskey  = "misskey"
+	SoftwareLemmy    = "lemmy"
+)
+
+// 1回の取得件数
+const pageLimit = 40
+
+// タイムラインから取得した1件の投稿
+type item struct {
+	ID        string
+	CreatedAt time.Time
+	Raw       json.RawMessage
+	Media     []string // 添付メディアのURL
+	Link      string   // 外部リンク (メディアか不明なもの)
+	Origin    string   // 投稿元のURL (サーバー探索用)
+}
+
+// api はソフトウェアごとのタイムラインREST APIの違いを吸収する
+type api interface {
+	// sinceID より新しい投稿を取得するリクエストを作成する (sinceID が空なら最新のページ)
+	request(ctx context.Context, host string, spec models.TimelineSpec, sinceID, token string) (*http.Request, error)
+	// レスポンスを投稿の一覧に変換する
+	parse(body []byte) ([]item, error)
+	// 投稿の生データを正規化する
+	normalize(raw json.RawMessage, host string) (models.Post, error)
+}
+
+func newAPI(software string) (api, error) {
+	switch software {
+	case SoftwareMastodon:
+		return mastodonAPI{}, nil
+	case SoftwareMisskey:
+		return misskeyAPI{}, nil
+	case SoftwareLemmy:
+		return lemmyAPI{}, nil
+	default:
+		return nil, fmt.Errorf("polling is not supported for %s", software)
+	}
+}
+
+func unsupported(software string, spec models.TimelineSpec) error {
+	name := spec.Kind
+	if spec.Arg != "" {
+		name += ":" + spec.Arg
+	}
+	return fmt.Errorf("%w for %s polling: %s", models.ErrUnsupportedTimeline, software, name)
+}
+
+// ---------------- Mastodon ----------------
+
+type mastodonAPI struct{}
+
+func (mastodonAPI) request(ctx context.Context, host string, spec models.TimelineSpec, sinceID, token string) (*http.Request, error) {
+	q := url.Values{}
+	q.Set("limit", strconv.Itoa(pageLimit))
+	var path string
+	switch spec.Kind {
+	case models.TimelineLocal:
+		path = "/api/v1/timelines/public"
+		q.Set("local", "true")
+	case models.TimelineRemote:
+		path = "/api/v1/timelines/public"
+		q.Set("remote", "true")
+	case models.TimelineGlobal:
+		path = "/api/v1/timelines/public"
+	case models.TimelineHome:
+		path = "/api/v1/timelines/home"
+	case models.TimelineHashtag:
+		path = "/api/v1/timelines/tag/" + url.PathEscape(spec.Arg)
+	case models.TimelineList:
+		path = "/api/v1/timelines/list/" + url.PathEscape(spec.Arg)
+	default:
+		return nil, unsupported(SoftwareMastodon, spec)
+	}
+	if spec.Media {
+		q.Set("only_media", "true")
+	}
+	if sinceID != "" {
+		// since_id は最新のページを返すため取りこぼしうる。min_id なら直後から順に取得できる
+		q.Set("min_id", sinceID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+host+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+func (mastodonAPI) parse(body []byte) ([]item, error) {
+	var statuses []json.RawMessage
+	if err := json.Unmarshal(body, &statuses); err != nil {
+		return nil, err
+	}
+	items := make([]item, 0, len(statuses))
+	for _, raw := range statuses {
+		var status struct {
+			ID               string    `json:"id"`
+			CreatedAt        time.Time `json:"created_at"`
+			URI              string    `json:"uri"`
+			MediaAttachments []struct {
+				URL string `json:"url"`
+			} `json:"media_attachments"`
+		}
+		if err := json.Unmarshal(raw, &status); err != nil || status.ID == "" {
+			continue
+		}
+		it := item{ID: status.ID, CreatedAt: status.CreatedAt, Raw: raw, Origin: status.URI}
+		for _, media := range status.MediaAttachments {
+			it.Media = append(it.Media, media.URL)
+		}
+		items = append(items, it)
+	}
+	return items, nil
+}
+
+func (mastodonAPI) normalize(raw json.RawMessage, host string) (models.Post, error) {
+	return mastodon.NormalizeStatus(raw, host)
+}
+
+// ---------------- Misskey ----------------
+
+type misskeyAPI struct{}
+
+func (misskeyAPI) request(ctx context.Context, host string, spec models.TimelineSpec, sinceID, token string) (*http.Request, error) {
+	params := map[string]interface{}{"limit": pageLimit}
+	var endpoint string
+	switch spec.Kind {
+	case models.TimelineLocal:
+		endpoint = "notes/local-timeline"
+	case models.TimelineGlobal:
+		endpoint = "notes/global-timeline"
+	case models.TimelineHybrid:
+		endpoint = "notes/hybrid-timeline"
+	case models.TimelineHome:
+		endpoint = "notes/timeline"
+	case models.TimelineHashtag:
+		endpoint = "notes/search-by-tag"
+		params["tag"] = spec.Arg
+	case models.TimelineList:
+		endpoint = "notes/user-list-timeline"
+		params["listId"] = spec.Arg
+	case models.TimelineChannel:
+		endpoint = "channels/timeline"
+		params["channelId"] = spec.Arg
+	case models.TimelineAntenna:
+		endpoint = "antennas/notes"
+		params["antennaId"] = spec.Arg
+	default:
+		return nil, unsupported(SoftwareMisskey, spec)
+	}
+	if spec.Media {
+		params["withFiles"] = true
+	}
+	if sinceID != "" {
+		params["sinceId"] = sinceID
+	}
+	if token != "" {
+		params["i"] = token
+	}
+
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://"+host+"/api/"+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (misskeyAPI) parse(body []byte) ([]item, error) {
+	var notes []json.RawMessage
+	if err := json.Unmarshal(body, &notes); err != nil {
+		return nil, err
+	}
+	items := make([]item, 0, len(notes))
+	for _, raw := range notes {
+		var note struct {
+			ID        string    `json:"id"`
+			CreatedAt time.Time `json:"createdAt"`
+			URI       string    `json:"uri"`
+			Files     []struct {
+				URL string `json:"url"`
+			} `json:"files"`
+		}
+		if err := json.Unmarshal(raw, &note); err != nil || note.ID == "" {
+			continue
+		}
+		it := item{ID: note.ID, CreatedAt: note.CreatedAt, Raw: raw, Origin: note.URI}
+		for _, file := range note.Files {
+			it.Media = append(it.Media, file.URL)
+		}
+		items = append(items, it)
+	}
+	return items, nil
+}
+
+func (misskeyAPI) normalize(raw json.RawMessage, host string) (models.Post, error) {
+	var note misskey.Note
+	if err := json.Unmarshal(raw, &note); err != nil {
+		return models.Post{}, err
+	}
+	return misskey.NormalizeNote(note, host), nil
+}
+
+// ---------------- Lemmy ----------------
+// Lemmyには since_id がないため，新着順の1ページを取得して既知のIDより新しいものだけを使う
+
+type lemmyAPI struct{}
+
+func (lemmyAPI) request(ctx context.Context, host string, spec models.TimelineSpec, sinceID, token string) (*http.Request, error) {
+	q := url.Values{}
+	q.Set("sort", "New")
+	q.Set("limit", strconv.Itoa(pageLimit))
+	switch spec.Kind {
+	case models.TimelineLocal:
+		q.Set("type_", "Local")
+	case models.TimelineGlobal:
+		q.Set("type_", "All")
+	case models.TimelineHome:
+		q.Set("type_", "Subscribed")
+	default:
+		return nil, unsupported(SoftwareLemmy, spec)
+	}
+	if spec.Media {
+		return nil, unsupported(SoftwareLemmy, spec)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+host+"/api/v3/post/list?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+func (lemmyAPI) parse(body []byte) ([]item, error) {
+	var resp struct {
+		Posts []json.RawMessage `json:"posts"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	items := make([]item, 0, len(resp.Posts))
+	for _, raw := range resp.Posts {
+		var view struct {
+			Post struct {
+				ID           int64  `json:"id"`
+				Published    string `json:"published"`
+				URL          string `json:"url"`
+				ThumbnailURL string `json:"thumbnail_url"`
+				ApID         string `json:"ap_id"`
+			} `json:"post"`
+		}
+		if err := json.Unmarshal(raw, &view); err != nil || view.Post.ID == 0 {
+			continue
+		}
+		it := item{
+			ID:        strconv.FormatInt(view.Post.ID, 10),
+			CreatedAt: parseLemmyTime(view.Post.Published),
+			Raw:       raw,
+			Link:      view.Post.URL,
+			Origin:    view.Post.ApID,
+		}
+		if view.Post.ThumbnailURL != "" {
+			it.Media = append(it.Media, view.Post.ThumbnailURL)
+		}
+		items = append(items, it)
+	}
+	return items, nil
+}
+
+func (lemmyAPI) normalize(raw json.RawMessage, host string) (models.Post, error) {
+	var view struct {
+		Post struct {
+			ID           int64  `json:"id"`
+			Name         string `json:"name"`
+			Body         string `json:"body"`
+			URL          string `json:"url"`
+			ThumbnailURL string `json:"thumbnail_url"`
+			Published    string `json:"published"`
+			ApID         string `json:"ap_id"`
+			NSFW         bool   `json:"nsfw"`
+		} `json:"post"`
+		Creator struct {
+			ID          int64  `json:"id"`
+			Name        string `json:"name"`
+			DisplayName string `json:"display_name"`
+			ActorID     string `json:"actor_id"`
+		} `json:"creator"`
+	}
+	if err := json.Unmarshal(raw, &view); err != nil {
+		return models.Post{}, err
+	}
+
+	post := models.Post{
+		ID:         strconv.FormatInt(view.Post.ID, 10),
+		URI:        view.Post.ApID,
+		URL:        view.Post.ApID,
+		Platform:   SoftwareLemmy,
+		Server:     host,
+		CreatedAt:  parseLemmyTime(view.Post.Published),
+		Text:       view.Post.Body,
+		Summary:    view.Post.Name, // タイトル
+		Sensitive:  view.Post.NSFW,
+		Visibility: models.VisibilityPublic,
+		Author: models.PostAuthor{
+			ID:          strconv.FormatInt(view.Creator.ID, 10),
+			Username:    view.Creator.Name,
+			DisplayName: view.Creator.DisplayName,
+			URI:         view.Creator.ActorID,
+		},
+	}
+	if u, err := url.Parse(view.Creator.ActorID); err == nil {
+		post.Author.Host = u.Host
+	}
+	if view.Post.ThumbnailURL != "" {
+		post.Media = append(post.Media, models.PostMedia{URL: view.Post.ThumbnailURL})
+	}
+	return post, nil
+}
+
+// 古いLemmyはタイムゾーンなしの時刻を返す (UTC)
+func parseLemmyTime(s string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
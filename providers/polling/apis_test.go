@@ -0,0 +1,135 @@
+package polling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+// fetchIDs は fetch で取得した投稿のIDを返す
+func fetchIDs(t *testing.T, p *PollingProvider) string {
+	t.Helper()
+	items, _, err := p.fetch(context.Background(), p.feeds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, it := range items {
+		ids = append(ids, it.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+// newTestProvider はテスト用サーバーをポーリングする Provider を作る
+func newTestProvider(t *testing.T, software string, handler http.HandlerFunc) *PollingProvider {
+	t.Helper()
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	client := httpClient
+	httpClient = server.Client()
+	t.Cleanup(func() { httpClient = client })
+
+	p := NewPollingProvider(server.URL, models.TimelineLocal, software)
+	if _, err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestMastodonPaging(t *testing.T) {
+	// min_id の直後から新しい順に返す
+	pages := map[string]string{
+		"":  `[{"id":"3"},{"id":"2"}]`,
+		"3": `[{"id":"5"},{"id":"4"}]`,
+		"5": `[]`,
+	}
+	p := newTestProvider(t, SoftwareMastodon, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/timelines/public" || r.URL.Query().Get("local") != "true" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, pages[r.URL.Query().Get("min_id")])
+	})
+
+	// 古い順に返し，次は最新のIDを min_id にして取得する
+	for _, want := range []string{"2,3", "4,5", ""} {
+		if got := fetchIDs(t, p); got != want {
+			t.Errorf("fetched %q, want %q", got, want)
+		}
+	}
+}
+
+func TestMisskeySinceID(t *testing.T) {
+	spec, _ := models.ParseTimeline("hashtag:fedi")
+	for sinceID, want := range map[string]string{
+		"":     `{"limit":40,"tag":"fedi"}`,
+		"9abc": `{"i":"token","limit":40,"sinceId":"9abc","tag":"fedi"}`,
+	} {
+		token := ""
+		if sinceID != "" {
+			token = "token"
+		}
+		req, err := misskeyAPI{}.request(context.Background(), "misskey.example", spec, sinceID, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.URL.String() != "https://misskey.example/api/notes/search-by-tag" {
+			t.Errorf("URL = %s", req.URL)
+		}
+		var params map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&params)
+		got, _ := json.Marshal(params)
+		if string(got) != want {
+			t.Errorf("params = %s, want %s", got, want)
+		}
+	}
+}
+
+func TestLemmySkipsKnownPosts(t *testing.T) {
+	// Lemmyは since_id がなく，毎回新着順の1ページを返す
+	responses := []string{
+		`{"posts":[{"post":{"id":12}},{"post":{"id":11}},{"post":{"id":10}}]}`,
+		`{"posts":[{"post":{"id":13}},{"post":{"id":12}},{"post":{"id":11}}]}`,
+		`{"posts":[{"post":{"id":13}},{"post":{"id":12}}]}`,
+	}
+	requests := 0
+	p := newTestProvider(t, SoftwareLemmy, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/post/list" || r.URL.Query().Get("type_") != "Local" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, responses[requests])
+		requests++
+	})
+
+	// 既知のIDより新しい投稿だけを返す
+	for _, want := range []string{"10,11,12", "13", ""} {
+		if got := fetchIDs(t, p); got != want {
+			t.Errorf("fetched %q, want %q", got, want)
+		}
+	}
+}
+
+func TestParseLemmyTime(t *testing.T) {
+	want := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	for _, s := range []string{
+		"2024-01-02T03:04:05.123456",       // 古いLemmy (タイムゾーンなし)
+		"2024-01-02T03:04:05.123456Z",      // 新しいLemmy
+		"2024-01-02T12:04:05.123456+09:00", // オフセット付き
+	} {
+		if got := parseLemmyTime(s); !got.Equal(want) {
+			t.Errorf("parseLemmyTime(%s) = %s, want %s", s, got, want)
+		}
+	}
+	if got := parseLemmyTime("yesterday"); !got.IsZero() {
+		t.Errorf("parseLemmyTime(yesterday) = %s, want zero", got)
+	}
+}
@@ -0,0 +1,458 @@
+package polling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/credentials"
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/nodeinfo"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
+)
+
+/*
+[RESTポーリング]
+ストリーミングAPIを持たない (Lemmy) か，無効にしているサーバー向け。
+タイムラインのREST APIを定期的に取得し，前回の最新IDより新しい投稿だけを
+ストリーミングと同じように RawMessage として送る。
+
+- 取得間隔は投稿の流量に合わせて MinInterval〜MaxInterval の間で調整する
+- ETag があれば (リクエストURLごとに) If-None-Match を送り，304 なら新着なしとする
+- 複数のタイムラインを1つの取得ループで順に取得する (MultiplexProvider)
+- 429/503 の Retry-After に従って待つ
+*/
+
+// 取得間隔の初期値
+var (
+	DefaultMinInterval = 10 * time.Second
+	DefaultMaxInterval = 5 * time.Minute
+)
+
+// 1回の取得の期限
+const requestTimeout = 30 * time.Second
+
+var httpClient = &http.Client{}
+
+type PollingProvider struct {
+	URL      string
+	Timeline string
+	Software string // mastodon, misskey, lemmy
+
+	MinInterval time.Duration
+	MaxInterval time.Duration
+
+	Timelines     []string        // 複数のタイムラインを取得する場合 (SetTimelines)
+	discoveryOnly map[string]bool // 探索のためだけに取得するタイムライン
+
+	api      api
+	feeds    []*feed
+	interval time.Duration
+
+	// Providerの context。Close でキャンセルし，取得中のリクエストも中断する
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+// feed は1つのタイムラインの取得状態
+type feed struct {
+	timeline      string
+	spec          models.TimelineSpec
+	sinceID       string
+	etags         map[string]string // リクエストURL → ETag
+	discoveryOnly bool
+}
+
+// 新しい PollingProvider を作成
+func NewPollingProvider(url, timeline, software string) *PollingProvider {
+	p := &PollingProvider{
+		URL:         url,
+		Timeline:    timeline,
+		Software:    software,
+		MinInterval: DefaultMinInterval,
+		MaxInterval: DefaultMaxInterval,
+	}
+	p.ctx, p.stop = context.WithCancel(context.Background())
+	return p
+}
+
+// SetTimelines は1つの取得ループで取得するタイムラインを設定する (Connect前に呼ぶ)
+func (p *PollingProvider) SetTimelines(timelines []string, discoveryOnly []string) {
+	p.Timelines = append(append([]string{}, timelines...), discoveryOnly...)
+	p.discoveryOnly = make(map[string]bool)
+	for _, timeline := range discoveryOnly {
+		p.discoveryOnly[timeline] = true
+	}
+}
+
+// 取得対象のタイムライン一覧
+func (p *PollingProvider) timelines() []string {
+	if len(p.Timelines) > 0 {
+		return p.Timelines
+	}
+	return []string{p.Timeline}
+}
+
+// Connect はAPIとタイムラインを検証し，取得先のURLを返す (接続は保持しない)。
+// 複数のタイムラインを取得する場合は先頭のタイムラインのURLを返す
+func (p *PollingProvider) Connect() (string, error) {
+	a, err := newAPI(p.Software)
+	if err != nil {
+		return p.URL, err
+	}
+
+	// 再接続時は取得済みの位置から続ける
+	known := make(map[string]*feed)
+	for _, f := range p.feeds {
+		known[f.timeline] = f
+	}
+	var feeds []*feed
+	var sourceURL string
+	for _, timeline := range p.timelines() {
+		spec, err := models.ParseTimeline(timeline)
+		if err != nil {
+			return p.URL, err
+		}
+		req, err := a.request(p.ctx, p.host(), spec, "", "")
+		if err != nil {
+			return p.URL, err
+		}
+		if sourceURL == "" {
+			sourceURL = req.URL.String()
+		}
+
+		f, ok := known[timeline]
+		if !ok {
+			f = &feed{timeline: timeline, spec: spec}
+		}
+		f.etags = make(map[string]string)
+		f.discoveryOnly = p.discoveryOnly[timeline]
+		feeds = append(feeds, f)
+		logger.Info("Polling ", req.URL.String())
+	}
+
+	p.api = a
+	p.feeds = feeds
+	if p.interval == 0 {
+		p.interval = p.MinInterval * 3
+	}
+	logger.Info("Polling ", p.URL, " every ", p.interval)
+	return sourceURL, nil
+}
+
+// Open は Connect と同じ (ポーリングは接続を保持しない)。Close 後は開けない
+func (p *PollingProvider) Open(ctx context.Context) (string, []byte, error) {
+	if p.ctx.Err() != nil {
+		return "", nil, providers.ErrProviderClosed
+	}
+	sourceURL, err := p.Connect()
+	return sourceURL, nil, err
+}
+
+// ポーリングにはチャンネルの概念がない
+func (p *PollingProvider) ConnectChannel() ([]byte, error) {
+	return nil, nil
+}
+
+// CheckTimeline はタイムラインをREST APIで取得できるか確認する
+func (p *PollingProvider) CheckTimeline(timeline string) error {
+	a, err := newAPI(p.Software)
+	if err != nil {
+		return err
+	}
+	spec, err := models.ParseTimeline(timeline)
+	if err != nil {
+		return err
+	}
+	_, err = a.request(p.ctx, p.host(), spec, "", "")
+	return err
+}
+
+// 新着投稿を取得し続け，メディアURLを output チャンネルに送信
+func (p *PollingProvider) ReceiveMessages(output chan<- models.DownloadItem, message chan<- models.RawMessage) error {
+	return p.Receive(context.Background(), output, message)
+}
+
+// Receive は取得に失敗するか ctx がキャンセルされるまで新着投稿を取得し続ける
+func (p *PollingProvider) Receive(ctx context.Context, output chan<- models.DownloadItem, message chan<- models.RawMessage) error {
+	logger.Info("PollingProvider: Starting to poll [", p.URL, "]")
+
+	return p.poll(ctx, func(f *feed, it item) {
+		message <- p.toRawMessage(f, it)
+		if f.discoveryOnly {
+			return
+		}
+
+		for _, mediaURL := range it.Media {
+			p.enqueue(output, models.DownloadItem{URL: mediaURL, Datetime: it.CreatedAt})
+		}
+		if it.Link != "" {
+			// 外部リンクはメディアとは限らないため，取得前にContent-Typeを確認する
+			p.enqueue(output, models.DownloadItem{URL: it.Link, Datetime: it.CreatedAt, CheckContentType: true})
+		}
+	})
+}
+
+// 新着投稿の投稿元から新規サーバーを探索する
+func (p *PollingProvider) CrawlNewServer(server chan<- models.Server) error {
+	return p.Discover(context.Background(), server)
+}
+
+// Discover は取得に失敗するか ctx がキャンセルされるまで新規サーバーを探索する
+func (p *PollingProvider) Discover(ctx context.Context, server chan<- models.Server) error {
+	logger.Info("PollingProvider: Starting to crawl new servers [", p.URL, "]")
+
+	seen := make(map[string]bool)
+	return p.poll(ctx, func(f *feed, it item) {
+		found, ok := p.originServer(it.Origin)
+		if !ok || seen[found.URL] {
+			return
+		}
+		seen[found.URL] = true
+		// 停止後は受け取られないため待たない
+		select {
+		case server <- found:
+		case <-ctx.Done():
+		case <-p.ctx.Done():
+		}
+	})
+}
+
+// DiscoverServers は受信済みの投稿の投稿元から新規サーバーを抽出する (Explorer用)
+func (p *PollingProvider) DiscoverServers(raw models.RawMessage) []models.Server {
+	if len(raw.Posts) == 0 {
+		return nil
+	}
+	found, ok := p.originServer(raw.Posts[0].URI)
+	if !ok {
+		return nil
+	}
+	return []models.Server{found}
+}
+
+// originServer は投稿元のURLが他サーバーであればそのサーバーを返す
+func (p *PollingProvider) originServer(origin string) (models.Server, bool) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" || u.Host == p.host() {
+		return models.Server{}, false
+	}
+
+	softwareName, err := nodeinfo.GetSoftwareName(u.Host)
+	if err != nil {
+		logger.Debugf("Failed to get software name: %v", err)
+		return models.Server{}, false
+	}
+	return models.Server{
+		Type: softwareName,
+		URL:  u.Host,
+	}, true
+}
+
+// CloseStream は何もしない (ポーリングは接続を保持しない)。再度 Open できる
+func (p *PollingProvider) CloseStream() error {
+	return nil
+}
+
+// Close はポーリングを止め，取得中のリクエストを中断する。再度 Open できない
+func (p *PollingProvider) Close() error {
+	p.stop()
+	return nil
+}
+
+// poll は取得ループ。Closeされると nil を，ctx がキャンセルされると ctx.Err() を返す
+// 取得間隔は最も流量の多いタイムラインに合わせる
+func (p *PollingProvider) poll(ctx context.Context, handle func(*feed, item)) error {
+	if p.api == nil {
+		return errors.New("polling provider is not connected")
+	}
+	// ctx のキャンセルでも Close でも止める。Close で止まった場合 outer.Err() は nil
+	outer := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(p.ctx, cancel)()
+	for {
+		var wait time.Duration
+		most, total := 0, 0
+		for _, f := range p.feeds {
+			items, retry, err := p.fetch(ctx, f)
+			if ctx.Err() != nil {
+				return outer.Err()
+			}
+			if err != nil {
+				logger.Errorf("PollingProvider: fetch error: %v [%s]", err, p.URL)
+				return err
+			}
+			for _, it := range items {
+				handle(f, it)
+			}
+			if retry > wait {
+				wait = retry
+			}
+			if len(items) > most {
+				most = len(items)
+			}
+			total += len(items)
+		}
+
+		if wait == 0 {
+			wait = p.adjustInterval(most)
+		}
+		logger.Debugf("Fetched %d new posts from %s, next poll in %s", total, p.URL, wait)
+
+		select {
+		case <-ctx.Done():
+			return outer.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// fetch は新着投稿を古い順に返す。サーバーが待機を求めた場合はその時間も返す
+func (p *PollingProvider) fetch(ctx context.Context, f *feed) ([]item, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := p.api.request(ctx, p.host(), f.spec, f.sinceID, credentials.DefaultStore.Token(p.URL))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; FediverseArchiveBot/1.0)")
+	req.Header.Set("Accept", "application/json")
+	requestURL := req.URL.String()
+	if etag := f.etags[requestURL]; etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, 0, nil
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		wait := retryAfter(resp.Header.Get("Retry-After"))
+		if wait == 0 {
+			wait = p.MaxInterval
+		}
+		logger.Warnf("Rate limited by %s (status %d), waiting %s", p.URL, resp.StatusCode, wait)
+		return nil, wait, nil
+	default:
+		return nil, 0, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, req.URL.String())
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	etag := resp.Header.Get("ETag")
+
+	items, err := p.api.parse(body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse timeline: %w", err)
+	}
+
+	// 既知の投稿を除き，古い順に並べる (since_id のないAPIや順序の違いを吸収する)
+	var fresh []item
+	for _, it := range items {
+		if f.sinceID == "" || idGreater(it.ID, f.sinceID) {
+			fresh = append(fresh, it)
+		}
+	}
+	sort.Slice(fresh, func(i, j int) bool { return idGreater(fresh[j].ID, fresh[i].ID) })
+	if len(fresh) > 0 {
+		// since_id が変わると以前のURLは使わなくなるため，ETagも捨てる
+		f.sinceID = fresh[len(fresh)-1].ID
+		f.etags = make(map[string]string)
+	} else if etag != "" {
+		f.etags[requestURL] = etag
+	}
+	return fresh, 0, nil
+}
+
+// adjustInterval は取得件数から次の取得間隔を決める。
+// 1ページの半分程度が取れる間隔を目標にし，取りこぼしそうなら縮め，新着がなければ伸ばす
+func (p *PollingProvider) adjustInterval(n int) time.Duration {
+	switch {
+	case n >= pageLimit:
+		p.interval /= 2
+	case n == 0:
+		p.interval = p.interval * 3 / 2
+	case n > pageLimit/2:
+		p.interval = p.interval * 3 / 4
+	}
+	if p.interval < p.MinInterval {
+		p.interval = p.MinInterval
+	}
+	if p.interval > p.MaxInterval {
+		p.interval = p.MaxInterval
+	}
+	return p.interval
+}
+
+func (p *PollingProvider) toRawMessage(f *feed, it item) models.RawMessage {
+	raw := models.RawMessage{
+		Data:       it.Raw,
+		CreatedAt:  it.CreatedAt,
+		ReceivedAt: time.Now(),
+		DataType:   "json",
+		Metadata: map[string]string{
+			"timeline":  f.timeline,
+			"transport": "polling",
+			"item_id":   it.ID,
+		},
+	}
+	if post, err := p.api.normalize(it.Raw, p.host()); err == nil {
+		raw.Posts = []models.Post{post}
+	}
+	return raw
+}
+
+func (p *PollingProvider) enqueue(output chan<- models.DownloadItem, item models.DownloadItem) {
+	select {
+	case output <- item:
+	default:
+		logger.Warn("Skipped enqueue media. Media download queue is full.: ", item.URL)
+	}
+}
+
+// host はURLからスキームを除いたホスト名
+func (p *PollingProvider) host() string {
+	host := strings.TrimPrefix(strings.TrimPrefix(p.URL, "https://"), "http://")
+	return strings.TrimSuffix(host, "/")
+}
+
+// idGreater は投稿IDを比較する。
+// MastodonのID (数値) は桁数，MisskeyのID (aid等) は辞書順で大小が決まる
+func idGreater(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// retryAfter は Retry-After ヘッダー (秒数またはHTTP日付) を解釈する
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(t); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
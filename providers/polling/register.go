@@ -0,0 +1,33 @@
+package polling
+
+import (
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/providers"
+)
+
+func init() {
+	register("lemmy", SoftwareLemmy, []string{
+		models.TimelineLocal, models.TimelineGlobal, models.TimelineHome,
+	})
+	// ストリーミングを無効にしているサーバー向け
+	register("mastodon-poll", SoftwareMastodon, []string{
+		models.TimelineLocal, models.TimelineGlobal, models.TimelineRemote, models.TimelineHome,
+		models.TimelineHashtag, models.TimelineList,
+	})
+	register("misskey-poll", SoftwareMisskey, []string{
+		models.TimelineLocal, models.TimelineGlobal, models.TimelineHybrid, models.TimelineHome,
+		models.TimelineHashtag, models.TimelineList, models.TimelineChannel, models.TimelineAntenna,
+	})
+}
+
+func register(name, software string, timelines []string) {
+	providers.Register(name, func(target models.Target) providers.PlatformProvider {
+		return NewPollingProvider(target.Server.URL, target.Timeline, software)
+	}, providers.Capabilities{
+		Timelines: timelines,
+		Discovery: true,
+		Multiplex: true,
+		Backfill:  false,
+		DataType:  "json",
+	})
+}
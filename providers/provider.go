@@ -19,6 +19,24 @@ type PlatformProvider interface {
 	Close() error
 }
 
+// 1本の接続で複数のタイムラインを購読できるProviderが追加で実装するインターフェース。
+// ReceiveMessages が送信するメッセージの Metadata["timeline"] には，
+// そのメッセージが属する共通タイムライン名が入る。
+type MultiplexProvider interface {
+	PlatformProvider
+	// 購読するタイムラインを設定する (Connect前に呼ぶ)
+	// discoveryOnly は探索のためだけに購読するタイムラインで，メディアの抽出を行わない
+	SetTimelines(timelines []string, discoveryOnly []string)
+	// 受信済みメッセージから新規サーバーを抽出する (Explorer用)
+	DiscoverServers(msg models.RawMessage) []models.Server
+}
+
+// タイムライン指定を解釈するProviderが追加で実装するインターフェース。
+// 対応していないタイムラインには models.ErrUnsupportedTimeline をラップしたエラーを返す。
+type TimelineChecker interface {
+	CheckTimeline(timeline string) error
+}
+
 // 受信した生JSONをJson line形式で書き出す
 func AppendToFile(text string, filepath string) {
 	
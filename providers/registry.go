@@ -0,0 +1,115 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+/*
+[Providerレジストリ]
+各Providerパッケージは init() で Register を呼び，コンストラクタと対応機能を登録する。
+CrawlManager はレジストリ経由でProviderを作るため，Providerを追加しても
+crawlManager を変更する必要はない (main で import するだけ)。
+*/
+
+// Constructor は監視対象に対する新しいProviderを作成する
+type Constructor func(target models.Target) PlatformProvider
+
+// Capabilities はProviderが対応している機能
+type Capabilities struct {
+	Timelines []string // 対応するタイムラインの種類 (models.TimelineLocal 等)。nil ならタイムラインを区別しない
+	Discovery bool     // CrawlNewServer で新規サーバーを探索できる
+	Multiplex bool     // 1本の接続で複数のタイムラインを購読できる (MultiplexProvider)
+	Backfill  bool     // 過去の投稿を取得できる (past モード)
+	DataType  string   // 受信データの形式 (json, cbor)
+}
+
+// Registration は登録されたProvider
+type Registration struct {
+	Name         string
+	New          Constructor
+	Capabilities Capabilities
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Registration)
+	setups     []func(downloadDir string) error
+)
+
+// Register はProviderを登録する。同じ名前の二重登録は panic する
+func Register(name string, constructor Constructor, capabilities Capabilities) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := registry[name]; exists {
+		panic("providers: Register called twice for " + name)
+	}
+	registry[name] = Registration{Name: name, New: constructor, Capabilities: capabilities}
+}
+
+// RegisterSetup はクロール開始時に一度だけ呼ばれる初期化処理を登録する
+// (永続化した状態の読み込み等)
+func RegisterSetup(setup func(downloadDir string) error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	setups = append(setups, setup)
+}
+
+// Setup は登録された初期化処理を全て実行する
+func Setup(downloadDir string) error {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	var errs []error
+	for _, setup := range setups {
+		if err := setup(downloadDir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Lookup は名前から登録済みProviderを探す
+func Lookup(name string) (Registration, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	reg, ok := registry[name]
+	return reg, ok
+}
+
+// New は監視対象のサーバー種別に対応するProviderを作成する
+func New(target models.Target) (PlatformProvider, error) {
+	reg, ok := Lookup(target.Server.Type)
+	if !ok {
+		return nil, fmt.Errorf("unsupported system specified: %s (available: %v)", target.Server.Type, Available())
+	}
+	return reg.New(target), nil
+}
+
+// Available は登録済みProviderの名前を返す
+func Available() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SupportsTimelineKind はProviderがタイムラインの種類に対応しているかを返す
+func (c Capabilities) SupportsTimelineKind(kind string) bool {
+	if c.Timelines == nil {
+		return true
+	}
+	for _, t := range c.Timelines {
+		if t == kind {
+			return true
+		}
+	}
+	return false
+}
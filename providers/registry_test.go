@@ -0,0 +1,73 @@
+package providers
+
+import (
+	"testing"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+// unregister はテストで登録したProviderを取り除く
+func unregister(t *testing.T, names ...string) {
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		for _, name := range names {
+			delete(registry, name)
+		}
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	unregister(t, "test-a", "test-b")
+	var created models.Target
+	Register("test-b", func(target models.Target) PlatformProvider {
+		created = target
+		return nil
+	}, Capabilities{Timelines: []string{models.TimelineLocal}, Discovery: true})
+	Register("test-a", func(models.Target) PlatformProvider { return nil }, Capabilities{})
+
+	// 1. 登録した名前で探せる
+	reg, ok := Lookup("test-b")
+	if !ok || reg.Name != "test-b" || !reg.Capabilities.Discovery {
+		t.Fatalf("Lookup(test-b) = %+v, %v", reg, ok)
+	}
+	if _, ok := Lookup("unknown"); ok {
+		t.Error("Lookup(unknown) found a provider")
+	}
+
+	// 2. 一覧は名前順
+	var names []string
+	for _, name := range Available() {
+		if name == "test-a" || name == "test-b" {
+			names = append(names, name)
+		}
+	}
+	if len(names) != 2 || names[0] != "test-a" {
+		t.Errorf("Available() = %v, want test-a before test-b", names)
+	}
+
+	// 3. サーバー種別からProviderを作る
+	target := models.Target{Server: models.Server{Type: "test-b", URL: "example.com"}, Timeline: models.TimelineLocal}
+	if _, err := New(target); err != nil || created != target {
+		t.Errorf("New(test-b) = %v, created %+v", err, created)
+	}
+	if _, err := New(models.Target{Server: models.Server{Type: "unknown"}}); err == nil {
+		t.Error("New(unknown) succeeded")
+	}
+
+	// 4. タイムラインの種類の対応
+	if !reg.Capabilities.SupportsTimelineKind(models.TimelineLocal) || reg.Capabilities.SupportsTimelineKind(models.TimelineGlobal) {
+		t.Error("SupportsTimelineKind does not follow Capabilities.Timelines")
+	}
+	if a, _ := Lookup("test-a"); !a.Capabilities.SupportsTimelineKind(models.TimelineGlobal) {
+		t.Error("provider without Timelines should accept any timeline")
+	}
+
+	// 5. 二重登録は panic する
+	defer func() {
+		if recover() == nil {
+			t.Error("registering test-a twice did not panic")
+		}
+	}()
+	Register("test-a", func(models.Target) PlatformProvider { return nil }, Capabilities{})
+}
@@ -0,0 +1,87 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+/*
+[WebSocketのProvider]
+websocket.Message.Receive は ctx を受け取らないため，読み取り期限 (SetReadDeadline) で止める。
+
+  - ctx がキャンセルされたら期限を過去にして，ブロック中の受信をすぐに戻す
+  - 受信のたびに期限を ReadTimeout だけ延長し，その間に届かなければ ErrReadTimeout を返す
+
+ContextProvider を実装するProviderは DialWebSocket で接続し，GuardRead で受信する。
+*/
+
+// DialWebSocket は ctx でキャンセルできる websocket.Dial
+func DialWebSocket(ctx context.Context, url, origin string) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(url, origin)
+	if err != nil {
+		return nil, err
+	}
+	return config.DialContext(ctx)
+}
+
+// ReadGuard は ctx のキャンセルと読み取り期限で接続からの受信を止める
+type ReadGuard struct {
+	ctx     context.Context
+	conn    *websocket.Conn
+	timeout time.Duration
+	stop    func() bool
+}
+
+// GuardRead は conn からの受信を ctx のキャンセルで止められるようにする。
+// timeout が0なら読み取り期限を設けない。使い終わったら Release を呼ぶ
+func GuardRead(ctx context.Context, conn *websocket.Conn, timeout time.Duration) *ReadGuard {
+	return &ReadGuard{
+		ctx:     ctx,
+		conn:    conn,
+		timeout: timeout,
+		stop: context.AfterFunc(ctx, func() {
+			conn.SetReadDeadline(time.Unix(1, 0))
+		}),
+	}
+}
+
+// Receive は期限を延長して次のメッセージを受信する (v は *string または *[]byte)。
+// ctx がキャンセルされたら ctx.Err() を，期限を過ぎたら ErrReadTimeout を返す
+func (g *ReadGuard) Receive(v interface{}) error {
+	if err := g.ctx.Err(); err != nil {
+		return err
+	}
+	var deadline time.Time
+	if g.timeout > 0 {
+		deadline = time.Now().Add(g.timeout)
+	}
+	if err := g.conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	// キャンセル時に過去にした期限を上書きした場合に備えて確認し直す
+	if err := g.ctx.Err(); err != nil {
+		return err
+	}
+
+	err := websocket.Message.Receive(g.conn, v)
+	if err == nil {
+		return nil
+	}
+	if ctxErr := g.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrReadTimeout
+	}
+	return err
+}
+
+// Release は ctx の監視をやめる
+func (g *ReadGuard) Release() {
+	g.stop()
+}
@@ -0,0 +1,74 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestGuardRead(t *testing.T) {
+	// 1通だけ送り，あとは切断されるまで何も送らないサーバー
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		websocket.Message.Send(ws, "hello")
+		var discard string
+		websocket.Message.Receive(ws, &discard)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, err := DialWebSocket(context.Background(), wsURL, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 1. 届いたメッセージを受信する
+	ctx, cancel := context.WithCancel(context.Background())
+	guard := GuardRead(ctx, conn, time.Minute)
+	defer guard.Release()
+	var msg string
+	if err := guard.Receive(&msg); err != nil || msg != "hello" {
+		t.Fatalf("Receive = %q, %v", msg, err)
+	}
+
+	// 2. ブロック中の受信は ctx のキャンセルで戻る
+	done := make(chan error, 1)
+	go func() { done <- guard.Receive(&msg) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Receive after cancel = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Receive did not return after cancel")
+	}
+}
+
+func TestGuardReadTimeout(t *testing.T) {
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var discard string
+		websocket.Message.Receive(ws, &discard)
+	}))
+	defer server.Close()
+
+	conn, err := DialWebSocket(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 期限の間に何も届かなければ ErrReadTimeout
+	guard := GuardRead(context.Background(), conn, 50*time.Millisecond)
+	defer guard.Release()
+	var msg string
+	if err := guard.Receive(&msg); !errors.Is(err, ErrReadTimeout) {
+		t.Errorf("Receive without messages = %v, want ErrReadTimeout", err)
+	}
+}
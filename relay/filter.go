@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/chcolte/fediverse-archive-bot-go/providers/nostr"
+)
+
+// Filter はNIP-01のREQフィルタ
+type Filter struct {
+	IDs     []string
+	Authors []string
+	Kinds   []int
+	Tags    map[string][]string // "#e" 等の一文字タグ (キーは "#" を除いたもの)
+	Since   *int64
+	Until   *int64
+	Limit   *int
+}
+
+// UnmarshalJSON は "#<letter>" 形式のタグフィルタを含めて読み込む
+func (f *Filter) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for key, value := range fields {
+		var err error
+		switch {
+		case key == "ids":
+			err = json.Unmarshal(value, &f.IDs)
+		case key == "authors":
+			err = json.Unmarshal(value, &f.Authors)
+		case key == "kinds":
+			err = json.Unmarshal(value, &f.Kinds)
+		case key == "since":
+			err = json.Unmarshal(value, &f.Since)
+		case key == "until":
+			err = json.Unmarshal(value, &f.Until)
+		case key == "limit":
+			err = json.Unmarshal(value, &f.Limit)
+		case strings.HasPrefix(key, "#") && len(key) == 2:
+			var values []string
+			err = json.Unmarshal(value, &values)
+			if f.Tags == nil {
+				f.Tags = make(map[string][]string)
+			}
+			f.Tags[key[1:]] = values
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches はイベントがフィルタの全条件を満たすかを判定する
+func (f *Filter) Matches(event *nostr.NostrEvent) bool {
+	if len(f.IDs) > 0 && !containsPrefix(f.IDs, event.ID) {
+		return false
+	}
+	if len(f.Authors) > 0 && !containsPrefix(f.Authors, event.PubKey) {
+		return false
+	}
+	if len(f.Kinds) > 0 && !containsInt(f.Kinds, event.Kind) {
+		return false
+	}
+	if f.Since != nil && event.CreatedAt < *f.Since {
+		return false
+	}
+	if f.Until != nil && event.CreatedAt > *f.Until {
+		return false
+	}
+	for name, values := range f.Tags {
+		if !hasTag(event.Tags, name, values) {
+			return false
+		}
+	}
+	return true
+}
+
+// 旧仕様のプレフィックス指定にも対応する
+func containsPrefix(values []string, s string) bool {
+	for _, v := range values {
+		if strings.HasPrefix(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(values []int, n int) bool {
+	for _, v := range values {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTag(tags [][]string, name string, values []string) bool {
+	for _, tag := range tags {
+		if len(tag) < 2 || tag[0] != name {
+			continue
+		}
+		for _, v := range values {
+			if tag[1] == v {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/chcolte/fediverse-archive-bot-go/providers/nostr"
+)
+
+func TestFilterMatches(t *testing.T) {
+	event := &nostr.NostrEvent{
+		ID:        "abcdef",
+		PubKey:    "alice",
+		CreatedAt: 1000,
+		Kind:      1,
+		Tags:      [][]string{{"e", "root"}, {"p", "bob"}, {"t"}},
+	}
+
+	// フィルタ → 一致するか
+	filters := map[string]bool{
+		`{}`:                      true,
+		`{"ids":["xyz","abc"]}`:   true, // IDはプレフィックスで一致
+		`{"ids":["bcd"]}`:         false,
+		`{"authors":["bob"]}`:     false,
+		`{"kinds":[7]}`:           false,
+		`{"since":1000}`:          true, // since と until は境界を含む
+		`{"until":999}`:           false,
+		`{"#e":["other","root"]}`: true,
+		`{"#t":[""]}`:             false, // 値のないタグは一致しない
+		`{"#ee":["x"]}`:           true,  // 二文字以上のタグ名は無視
+		`{"limit":0}`:             true,  // limit は一致判定に使わない
+		`{"authors":["alice"],"kinds":[1],"#p":["bob"],"since":900,"until":1100}`: true,
+		`{"authors":["alice"],"kinds":[1],"#p":["carol"]}`:                        false,
+	}
+	for data, want := range filters {
+		var filter Filter
+		if err := json.Unmarshal([]byte(data), &filter); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", data, err)
+		}
+		if got := filter.Matches(event); got != want {
+			t.Errorf("Matches(%s) = %v, want %v", data, got, want)
+		}
+	}
+
+	var filter Filter
+	if err := json.Unmarshal([]byte(`{"kinds":["1"]}`), &filter); err == nil {
+		t.Error("Unmarshal accepted a string kind")
+	}
+}
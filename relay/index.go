@@ -0,0 +1,376 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/providers/nostr"
+	"github.com/chcolte/fediverse-archive-bot-go/utils"
+	"github.com/chcolte/fediverse-archive-bot-go/writer"
+)
+
+// 索引に載せたイベント
+type Entry struct {
+	Event *nostr.NostrEvent
+	Raw   json.RawMessage // 保存されていたイベントJSON (署名検証できるよう，そのまま返す)
+
+	removed bool // 新しいバージョンに置き換えられたか，削除リクエストで削除された
+}
+
+// Index はアーカイブ済みNostrイベントのメモリ上の索引。
+// リレーとして返すのは置き換え可能イベントの最新バージョンだけで，削除リクエスト (NIP-09) の対象は返さない
+type Index struct {
+	byID     map[string]*Entry
+	byAuthor map[string][]*Entry
+	byKind   map[int][]*Entry
+	all      []*Entry // created_at の新しい順
+
+	latest       map[string]*Entry // アドレス → 最新バージョン
+	superseded   map[string]bool   // 置き換え可能イベントの記録で古いバージョンとされたイベントID
+	deletedIDs   map[string]bool   // e タグで削除されたイベント ("イベントID:削除者")
+	deletedAddrs map[string]int64  // a タグで削除されたアドレス → この時刻以前のバージョンを削除
+	deletions    map[string]bool   // 反映済みの削除リクエストのID
+}
+
+// 新しい空の Index を作成
+func NewIndex() *Index {
+	return &Index{
+		byID:         make(map[string]*Entry),
+		byAuthor:     make(map[string][]*Entry),
+		byKind:       make(map[int][]*Entry),
+		latest:       make(map[string]*Entry),
+		superseded:   make(map[string]bool),
+		deletedIDs:   make(map[string]bool),
+		deletedAddrs: make(map[string]int64),
+		deletions:    make(map[string]bool),
+	}
+}
+
+// BuildIndex はアーカイブディレクトリ (例: downloads/nostr) 以下のJSONLを読み込んで索引を作る。
+// イベントの他に，置き換え可能イベントの記録と削除リクエストの記録のストリームも読む
+func BuildIndex(nostrDir string) (*Index, error) {
+	idx := NewIndex()
+	err := filepath.WalkDir(nostrDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		var add func(json.RawMessage)
+		switch stream, ok := fileStream(d.Name()); {
+		case !ok:
+			return nil
+		case stream == "":
+			add = idx.addMessage
+		case stream == nostr.StreamReplaceable:
+			add = idx.addVersion
+		case stream == nostr.StreamDeletions:
+			add = idx.addDeletionRecord
+		default:
+			// 観測記録などはイベントを含まない
+			return nil
+		}
+		if err := loadFile(path, add); err != nil {
+			logger.Errorf("Failed to index %s: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	idx.sort()
+	logger.Infof("Indexed %d Nostr events from %s", len(idx.all), nostrDir)
+	return idx, nil
+}
+
+// fileStream はタイムラインのファイルのストリーム名 (メッセージ本体なら空文字列) を返す。
+// メタデータファイルなどタイムラインのファイルでなければ ok は false。書き込み中・圧縮済みのセグメントも読む。
+func fileStream(name string) (stream string, ok bool) {
+	name = utils.TrimCompressionExt(strings.TrimSuffix(name, writer.PartSuffix))
+	if !strings.HasSuffix(name, ".jsonl") {
+		return "", false
+	}
+	// 日付で始まるファイルのみ (crawl_sessions.jsonl, relayinfo.jsonl 等を除く)
+	if len(name) <= 10 || name[4] != '-' || name[7] != '-' {
+		return "", false
+	}
+	for _, stream := range []string{nostr.StreamSightings, nostr.StreamReplaceable, nostr.StreamDeletions, writer.StreamNormalized} {
+		if strings.Contains(name, "_"+stream+"_") {
+			return stream, true
+		}
+	}
+	return "", true
+}
+
+// loadFile はJSONLファイル内の message レコードの生データを add に渡す
+func loadFile(path string, add func(json.RawMessage)) error {
+	file, err := utils.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record struct {
+			RecordType string `json:"record_type"`
+			Data       struct {
+				Raw json.RawMessage `json:"raw"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if record.RecordType != "message" {
+			continue
+		}
+		add(record.Data.Raw)
+	}
+	return scanner.Err()
+}
+
+// addMessage はリレーから受信した ["EVENT", subscription_id, event] のイベントを索引に追加する
+func (idx *Index) addMessage(raw json.RawMessage) {
+	var msg []json.RawMessage
+	if err := json.Unmarshal(raw, &msg); err != nil || len(msg) < 3 {
+		return
+	}
+	var msgType string
+	if err := json.Unmarshal(msg[0], &msgType); err != nil || msgType != "EVENT" {
+		return
+	}
+	idx.Add(msg[2])
+}
+
+// addVersion は置き換え可能イベントのバージョン記録から，古いとされたバージョンを除く
+func (idx *Index) addVersion(raw json.RawMessage) {
+	var version nostr.ReplaceableVersion
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return
+	}
+	if version.PreviousEventID != "" {
+		idx.supersede(version.PreviousEventID)
+	}
+	if version.SupersededBy != "" {
+		idx.supersede(version.EventID)
+	}
+}
+
+func (idx *Index) supersede(id string) {
+	idx.superseded[id] = true
+	if entry, ok := idx.byID[id]; ok {
+		entry.removed = true
+	}
+}
+
+// addDeletionRecord は削除リクエストの記録を反映する
+func (idx *Index) addDeletionRecord(raw json.RawMessage) {
+	var req nostr.DeletionRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.DeletionEventID == "" {
+		return
+	}
+	idx.applyDeletion(req)
+}
+
+// applyDeletion は削除リクエストの対象を除く (NIP-09: 削除者自身のイベントのみ)
+func (idx *Index) applyDeletion(req nostr.DeletionRequest) {
+	if idx.deletions[req.DeletionEventID] {
+		return
+	}
+	idx.deletions[req.DeletionEventID] = true
+	for _, target := range req.Targets {
+		switch target.Type {
+		case "e":
+			idx.deletedIDs[target.EventID+":"+req.PubKey] = true
+			if entry, ok := idx.byID[target.EventID]; ok && idx.deleted(entry.Event) {
+				entry.removed = true
+			}
+		case "a":
+			if target.AuthorMatch == nil || !*target.AuthorMatch {
+				continue
+			}
+			if req.CreatedAt > idx.deletedAddrs[target.Address] {
+				idx.deletedAddrs[target.Address] = req.CreatedAt
+			}
+			if entry, ok := idx.latest[target.Address]; ok && idx.deleted(entry.Event) {
+				entry.removed = true
+			}
+		}
+	}
+}
+
+// deleted はイベントが削除リクエストの対象かどうか (削除リクエスト自体は削除できない)
+func (idx *Index) deleted(event *nostr.NostrEvent) bool {
+	if event.Kind == nostr.KindDeletion {
+		return false
+	}
+	if idx.deletedIDs[event.ID+":"+event.PubKey] {
+		return true
+	}
+	if address := nostr.EventAddress(event); address != "" {
+		if deletedAt, ok := idx.deletedAddrs[address]; ok && event.CreatedAt <= deletedAt {
+			return true
+		}
+	}
+	return false
+}
+
+// Add はイベントJSONを索引に追加する (重複・IDか署名を検証できないイベントは無視)。
+// 置き換え可能イベントは最新バージョンだけを残し，削除リクエスト (kind 5) はその対象を除く
+func (idx *Index) Add(raw json.RawMessage) {
+	var event nostr.NostrEvent
+	if err := json.Unmarshal(raw, &event); err != nil || event.ID == "" {
+		return
+	}
+	if _, exists := idx.byID[event.ID]; exists {
+		return
+	}
+	// 偽造されたイベントで本物のイベントを置き換えたり削除したりさせない
+	if !nostr.VerifyEvent(&event) {
+		logger.Warnf("Skipped Nostr event with an invalid ID or signature: %s", event.ID)
+		return
+	}
+	entry := &Entry{Event: &event, Raw: raw}
+	entry.removed = idx.superseded[event.ID] || idx.deleted(&event)
+	if address := nostr.EventAddress(&event); address != "" {
+		current, ok := idx.latest[address]
+		switch {
+		case !ok:
+			idx.latest[address] = entry
+		case newerEvent(&event, current.Event):
+			current.removed = true
+			idx.latest[address] = entry
+		default:
+			entry.removed = true
+		}
+	}
+
+	idx.byID[event.ID] = entry
+	idx.byAuthor[event.PubKey] = append(idx.byAuthor[event.PubKey], entry)
+	idx.byKind[event.Kind] = append(idx.byKind[event.Kind], entry)
+	idx.all = append(idx.all, entry)
+
+	if event.Kind == nostr.KindDeletion {
+		idx.applyDeletion(nostr.NewDeletionRequest(&event, ""))
+	}
+}
+
+// NIP-01: created_at が新しい方，同じならIDが辞書順で小さい方を残す
+func newerEvent(a, b *nostr.NostrEvent) bool {
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt > b.CreatedAt
+	}
+	return a.ID < b.ID
+}
+
+// Size は索引内のイベント数を返す
+func (idx *Index) Size() int {
+	return len(idx.all)
+}
+
+// sort は置き換えられた・削除されたイベントを除き，各リストを created_at の新しい順に並べる
+func (idx *Index) sort() {
+	idx.all = sortEntries(idx.all)
+	for author, entries := range idx.byAuthor {
+		idx.byAuthor[author] = sortEntries(entries)
+	}
+	for kind, entries := range idx.byKind {
+		idx.byKind[kind] = sortEntries(entries)
+	}
+}
+
+func sortEntries(entries []*Entry) []*Entry {
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !entry.removed {
+			kept = append(kept, entry)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		if kept[i].Event.CreatedAt != kept[j].Event.CreatedAt {
+			return kept[i].Event.CreatedAt > kept[j].Event.CreatedAt
+		}
+		return kept[i].Event.ID < kept[j].Event.ID
+	})
+	return kept
+}
+
+// Query はフィルタに一致するイベントを新しい順に返す
+func (idx *Index) Query(filter Filter, maxLimit int) []*Entry {
+	limit := maxLimit
+	if filter.Limit != nil && *filter.Limit < limit {
+		limit = *filter.Limit
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	var result []*Entry
+	for _, entry := range idx.candidates(filter) {
+		if entry.removed || !filter.Matches(entry.Event) {
+			continue
+		}
+		result = append(result, entry)
+		if len(result) >= limit {
+			break
+		}
+	}
+	return result
+}
+
+// candidates は走査対象を最も絞り込める索引から選ぶ
+func (idx *Index) candidates(filter Filter) []*Entry {
+	if len(filter.IDs) > 0 && allFullIDs(filter.IDs) {
+		var entries []*Entry
+		for _, id := range filter.IDs {
+			if entry, ok := idx.byID[id]; ok {
+				entries = append(entries, entry)
+			}
+		}
+		return sortEntries(entries)
+	}
+
+	var best []*Entry
+	found := false
+	if len(filter.Authors) > 0 && allFullIDs(filter.Authors) {
+		best, found = mergeLists(idx.byAuthor, filter.Authors), true
+	}
+	if len(filter.Kinds) > 0 {
+		var kinds []*Entry
+		for _, kind := range filter.Kinds {
+			kinds = append(kinds, idx.byKind[kind]...)
+		}
+		if !found || len(kinds) < len(best) {
+			best, found = sortEntries(kinds), true
+		}
+	}
+	if found {
+		return best
+	}
+	return idx.all
+}
+
+func mergeLists(lists map[string][]*Entry, keys []string) []*Entry {
+	var entries []*Entry
+	for _, key := range keys {
+		entries = append(entries, lists[key]...)
+	}
+	return sortEntries(entries)
+}
+
+// プレフィックス指定が混ざっている場合はID・作者の索引を使えない
+func allFullIDs(ids []string) bool {
+	for _, id := range ids {
+		if len(id) != 64 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package relay
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/providers/nostr"
+	"github.com/chcolte/fediverse-archive-bot-go/utils"
+)
+
+// 秘密鍵1と2の署名者
+var alice, bob = testSigner("01"), testSigner("02")
+
+func testSigner(key string) *nostr.Signer {
+	signer, err := nostr.NewSigner(strings.Repeat("0", 64-len(key)) + key)
+	if err != nil {
+		panic(err)
+	}
+	return signer
+}
+
+// signed は署名済みのイベントを作る
+func signed(t *testing.T, signer *nostr.Signer, createdAt int64, kind int, content string, tags ...[]string) *nostr.NostrEvent {
+	t.Helper()
+	event := &nostr.NostrEvent{CreatedAt: createdAt, Kind: kind, Tags: tags, Content: content}
+	if err := signer.Sign(event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func eventJSON(t *testing.T, event *nostr.NostrEvent) json.RawMessage {
+	t.Helper()
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// contents はクエリ結果のイベントの本文を新しい順に並べる
+func contents(idx *Index, filter Filter) string {
+	var result []string
+	for _, entry := range idx.Query(filter, 100) {
+		result = append(result, entry.Event.Content)
+	}
+	return strings.Join(result, ",")
+}
+
+func TestIndex(t *testing.T) {
+	idx := NewIndex()
+	add := func(event *nostr.NostrEvent) *nostr.NostrEvent {
+		idx.Add(eventJSON(t, event))
+		return event
+	}
+
+	note := add(signed(t, alice, 100, 1, "note"))
+	add(signed(t, bob, 200, 1, "reply", []string{"e", note.ID}))
+	add(signed(t, alice, 300, 0, "profile-new"))
+	add(signed(t, alice, 250, 0, "profile-old")) // 古いバージョンを後から受信
+	add(signed(t, alice, 150, 30023, "draft", []string{"d", "post"}))
+	add(signed(t, alice, 160, nostr.KindDeletion, "delete-post", []string{"a", "30023:" + alice.PubKey + ":post"}))
+	add(signed(t, alice, 170, 30023, "article", []string{"d", "post"})) // 削除より後のバージョンは残る
+	// 他人のイベントは削除できない
+	add(signed(t, bob, 400, nostr.KindDeletion, "delete-note", []string{"e", note.ID}))
+	idx.Add(eventJSON(t, note)) // 重複は無視
+	idx.sort()
+
+	if got, want := contents(idx, Filter{}), "delete-note,profile-new,reply,article,delete-post,note"; got != want {
+		t.Errorf("Query = %s, want %s", got, want)
+	}
+	if got := contents(idx, Filter{Authors: []string{alice.PubKey}, Kinds: []int{0}}); got != "profile-new" {
+		t.Errorf("Query(kind 0) = %s, want profile-new", got)
+	}
+	limit := 2
+	if got := contents(idx, Filter{Limit: &limit}); got != "delete-note,profile-new" {
+		t.Errorf("Query(limit 2) = %s", got)
+	}
+
+	// 本人の削除リクエストは，先に届いても後から届いたイベントを除く
+	late := signed(t, bob, 450, 1, "late")
+	add(signed(t, bob, 500, nostr.KindDeletion, "delete-late", []string{"e", late.ID}))
+	add(late)
+	idx.sort()
+	if got := contents(idx, Filter{IDs: []string{late.ID}}); got != "" {
+		t.Errorf("Query(deleted id) = %s, want nothing", got)
+	}
+
+	// IDや署名を検証できないイベントは索引に載せず，削除にも使わない
+	forged := signed(t, alice, 600, nostr.KindDeletion, "forged-delete", []string{"e", note.ID})
+	forged.Sig = signed(t, bob, 600, nostr.KindDeletion, "forged-delete", []string{"e", note.ID}).Sig // IDは正しいが署名が合わない
+	add(forged)
+	tampered := signed(t, alice, 700, 0, "profile-tampered")
+	tampered.Content = "profile-forged" // IDが内容と合わない
+	add(tampered)
+	idx.sort()
+	if got := contents(idx, Filter{Authors: []string{alice.PubKey}, Kinds: []int{0, 1, nostr.KindDeletion}}); got != "profile-new,delete-post,note" {
+		t.Errorf("Query after forged events = %s", got)
+	}
+}
+
+func TestBuildIndex(t *testing.T) {
+	dir := t.TempDir()
+	dailyDir := filepath.Join(dir, "nostr", "relay.example", "2026-01-01")
+	save := func(name string, data interface{}) {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := models.RawMessage{Data: raw, ReceivedAt: time.Now(), CreatedAt: time.Now(), DataType: "json"}
+		if err := utils.SaveMessage(utils.NewEnvelope(utils.RecordTypeMessage), msg, "session", filepath.Join(dailyDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventMessage := func(event *nostr.NostrEvent) []interface{} {
+		return []interface{}{"EVENT", "sub", event}
+	}
+
+	newer := signed(t, alice, 200, 0, "profile-new")
+	older := signed(t, alice, 100, 0, "profile-old")
+	deleted := signed(t, alice, 600, 1, "deleted")
+	save("2026-01-01_global_2026-01-01.jsonl", eventMessage(newer))
+	save("2026-01-01_global_2026-01-01.jsonl", eventMessage(signed(t, alice, 500, 1, "note")))
+	save("2026-01-01_global_2026-01-01.jsonl", []interface{}{"EOSE", "sub"})
+	save("2026-01-01_global_2026-01-01_0002.jsonl", eventMessage(older))
+	save("2026-01-01_global_2026-01-01_0002.jsonl", eventMessage(deleted))
+	// 削除リクエストのイベント本体は保存されておらず，記録だけが残っている
+	save("2026-01-01_global_deletions_2026-01-01.jsonl", nostr.DeletionRequest{
+		DeletionEventID: strings.Repeat("9", 64),
+		PubKey:          alice.PubKey,
+		CreatedAt:       700,
+		Targets:         []nostr.DeletionTarget{{Type: "e", EventID: deleted.ID}},
+	})
+	save("2026-01-01_global_replaceable_2026-01-01.jsonl", nostr.ReplaceableVersion{EventID: older.ID, SupersededBy: newer.ID})
+	// 観測記録や正規化済みの投稿はイベントとして読まない
+	save("2026-01-01_global_sightings_2026-01-01.jsonl", eventMessage(signed(t, alice, 700, 1, "sighting")))
+	save("2026-01-01_global_normalized_2026-01-01.jsonl", eventMessage(signed(t, alice, 800, 1, "normalized")))
+	save("crawl_sessions.jsonl", eventMessage(signed(t, alice, 900, 1, "session")))
+
+	idx, err := BuildIndex(filepath.Join(dir, "nostr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contents(idx, Filter{}), "note,profile-new"; got != want {
+		t.Errorf("Query = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,151 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/utils"
+	"golang.org/x/net/websocket"
+)
+
+// Server はアーカイブを読み取り専用のNIP-01リレーとして公開する
+type Server struct {
+	Index       *Index
+	Name        string
+	Description string
+	MaxLimit    int // 1フィルタあたりの最大返却数
+}
+
+// 新しい Server を作成
+func NewServer(index *Index) *Server {
+	return &Server{
+		Index:       index,
+		Name:        "fediverse-archive-bot archive relay",
+		Description: "Read-only relay serving archived Nostr events",
+		MaxLimit:    500,
+	}
+}
+
+// ServeHTTP はNIP-11のリクエストには情報ドキュメントを，それ以外はWebSocketとして扱う
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept"), "application/nostr+json") {
+		s.serveRelayInfo(w)
+		return
+	}
+	websocket.Server{
+		// ネイティブクライアントはOriginを送らないことがあるため検証しない
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   s.handleConn,
+	}.ServeHTTP(w, r)
+}
+
+// serveRelayInfo はNIP-11ドキュメントを返す
+func (s *Server) serveRelayInfo(w http.ResponseWriter) {
+	info := map[string]interface{}{
+		"name":           s.Name,
+		"description":    s.Description,
+		"supported_nips": []int{1, 11},
+		"software":       "https://github.com/chcolte/fediverse-archive-bot-go",
+		"version":        utils.ToolVersion,
+		"limitation": map[string]interface{}{
+			"max_limit":         s.MaxLimit,
+			"restricted_writes": true,
+		},
+	}
+	w.Header().Set("Content-Type", "application/nostr+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(info)
+}
+
+// handleConn は1クライアントとのWebSocketセッションを処理する
+func (s *Server) handleConn(ws *websocket.Conn) {
+	defer ws.Close()
+	remote := ws.Request().RemoteAddr
+	logger.Debugf("Relay client connected: %s", remote)
+
+	var mu sync.Mutex // 送信を直列化
+	send := func(v ...interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return websocket.JSON.Send(ws, v)
+	}
+
+	for {
+		var rawMsg string
+		if err := websocket.Message.Receive(ws, &rawMsg); err != nil {
+			logger.Debugf("Relay client disconnected: %s (%v)", remote, err)
+			return
+		}
+
+		var msg []json.RawMessage
+		if err := json.Unmarshal([]byte(rawMsg), &msg); err != nil || len(msg) < 1 {
+			send("NOTICE", "error: invalid message")
+			continue
+		}
+		var msgType string
+		if err := json.Unmarshal(msg[0], &msgType); err != nil {
+			send("NOTICE", "error: invalid message type")
+			continue
+		}
+
+		var err error
+		switch msgType {
+		case "REQ":
+			err = s.handleREQ(msg, send)
+		case "CLOSE":
+			// 購読はEOSEで完結しているため，保持している状態はない
+		case "EVENT":
+			err = s.rejectEVENT(msg, send)
+		default:
+			err = send("NOTICE", "error: unsupported message type: "+msgType)
+		}
+		if err != nil {
+			logger.Debugf("Relay send error to %s: %v", remote, err)
+			return
+		}
+	}
+}
+
+// handleREQ はフィルタに一致するイベントを送信し，EOSEで締めくくる
+func (s *Server) handleREQ(msg []json.RawMessage, send func(...interface{}) error) error {
+	if len(msg) < 2 {
+		return send("NOTICE", "error: REQ requires a subscription id")
+	}
+	var subID string
+	if err := json.Unmarshal(msg[1], &subID); err != nil || subID == "" {
+		return send("NOTICE", "error: invalid subscription id")
+	}
+
+	sent := make(map[string]bool)
+	for _, rawFilter := range msg[2:] {
+		var filter Filter
+		if err := json.Unmarshal(rawFilter, &filter); err != nil {
+			return send("CLOSED", subID, fmt.Sprintf("error: invalid filter: %v", err))
+		}
+		for _, entry := range s.Index.Query(filter, s.MaxLimit) {
+			if sent[entry.Event.ID] {
+				continue
+			}
+			sent[entry.Event.ID] = true
+			if err := send("EVENT", subID, entry.Raw); err != nil {
+				return err
+			}
+		}
+	}
+	return send("EOSE", subID)
+}
+
+// rejectEVENT は書き込みを拒否する (読み取り専用)
+func (s *Server) rejectEVENT(msg []json.RawMessage, send func(...interface{}) error) error {
+	var event struct {
+		ID string `json:"id"`
+	}
+	if len(msg) >= 2 {
+		json.Unmarshal(msg[1], &event)
+	}
+	return send("OK", event.ID, false, "blocked: this relay is a read-only archive")
+}
@@ -0,0 +1,309 @@
+package sqlitestore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+/*
+[SQLite]
+JSONLと並行して，受信したメッセージをSQLiteのデータベースに保存する。
+grep の代わりにSQLでアーカイブを検索できるようにするためのもの。
+
+  - records: メッセージのエンベロープ (record_id, server_session, saved_at, record_type) と生データ，
+    および抽出したフィールド (プラットフォーム，サーバー，タイムライン，作成・受信時刻)
+  - posts:   正規化した投稿 (models.Post)。投稿ID・投稿者・作成時刻で検索できる
+
+書き込みは WAL モードで行い，複数のメッセージを1つのトランザクションにまとめて挿入する。
+まとめた挿入が失敗したら1件ずつ挿入し直し，書き込めないレコードだけを捨てる (件数は Dropped で分かる)。
+時刻は UTC の固定幅の文字列 (2006-01-02T15:04:05.000000000Z) で保存するため，文字列のまま比較・並べ替えできる。
+例:
+
+	SELECT p.created_at, p.author_username, p.text FROM posts p
+	WHERE p.server = 'misskey.io' AND p.created_at >= '2026-01-01' ORDER BY p.created_at;
+*/
+
+// DefaultStore は保存先のデータベース。nil ならSQLiteに保存しない
+var DefaultStore *Store
+
+// 初期値
+const (
+	DefaultBatchSize     = 500
+	DefaultFlushInterval = time.Second
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS records (
+	record_id        TEXT PRIMARY KEY,
+	server_session   TEXT NOT NULL,
+	saved_at         TEXT NOT NULL,
+	record_type      TEXT NOT NULL,
+	crawl_session_id TEXT,
+	platform         TEXT,
+	server           TEXT,
+	timeline         TEXT,
+	stream           TEXT,
+	created_at       TEXT,
+	received_at      TEXT,
+	data_type        TEXT,
+	metadata         TEXT,
+	raw              BLOB
+);
+CREATE INDEX IF NOT EXISTS records_server_timeline ON records (server, timeline, created_at);
+CREATE INDEX IF NOT EXISTS records_crawl_session ON records (crawl_session_id);
+CREATE INDEX IF NOT EXISTS records_created_at ON records (created_at);
+
+CREATE TABLE IF NOT EXISTS posts (
+	record_id       TEXT NOT NULL REFERENCES records (record_id),
+	platform        TEXT NOT NULL,
+	server          TEXT,
+	timeline        TEXT,
+	post_id         TEXT NOT NULL,
+	uri             TEXT,
+	url             TEXT,
+	author_id       TEXT,
+	author_username TEXT,
+	author_host     TEXT,
+	created_at      TEXT,
+	visibility      TEXT,
+	text            TEXT,
+	reply_to        TEXT,
+	quote_of        TEXT,
+	boost_of        TEXT,
+	data            TEXT
+);
+CREATE INDEX IF NOT EXISTS posts_post_id ON posts (platform, post_id);
+CREATE INDEX IF NOT EXISTS posts_author ON posts (platform, author_id);
+CREATE INDEX IF NOT EXISTS posts_server_created_at ON posts (server, created_at);
+`
+
+const insertRecord = `INSERT OR IGNORE INTO records (record_id, server_session, saved_at, record_type, crawl_session_id,
+	platform, server, timeline, stream, created_at, received_at, data_type, metadata, raw)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+const insertPost = `INSERT INTO posts (record_id, platform, server, timeline, post_id, uri, url,
+	author_id, author_username, author_host, created_at, visibility, text, reply_to, quote_of, boost_of, data)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// Record は保存する1件のメッセージ
+type Record struct {
+	RecordID       string
+	ServerSession  string
+	SavedAt        time.Time
+	RecordType     string
+	CrawlSessionID string
+	Platform       string // サーバー種別 (misskey, mastodon, ...)
+	Server         string // ホスト名
+	Timeline       string
+	Stream         string // 別ストリーム (重複観測記録など) の名前
+	CreatedAt      time.Time
+	ReceivedAt     time.Time
+	DataType       string // json / cbor
+	Metadata       map[string]string
+	Raw            []byte
+	Posts          []models.Post
+}
+
+type Store struct {
+	BatchSize     int
+	FlushInterval time.Duration
+
+	db      *sql.DB
+	queue   chan Record
+	done    chan struct{}
+	closer  sync.Once
+	dropped atomic.Int64 // 書き込めずに捨てたレコードの数
+}
+
+// Open はデータベースを開き (なければ作成し)，書き込みを開始する
+func Open(path string, batchSize int, flushInterval time.Duration) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_foreign_keys=on")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	// 書き込みは1つの接続から行う
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create tables: %w", err)
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+	s := &Store{
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+		db:            db,
+		queue:         make(chan Record, batchSize*2),
+		done:          make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Add はメッセージを書き込み待ちに加える。待ちが一杯なら空くまで待つ
+func (s *Store) Add(record Record) {
+	if s == nil {
+		return
+	}
+	s.queue <- record
+}
+
+// Close は書き込み待ちのメッセージを全て書き込んでから閉じる
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.closer.Do(func() { close(s.queue) })
+	<-s.done
+	if dropped := s.Dropped(); dropped > 0 {
+		logger.Warnf("Dropped %d records that could not be written to SQLite", dropped)
+	}
+	return s.db.Close()
+}
+
+// Dropped は書き込めずに捨てたレコードの数を返す
+func (s *Store) Dropped() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.dropped.Load()
+}
+
+// run は BatchSize 件ごと，または FlushInterval ごとにまとめて書き込む
+func (s *Store) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, s.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		s.write(batch)
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case record, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) >= s.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// write はまとめて書き込み，失敗したら1件ずつ書き込み直して，書き込めないレコードだけを捨てる
+func (s *Store) write(batch []Record) {
+	err := s.insert(batch)
+	if err == nil {
+		return
+	}
+	if len(batch) > 1 {
+		logger.Warnf("Failed to write %d records to SQLite, retrying one by one: %v", len(batch), err)
+		for _, r := range batch {
+			if err := s.insert([]Record{r}); err != nil {
+				s.dropped.Add(1)
+				logger.Errorf("Dropped a record that could not be written to SQLite: %v", err)
+			}
+		}
+		return
+	}
+	s.dropped.Add(1)
+	logger.Errorf("Dropped a record that could not be written to SQLite: %v", err)
+}
+
+// insert は1つのトランザクションで書き込む
+func (s *Store) insert(batch []Record) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Commit 済みなら何もしない
+
+	recordStmt, err := tx.Prepare(insertRecord)
+	if err != nil {
+		return err
+	}
+	defer recordStmt.Close()
+	postStmt, err := tx.Prepare(insertPost)
+	if err != nil {
+		return err
+	}
+	defer postStmt.Close()
+
+	for _, r := range batch {
+		var metadata interface{}
+		if len(r.Metadata) > 0 {
+			data, _ := json.Marshal(r.Metadata)
+			metadata = string(data)
+		}
+		if _, err := recordStmt.Exec(r.RecordID, r.ServerSession, formatTime(r.SavedAt), r.RecordType, r.CrawlSessionID,
+			r.Platform, r.Server, r.Timeline, nullable(r.Stream), formatTime(r.CreatedAt), formatTime(r.ReceivedAt),
+			r.DataType, metadata, r.Raw); err != nil {
+			return fmt.Errorf("record %s: %w", r.RecordID, err)
+		}
+		for _, post := range r.Posts {
+			data, err := json.Marshal(post)
+			if err != nil {
+				return fmt.Errorf("post %s: %w", post.ID, err)
+			}
+			if _, err := postStmt.Exec(r.RecordID, post.Platform, post.Server, r.Timeline, post.ID, post.URI, post.URL,
+				post.Author.ID, post.Author.Username, post.Author.Host, formatTime(post.CreatedAt), post.Visibility,
+				post.Text, refID(post.ReplyTo), refID(post.QuoteOf), refID(post.BoostOf), string(data)); err != nil {
+				return fmt.Errorf("post %s: %w", post.ID, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// 時刻列の書式。RFC3339Nano は末尾の0を省くため文字列の順序と時刻の順序が一致しない。ナノ秒まで固定幅にする
+const timeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// formatTime は文字列で比較・並べ替えできるよう UTC の固定幅の書式にする
+func formatTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(timeLayout)
+}
+
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func refID(ref *models.PostRef) interface{} {
+	if ref == nil {
+		return nil
+	}
+	return ref.ID
+}
@@ -0,0 +1,59 @@
+package sqlitestore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/models"
+)
+
+func TestStoreSkipsOnlyBadRecords(t *testing.T) {
+	// 間隔では書き込まず，3件そろったらまとめて書き込む
+	store, err := Open(filepath.Join(t.TempDir(), "archive.db"), 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// record_id が bad のレコードだけ挿入に失敗させる
+	if _, err := store.db.Exec(`CREATE TRIGGER reject_bad BEFORE INSERT ON records WHEN NEW.record_id = 'bad'
+		BEGIN SELECT RAISE(ABORT, 'rejected'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, id := range []string{"a", "bad", "c"} {
+		store.Add(Record{RecordID: id, ServerSession: "s", SavedAt: now, RecordType: "message",
+			Posts: []models.Post{{ID: "post-" + id, Platform: "misskey"}}})
+	}
+	// Close は書き込みを待つが，db も閉じるため件数は先に数える
+	store.closer.Do(func() { close(store.queue) })
+	<-store.done
+
+	var records, posts int
+	store.db.QueryRow(`SELECT COUNT(*) FROM records`).Scan(&records)
+	store.db.QueryRow(`SELECT COUNT(*) FROM posts`).Scan(&posts)
+	if records != 2 || posts != 2 {
+		t.Errorf("wrote %d records and %d posts, want 2 and 2", records, posts)
+	}
+	if store.Dropped() != 1 {
+		t.Errorf("Dropped() = %d, want 1", store.Dropped())
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormatTimeSorts(t *testing.T) {
+	// 秒ちょうどと秒未満を含む時刻でも，文字列の順序が時刻の順序と一致する
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+	times := []time.Time{base, base.Add(100 * time.Millisecond), base.Add(time.Second), base.Add(time.Second + time.Nanosecond)}
+	for i := 1; i < len(times); i++ {
+		prev, cur := formatTime(times[i-1]).(string), formatTime(times[i]).(string)
+		if prev >= cur {
+			t.Errorf("%s sorts after %s", prev, cur)
+		}
+	}
+	if got := formatTime(base); got != "2025-12-31T15:00:00.000000000Z" {
+		t.Errorf("formatTime = %v", got)
+	}
+}
@@ -4,14 +4,13 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/chcolte/fediverse-archive-bot-go/logger"
 	"github.com/chcolte/fediverse-archive-bot-go/models"
+	"github.com/chcolte/fediverse-archive-bot-go/warc"
 	"github.com/google/uuid"
 )
 
@@ -28,8 +27,29 @@ const (
 	RecordTypeMetadata     = "metadata"
 	RecordTypeMessage      = "message"
 	RecordTypeMediaMapping = "media_mapping"
+	RecordTypePost         = "post"
+	RecordTypeSegment      = "segment"
 )
 
+// Envelope はJSONLの各レコードに付けるエンベロープ (data 以外の必須フィールド)。
+// 同じレコードを別の保存先 (SQLite等) にも書き込む場合に，IDと保存時刻を揃えるために使う
+type Envelope struct {
+	RecordID      string
+	ServerSession string
+	SavedAt       time.Time // JSONLには秒単位で書き込むため，秒未満は切り捨てておく
+	RecordType    string
+}
+
+// NewEnvelope は新しいレコードIDと現在時刻でエンベロープを作る
+func NewEnvelope(recordType string) Envelope {
+	return Envelope{
+		RecordID:      uuid.New().String(),
+		ServerSession: ServerSessionID,
+		SavedAt:       time.Now().Truncate(time.Second),
+		RecordType:    recordType,
+	}
+}
+
 // SaveRecord はJSONL形式で保存するベース関数。
 // エンベロープ（必須フィールド）のみを管理し、dataの中身は呼び出し側が構築する。
 //
@@ -39,6 +59,11 @@ const (
 //   - saved_at:        保存時刻（RFC3339）
 //   - record_type:     レコード種別
 func SaveRecord(recordType string, data interface{}, savePath string) error {
+	return SaveEnvelope(NewEnvelope(recordType), data, savePath)
+}
+
+// SaveEnvelope は呼び出し側が作ったエンベロープで保存する
+func SaveEnvelope(env Envelope, data interface{}, savePath string) error {
 	envelope := struct {
 		RecordID      string      `json:"record_id"`
 		ServerSession string      `json:"server_session"`
@@ -46,38 +71,26 @@ func SaveRecord(recordType string, data interface{}, savePath string) error {
 		RecordType    string      `json:"record_type"`
 		Data          interface{} `json:"data"`
 	}{
-		RecordID:      uuid.New().String(),
-		ServerSession: ServerSessionID,
-		SavedAt:       time.Now().Format(time.RFC3339),
-		RecordType:    recordType,
+		RecordID:      env.RecordID,
+		ServerSession: env.ServerSession,
+		SavedAt:       env.SavedAt.Format(time.RFC3339),
+		RecordType:    env.RecordType,
 		Data:          data,
 	}
 
-	line, err := json.Marshal(envelope)
-	if err != nil {
-		return fmt.Errorf("failed to marshal record: %w", err)
-	}
-
-	// ディレクトリを自動作成
-	dir := filepath.Dir(savePath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
-	}
-
 	// JSONL形式でappend
-	// TODO: 将来的には，ファイルを開きっぱなしにして，ストリームを流し込むような形にできないだろうか -> Encoder
-	// TODO: bufioも使えれば速そう
-	f, err := os.OpenFile(savePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+	// DefaultFilePool があればハンドルを開いたままバッファに書き込み，なければレコードごとに開閉する
+	var err error
+	if DefaultFilePool != nil {
+		err = DefaultFilePool.Encode(savePath, envelope)
+	} else {
+		err = appendRecord(savePath, envelope)
 	}
-	defer f.Close()
-
-	if _, err := f.WriteString(string(line) + "\n"); err != nil {
-		return fmt.Errorf("failed to write: %w", err)
+	if err != nil {
+		return err
 	}
 
-	logger.Debugf("Saved %s record to %s", recordType, savePath)
+	logger.Debugf("Saved %s record to %s", env.RecordType, savePath)
 	return nil
 }
 
@@ -109,9 +122,29 @@ func SaveArchiveInfo(savePath string, mode string, timelines []string, scope str
 		Scope:       scope,
 		SeedServers: strings.Join(urls, ","),
 	}
+	if err := warc.DefaultWriter.SetInfo(archiveWarcinfo(data.Software, mode, timelines, scope, urls)); err != nil {
+		logger.Errorf("Failed to write warcinfo: %v", err)
+	}
 	return SaveRecord(RecordTypeArchiveInfo, data, savePath)
 }
 
+// archiveWarcinfo はアーカイブ情報を warcinfo のフィールドにする
+func archiveWarcinfo(software, mode string, timelines []string, scope string, seedServers []string) warc.Fields {
+	var info warc.Fields
+	info.Add("software", software)
+	info.Add("format", "WARC File Format 1.0")
+	info.Add("conformsTo", "http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.0/")
+	if hostname, err := os.Hostname(); err == nil {
+		info.Add("hostname", hostname)
+	}
+	info.Add("server-session-id", ServerSessionID)
+	info.Add("mode", mode)
+	info.Add("timelines", strings.Join(timelines, ","))
+	info.Add("scope", scope)
+	info.Add("seed-servers", strings.Join(seedServers, ","))
+	return info
+}
+
 // computeDigest は生データのSHA256ダイジェストを計算する。
 func computeDigest(rawJSON []byte) string {
 	hash := sha256.Sum256(rawJSON)
@@ -143,6 +176,14 @@ func SaveRequest(rawJSON []byte, targetURL string, crawlSessionID string, savePa
 		"target_url":       targetURL,
 		"crawl_session_id": crawlSessionID,
 	}
+
+	// 接続・購読のリクエストはWARCでは metadata レコードとして残す
+	var fields warc.Fields
+	fields.Add("crawl-session-id", crawlSessionID)
+	fields.Add("sent-message", string(rawJSON))
+	if err := warc.DefaultWriter.WriteMetadata(targetURL, "", fields); err != nil {
+		logger.Errorf("Failed to write WARC metadata: %v", err)
+	}
 	return SaveRecord(RecordTypeRequest, buildDataWithContent(rawJSON, meta), savePath)
 }
 
@@ -158,7 +199,8 @@ func SaveMetadata(rawJSON []byte, crawlSessionID string, savePath string, meta m
 }
 
 // SaveMessage は受信メッセージをエンベロープ付きで保存する。
-func SaveMessage(msg models.RawMessage, crawlSessionID string, savePath string) error {
+// env は NewEnvelope(RecordTypeMessage) で作ったもの (SQLite等に同じレコードIDで書き込むため呼び出し側が作る)
+func SaveMessage(env Envelope, msg models.RawMessage, crawlSessionID string, savePath string) error {
 	meta := map[string]interface{}{
 		"crawl_session_id": crawlSessionID,
 		"received_at":      msg.ReceivedAt.Format(time.RFC3339),
@@ -168,5 +210,20 @@ func SaveMessage(msg models.RawMessage, crawlSessionID string, savePath string)
 	for k, v := range msg.Metadata {
 		meta[k] = v
 	}
-	return SaveRecord(RecordTypeMessage, buildDataWithContent(msg.Data, meta), savePath)
+	return SaveEnvelope(env, buildDataWithContent(msg.Data, meta), savePath)
+}
+
+// SavePost は正規化した投稿を保存する。
+// raw_sha256 は元になった生データのダイジェストで，message レコードとの対応付けに使う。
+func SavePost(post models.Post, msg models.RawMessage, crawlSessionID string, savePath string) error {
+	data := struct {
+		models.Post
+		CrawlSessionID string `json:"crawl_session_id"`
+		RawSHA256      string `json:"raw_sha256"`
+	}{
+		Post:           post,
+		CrawlSessionID: crawlSessionID,
+		RawSHA256:      computeDigest(msg.Data),
+	}
+	return SaveRecord(RecordTypePost, data, savePath)
 }
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 1件のメッセージに相当するレコード
+var benchmarkData = map[string]interface{}{
+	"raw":              `{"type":"channel","body":{"id":"global","type":"note","body":{"id":"9xyz","text":"hello fediverse"}}}`,
+	"crawl_session_id": "5f0c3b9e-0000-4000-8000-000000000000",
+	"created_at":       "2026-01-01T00:00:00Z",
+	"received_at":      "2026-01-01T00:00:00Z",
+}
+
+// go test ./utils -run '^$' -bench SaveRecord
+func BenchmarkSaveRecord(b *testing.B) {
+	b.Run("write-through", func(b *testing.B) {
+		benchmarkSaveRecord(b, nil)
+	})
+	b.Run("pooled", func(b *testing.B) {
+		benchmarkSaveRecord(b, NewFilePool(DefaultFlushInterval, DefaultIdleTimeout))
+	})
+}
+
+func benchmarkSaveRecord(b *testing.B, pool *FilePool) {
+	DefaultFilePool = pool
+	defer func() { DefaultFilePool = nil }()
+	savePath := filepath.Join(b.TempDir(), "2026-01-01", "2026-01-01_global_2026-01-01.jsonl")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if err := SaveRecord(RecordTypeMessage, benchmarkData, savePath); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// 書き出しまでを計測に含める
+	if err := pool.Close(); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "records/s")
+}
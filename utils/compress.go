@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+[圧縮]
+JSONLは拡張子で圧縮方式を判別する (.jsonl.gz / .jsonl.zst)。
+
+gzip のメンバー，zstd のフレームはそれぞれ連結しても1つのファイルとして展開できるため，
+書き込みのたびに独立したメンバー (フレーム) を追記する。これにより再起動後も
+同じファイルに追記でき，途中で中断しても書き込み済みの部分は展開できる。
+*/
+
+// 圧縮方式
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// ParseCompression は圧縮方式の名前を解釈する
+func ParseCompression(name string) (Compression, error) {
+	switch Compression(name) {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip, CompressionZstd:
+		return Compression(name), nil
+	}
+	return "", fmt.Errorf("unsupported compression: %s (none, gzip or zstd)", name)
+}
+
+// Ext は圧縮方式の拡張子 (.gz / .zst)
+func (c Compression) Ext() string {
+	switch c {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// CompressionOf はファイル名の拡張子から圧縮方式を判別する。
+// 書き込み中のセグメント (.jsonl.gz.part など) は .part の前の拡張子で判別する
+func CompressionOf(path string) Compression {
+	path = strings.TrimSuffix(path, ".part")
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return CompressionGzip
+	case strings.HasSuffix(path, ".zst"):
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+// TrimCompressionExt はファイル名から圧縮の拡張子を除く (.part は先に除いておくこと)
+func TrimCompressionExt(name string) string {
+	return strings.TrimSuffix(name, CompressionOf(name).Ext())
+}
+
+// NewCompressWriter は w に独立したメンバー (フレーム) を書き込む Writer を返す。
+// Close でメンバーを閉じる (w は閉じない)
+func NewCompressWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// OpenReader はファイルを拡張子に応じて展開しながら読む
+func OpenReader(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	switch CompressionOf(path) {
+	case CompressionGzip:
+		gz, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		return readCloser{Reader: gz, closers: []io.Closer{gz, file}}, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(bufio.NewReader(file))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		return readCloser{Reader: zr, closers: []io.Closer{zstdCloser{zr}, file}}, nil
+	}
+	return file, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r readCloser) Close() error {
+	var first error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+type zstdCloser struct{ d *zstd.Decoder }
+
+func (z zstdCloser) Close() error {
+	z.d.Close()
+	return nil
+}
+
+// CompressTo は src を圧縮して dst (拡張子で圧縮方式を判別) に書き出す。
+// 一時ファイル (dst.tmp) に書き出してから rename するため，dst は完成するまで現れない。
+// src はそのまま残す
+func CompressTo(src, dst string) error {
+	c := CompressionOf(dst)
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // rename 済みなら何もしない
+
+	zw, err := NewCompressWriter(out, c)
+	if err == nil {
+		_, err = io.Copy(zw, in)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compress %s: %w", src, err)
+	}
+	return os.Rename(tmp, dst)
+}
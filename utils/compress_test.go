@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readAll はファイルを拡張子に応じて展開して読む
+func readAll(t *testing.T, path string) string {
+	t.Helper()
+	r, err := OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCompressTo(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "segment.jsonl")
+	content := strings.Repeat(`{"record_type":"message","data":{}}`+"\n", 100)
+	if err := os.WriteFile(src, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		dst := src + c.Ext()
+		if err := CompressTo(src, dst); err != nil {
+			t.Fatal(err)
+		}
+		if CompressionOf(dst) != c || TrimCompressionExt(filepath.Base(dst)) != "segment.jsonl" {
+			t.Errorf("%s: compression is not recognized from the file name", dst)
+		}
+		if got := readAll(t, dst); got != content {
+			t.Errorf("%s: decompressed %d bytes, want %d", c, len(got), len(content))
+		}
+		if _, err := os.Stat(dst + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("%s: temporary file left", c)
+		}
+	}
+
+	// 既にある出力先は上書きしない
+	if err := CompressTo(src, src+CompressionGzip.Ext()); err == nil {
+		t.Error("CompressTo overwrote an existing file")
+	}
+	if _, err := ParseCompression("bzip2"); err == nil {
+		t.Error("ParseCompression accepted bzip2")
+	}
+}
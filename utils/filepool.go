@@ -0,0 +1,397 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+)
+
+/*
+[ファイルハンドルの共有]
+SaveRecord がレコードごとに open / write / close するとシステムコールが多く，
+流量の多いタイムラインでは主な負荷になる。FilePool は出力ファイルごとにハンドルを開いたままにし，
+バッファに書き込んだレコードを一定間隔でまとめてファイルに書き出す。
+
+  - FlushInterval ごと，および Close 時にバッファを書き出す
+  - IdleTimeout の間書き込みのなかったファイルは閉じる
+  - 圧縮 (.gz / .zst) の場合は書き出しごとに独立したメンバー (フレーム) を閉じる
+  - AfterFlush で，レコードが書き出された後に行う処理 (重複排除テーブルの永続化など) を登録できる
+
+異常終了した場合は，最後の書き出しから FlushInterval の間に保存したレコードが失われうる。
+*/
+
+// DefaultFilePool は SaveRecord が使うファイルハンドルの共有先。nil ならレコードごとに開閉する
+var DefaultFilePool *FilePool
+
+// 書き出し間隔・アイドル時間の初期値
+const (
+	DefaultFlushInterval = time.Second
+	DefaultIdleTimeout   = 5 * time.Minute
+)
+
+// バッファの大きさ
+const poolBufferSize = 64 * 1024
+
+type FilePool struct {
+	FlushInterval time.Duration
+	IdleTimeout   time.Duration
+
+	mu     sync.Mutex
+	files  map[string]*pooledFile
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// pooledFile は開いたままの出力ファイル
+type pooledFile struct {
+	path        string
+	file        *os.File
+	buf         *bufio.Writer
+	compression Compression
+	zw          io.WriteCloser // 書き込み中の圧縮メンバー (次の書き出しで閉じる)
+	written     int64          // ファイルに書き出した大きさ (圧縮後)
+	dirty       bool
+	lastUsed    time.Time
+	afterFlush  []func() // 次の書き出しの後に呼ぶ関数
+	onDrop      []func() // 書き出せずにハンドルを捨てた場合に呼ぶ関数
+}
+
+// 新しい FilePool を作成し，定期的な書き出しを開始する
+func NewFilePool(flushInterval, idleTimeout time.Duration) *FilePool {
+	p := &FilePool{
+		FlushInterval: flushInterval,
+		IdleTimeout:   idleTimeout,
+		files:         make(map[string]*pooledFile),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Encode は v をJSONの1行として path に追記する (バッファに書き込む)。
+// Close 後はレコードごとに開閉して書き込む
+func (p *FilePool) Encode(path string, v interface{}) error {
+	// 先に変換し，変換できないレコードではハンドルに触らない
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return appendLine(path, line)
+	}
+
+	f, ok := p.files[path]
+	if !ok {
+		var err error
+		if f, err = openPooledFile(path); err != nil {
+			return err
+		}
+		p.files[path] = f
+	}
+	f.lastUsed = time.Now()
+	f.dirty = true
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		// バッファが満杯で書き出しに失敗した場合は，それまでの分を書き出せるだけ書き出して閉じ，次の Encode で開き直す
+		if flushErr := f.flush(); flushErr != nil {
+			logger.Errorf("Failed to flush %s: %v", path, flushErr)
+		}
+		p.drop(path, f)
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	return nil
+}
+
+// AfterFlush は path に書き込んだレコードがファイルに書き出された後に fn を呼ぶ。
+// 書き出し済み (または FilePool を使っていない) ならすぐに呼ぶ。
+// 書き出せないままハンドルを捨てた場合は，代わりに failed を呼ぶ (どちらも nil なら何もしない)
+func (p *FilePool) AfterFlush(path string, fn, failed func()) {
+	if p != nil {
+		p.mu.Lock()
+		f, ok := p.files[path]
+		if ok && f.dirty {
+			if fn != nil {
+				f.afterFlush = append(f.afterFlush, fn)
+			}
+			if failed != nil {
+				f.onDrop = append(f.onDrop, failed)
+			}
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+	}
+	if fn != nil {
+		fn()
+	}
+}
+
+// Size は path のファイルのディスク上の大きさ (圧縮後) を返す。
+// 書き出し待ちのバッファも含むが，閉じていない圧縮メンバーの分は書き出すまで数えない
+func (p *FilePool) Size(path string) (int64, error) {
+	if p != nil {
+		p.mu.Lock()
+		f, ok := p.files[path]
+		var size int64
+		if ok {
+			size = f.written + int64(f.buf.Buffered())
+		}
+		p.mu.Unlock()
+		if ok {
+			return size, nil
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// CloseFile は path のファイルを書き出して閉じる (rename 等の前に呼ぶ)
+func (p *FilePool) CloseFile(path string) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.files[path]
+	if !ok {
+		return nil
+	}
+	delete(p.files, path)
+	return f.close()
+}
+
+// Flush は全てのファイルのバッファを書き出す
+func (p *FilePool) Flush() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var first error
+	for path, f := range p.files {
+		if err := p.flushFile(path, f); err != nil && first == nil {
+			first = fmt.Errorf("failed to flush %s: %w", path, err)
+		}
+	}
+	return first
+}
+
+// Close は定期的な書き出しを止め，全てのファイルを書き出して閉じる
+func (p *FilePool) Close() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.stop)
+	var first error
+	for path, f := range p.files {
+		if err := f.close(); err != nil && first == nil {
+			first = fmt.Errorf("failed to close %s: %w", path, err)
+		}
+		delete(p.files, path)
+	}
+	p.mu.Unlock()
+	<-p.done
+	return first
+}
+
+// run は FlushInterval ごとにバッファを書き出し，使われなくなったファイルを閉じる
+func (p *FilePool) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			p.tick(now)
+		}
+	}
+}
+
+func (p *FilePool) tick(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for path, f := range p.files {
+		if p.IdleTimeout > 0 && now.Sub(f.lastUsed) >= p.IdleTimeout {
+			if err := f.close(); err != nil {
+				logger.Errorf("Failed to close %s: %v", path, err)
+			}
+			delete(p.files, path)
+			continue
+		}
+		if err := p.flushFile(path, f); err != nil {
+			logger.Errorf("Failed to flush %s: %v", path, err)
+		}
+	}
+}
+
+// flushFile はバッファを書き出す。失敗したらハンドルを閉じて外し，次の Encode で開き直す (ロック取得済みであること)
+func (p *FilePool) flushFile(path string, f *pooledFile) error {
+	err := f.flush()
+	if err != nil {
+		p.drop(path, f)
+	}
+	return err
+}
+
+// drop は書き込みに失敗したハンドルを閉じて外す。
+// 書き出せなかったレコードは AfterFlush の fn ではなく failed を呼ぶ (ロック取得済みであること)
+func (p *FilePool) drop(path string, f *pooledFile) {
+	if f.zw != nil {
+		f.zw.Close()
+		f.zw = nil
+	}
+	f.file.Close()
+	f.fail()
+	delete(p.files, path)
+}
+
+func openPooledFile(path string) (*pooledFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	f := &pooledFile{
+		path:        path,
+		file:        file,
+		compression: CompressionOf(path),
+		written:     info.Size(),
+	}
+	f.buf = bufio.NewWriterSize(writerFunc(f.writeFile), poolBufferSize)
+	return f, nil
+}
+
+// Write はバッファ (圧縮する場合は圧縮メンバー) に書き込む
+func (f *pooledFile) Write(p []byte) (int, error) {
+	var w io.Writer = f.buf
+	if f.compression != CompressionNone {
+		if f.zw == nil {
+			zw, err := NewCompressWriter(f.buf, f.compression)
+			if err != nil {
+				return 0, err
+			}
+			f.zw = zw
+		}
+		w = f.zw
+	}
+	return w.Write(p)
+}
+
+// writeFile はバッファから書き出された分をファイルに書き込み，大きさを数える
+func (f *pooledFile) writeFile(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (fn writerFunc) Write(p []byte) (int, error) { return fn(p) }
+
+// flush は圧縮メンバーを閉じ，バッファをファイルに書き出す
+func (f *pooledFile) flush() error {
+	if !f.dirty {
+		return nil
+	}
+	if f.zw != nil {
+		err := f.zw.Close()
+		f.zw = nil
+		if err != nil {
+			return err
+		}
+	}
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	f.dirty = false
+	for _, fn := range f.afterFlush {
+		fn()
+	}
+	f.afterFlush = nil
+	f.onDrop = nil
+	return nil
+}
+
+// fail は書き出せなかったレコードの failed を呼ぶ
+func (f *pooledFile) fail() {
+	for _, fn := range f.onDrop {
+		fn()
+	}
+	f.afterFlush = nil
+	f.onDrop = nil
+}
+
+func (f *pooledFile) close() error {
+	err := f.flush()
+	if err != nil {
+		f.fail()
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// appendRecord は v をJSONの1行として path に追記する (レコードごとに開閉する)
+func appendRecord(path string, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	return appendLine(path, line)
+}
+
+// appendLine はJSONの1行を path に追記する (レコードごとに開閉する)
+func appendLine(path string, line []byte) error {
+	// ディレクトリを自動作成
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	// .gz / .zst なら1行ごとに独立したメンバー (フレーム) として追記する
+	zw, err := NewCompressWriter(f, CompressionOf(path))
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	if _, err := zw.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	return nil
+}
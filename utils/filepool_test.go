@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilePool(t *testing.T) {
+	// 自動では書き出さない (テストの中で Flush と tick を呼ぶ)
+	pool := NewFilePool(time.Hour, time.Minute)
+	defer pool.Close()
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "sub", "records.jsonl")
+	zst := filepath.Join(dir, "records.jsonl.zst")
+
+	var flushed []string
+	pool.Encode(plain, "a")
+	pool.Encode(zst, "a")
+	pool.AfterFlush(plain, func() { flushed = append(flushed, "plain") }, nil)
+
+	// 1. 書き出すまではバッファにある
+	if got := readAll(t, plain); got != "" || len(flushed) != 0 {
+		t.Fatalf("before flush: content %q, callbacks %v", got, flushed)
+	}
+
+	// 2. 書き出した後に AfterFlush の関数を呼ぶ
+	if err := pool.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, plain); got != "\"a\"\n" {
+		t.Errorf("after flush = %q", got)
+	}
+	if strings.Join(flushed, ",") != "plain" {
+		t.Errorf("callbacks = %v", flushed)
+	}
+	// 書き出し済みならすぐに呼ぶ
+	pool.AfterFlush(plain, func() { flushed = append(flushed, "again") }, nil)
+	if len(flushed) != 2 {
+		t.Errorf("callback for a flushed file was not called immediately")
+	}
+
+	// 3. 圧縮メンバーは書き出しごとに閉じるため，続けて追記しても展開できる
+	pool.Encode(zst, "b")
+	pool.Flush()
+	if got := readAll(t, zst); got != "\"a\"\n\"b\"\n" {
+		t.Errorf("zstd content = %q", got)
+	}
+
+	// 4. 使われなくなったファイルは閉じ，次の書き込みで開き直して追記する
+	pool.tick(time.Now().Add(2 * time.Minute))
+	if len(pool.files) != 0 {
+		t.Errorf("%d files still open after the idle timeout", len(pool.files))
+	}
+	pool.Encode(plain, "b")
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, plain); got != "\"a\"\n\"b\"\n" {
+		t.Errorf("reopened content = %q", got)
+	}
+
+	// 5. Close 後はレコードごとに開閉して書き込む
+	if err := pool.Encode(plain, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, plain); !strings.HasSuffix(got, "\"c\"\n") {
+		t.Errorf("content after close = %q", got)
+	}
+}
+
+func TestFilePoolFlushError(t *testing.T) {
+	// 書き込むと常に ENOSPC になる
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("/dev/full is not available")
+	}
+	full.Close()
+
+	pool := NewFilePool(time.Hour, time.Hour)
+	defer pool.Close()
+	called, failed := false, false
+	pool.Encode("/dev/full", "lost")
+	pool.AfterFlush("/dev/full", func() { called = true }, func() { failed = true })
+
+	if err := pool.Flush(); err == nil {
+		t.Fatal("Flush to /dev/full succeeded")
+	}
+	if called {
+		t.Error("AfterFlush was called for records that were not written")
+	}
+	if !failed {
+		t.Error("failed was not called for records that were not written")
+	}
+	// 失敗したハンドルは外し，次の書き込みで開き直す
+	if _, open := pool.files["/dev/full"]; open {
+		t.Error("failed handle is still in the pool")
+	}
+	if err := pool.Encode("/dev/full", "retry"); err != nil {
+		t.Errorf("Encode after a failed flush = %v", err)
+	}
+}
+
+func TestFilePoolEncodeError(t *testing.T) {
+	pool := NewFilePool(time.Hour, time.Hour)
+	defer pool.Close()
+	path := filepath.Join(t.TempDir(), "records.jsonl.gz")
+
+	// 変換できないレコードは書き込まず，前後のレコードはそのまま残る
+	if err := pool.Encode(path, json.RawMessage(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Encode(path, json.RawMessage(`{broken`)); err == nil {
+		t.Error("Encode of invalid raw JSON succeeded")
+	}
+	if err := pool.Encode(path, json.RawMessage(`{"b":2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, _ := io.ReadAll(r)
+	if got := string(data); got != "{\"a\":1}\n{\"b\":2}\n" {
+		t.Errorf("records = %q", got)
+	}
+}
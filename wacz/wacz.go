@@ -0,0 +1,322 @@
+package wacz
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/chcolte/fediverse-archive-bot-go/warc"
+)
+
+/*
+[WACZ]
+WARCファイルから1日分，または1つのクロールセッション分のレコードを選び，
+pywb / ReplayWeb.page でそのまま再生できる WACZ (Web Archive Collection Zipped) にまとめる。
+
+	archive/data.warc.gz      選んだレコード (レコードごとのgzipメンバー，zip内では無圧縮)
+	indexes/index.cdx         data.warc.gz のCDXJ索引
+	pages/pages.jsonl         取得したページ (HTTPレスポンス) の一覧
+	datapackage.json          各ファイルのハッシュと大きさ
+	datapackage-digest.json   datapackage.json のハッシュ
+*/
+
+const (
+	Version     = "1.1.1"
+	archiveName = "data.warc.gz"
+)
+
+// Options はパッケージに含めるレコードの条件とパッケージの情報
+type Options struct {
+	Title    string
+	Software string
+	Date     time.Time // この日 (UTC) のレコードだけを含める (ゼロなら絞り込まない)
+	Session  string    // このクロールセッションのレコードだけを含める (空なら絞り込まない)
+}
+
+// DataPackage は datapackage.json
+type DataPackage struct {
+	Profile     string     `json:"profile"`
+	WACZVersion string     `json:"wacz_version"`
+	Title       string     `json:"title,omitempty"`
+	Created     string     `json:"created"`
+	Software    string     `json:"software,omitempty"`
+	Resources   []Resource `json:"resources"`
+}
+
+// Resource はパッケージ内の1ファイル
+type Resource struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Hash  string `json:"hash"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Page は pages.jsonl の1行
+type Page struct {
+	ID    string `json:"id"`
+	URL   string `json:"url"`
+	TS    string `json:"ts"`
+	Title string `json:"title,omitempty"`
+}
+
+// Create は files から条件に合うレコードを選び，out に WACZ を作成する。
+// 含めたレコードの件数を返す
+func Create(out string, files []string, opts Options) (int, error) {
+	selected, err := newSelector(files, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	archive, err := os.CreateTemp("", "wacz-*.warc.gz")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	data := &hashWriter{w: archive, h: sha256.New()}
+	var entries []warc.IndexEntry
+	var pages []Page
+	seenPages := make(map[string]bool)
+	count := 0
+
+	writeRecord := func(record *warc.ReadRecord) error {
+		offset := data.n
+		gz := gzip.NewWriter(data)
+		if _, err := record.WriteTo(gz); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		count++
+
+		written := &warc.ReadRecord{Record: record.Record, Offset: offset, Length: data.n - offset}
+		entry, ok := warc.NewIndexEntry(written, archiveName)
+		if !ok {
+			return nil
+		}
+		entries = append(entries, entry)
+		if record.Type == warc.TypeResponse && strings.HasPrefix(entry.Status, "2") &&
+			strings.HasPrefix(entry.URL, "http") && !seenPages[entry.URL] {
+			seenPages[entry.URL] = true
+			pages = append(pages, Page{
+				ID:  uuid.New().String(),
+				URL: entry.URL,
+				TS:  record.Date.UTC().Format(time.RFC3339),
+			})
+		}
+		return nil
+	}
+
+	for _, file := range files {
+		// 各ファイルの warcinfo は，そのファイルから最初のレコードを選んだときに書き込む
+		var info *warc.ReadRecord
+		err := warc.ReadFile(file, func(record *warc.ReadRecord) error {
+			if record.Type == warc.TypeWarcinfo {
+				info = record
+				return nil
+			}
+			if !selected(record) {
+				return nil
+			}
+			if info != nil {
+				if err := writeRecord(info); err != nil {
+					return err
+				}
+				info = nil
+			}
+			return writeRecord(record)
+		})
+		if err != nil {
+			return count, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("no records matched")
+	}
+
+	var index, pageList bytes.Buffer
+	if err := warc.WriteCDXJ(&index, entries); err != nil {
+		return count, err
+	}
+	if err := writePages(&pageList, pages); err != nil {
+		return count, err
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return count, err
+	}
+	return count, writeZip(out, opts, archive, data, index.Bytes(), pageList.Bytes())
+}
+
+// writeZip はパッケージのzipファイルを作成する
+func writeZip(out string, opts Options, archive io.Reader, data *hashWriter, index, pages []byte) error {
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	zw := zip.NewWriter(file)
+
+	resources := []Resource{
+		{Name: "pages.jsonl", Path: "pages/pages.jsonl", Hash: sha256Hex(pages), Bytes: int64(len(pages))},
+		{Name: "index.cdx", Path: "indexes/index.cdx", Hash: sha256Hex(index), Bytes: int64(len(index))},
+		{Name: archiveName, Path: "archive/" + archiveName, Hash: "sha256:" + hex.EncodeToString(data.h.Sum(nil)), Bytes: data.n},
+	}
+	if err := writeEntry(zw, resources[0].Path, zip.Deflate, bytes.NewReader(pages)); err != nil {
+		return err
+	}
+	if err := writeEntry(zw, resources[1].Path, zip.Deflate, bytes.NewReader(index)); err != nil {
+		return err
+	}
+	// WARCは既にgzipで圧縮済みで，再生時にオフセットで読むため無圧縮で格納する
+	if err := writeEntry(zw, resources[2].Path, zip.Store, archive); err != nil {
+		return err
+	}
+
+	pkg, err := json.MarshalIndent(DataPackage{
+		Profile:     "data-package",
+		WACZVersion: Version,
+		Title:       opts.Title,
+		Created:     time.Now().UTC().Format(time.RFC3339),
+		Software:    opts.Software,
+		Resources:   resources,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeEntry(zw, "datapackage.json", zip.Deflate, bytes.NewReader(pkg)); err != nil {
+		return err
+	}
+	digest, err := json.MarshalIndent(map[string]string{
+		"path": "datapackage.json",
+		"hash": sha256Hex(pkg),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeEntry(zw, "datapackage-digest.json", zip.Deflate, bytes.NewReader(digest)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeEntry(zw *zip.Writer, name string, method uint16, r io.Reader) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to add %s: %w", name, err)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to add %s: %w", name, err)
+	}
+	return nil
+}
+
+// writePages は pages.jsonl (先頭行はヘッダー) を書き出す
+func writePages(w io.Writer, pages []Page) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	header := map[string]string{"format": "json-pages-1.0", "id": "pages", "title": "All Pages"}
+	if err := encoder.Encode(header); err != nil {
+		return err
+	}
+	for _, page := range pages {
+		if err := encoder.Encode(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newSelector はパッケージに含めるレコードを判定する関数を作る。
+//
+//   - Date:    WARC-Date がその日 (UTC) のレコード
+//   - Session: crawl-session-id がそのセッションの metadata レコードと，それが参照する
+//     resource レコード，およびセッションの期間内に取得したメディア等 (request / response)
+func newSelector(files []string, opts Options) (func(*warc.ReadRecord) bool, error) {
+	inDate := func(*warc.ReadRecord) bool { return true }
+	if !opts.Date.IsZero() {
+		start := opts.Date.UTC().Truncate(24 * time.Hour)
+		end := start.Add(24 * time.Hour)
+		inDate = func(record *warc.ReadRecord) bool {
+			return !record.Date.Before(start) && record.Date.Before(end)
+		}
+	}
+	if opts.Session == "" {
+		return inDate, nil
+	}
+
+	metadata := make(map[string]bool)
+	refers := make(map[string]bool)
+	var first, last time.Time
+	for _, file := range files {
+		err := warc.ReadFile(file, func(record *warc.ReadRecord) error {
+			if record.Type != warc.TypeMetadata || warc.ParseFields(record.Block).Get("crawl-session-id") != opts.Session {
+				return nil
+			}
+			metadata[record.ID()] = true
+			if refersTo := record.Header("WARC-Refers-To"); refersTo != "" {
+				refers[refersTo] = true
+			}
+			if first.IsZero() || record.Date.Before(first) {
+				first = record.Date
+			}
+			if record.Date.After(last) {
+				last = record.Date
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+	}
+	if len(metadata) == 0 {
+		return nil, fmt.Errorf("no records for crawl session %s", opts.Session)
+	}
+
+	return func(record *warc.ReadRecord) bool {
+		if !inDate(record) {
+			return false
+		}
+		switch record.Type {
+		case warc.TypeMetadata:
+			return metadata[record.ID()]
+		case warc.TypeResource:
+			return refers[record.ID()]
+		case warc.TypeRequest, warc.TypeResponse:
+			// メディア等の取得はセッションを記録していないため，期間で判定する
+			return !record.Date.Before(first) && !record.Date.After(last)
+		}
+		return false
+	}, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// hashWriter は書き込んだバイト数とハッシュを求める
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func (hw *hashWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	hw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,165 @@
+package warc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+[CDXJ]
+pywb / ReplayWeb.page が使うインデックス形式。1行が1件のキャプチャで，
+
+	<SURT> <14桁のタイムスタンプ> {"url": ..., "mime": ..., "status": ..., "digest": ..., "length": ..., "offset": ..., "filename": ...}
+
+の形になる。行は SURT，タイムスタンプの順に並べる。
+response (メディア・NodeInfo) と resource (受信メッセージ) を索引に載せる。
+*/
+
+// IndexEntry はCDXJの1行
+type IndexEntry struct {
+	URLKey    string `json:"-"`
+	Timestamp string `json:"-"`
+
+	URL      string `json:"url"`
+	Mime     string `json:"mime,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	Length   string `json:"length"`
+	Offset   string `json:"offset"`
+	Filename string `json:"filename"`
+}
+
+// String はCDXJの1行 (改行なし) にする
+func (e IndexEntry) String() string {
+	data, _ := json.Marshal(e)
+	return e.URLKey + " " + e.Timestamp + " " + string(data)
+}
+
+// NewIndexEntry は読み込んだレコードから索引の行を作る。
+// 索引に載せないレコード (warcinfo, request, metadata) なら false を返す
+func NewIndexEntry(record *ReadRecord, filename string) (IndexEntry, bool) {
+	targetURI := record.Header("WARC-Target-URI")
+	if targetURI == "" {
+		return IndexEntry{}, false
+	}
+	entry := IndexEntry{
+		URLKey:    SURT(targetURI),
+		Timestamp: record.Date.UTC().Format("20060102150405"),
+		URL:       targetURI,
+		Length:    strconv.FormatInt(record.Length, 10),
+		Offset:    strconv.FormatInt(record.Offset, 10),
+		Filename:  filename,
+	}
+	switch record.Type {
+	case TypeResponse:
+		entry.Status, entry.Mime = parseHTTPResponse(record.Block)
+		entry.Digest = record.Header("WARC-Payload-Digest")
+	case TypeResource:
+		entry.Status = "200"
+		entry.Mime = mediaType(record.Header("Content-Type"))
+		entry.Digest = Digest(record.Block)
+	default:
+		return IndexEntry{}, false
+	}
+	return entry, true
+}
+
+// IndexFile はWARCファイルの索引を作る。filename は索引に記録するファイル名
+func IndexFile(path, filename string) ([]IndexEntry, error) {
+	var entries []IndexEntry
+	err := ReadFile(path, func(record *ReadRecord) error {
+		if entry, ok := NewIndexEntry(record, filename); ok {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// WriteCDXJ は索引を並べ替えて書き出す
+func WriteCDXJ(w io.Writer, entries []IndexEntry) error {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].URLKey != entries[j].URLKey {
+			return entries[i].URLKey < entries[j].URLKey
+		}
+		return entries[i].Timestamp < entries[j].Timestamp
+	})
+	bw := bufio.NewWriter(w)
+	for _, entry := range entries {
+		if _, err := fmt.Fprintln(bw, entry.String()); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// SURT はURLを索引のキー (Sort-friendly URI Reordering Transform) にする。
+// 例: https://www.example.com/a?b=2&a=1 → com,example)/a?a=1&b=2
+func SURT(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		// urn: 等はそのまま
+		return strings.ToLower(rawURL)
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	labels := strings.Split(host, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	key := strings.Join(labels, ",")
+	if port := u.Port(); port != "" && !isDefaultPort(u.Scheme, port) {
+		key += ":" + port
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	key += ")" + path
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		sort.Strings(params)
+		key += "?" + strings.Join(params, "&")
+	}
+	return strings.ToLower(key)
+}
+
+func isDefaultPort(scheme, port string) bool {
+	switch scheme {
+	case "http", "ws":
+		return port == "80"
+	case "https", "wss":
+		return port == "443"
+	}
+	return false
+}
+
+// parseHTTPResponse はresponseレコードのブロックからステータスコードとContent-Typeを取り出す
+func parseHTTPResponse(block []byte) (status, mime string) {
+	head, _, _ := bytes.Cut(block, []byte("\r\n\r\n"))
+	lines := strings.Split(string(head), "\r\n")
+	if parts := strings.Fields(lines[0]); len(parts) >= 2 {
+		status = parts[1]
+	}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(name, "Content-Type") {
+			mime = mediaType(value)
+		}
+	}
+	return status, mime
+}
+
+// mediaType はContent-Typeからパラメーターを除く
+func mediaType(contentType string) string {
+	mime, _, _ := strings.Cut(contentType, ";")
+	return strings.TrimSpace(mime)
+}
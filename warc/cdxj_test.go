@@ -0,0 +1,79 @@
+package warc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSURT(t *testing.T) {
+	for rawURL, want := range map[string]string{
+		"https://www.Example.com/a?b=2&a=1":      "com,example)/a?a=1&b=2",
+		"wss://relay.example.com:443/":           "com,example,relay)/",
+		"https://example.com:8443/x":             "com,example:8443)/x",
+		"http://media.example.co.jp/files/A.png": "jp,co,example,media)/files/a.png",
+		"urn:uuid:ABC":                           "urn:uuid:abc",
+	} {
+		if got := SURT(rawURL); got != want {
+			t.Errorf("SURT(%q) = %q, want %q", rawURL, got, want)
+		}
+	}
+}
+
+func TestIndexFile(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, "test", 0, true)
+	date := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	w.WriteResource("wss://relay.example.com/", "application/json; charset=utf-8", date, []byte(`["EVENT","b"]`), Fields{{Name: "timeline", Value: "global"}})
+	w.WriteResource("wss://a.example.com/", "application/json", date, []byte(`["EVENT","a"]`), nil)
+	w.Close()
+
+	files, err := ListFiles(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("ListFiles = %v, %v", files, err)
+	}
+	entries, err := IndexFile(files[0], "test.warc.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// warcinfo と metadata は索引に載せない
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if e := entries[0]; e.URLKey != "com,example,relay)/" || e.Timestamp != "20260102030405" || e.Mime != "application/json" || e.Status != "200" {
+		t.Errorf("entry = %+v", e)
+	}
+
+	// offset と length の範囲だけで，そのレコードのgzipメンバーを読める
+	data, _ := os.ReadFile(files[0])
+	for _, entry := range entries {
+		offset, _ := strconv.Atoi(entry.Offset)
+		length, _ := strconv.Atoi(entry.Length)
+		zr, err := gzip.NewReader(bytes.NewReader(data[offset : offset+length]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := readRecord(bufio.NewReader(zr))
+		if err != nil {
+			t.Fatalf("record at %d: %v", offset, err)
+		}
+		if got := record.Headers.Get("WARC-Target-URI"); got != entry.URL {
+			t.Errorf("record at %d is %s, want %s", offset, got, entry.URL)
+		}
+	}
+
+	// CDXJ はURLキーの順に並べる
+	var buf bytes.Buffer
+	if err := WriteCDXJ(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "com,example,a)/ 20260102030405 {") {
+		t.Errorf("CDXJ =\n%s", buf.String())
+	}
+}
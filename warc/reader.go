@@ -0,0 +1,219 @@
+package warc
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReadRecord は読み込んだレコードと，ファイル内の位置
+type ReadRecord struct {
+	*Record
+	Offset int64 // ファイル先頭からの位置 (gzipならメンバーの先頭)
+	Length int64 // ファイル上の長さ (gzipなら圧縮後の長さ)
+}
+
+// Header は読み込んだレコードのヘッダーの値を返す
+func (r *ReadRecord) Header(name string) string {
+	return r.Headers.Get(name)
+}
+
+// ListFiles はディレクトリ内のWARCファイル (.warc / .warc.gz) を名前順に返す
+func ListFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && (strings.HasSuffix(name, ".warc") || strings.HasSuffix(name, ".warc.gz")) {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ReadFile はWARCファイル (.warc / .warc.gz) のレコードを順に fn に渡す。
+// 読み込んだレコードは Record.WriteTo でそのまま書き出せる
+// (Headers には WriteTo が付け直すヘッダーを含めない)
+func ReadFile(path string, fn func(*ReadRecord) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	cr := &countingReader{r: bufio.NewReader(file)}
+	if strings.HasSuffix(path, ".gz") {
+		return readGzip(cr, fn)
+	}
+	for {
+		offset := cr.n
+		record, err := readRecord(cr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s at offset %d: %w", path, offset, err)
+		}
+		if err := fn(&ReadRecord{Record: record, Offset: offset, Length: cr.n - offset}); err != nil {
+			return err
+		}
+	}
+}
+
+// readGzip はレコードごとのgzipメンバーを1つずつ展開して読む
+func readGzip(cr *countingReader, fn func(*ReadRecord) error) error {
+	var gz *gzip.Reader
+	for {
+		offset := cr.n
+		var err error
+		if gz == nil {
+			gz, err = gzip.NewReader(cr)
+		} else {
+			err = gz.Reset(cr)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("gzip member at offset %d: %w", offset, err)
+		}
+		gz.Multistream(false)
+
+		br := bufio.NewReader(gz)
+		record, err := readRecord(br)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		// メンバーの末尾 (gzipのフッター) まで読み進める
+		if _, err := io.Copy(io.Discard, br); err != nil {
+			return fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		if err := fn(&ReadRecord{Record: record, Offset: offset, Length: cr.n - offset}); err != nil {
+			return err
+		}
+	}
+}
+
+// byteReader はレコードの読み込みに使うリーダー
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readRecord は1件のレコードを読む。
+// 非圧縮のファイルではオフセットを正確に数えるため，r は余分に先読みしてはならない
+func readRecord(r byteReader) (*Record, error) {
+	line, err := readLine(r)
+	if err == io.EOF && line == "" {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "WARC/") {
+		return nil, fmt.Errorf("invalid WARC version line: %q", line)
+	}
+
+	var headers Fields
+	var id, length string
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header line: %q", line)
+		}
+		field := Field{Name: name, Value: strings.TrimSpace(value)}
+		switch strings.ToLower(field.Name) {
+		case "warc-record-id":
+			id = field.Value
+		case "content-length":
+			length = field.Value
+		case "warc-block-digest":
+			// WriteTo で付け直す
+		default:
+			headers = append(headers, field)
+		}
+	}
+
+	size, err := strconv.Atoi(length)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length: %w", err)
+	}
+	block := make([]byte, size)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, fmt.Errorf("truncated block: %w", err)
+	}
+	// レコード末尾の \r\n\r\n
+	for i := 0; i < 4; i++ {
+		if _, err := r.ReadByte(); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	}
+
+	record := &Record{Block: block, id: id}
+	for _, field := range headers {
+		switch strings.ToLower(field.Name) {
+		case "warc-type":
+			record.Type = field.Value
+		case "warc-date":
+			record.Date, _ = time.Parse(time.RFC3339Nano, field.Value)
+		default:
+			record.Headers = append(record.Headers, field)
+		}
+	}
+	return record, nil
+}
+
+// readLine は \r\n (または \n) までの1行を読む
+func readLine(r io.ByteReader) (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return sb.String(), err
+		}
+		if b == '\n' {
+			return strings.TrimSuffix(sb.String(), "\r"), nil
+		}
+		sb.WriteByte(b)
+	}
+}
+
+// countingReader は読み進めたバイト数を数える。
+// io.ByteReader を実装するため，gzip はメンバーの末尾を超えて読まない
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
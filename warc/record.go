@@ -0,0 +1,175 @@
+package warc
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// レコード種別 (ISO 28500)
+const (
+	TypeWarcinfo = "warcinfo"
+	TypeRequest  = "request"
+	TypeResponse = "response"
+	TypeResource = "resource"
+	TypeMetadata = "metadata"
+)
+
+// ヘッダーやwarc-fields形式のブロックに使う順序付きのフィールド
+type Field struct {
+	Name  string
+	Value string
+}
+
+type Fields []Field
+
+// Add はフィールドを追加する (値が空なら追加しない)
+func (f *Fields) Add(name, value string) {
+	if value == "" {
+		return
+	}
+	*f = append(*f, Field{Name: name, Value: value})
+}
+
+// Get は最初に見つかったフィールドの値を返す
+func (f Fields) Get(name string) string {
+	for _, field := range f {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Bytes は application/warc-fields 形式にする
+func (f Fields) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, field := range f {
+		// 改行はヘッダーを壊すため空白にする
+		value := strings.NewReplacer("\r", " ", "\n", " ").Replace(field.Value)
+		fmt.Fprintf(&buf, "%s: %s\r\n", field.Name, value)
+	}
+	return buf.Bytes()
+}
+
+// ParseFields は application/warc-fields 形式のブロックを読む
+func ParseFields(block []byte) Fields {
+	var fields Fields
+	for _, line := range strings.Split(string(block), "\n") {
+		name, value, ok := strings.Cut(strings.TrimSuffix(line, "\r"), ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, Field{Name: name, Value: strings.TrimSpace(value)})
+	}
+	return fields
+}
+
+// Record は1件のWARCレコード
+type Record struct {
+	Type    string
+	Headers Fields // WARC-Type, WARC-Record-ID, WARC-Date, Content-Length, ダイジェスト以外のヘッダー
+	Block   []byte
+	Date    time.Time
+
+	id string
+}
+
+// NewRecord は新しいレコードを作成する
+func NewRecord(recordType string, date time.Time, block []byte) *Record {
+	if date.IsZero() {
+		date = time.Now()
+	}
+	return &Record{
+		Type:  recordType,
+		Block: block,
+		Date:  date,
+		id:    "<urn:uuid:" + uuid.New().String() + ">",
+	}
+}
+
+// ID は WARC-Record-ID (<urn:uuid:...>)
+func (r *Record) ID() string {
+	return r.id
+}
+
+// WriteTo はレコードを書き出す
+func (r *Record) WriteTo(w io.Writer) (int64, error) {
+	var head Fields
+	head.Add("WARC-Type", r.Type)
+	head.Add("WARC-Record-ID", r.id)
+	head.Add("WARC-Date", r.Date.UTC().Format(time.RFC3339))
+	head = append(head, r.Headers...)
+	head.Add("WARC-Block-Digest", Digest(r.Block))
+	head.Add("Content-Length", strconv.Itoa(len(r.Block)))
+
+	var buf bytes.Buffer
+	buf.WriteString("WARC/1.0\r\n")
+	buf.Write(head.Bytes())
+	buf.WriteString("\r\n")
+	buf.Write(r.Block)
+	buf.WriteString("\r\n\r\n")
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// Digest はWARCで一般的な SHA-1 (Base32) のダイジェスト
+func Digest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// HTTPRequestBlock はHTTPリクエストをWARCの request レコードのブロックにする
+func HTTPRequestBlock(req *http.Request) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	fmt.Fprintf(&buf, "Host: %s\r\n", req.URL.Host)
+	writeHeader(&buf, req.Header)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// HTTPResponseBlock はHTTPレスポンスをWARCの response レコードのブロックにする。
+// body は転送エンコーディングを解いた後の本文なので，Content-Length を付け直す
+func HTTPResponseBlock(resp *http.Response, body []byte) []byte {
+	header := resp.Header.Clone()
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	if resp.Uncompressed {
+		// Goが透過的に展開した本文には Content-Encoding が当てはまらない
+		header.Del("Content-Encoding")
+	}
+
+	var buf bytes.Buffer
+	proto := resp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	fmt.Fprintf(&buf, "%s %s\r\n", proto, resp.Status)
+	writeHeader(&buf, header)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func writeHeader(buf *bytes.Buffer, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package warc
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+[WARC出力]
+JSONLと並行して，標準的なウェブアーカイブのツール (pywb 等) で扱える
+ISO 28500 WARC ファイルを書き出す。
+
+  - warcinfo:           アーカイブ情報 (各ファイルの先頭)
+  - request/response:   メディア・NodeInfo の取得
+  - resource/metadata:  WebSocket等で受信したメッセージと，その付随情報
+
+ファイルが MaxSize を超えたら次のファイルに切り替える。
+Gzip の場合はレコードごとに独立したgzipメンバーにする (.warc.gz)。
+*/
+
+// DefaultWriter はWARC出力先。nil ならWARCを出力しない
+var DefaultWriter *Writer
+
+// 1ファイルの大きさの初期値 (WARCの慣習的な上限)
+const DefaultMaxSize = 1 << 30
+
+type Writer struct {
+	Dir     string // 出力ディレクトリ
+	Prefix  string // ファイル名の接頭辞
+	MaxSize int64  // この大きさを超えたら次のファイルに切り替える (0なら切り替えない)
+	Gzip    bool
+
+	mu     sync.Mutex
+	file   *os.File
+	name   string
+	size   int64
+	serial int
+	info   Fields // warcinfo の内容
+}
+
+// 新しい Writer を作成 (ファイルは最初のレコードを書き込むときに作る)
+func NewWriter(dir, prefix string, maxSize int64, gzip bool) *Writer {
+	return &Writer{
+		Dir:     dir,
+		Prefix:  prefix,
+		MaxSize: maxSize,
+		Gzip:    gzip,
+	}
+}
+
+// SetInfo は warcinfo の内容を設定し，現在のファイルに warcinfo レコードを書き込む。
+// 以降に切り替えたファイルの先頭にも同じ warcinfo を書き込む
+func (w *Writer) SetInfo(info Fields) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.info = info
+	if w.file == nil {
+		return w.rotate()
+	}
+	return w.write(w.warcinfo())
+}
+
+// WriteHTTP はHTTPの取得を request / response レコードの組として書き込む
+func (w *Writer) WriteHTTP(resp *http.Response, body []byte) error {
+	if w == nil || resp.Request == nil {
+		return nil
+	}
+	now := time.Now()
+	targetURI := resp.Request.URL.String()
+
+	response := NewRecord(TypeResponse, now, HTTPResponseBlock(resp, body))
+	response.Headers.Add("WARC-Target-URI", targetURI)
+	response.Headers.Add("WARC-Payload-Digest", Digest(body))
+	response.Headers.Add("Content-Type", "application/http; msgtype=response")
+
+	request := NewRecord(TypeRequest, now, HTTPRequestBlock(resp.Request))
+	request.Headers.Add("WARC-Target-URI", targetURI)
+	request.Headers.Add("WARC-Concurrent-To", response.ID())
+	request.Headers.Add("Content-Type", "application/http; msgtype=request")
+
+	return w.Write(response, request)
+}
+
+// WriteResource は受信したメッセージを resource レコードとして書き込む。
+// metadata があれば，それを参照する metadata レコードを同じファイルに続けて書き込む
+func (w *Writer) WriteResource(targetURI, contentType string, date time.Time, block []byte, metadata Fields) error {
+	if w == nil {
+		return nil
+	}
+	resource := NewRecord(TypeResource, date, block)
+	resource.Headers.Add("WARC-Target-URI", targetURI)
+	resource.Headers.Add("Content-Type", contentType)
+	if len(metadata) == 0 {
+		return w.Write(resource)
+	}
+	return w.Write(resource, newMetadata(targetURI, resource.ID(), metadata))
+}
+
+// WriteMetadata は付随情報を metadata レコードとして書き込む。
+// refersTo があれば，そのレコードについての情報として関連付ける
+func (w *Writer) WriteMetadata(targetURI, refersTo string, fields Fields) error {
+	if w == nil {
+		return nil
+	}
+	return w.Write(newMetadata(targetURI, refersTo, fields))
+}
+
+func newMetadata(targetURI, refersTo string, fields Fields) *Record {
+	record := NewRecord(TypeMetadata, time.Now(), fields.Bytes())
+	record.Headers.Add("WARC-Target-URI", targetURI)
+	record.Headers.Add("WARC-Refers-To", refersTo)
+	record.Headers.Add("Content-Type", "application/warc-fields")
+	return record
+}
+
+// Write はレコードを順に書き込む。まとめて渡したレコードは同じファイルに入る
+func (w *Writer) Write(records ...*Record) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil || (w.MaxSize > 0 && w.size >= w.MaxSize) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	for _, record := range records {
+		if err := w.write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close は現在のファイルを閉じる
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// rotate は次のファイルを開き，先頭に warcinfo を書き込む
+func (w *Writer) rotate() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return fmt.Errorf("failed to close %s: %w", w.name, err)
+		}
+		w.file = nil
+	}
+	if err := os.MkdirAll(w.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	w.serial++
+	ext := ".warc"
+	if w.Gzip {
+		ext += ".gz"
+	}
+	w.name = fmt.Sprintf("%s-%s-%05d%s", w.Prefix, time.Now().UTC().Format("20060102150405"), w.serial, ext)
+	file, err := os.OpenFile(filepath.Join(w.Dir, w.name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", w.name, err)
+	}
+	w.file = file
+	w.size = 0
+	return w.write(w.warcinfo())
+}
+
+func (w *Writer) warcinfo() *Record {
+	record := NewRecord(TypeWarcinfo, time.Now(), w.info.Bytes())
+	record.Headers.Add("WARC-Filename", w.name)
+	record.Headers.Add("Content-Type", "application/warc-fields")
+	return record
+}
+
+// write は1件のレコードを現在のファイルに書き込む
+func (w *Writer) write(record *Record) error {
+	counter := &countingWriter{w: w.file}
+	if w.Gzip {
+		gz := gzip.NewWriter(counter)
+		if _, err := record.WriteTo(gz); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	} else if _, err := record.WriteTo(counter); err != nil {
+		return err
+	}
+	w.size += counter.n
+	return nil
+}
+
+type countingWriter struct {
+	w *os.File
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,108 @@
+package warc
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, "test", 0, true)
+	if err := w.SetInfo(Fields{{Name: "software", Value: "fediverse-archive-bot"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	reqURL, _ := url.Parse("https://media.example.com/a.png")
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Proto:      "HTTP/1.1",
+		Header:     http.Header{"Content-Type": {"image/png"}},
+		Request:    &http.Request{Method: "GET", URL: reqURL, Header: http.Header{}},
+	}
+	if err := w.WriteHTTP(resp, []byte("\x89PNG")); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := w.WriteResource("wss://relay.example.com/", "application/json", date, []byte(`["EVENT"]`), Fields{{Name: "timeline", Value: "global"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "test-*-00001.warc.gz"))
+	if len(matches) != 1 {
+		t.Fatalf("files = %v", matches)
+	}
+	// レコードごとのgzipメンバーは続けて展開できる
+	file, err := os.Open(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+
+	types := regexp.MustCompile(`WARC-Type: (\w+)`).FindAllStringSubmatch(content, -1)
+	var got []string
+	for _, m := range types {
+		got = append(got, m[1])
+	}
+	if want := "warcinfo,response,request,resource,metadata"; strings.Join(got, ",") != want {
+		t.Errorf("record types = %v, want %s", got, want)
+	}
+
+	// request は response を，metadata は resource を参照する
+	ids := regexp.MustCompile(`WARC-Record-ID: (<[^>]+>)`).FindAllStringSubmatch(content, -1)
+	if len(ids) != 5 {
+		t.Fatalf("got %d record IDs", len(ids))
+	}
+	if !strings.Contains(content, "WARC-Concurrent-To: "+ids[1][1]) {
+		t.Error("request does not refer to the response")
+	}
+	if !strings.Contains(content, "WARC-Refers-To: "+ids[3][1]) {
+		t.Error("metadata does not refer to the resource")
+	}
+	if !strings.Contains(content, "WARC-Date: 2026-01-02T03:04:05Z") {
+		t.Error("resource date is not the receive time")
+	}
+}
+
+func TestWriterRotate(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, "test", 1, false)
+	for i := 0; i < 3; i++ {
+		if err := w.WriteResource("urn:test", "text/plain", time.Now(), []byte("x"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.warc"))
+	if len(matches) != 3 {
+		t.Fatalf("files = %v, want 3 files", matches)
+	}
+	// 切り替えたファイルもそれぞれ warcinfo から始まる
+	for _, path := range matches {
+		data, _ := os.ReadFile(path)
+		if !strings.HasPrefix(string(data), "WARC/1.0\r\nWARC-Type: warcinfo\r\n") {
+			t.Errorf("%s does not start with warcinfo", filepath.Base(path))
+		}
+	}
+}
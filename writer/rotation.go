@@ -0,0 +1,569 @@
+package writer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/logger"
+	"github.com/chcolte/fediverse-archive-bot-go/utils"
+)
+
+/*
+[ファイルのローテーション]
+メッセージのJSONLは，保存時刻の期間 (日・時間) ごと，および大きさ・件数の上限ごとに
+セグメントとして分割する。
+
+	<作成日>_<タイムライン>[_<ストリーム>]_<期間>[_<連番>].jsonl
+
+  - 期間は daily なら 2006-01-02，hourly なら 2006-01-02T15 (保存時刻)
+  - 同じ期間の2つ目以降のセグメントには _0002 からの連番を付ける
+  - 書き込み中のセグメントは末尾に .part を付け，完成したら rename で外す
+  - Compression を指定した場合は，書き込み中から圧縮する (.jsonl.gz.part / .jsonl.zst.part)。
+    書き出しごとに独立したメンバーを追記するため，再起動後も .part にそのまま追記できる
+  - MaxBytes はディスク上の大きさ (圧縮する場合は圧縮後) で数える
+  - 完成したセグメントは日付ディレクトリの completed_segments.jsonl に記録する
+
+外部の同期ジョブは .part の付いていないファイル (または completed_segments.jsonl に
+記録されたファイル) だけを扱えば，書き込み途中のファイルを拾わない。
+
+異常終了した場合の扱い:
+  - 今の期間の .part は，再起動後に続きから書き込む。最終行が途中で切れていれば改行で終端してから追記する。
+    圧縮した .part の末尾のメンバーが途中で切れていれば，展開できる部分だけを圧縮し直す
+  - 過ぎた期間の .part は，起動時に FinishStaleSegments で完成させる
+*/
+
+// ローテーションの期間
+const (
+	RotateDaily  = "daily"
+	RotateHourly = "hourly"
+)
+
+// 書き込み中のセグメントの接尾辞
+const PartSuffix = ".part"
+
+// 完成したセグメントを記録するファイル名 (日付ディレクトリごと)
+const CompletedSegmentsFile = "completed_segments.jsonl"
+
+// RotationPolicy はセグメントを切り替える条件
+type RotationPolicy struct {
+	Interval   string // RotateDaily または RotateHourly
+	MaxBytes   int64  // ディスク上の大きさ (圧縮後) がこれに達したら切り替える (0なら無制限)
+	MaxRecords int    // この件数に達したら切り替える (0なら無制限)
+
+	Compression utils.Compression // 新しく開くセグメントの圧縮方式
+}
+
+// DefaultRotation は全ての Writer が使うローテーション条件
+var DefaultRotation = RotationPolicy{Interval: RotateDaily, Compression: utils.CompressionNone}
+
+// Validate は条件が正しいかを確認する
+func (p RotationPolicy) Validate() error {
+	switch p.Interval {
+	case RotateDaily, RotateHourly:
+	default:
+		return fmt.Errorf("unsupported rotation interval: %s (daily or hourly)", p.Interval)
+	}
+	if p.MaxBytes < 0 || p.MaxRecords < 0 {
+		return fmt.Errorf("rotation limits must not be negative")
+	}
+	if _, err := utils.ParseCompression(string(p.Compression)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// period は保存時刻の属する期間
+func (p RotationPolicy) period(t time.Time) string {
+	if p.Interval == RotateHourly {
+		return t.Format("2006-01-02T15")
+	}
+	return t.Format("2006-01-02")
+}
+
+func (p RotationPolicy) full(seg *segment) bool {
+	return (p.MaxBytes > 0 && seg.bytes >= p.MaxBytes) ||
+		(p.MaxRecords > 0 && seg.records >= p.MaxRecords)
+}
+
+// segment は書き込み中のファイル
+type segment struct {
+	dir      string // 日付ディレクトリ
+	name     string // 完成後のファイル名
+	period   string
+	seq      int
+	bytes    int64 // ディスク上の大きさ
+	records  int
+	openedAt time.Time
+
+	compression utils.Compression // 書き込み中のファイルの圧縮方式
+}
+
+func (s *segment) path() string {
+	return filepath.Join(s.dir, s.name) + s.compression.Ext() + PartSuffix
+}
+
+// segmentName は決まった規則でセグメントのファイル名を作る
+func segmentName(base, period string, seq int) string {
+	if seq > 1 {
+		return fmt.Sprintf("%s_%s_%04d.jsonl", base, period, seq)
+	}
+	return base + "_" + period + ".jsonl"
+}
+
+// segmentPattern は segmentName の作るファイル名 (期間と連番) に一致する
+var segmentPattern = regexp.MustCompile(`_(\d{4}-\d{2}-\d{2}(?:T\d{2})?)(?:_(\d{4}))?\.jsonl$`)
+
+// SplitSegmentName はセグメントのファイル名 (.part・圧縮の拡張子を除いたもの) を
+// ストリームの名前・期間・連番に分ける。同じストリームのセグメントは期間・連番の順に書き込まれる
+func SplitSegmentName(name string) (base, period string, seq int, ok bool) {
+	period, seq, ok = parseSegmentName(name)
+	if !ok {
+		return "", "", 0, false
+	}
+	return name[:segmentPattern.FindStringIndex(name)[0]], period, seq, true
+}
+
+// parseSegmentName はセグメントのファイル名から期間と連番を取り出す
+func parseSegmentName(name string) (period string, seq int, ok bool) {
+	m := segmentPattern.FindStringSubmatch(name)
+	if m == nil {
+		return "", 0, false
+	}
+	seq = 1
+	if m[2] != "" {
+		seq, _ = strconv.Atoi(m[2])
+	}
+	return m[1], seq, true
+}
+
+// segmentPath は dir/base のストリームに今書き込むべきファイル (.part) のパスを返す。
+// 期間が変わっていれば，書き込み中のセグメントを完成させて次のセグメントに切り替える
+func (w *Writer) segmentPath(dir, base string, now time.Time) (string, error) {
+	if w.segments == nil {
+		w.segments = make(map[string]*segment)
+	}
+	key := filepath.Join(dir, base)
+	period := DefaultRotation.period(now)
+
+	seg := w.segments[key]
+	if seg != nil && seg.period != period {
+		w.finishSegment(key, seg)
+		seg = nil
+	}
+	if seg == nil {
+		var err error
+		if seg, err = openSegment(dir, base, period, 1); err != nil {
+			return "", err
+		}
+		w.segments[key] = seg
+	}
+	return seg.path(), nil
+}
+
+// recordWritten は書き込み後にセグメントの大きさと件数を更新し，上限に達したら完成させる
+func (w *Writer) recordWritten(dir, base string, records int) {
+	key := filepath.Join(dir, base)
+	seg := w.segments[key]
+	if seg == nil {
+		return
+	}
+	seg.records += records
+	if size, err := utils.DefaultFilePool.Size(seg.path()); err == nil {
+		seg.bytes = size
+	}
+	if DefaultRotation.full(seg) {
+		w.finishSegment(key, seg)
+		// 同じ期間の次のセグメントは次の書き込みで開く
+		next, err := openSegment(dir, base, seg.period, seg.seq+1)
+		if err != nil {
+			logger.Errorf("Failed to open next segment of %s: %v", key, err)
+			return
+		}
+		w.segments[key] = next
+	}
+}
+
+// finishExpired は期間の過ぎたセグメントを完成させる (メッセージが途絶えた場合のため)
+func (w *Writer) finishExpired(now time.Time) {
+	period := DefaultRotation.period(now)
+	for key, seg := range w.segments {
+		if seg.period != period {
+			w.finishSegment(key, seg)
+		}
+	}
+}
+
+// finishAll は全てのセグメントを完成させる
+func (w *Writer) finishAll() {
+	for key, seg := range w.segments {
+		w.finishSegment(key, seg)
+	}
+}
+
+// openSegment は seq 番目以降で，まだ完成していないセグメントを開く。
+// 前回の書き込み中のセグメント (.part) が残っていれば，その圧縮方式のまま続きに書き込む
+func openSegment(dir, base, period string, seq int) (*segment, error) {
+	for ; ; seq++ {
+		seg := &segment{dir: dir, name: segmentName(base, period, seq), period: period, seq: seq, openedAt: time.Now()}
+		completed, err := segmentCompleted(dir, seg.name)
+		if err != nil {
+			return nil, err
+		}
+		if completed {
+			continue
+		}
+		if seg.compression, err = partCompression(dir, seg.name); err != nil {
+			return nil, err
+		}
+		if err := seg.load(); err != nil {
+			return nil, err
+		}
+		return seg, nil
+	}
+}
+
+// partCompression は name の書き込み中のファイルが残っていればその圧縮方式を，なければ DefaultRotation の圧縮方式を返す
+func partCompression(dir, name string) (utils.Compression, error) {
+	for _, c := range []utils.Compression{utils.CompressionNone, utils.CompressionGzip, utils.CompressionZstd} {
+		_, err := os.Stat(filepath.Join(dir, name+c.Ext()+PartSuffix))
+		if err == nil {
+			return c, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return DefaultRotation.Compression, nil
+}
+
+// load は前回の書き込み中のセグメント (.part) が残っていれば，その大きさと件数を読み込む。
+// 最終行が途中で切れていれば (書き込み中の異常終了)，次のレコードと混ざらないよう改行で終端する
+func (s *segment) load() error {
+	info, err := os.Stat(s.path())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.bytes = info.Size()
+	if s.bytes == 0 {
+		return nil
+	}
+	if s.compression != utils.CompressionNone {
+		return s.loadCompressed()
+	}
+
+	file, err := os.OpenFile(s.path(), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, s.bytes-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		logger.Warnf("Terminated an incomplete last line of %s", s.path())
+		if _, err := file.Write([]byte("\n")); err != nil {
+			return err
+		}
+		s.bytes++
+	}
+
+	// 件数は行数 (ファイル全体を読み込まないよう少しずつ数える)
+	s.records, err = countLines(io.NewSectionReader(file, 0, s.bytes))
+	return err
+}
+
+// loadCompressed は圧縮した .part を展開して件数を数える。
+// 末尾のメンバーが途中で切れていれば (書き込み中の異常終了)，展開できる部分だけを圧縮し直して置き換える
+func (s *segment) loadCompressed() error {
+	r, err := utils.OpenReader(s.path())
+	if err != nil {
+		return err
+	}
+	var last byte
+	s.records, last, err = countLinesLast(r)
+	r.Close()
+	if err != nil {
+		logger.Warnf("Recompressing the readable part of %s: %v", s.path(), err)
+		return s.recompress()
+	}
+
+	// 展開できても最終行が終端していなければ，改行だけのメンバーを追記する
+	if last != '\n' {
+		logger.Warnf("Terminated an incomplete last line of %s", s.path())
+		file, err := os.OpenFile(s.path(), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		zw, err := utils.NewCompressWriter(file, s.compression)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write([]byte("\n")); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		s.records++
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		s.bytes = info.Size()
+	}
+	return nil
+}
+
+// recompress は .part の展開できる部分を改行で終端して圧縮し直し，置き換える
+func (s *segment) recompress() error {
+	src, err := utils.OpenReader(s.path())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpPath := s.path() + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer tmp.Close()
+	zw, err := utils.NewCompressWriter(tmp, s.compression)
+	if err != nil {
+		return err
+	}
+
+	// 展開に失敗するまでの部分を書き写す
+	var lw lastByteWriter
+	io.Copy(io.MultiWriter(zw, &lw), src)
+	if lw.n > 0 && lw.last != '\n' {
+		if _, err := zw.Write([]byte("\n")); err != nil {
+			return err
+		}
+		lw.lines++
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path()); err != nil {
+		return err
+	}
+	info, err := os.Stat(s.path())
+	if err != nil {
+		return err
+	}
+	s.bytes = info.Size()
+	s.records = lw.lines
+	return nil
+}
+
+// lastByteWriter は書き込まれた大きさ・行数・最後のバイトを記録する
+type lastByteWriter struct {
+	n     int64
+	lines int
+	last  byte
+}
+
+func (w *lastByteWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		w.n += int64(len(p))
+		w.lines += bytes.Count(p, []byte("\n"))
+		w.last = p[len(p)-1]
+	}
+	return len(p), nil
+}
+
+func countLines(r io.Reader) (int, error) {
+	count, _, err := countLinesLast(r)
+	return count, err
+}
+
+// countLinesLast は行数と最後のバイトを返す
+func countLinesLast(r io.Reader) (int, byte, error) {
+	var w lastByteWriter
+	_, err := io.Copy(&w, r)
+	return w.lines, w.last, err
+}
+
+// FinishStaleSegments は dir 以下に残っている，今の期間でない書き込み中のセグメント (.part) を完成させる。
+// 前回の実行が異常終了した場合や，期間が過ぎてから再起動した場合に残る (今の期間のセグメントは続きに書き込む)。
+// Writer を開始する前に呼ぶ。完成させたセグメントの数を返す
+func FinishStaleSegments(dir string, now time.Time) (int, error) {
+	current := DefaultRotation.period(now)
+	var count int
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || filepath.Ext(path) != PartSuffix {
+			return nil
+		}
+		name := entry.Name()[:len(entry.Name())-len(PartSuffix)]
+		compression := utils.CompressionOf(name)
+		name = utils.TrimCompressionExt(name)
+		period, seq, ok := parseSegmentName(name)
+		if !ok || period == current {
+			return nil
+		}
+
+		seg := &segment{dir: filepath.Dir(path), name: name, period: period, seq: seq, compression: compression}
+		completed, err := segmentCompleted(seg.dir, name)
+		if err != nil {
+			return err
+		}
+		if completed {
+			// 完成済みのファイルを上書きしない
+			logger.Warnf("Skipped stale segment %s: already completed", path)
+			return nil
+		}
+		if err := seg.load(); err != nil {
+			logger.Errorf("Failed to read stale segment %s: %v", path, err)
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			seg.openedAt = info.ModTime()
+		}
+		if completeSegment(seg, map[string]interface{}{"recovered": true}) {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// segmentCompleted は完成済みのセグメント (圧縮済みを含む) があるかを確認する
+func segmentCompleted(dir, name string) (bool, error) {
+	for _, c := range []utils.Compression{utils.CompressionNone, utils.CompressionGzip, utils.CompressionZstd} {
+		_, err := os.Stat(filepath.Join(dir, name+c.Ext()))
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// finishSegment は .part を外してセグメントを完成させ，
+// completed_segments.jsonl に記録する。1件も書き込まなかったセグメントは何もしない
+func (w *Writer) finishSegment(key string, seg *segment) {
+	delete(w.segments, key)
+	partPath := seg.path()
+	// 開いたままのハンドルがあれば，バッファを書き出して閉じてから rename する
+	if err := utils.DefaultFilePool.CloseFile(partPath); err != nil {
+		logger.Errorf("Failed to close segment %s: %v", partPath, err)
+	}
+	completeSegment(seg, nil)
+}
+
+// completeSegment は .part を完成後の名前にして記録する。extra は記録に加える項目。完成させたかを返す
+func completeSegment(seg *segment, extra map[string]interface{}) bool {
+	partPath := seg.path()
+	if _, err := os.Stat(partPath); os.IsNotExist(err) {
+		return false
+	}
+
+	// 圧縮せずに書き込んだ .part (圧縮を指定する前のもの) は，完成時に圧縮する
+	compression := seg.compression
+	if compression == utils.CompressionNone {
+		compression = DefaultRotation.Compression
+	}
+	name := seg.name + compression.Ext()
+	finalPath := filepath.Join(seg.dir, name)
+	compressed := compression != seg.compression
+	var err error
+	if !compressed {
+		err = os.Rename(partPath, finalPath)
+	} else if err = utils.CompressTo(partPath, finalPath); err == nil {
+		err = os.Remove(partPath)
+	}
+	if err != nil {
+		logger.Errorf("Failed to complete segment %s: %v", partPath, err)
+		return false
+	}
+
+	marker := map[string]interface{}{
+		"period":    seg.period,
+		"sequence":  seg.seq,
+		"records":   seg.records,
+		"opened_at": seg.openedAt.Format(time.RFC3339),
+	}
+	if compressed {
+		marker["uncompressed_bytes"] = seg.bytes
+	}
+	for k, v := range extra {
+		marker[k] = v
+	}
+	recordSegment(finalPath, marker)
+	logger.Debugf("Completed segment %s (%d records, %d bytes)", name, seg.records, seg.bytes)
+	return true
+}
+
+// CompressSegment は完成済みのセグメント (ローテーション導入前の日ごとのファイルを含む) を圧縮して置き換え，
+// 圧縮後のファイルを completed_segments.jsonl に記録する。圧縮後のパスを返す
+func CompressSegment(path string, c utils.Compression) (string, error) {
+	if c == utils.CompressionNone || utils.CompressionOf(path) != utils.CompressionNone {
+		return path, nil
+	}
+	dst := path + c.Ext()
+	if err := utils.CompressTo(path, dst); err != nil {
+		return "", err
+	}
+	if err := os.Remove(path); err != nil {
+		return dst, err
+	}
+	recordSegment(dst, map[string]interface{}{"compressed_from": filepath.Base(path)})
+	return dst, nil
+}
+
+// recordSegment は完成したファイルの名前・大きさ・ハッシュを completed_segments.jsonl に追記する
+func recordSegment(path string, marker map[string]interface{}) {
+	digest, err := fileSHA256(path)
+	if err != nil {
+		logger.Errorf("Failed to read segment %s: %v", path, err)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Errorf("Failed to read segment %s: %v", path, err)
+		return
+	}
+	marker["file"] = filepath.Base(path)
+	marker["bytes"] = info.Size()
+	marker["sha256"] = digest
+	marker["completed_at"] = time.Now().Format(time.RFC3339)
+	if err := utils.SaveRecord(utils.RecordTypeSegment, marker, filepath.Join(filepath.Dir(path), CompletedSegmentsFile)); err != nil {
+		logger.Errorf("Failed to record completed segment %s: %v", path, err)
+	}
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,167 @@
+package writer
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chcolte/fediverse-archive-bot-go/utils"
+)
+
+// setRotation はテストの間だけ DefaultRotation を差し替える
+func setRotation(t *testing.T, policy RotationPolicy) {
+	t.Helper()
+	saved := DefaultRotation
+	DefaultRotation = policy
+	t.Cleanup(func() { DefaultRotation = saved })
+}
+
+func listDir(t *testing.T, dir string) string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestWriterRotatesSegments(t *testing.T) {
+	setRotation(t, RotationPolicy{Interval: RotateDaily, MaxRecords: 2})
+	dir := t.TempDir()
+	w := &Writer{}
+	day1 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.Local)
+	day2 := day1.Add(24 * time.Hour)
+
+	write := func(now time.Time) {
+		path, err := w.segmentPath(dir, "base", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := utils.SaveRecord(utils.RecordTypeMessage, map[string]string{"at": now.String()}, path); err != nil {
+			t.Fatal(err)
+		}
+		w.recordWritten(dir, "base", 1)
+	}
+
+	// 1. 件数の上限で切り替える
+	for i := 0; i < 3; i++ {
+		write(day1)
+	}
+	if got, want := listDir(t, dir), "base_2026-01-01.jsonl,base_2026-01-01_0002.jsonl.part,"+CompletedSegmentsFile; got != want {
+		t.Errorf("files = %s, want %s", got, want)
+	}
+
+	// 2. 期間が変わったら書き込み中のセグメントも完成させる
+	write(day2)
+	w.finishAll()
+	if got, want := listDir(t, dir), "base_2026-01-01.jsonl,base_2026-01-01_0002.jsonl,base_2026-01-02.jsonl,"+CompletedSegmentsFile; got != want {
+		t.Errorf("files = %s, want %s", got, want)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, CompletedSegmentsFile))
+	if n := strings.Count(string(data), "\n"); n != 3 {
+		t.Errorf("%d completion markers, want 3", n)
+	}
+
+	// 3. 完成済みの連番は再起動後も使わない
+	seg, err := openSegment(dir, "base", "2026-01-01", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg.seq != 3 {
+		t.Errorf("next sequence = %d, want 3", seg.seq)
+	}
+}
+
+func TestFinishStaleSegments(t *testing.T) {
+	setRotation(t, RotationPolicy{Interval: RotateDaily})
+	daily := filepath.Join(t.TempDir(), "misskey", "example.com", "2026-01-01")
+	os.MkdirAll(daily, 0755)
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(daily, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("2026-01-01_local_2026-01-01.jsonl.part", "{}\n{\"cut\":") // 過ぎた期間: 完成させる
+	write("2026-01-01_local_2026-01-02.jsonl.part", "{}\n")          // 今の期間: 続きに書き込むため残す
+	write("2026-01-01_global_2026-01-01.jsonl", "{}\n")              // 完成済み
+	write("2026-01-01_global_2026-01-01.jsonl.part", "{}\n")         // 完成済みがあるので上書きしない
+
+	count, err := FinishStaleSegments(filepath.Dir(daily), time.Date(2026, 1, 2, 0, 0, 0, 0, time.Local))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("count = %d, want 1", count)
+	}
+	want := "2026-01-01_global_2026-01-01.jsonl,2026-01-01_global_2026-01-01.jsonl.part," +
+		"2026-01-01_local_2026-01-01.jsonl,2026-01-01_local_2026-01-02.jsonl.part," + CompletedSegmentsFile
+	if got := listDir(t, daily); got != want {
+		t.Errorf("files = %s, want %s", got, want)
+	}
+	// 途中で切れた最終行は改行で終端する
+	data, _ := os.ReadFile(filepath.Join(daily, "2026-01-01_local_2026-01-01.jsonl"))
+	if string(data) != "{}\n{\"cut\":\n" {
+		t.Errorf("recovered content = %q", data)
+	}
+}
+
+func TestCompressedSegments(t *testing.T) {
+	setRotation(t, RotationPolicy{Interval: RotateDaily, Compression: utils.CompressionGzip})
+	dir := t.TempDir()
+	w := &Writer{}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.Local)
+	record := map[string]string{"text": strings.Repeat("a", 1000)}
+
+	// 1. 書き込み中から圧縮し，大きさは圧縮後で数える
+	path, err := w.segmentPath(dir, "base", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(path) != "base_2026-01-01.jsonl.gz.part" {
+		t.Fatalf("part = %s", path)
+	}
+	for i := 0; i < 2; i++ {
+		utils.SaveRecord(utils.RecordTypeMessage, record, path)
+		w.recordWritten(dir, "base", 1)
+	}
+	seg := w.segments[filepath.Join(dir, "base")]
+	info, _ := os.Stat(path)
+	if seg.bytes != info.Size() || seg.bytes > 1000 {
+		t.Errorf("segment bytes = %d, file size %d", seg.bytes, info.Size())
+	}
+
+	// 2. 末尾のメンバーが切れていても，展開できる部分から続きに書き込む
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, data[:len(data)-20], 0644)
+	resumed, err := openSegment(dir, "base", "2026-01-01", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.compression != utils.CompressionGzip || resumed.records != 2 {
+		t.Errorf("resumed %s segment with %d records, want gzip with 2", resumed.compression, resumed.records)
+	}
+	r, err := utils.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !strings.HasSuffix(string(content), "\n") {
+		t.Errorf("recompressed part: %q, %v", content, err)
+	}
+
+	// 3. 完成させるときは rename するだけ
+	w.finishAll()
+	if got, want := listDir(t, dir), "base_2026-01-01.jsonl.gz,"+CompletedSegmentsFile; got != want {
+		t.Errorf("files = %s, want %s", got, want)
+	}
+}
@@ -4,24 +4,62 @@ package writer
 import (
     "os"
     "path/filepath"
+    "sort"
+    "sync"
     "time"
 
     "github.com/chcolte/fediverse-archive-bot-go/logger"
     "github.com/chcolte/fediverse-archive-bot-go/models"
+    "github.com/chcolte/fediverse-archive-bot-go/sqlitestore"
     "github.com/chcolte/fediverse-archive-bot-go/utils"
+    "github.com/chcolte/fediverse-archive-bot-go/warc"
 )
 
+// 正規化した投稿 (models.Post) を保存するストリーム名
+const StreamNormalized = "normalized"
+
 type Writer struct {
     BaseDir        string // e.g. "downloads/misskey/misskey.io"
     Timeline       string // e.g. "local"
-    CrawlSessionID string
+    CrawlSessionID string // Run の開始後は SetCrawlSessionID で変更する
+    SourceURL      string // 受信元 (ストリーミングAPI等) のURL。WARC-Target-URI に使う
+
+    segments  map[string]*segment // 書き込み中のセグメント (Run のgoroutineからのみ触る)
+    sessionMu sync.Mutex          // CrawlSessionID を保護する (再接続時に受信側のgoroutineから変更される)
 }
 
-// goroutineとして起動されることを想定。channelが閉じられると終了
+// SetCrawlSessionID は再接続時に新しいクロールセッションIDを設定する (Run と並行して呼べる)
+func (w *Writer) SetCrawlSessionID(id string) {
+    w.sessionMu.Lock()
+    defer w.sessionMu.Unlock()
+    w.CrawlSessionID = id
+}
+
+func (w *Writer) crawlSessionID() string {
+    w.sessionMu.Lock()
+    defer w.sessionMu.Unlock()
+    return w.CrawlSessionID
+}
+
+// 期間の過ぎたセグメントを確認する間隔
+const segmentCheckInterval = time.Minute
+
+// goroutineとして起動されることを想定。channelが閉じられると，書き込み中のセグメントを完成させて終了
 func (w *Writer) Run(queue <-chan models.RawMessage) {
-    for msg := range queue {
-        if err := w.writeMessage(msg); err != nil {
-            logger.Errorf("Failed to write message: %v", err)
+    ticker := time.NewTicker(segmentCheckInterval)
+    defer ticker.Stop()
+    defer w.finishAll()
+    for {
+        select {
+        case msg, ok := <-queue:
+            if !ok {
+                return
+            }
+            if err := w.writeMessage(msg); err != nil {
+                logger.Errorf("Failed to write message: %v", err)
+            }
+        case now := <-ticker.C:
+            w.finishExpired(now)
         }
     }
 }
@@ -30,30 +68,139 @@ func (w *Writer) writeMessage(msg models.RawMessage) error {
     dateStr := msg.CreatedAt.Format("2006-01-02")
     dailyDir := filepath.Join(w.BaseDir, dateStr)
 
+    // JSONLとSQLiteで同じレコードID・保存時刻を使う
+    env := utils.NewEnvelope(utils.RecordTypeMessage)
+
+    if err := w.writeWARC(msg); err != nil {
+        logger.Errorf("Failed to write WARC record: %v", err)
+    }
+    w.writeSQLite(msg, env)
+
 	switch msg.DataType {
 	case "cbor":
-        return w.writeCBOR(msg, dailyDir, dateStr) // fix?: msgからdatesdrもdailysdrも導出できるのに，引数として取らせているのはなんかへんだよね
+        return w.writeCBOR(msg, env, dailyDir, dateStr) // fix?: msgからdatesdrもdailysdrも導出できるのに，引数として取らせているのはなんかへんだよね
 	
 	case "json":
-        return w.writeJSON(msg, dailyDir, dateStr)
+        return w.writeJSON(msg, env, dailyDir, dateStr)
 	}
 	return nil
 }
 
-func (w *Writer) writeJSON(msg models.RawMessage, dailyDir, dateStr string) error {
-    suffix := string(time.Now().Format("2006-01-02"))
+func (w *Writer) writeJSON(msg models.RawMessage, env utils.Envelope, dailyDir, dateStr string) error {
+    now := time.Now()
     /* msg.receivedAtをつかうべきか，time.now()をつかうべきか
         url: https://github.com/chcolte/fediverse-archive-bot-go/issues/8
         receiveしてから，書き込むまでにタイムラグが一応存在はするから，どこかでスタックした場合，外部からファイルmvしたときの衝突は起こりうる可能性はある
         ならば，受信時刻ではなく，保存時刻でファイルを分割するべきなような気がする
         そもそも，ファイルの分割が主目的であって，1時間毎に保存先を変えるとか，100MBを超える毎に保存先を変えるとか，色々選択肢を今後作ることになるんではないか。保存時刻ベースで一旦処理する
+        -> 保存時刻の期間・大きさ・件数によるローテーションは rotation.go (DefaultRotation)
     */
     
-    savePath := filepath.Join(dailyDir, dateStr+"_"+w.Timeline+"_"+suffix+".jsonl")
-    return utils.SaveMessage(msg, w.CrawlSessionID, savePath)
+    // Providerが別ストリーム（重複観測記録など）を指定した場合は別ファイルに分ける
+    name := dateStr + "_" + models.TimelineFileName(w.Timeline)
+    if stream := msg.Metadata["stream"]; stream != "" {
+        name += "_" + stream
+    }
+    savePath, err := w.segmentPath(dailyDir, name, now)
+    if err == nil {
+        err = utils.SaveMessage(env, msg, w.crawlSessionID(), savePath)
+    }
+    if err != nil {
+        // 書き込めなかったことを Provider に知らせる (重複排除の記録の取り消しなど)
+        if msg.Failed != nil {
+            msg.Failed()
+        }
+        return err
+    }
+    utils.DefaultFilePool.AfterFlush(savePath, msg.Saved, msg.Failed)
+    w.recordWritten(dailyDir, name, 1)
+    return w.writePosts(msg, dailyDir, dateStr, now)
+}
+
+// 正規化した投稿は生データと並行する normalized ストリームに保存する
+func (w *Writer) writePosts(msg models.RawMessage, dailyDir, dateStr string, now time.Time) error {
+    if len(msg.Posts) == 0 {
+        return nil
+    }
+    name := dateStr + "_" + models.TimelineFileName(w.Timeline) + "_" + StreamNormalized
+    savePath, err := w.segmentPath(dailyDir, name, now)
+    if err != nil {
+        return err
+    }
+    for _, post := range msg.Posts {
+        if err := utils.SavePost(post, msg, w.crawlSessionID(), savePath); err != nil {
+            return err
+        }
+    }
+    w.recordWritten(dailyDir, name, len(msg.Posts))
+    return nil
+}
+
+// 受信メッセージは resource レコード，付随情報はそれを参照する metadata レコードにする
+func (w *Writer) writeWARC(msg models.RawMessage) error {
+    if warc.DefaultWriter == nil {
+        return nil
+    }
+    contentType := "application/json"
+    if msg.DataType == "cbor" {
+        contentType = "application/cbor"
+    }
+    targetURI := w.SourceURL
+    if targetURI == "" {
+        targetURI = "urn:fediverse-archive:" + filepath.ToSlash(w.BaseDir) + "#" + w.Timeline
+    }
+    var fields warc.Fields
+    fields.Add("crawl-session-id", w.crawlSessionID())
+    fields.Add("timeline", w.Timeline)
+    fields.Add("created-at", msg.CreatedAt.Format(time.RFC3339))
+    fields.Add("received-at", msg.ReceivedAt.Format(time.RFC3339))
+    keys := make([]string, 0, len(msg.Metadata))
+    for k := range msg.Metadata {
+        // metadata_json はCBORの場合の直前のメッセージと同じ内容
+        if k != "metadata_json" && k != "timeline" {
+            keys = append(keys, k)
+        }
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        fields.Add(k, msg.Metadata[k])
+    }
+    return warc.DefaultWriter.WriteResource(targetURI, contentType, msg.ReceivedAt, msg.Data, fields)
+}
+
+// SQLiteにはエンベロープ・生データ・正規化した投稿をまとめて保存する (書き込みは sqlitestore がまとめて行う)
+func (w *Writer) writeSQLite(msg models.RawMessage, env utils.Envelope) {
+    if sqlitestore.DefaultStore == nil {
+        return
+    }
+    metadata := make(map[string]string, len(msg.Metadata))
+    for k, v := range msg.Metadata {
+        // metadata_json はCBORの場合の直前のメッセージと同じ内容
+        if k != "metadata_json" {
+            metadata[k] = v
+        }
+    }
+    sqlitestore.DefaultStore.Add(sqlitestore.Record{
+        RecordID:       env.RecordID,
+        ServerSession:  env.ServerSession,
+        SavedAt:        env.SavedAt,
+        RecordType:     env.RecordType,
+        CrawlSessionID: w.crawlSessionID(),
+        Platform:       filepath.Base(filepath.Dir(w.BaseDir)),
+        Server:         filepath.Base(w.BaseDir),
+        Timeline:       w.Timeline,
+        Stream:         msg.Metadata["stream"],
+        CreatedAt:      msg.CreatedAt,
+        ReceivedAt:     msg.ReceivedAt,
+        DataType:       msg.DataType,
+        Metadata:       metadata,
+        Raw:            msg.Data,
+        Posts:          msg.Posts,
+    })
 }
 
-func (w *Writer) writeCBOR(msg models.RawMessage, dailyDir, dateStr string) error {
+// CBORの生データはファイルに保存し，JSONLにはメタデータのレコードを env で保存する
+func (w *Writer) writeCBOR(msg models.RawMessage, env utils.Envelope, dailyDir, dateStr string) error {
     cborDir := filepath.Join(dailyDir, "cbor")
     if err := os.MkdirAll(cborDir, 0755); err != nil {
         return err
@@ -70,8 +217,9 @@ func (w *Writer) writeCBOR(msg models.RawMessage, dailyDir, dateStr string) erro
             ReceivedAt: msg.ReceivedAt,
             DataType:   "json",
             Metadata:   msg.Metadata,
+            Posts:      msg.Posts,
         }
-        w.writeJSON(metaMsg, dailyDir, dateStr)
+        w.writeJSON(metaMsg, env, dailyDir, dateStr)
     }
     return nil
 }
\ No newline at end of file